@@ -79,6 +79,8 @@ func main() {
 	g.Printf("	Name string\n")
 	g.Printf("	// EBSOptimized is set to true if the instance type permits EBS optimization.\n")
 	g.Printf("	EBSOptimized bool\n")
+	g.Printf("	// EBSOptimizedByDefault is set to true if the instance type is EBS optimized by default.\n")
+	g.Printf("	EBSOptimizedByDefault bool\n")
 	g.Printf("	// VCPU stores the number of VCPUs provided by this instance type.\n")
 	g.Printf("	VCPU uint\n")
 	g.Printf("	// Memory stores the number of (fractional) GiB of memory provided by this instance type.\n")
@@ -91,6 +93,10 @@ func main() {
 	g.Printf("	Virt string\n")
 	g.Printf("	// NVMe specifies whether EBS block devices are exposed as NVMe volumes.\n")
 	g.Printf("	NVMe bool\n")
+	g.Printf("	// NetworkPerformance stores the network performance of this instance type, e.g., \"High\" or \"10 Gigabit\".\n")
+	g.Printf("	NetworkPerformance string\n")
+	g.Printf("	// EBSThroughput stores the baseline EBS throughput of this instance type, in MB/s.\n")
+	g.Printf("	EBSThroughput float64\n")
 	g.Printf("}\n")
 
 	g.Printf("// Types stores known EC2 instance types.\n")
@@ -131,6 +137,7 @@ func main() {
 		g.Printf("{\n")
 		g.Printf("	Name: %q,\n", e.Type)
 		g.Printf("	EBSOptimized: %v,\n", e.EBSOptimized)
+		g.Printf("	EBSOptimizedByDefault: %v,\n", e.EBSOptimizedByDefault)
 		g.Printf("	VCPU: %d,\n", e.VCPU)
 		g.Printf("	Memory: %f,\n", e.Memory)
 		g.Printf("	Price: map[string]float64{\n")
@@ -152,6 +159,8 @@ func main() {
 		g.Printf("	Generation: %q,\n", e.Generation)
 		g.Printf("	Virt: %q,\n", virt)
 		g.Printf("	NVMe: %v,\n", strings.HasPrefix(e.Type, "c5."))
+		g.Printf("	NetworkPerformance: %q,\n", e.Network)
+		g.Printf("	EBSThroughput: %f,\n", e.EBSThroughput)
 		g.Printf("},\n")
 	}
 	g.Printf("}\n")
@@ -168,15 +177,17 @@ func main() {
 }
 
 type entry struct {
-	Arch          []string                          `json:"arch"`
-	Type          string                            `json:"instance_type"`
-	EBSOptimized  bool                              `json:"ebs_optimized"`
-	Memory        float64                           `json:"memory"`
-	VCPU          uint                              `json:"vCPU"`
-	Pricing       map[string]map[string]interface{} `json:"pricing"`
-	Network       string                            `json:"network_performance"`
-	Generation    string                            `json:"generation"`
-	LinuxVirtType []string                          `json:"linux_virtualization_types"`
+	Arch                  []string                          `json:"arch"`
+	Type                  string                            `json:"instance_type"`
+	EBSOptimized          bool                              `json:"ebs_optimized"`
+	EBSOptimizedByDefault bool                              `json:"ebs_optimized_by_default"`
+	Memory                float64                           `json:"memory"`
+	VCPU                  uint                              `json:"vCPU"`
+	Pricing               map[string]map[string]interface{} `json:"pricing"`
+	Network               string                            `json:"network_performance"`
+	EBSThroughput         float64                           `json:"ebs_baseline_throughput"`
+	Generation            string                            `json:"generation"`
+	LinuxVirtType         []string                          `json:"linux_virtualization_types"`
 }
 
 type generator struct {
@@ -0,0 +1,84 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/grailbio/reflow/errors"
+)
+
+// reflowletVersionTag is the tag key by which AMIs are associated
+// with reflowlet versions.
+const reflowletVersionTag = "reflowlet-version"
+
+// defaultAMIOwner is the owner of the AMIs that are trusted by
+// default: those of the caller's own account.
+const defaultAMIOwner = "self"
+
+// ResolveAMI returns the ID of the newest available AMI (in the
+// region of the provided EC2 client) that is tagged with the given
+// reflowlet version. Because anyone may publish (public) AMIs with
+// matching tags, only AMIs owned by the provided owners (account IDs
+// or aliases such as "self" or "amazon") are considered. If no
+// owners are provided, only the caller's own AMIs are considered.
+func ResolveAMI(ctx context.Context, api ec2iface.EC2API, version string, owners ...string) (string, error) {
+	if len(owners) == 0 {
+		owners = []string{defaultAMIOwner}
+	}
+	resp, err := api.DescribeImagesWithContext(ctx, &ec2.DescribeImagesInput{
+		Owners: aws.StringSlice(owners),
+		Filters: []*ec2.Filter{
+			{Name: aws.String("tag:" + reflowletVersionTag), Values: []*string{aws.String(version)}},
+			{Name: aws.String("state"), Values: []*string{aws.String(ec2.ImageStateAvailable)}},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	var (
+		id     string
+		newest time.Time
+	)
+	for _, image := range resp.Images {
+		// Don't rely solely on the API to apply the owner filter.
+		if !trustedImage(image, owners) {
+			continue
+		}
+		created, err := time.Parse(time.RFC3339, aws.StringValue(image.CreationDate))
+		if err != nil {
+			return "", errors.Errorf("image %s: invalid creation date %q: %v",
+				aws.StringValue(image.ImageId), aws.StringValue(image.CreationDate), err)
+		}
+		if id == "" || created.After(newest) {
+			id = aws.StringValue(image.ImageId)
+			newest = created
+		}
+	}
+	if id == "" {
+		return "", errors.E(errors.NotExist, errors.Errorf("no AMI found for reflowlet version %s", version))
+	}
+	return id, nil
+}
+
+// trustedImage tells whether the image is owned by one of the
+// provided owners. Images are matched by owner ID or alias; the
+// "self" alias cannot be verified locally and trusts the API's
+// owner filter.
+func trustedImage(image *ec2.Image, owners []string) bool {
+	for _, owner := range owners {
+		switch owner {
+		case defaultAMIOwner:
+			return true
+		case aws.StringValue(image.OwnerId), aws.StringValue(image.ImageOwnerAlias):
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,108 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/grailbio/reflow/errors"
+)
+
+func TestResolveAMI(t *testing.T) {
+	images := []struct {
+		id, version, created string
+	}{
+		{"ami-1", "1.2.2", "2018-01-01T00:00:00.000Z"},
+		{"ami-2", "1.2.3", "2018-02-01T00:00:00.000Z"},
+		{"ami-3", "1.2.3", "2018-03-01T00:00:00.000Z"},
+		{"ami-4", "1.2.3", "2018-01-15T00:00:00.000Z"},
+		{"ami-5", "1.3.0", "2018-04-01T00:00:00.000Z"},
+	}
+	api := &mockEC2{
+		DescribeImagesFunc: func(in *ec2.DescribeImagesInput) (*ec2.DescribeImagesOutput, error) {
+			var version string
+			for _, f := range in.Filters {
+				if aws.StringValue(f.Name) == "tag:"+reflowletVersionTag {
+					version = aws.StringValue(f.Values[0])
+				}
+			}
+			out := new(ec2.DescribeImagesOutput)
+			for _, image := range images {
+				if image.version == version {
+					out.Images = append(out.Images, &ec2.Image{
+						ImageId:      aws.String(image.id),
+						CreationDate: aws.String(image.created),
+					})
+				}
+			}
+			return out, nil
+		},
+	}
+	ctx := context.Background()
+	for _, c := range []struct{ version, want string }{
+		{"1.2.2", "ami-1"},
+		{"1.2.3", "ami-3"},
+		{"1.3.0", "ami-5"},
+	} {
+		id, err := ResolveAMI(ctx, api, c.version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := id, c.want; got != want {
+			t.Errorf("%s: got %v, want %v", c.version, got, want)
+		}
+	}
+	if _, err := ResolveAMI(ctx, api, "2.0.0"); !errors.Match(errors.NotExist, err) {
+		t.Errorf("expected not exist error, got %v", err)
+	}
+}
+
+func TestResolveAMIOwners(t *testing.T) {
+	var owners []string
+	api := &mockEC2{
+		DescribeImagesFunc: func(in *ec2.DescribeImagesInput) (*ec2.DescribeImagesOutput, error) {
+			owners = aws.StringValueSlice(in.Owners)
+			// The (untrusted) public image is the newest.
+			return &ec2.DescribeImagesOutput{Images: []*ec2.Image{
+				{ImageId: aws.String("ami-trusted"), OwnerId: aws.String("111111111111"), CreationDate: aws.String("2018-01-01T00:00:00.000Z")},
+				{ImageId: aws.String("ami-amazon"), OwnerId: aws.String("137112412989"), ImageOwnerAlias: aws.String("amazon"), CreationDate: aws.String("2018-02-01T00:00:00.000Z")},
+				{ImageId: aws.String("ami-attacker"), OwnerId: aws.String("999999999999"), CreationDate: aws.String("2018-03-01T00:00:00.000Z")},
+			}}, nil
+		},
+	}
+	ctx := context.Background()
+	if _, err := ResolveAMI(ctx, api, "1.2.3"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(owners, ","), "self"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for _, c := range []struct {
+		owners []string
+		want   string
+	}{
+		{[]string{"111111111111"}, "ami-trusted"},
+		{[]string{"111111111111", "amazon"}, "ami-amazon"},
+		{[]string{"999999999999"}, "ami-attacker"},
+	} {
+		id, err := ResolveAMI(ctx, api, "1.2.3", c.owners...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := id, c.want; got != want {
+			t.Errorf("%v: got %v, want %v", c.owners, got, want)
+		}
+		if got, want := strings.Join(owners, ","), strings.Join(c.owners, ","); got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+	if _, err := ResolveAMI(ctx, api, "1.2.3", "222222222222"); !errors.Match(errors.NotExist, err) {
+		t.Errorf("expected not exist error, got %v", err)
+	}
+}
@@ -72,6 +72,12 @@ type Config struct {
 	// KeyName is the AWS SSH key with which to launch new instances.
 	// If unspecified, instances are launched without keys.
 	KeyName string
+	// Endpoint, if set, overrides the EC2 API endpoint, e.g., to
+	// target LocalStack or another EC2-compatible server in testing.
+	Endpoint string `yaml:"endpoint,omitempty"`
+	// RedactKeys is the set of configuration keys that are not
+	// provided to cluster instances.
+	RedactKeys []string `yaml:"redactkeys,omitempty"`
 }
 
 // Init initializes this EC2 configuration from the underlying configuration
@@ -104,6 +110,19 @@ func (c *Config) Marshal(keys config.Keys) error {
 	return nil
 }
 
+// ec2Config returns the AWS configuration for the cluster's EC2
+// client, applying the configured region and endpoint overrides.
+func (c *Config) ec2Config() *aws.Config {
+	cfg := &aws.Config{MaxRetries: aws.Int(13)}
+	if c.Region != "" {
+		cfg.Region = aws.String(c.Region)
+	}
+	if c.Endpoint != "" {
+		cfg.Endpoint = aws.String(c.Endpoint)
+	}
+	return cfg
+}
+
 // Cluster returns an EC2-based cluster using the provided parameters.
 func (c *Config) Cluster() (runner.Cluster, error) {
 	clientConfig, _, err := c.HTTPS()
@@ -121,7 +140,7 @@ func (c *Config) Cluster() (runner.Cluster, error) {
 	if err != nil {
 		return nil, err
 	}
-	svc := ec2.New(sess, &aws.Config{MaxRetries: aws.Int(13)})
+	svc := ec2.New(sess, c.ec2Config())
 	path := filepath.Join(os.ExpandEnv("$HOME/.reflow") /*c.Version,*/, "ec2cluster" /*+c.Config.EC2ClusterName*/)
 	state, err := state.Open(path)
 	if err != nil {
@@ -163,6 +182,8 @@ func (c *Config) Cluster() (runner.Cluster, error) {
 		AMI:            c.AMI,
 		SshKey:         c.SshKey,
 		KeyName:        c.KeyName,
+
+		RedactConfigKeys: c.RedactKeys,
 	}
 	if cluster.MaxInstances == 0 {
 		cluster.MaxInstances = defaultMaxInstances
@@ -0,0 +1,60 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestConfigEndpoint(t *testing.T) {
+	var (
+		called        bool
+		authorization string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		authorization = r.Header.Get("Authorization")
+		w.Write([]byte(describeInstancesResponse))
+	}))
+	defer srv.Close()
+	sess, err := session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{Region: "us-west-2", Endpoint: srv.URL}
+	cfg := c.ec2Config()
+	if got, want := aws.IntValue(cfg.MaxRetries), 13; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	api := ec2.New(sess, cfg)
+	if got, want := api.Endpoint, srv.URL; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if _, err := api.DescribeInstances(&ec2.DescribeInstancesInput{}); err != nil {
+		t.Fatal(err)
+	}
+	if !called {
+		t.Fatal("request was not sent to the configured endpoint")
+	}
+	// Requests are signed for the overridden region.
+	if !strings.Contains(authorization, "/us-west-2/ec2/") {
+		t.Errorf("request not signed for us-west-2: %s", authorization)
+	}
+
+	if cfg := (&Config{}).ec2Config(); cfg.Endpoint != nil || cfg.Region != nil {
+		t.Errorf("unexpected overrides: %v", cfg)
+	}
+}
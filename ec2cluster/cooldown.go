@@ -0,0 +1,98 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster
+
+import (
+	"time"
+
+	"github.com/grailbio/reflow/log"
+)
+
+// CooldownState is the persistent portion of a cluster's knowledge
+// of instance type availability.
+type CooldownState struct {
+	// Unavailable stores the time each instance type was last
+	// marked unavailable.
+	Unavailable map[string]time.Time
+	// Quarantined stores the time each instance type was last
+	// quarantined because its instances failed to boot.
+	Quarantined map[string]time.Time
+	// Failures stores the number of times each instance type has been
+	// marked unavailable.
+	Failures map[string]int
+}
+
+// CooldownStore persists a cluster's CooldownState, so that
+// capacity-constrained instance types are not immediately retried
+// after the controller restarts.
+type CooldownStore interface {
+	// Load returns the most recently saved state. Load should return
+	// an empty state if none has been saved.
+	Load() (CooldownState, error)
+	// Save saves the provided state.
+	Save(CooldownState) error
+}
+
+// SetStore restores the state's cooldowns from the provided store,
+// which is subsequently updated whenever an instance type is marked
+// unavailable or quarantined. Errors saving the state are logged
+// to the provided logger.
+func (s *instanceState) SetStore(store CooldownStore, log *log.Logger) error {
+	state, err := store.Load()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for typ, t := range state.Unavailable {
+		if t.After(s.unavailable[typ]) {
+			s.unavailable[typ] = t
+		}
+	}
+	for typ, t := range state.Quarantined {
+		if t.After(s.quarantined[typ]) {
+			s.quarantined[typ] = t
+		}
+	}
+	for typ, n := range state.Failures {
+		s.failures[typ] += n
+	}
+	s.store = store
+	s.log = log
+	return nil
+}
+
+// Failures returns the number of times the instance type typ has
+// been marked unavailable.
+func (s *instanceState) Failures(typ string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.failures[typ]
+}
+
+// save saves the state's cooldowns to its store, if any. It must be
+// called with s.mu held.
+func (s *instanceState) save() {
+	if s.store == nil {
+		return
+	}
+	state := CooldownState{
+		Unavailable: make(map[string]time.Time),
+		Quarantined: make(map[string]time.Time),
+		Failures:    make(map[string]int),
+	}
+	for typ, t := range s.unavailable {
+		state.Unavailable[typ] = t
+	}
+	for typ, t := range s.quarantined {
+		state.Quarantined[typ] = t
+	}
+	for typ, n := range s.failures {
+		state.Failures[typ] = n
+	}
+	if err := s.store.Save(state); err != nil {
+		s.log.Errorf("save cooldown state: %v", err)
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster
+
+import (
+	"testing"
+	"time"
+
+	"github.com/grailbio/reflow"
+)
+
+type testCooldownStore struct {
+	state CooldownState
+	saves int
+}
+
+func (s *testCooldownStore) Load() (CooldownState, error) {
+	return s.state, nil
+}
+
+func (s *testCooldownStore) Save(state CooldownState) error {
+	s.state = state
+	s.saves++
+	return nil
+}
+
+func TestCooldownStore(t *testing.T) {
+	configs := []instanceConfig{
+		{Type: "small", Resources: reflow.Resources{CPU: 2, Memory: 4 << 30}, Price: map[string]float64{"us-west-2": 0.1}},
+		{Type: "medium", Resources: reflow.Resources{CPU: 4, Memory: 8 << 30}, Price: map[string]float64{"us-west-2": 0.2}},
+		{Type: "large", Resources: reflow.Resources{CPU: 16, Memory: 64 << 30}, Price: map[string]float64{"us-west-2": 0.8}},
+	}
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := &testCooldownStore{state: CooldownState{
+		Unavailable: map[string]time.Time{"small": now.Add(-30 * time.Second)},
+		Quarantined: map[string]time.Time{"medium": now.Add(-time.Hour)},
+		Failures:    map[string]int{"small": 3},
+	}}
+	s := newInstanceState(configs, time.Minute, "us-west-2")
+	s.now = func() time.Time { return now }
+	if err := s.SetStore(store, nil); err != nil {
+		t.Fatal(err)
+	}
+	// The restored cooldowns apply.
+	for _, typ := range []string{"small", "medium"} {
+		if _, ok := s.Type(typ); ok {
+			t.Errorf("expected %s to be unavailable", typ)
+		}
+	}
+	if config, ok := s.MinAvailable(reflow.Resources{CPU: 1}, false); !ok || config.Type != "large" {
+		t.Errorf("got %v, want large", config.Type)
+	}
+	if got, want := s.Failures("small"), 3; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	now = now.Add(time.Minute)
+	if config, ok := s.MinAvailable(reflow.Resources{CPU: 1}, false); !ok || config.Type != "small" {
+		t.Errorf("got %v, want small", config.Type)
+	}
+
+	// Updates are saved.
+	s.Unavailable(configs[0])
+	for k := 0; k < bootFailureThreshold; k++ {
+		s.BootFailed("large")
+	}
+	if got, want := store.saves, 2; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := store.state.Failures["small"], 4; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := store.state.Unavailable["small"], now; !got.Equal(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := store.state.Quarantined["large"], now; !got.Equal(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if _, ok := store.state.Quarantined["medium"]; !ok {
+		t.Error("expected medium to remain quarantined")
+	}
+}
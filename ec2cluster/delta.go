@@ -0,0 +1,92 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/grailbio/reflow"
+	"github.com/grailbio/reflow/pool"
+)
+
+// resourceDeltaTag is the tag key with which instances are tagged
+// with their ResourceDelta.
+const resourceDeltaTag = "reflow:resource-delta"
+
+// ResourceDelta is the difference between the resources realized by
+// an instance's reflowlets and those for which the instance was
+// selected. Negative values indicate that the instance was
+// over-provisioned: it provides fewer resources than were expected.
+type ResourceDelta struct {
+	Memory int64
+	CPU    int
+	Disk   int64
+}
+
+// String renders the delta in the style of reflow.Resources.
+func (d ResourceDelta) String() string {
+	return fmt.Sprintf("mem %+d cpu %+d disk %+d", d.Memory, d.CPU, d.Disk)
+}
+
+// resourceDelta returns the difference between the realized and
+// selected resources.
+func resourceDelta(selected, realized reflow.Resources) ResourceDelta {
+	return ResourceDelta{
+		Memory: int64(realized.Memory) - int64(selected.Memory),
+		CPU:    int(realized.CPU) - int(selected.CPU),
+		Disk:   int64(realized.Disk) - int64(selected.Disk),
+	}
+}
+
+// realizedResources returns the resources realized by the reflowlets
+// whose offers are provided. Newly booted reflowlets offer all of
+// their resources, so each reflowlet is taken to realize its largest
+// offer.
+func realizedResources(offers [][]pool.Offer) reflow.Resources {
+	var realized reflow.Resources
+	for _, reflowlet := range offers {
+		var max reflow.Resources
+		for _, offer := range reflowlet {
+			max = max.Max(offer.Available())
+		}
+		realized = realized.Add(max)
+	}
+	return realized
+}
+
+// ResourceDelta returns the difference between the resources realized
+// by the instance's reflowlets and those of its configuration. It is
+// valid only after the instance was successfully launched.
+func (i *instance) ResourceDelta() ResourceDelta {
+	return i.resourceDelta
+}
+
+// recordResourceDelta computes the instance's resource delta from the
+// provided offers, logs it, and tags the instance with it. No delta is
+// recorded if the reflowlets made no offers. Tags are informational:
+// failures are logged.
+func (i *instance) recordResourceDelta(ctx context.Context, id string, offers [][]pool.Offer) {
+	realized := realizedResources(offers)
+	if realized.IsZeroAll() {
+		// The reflowlets made no offers from which to compute a delta.
+		return
+	}
+	i.resourceDelta = resourceDelta(i.Config.Resources, realized)
+	i.Log.Printf("instance %s (%s): selected %s, realized %s, delta %s",
+		id, i.Config.Type, i.Config.Resources, realized, i.resourceDelta)
+	if i.SkipTagging {
+		return
+	}
+	_, err := i.EC2.CreateTagsWithContext(ctx, &ec2.CreateTagsInput{
+		Resources: []*string{aws.String(id)},
+		Tags:      []*ec2.Tag{{Key: aws.String(resourceDeltaTag), Value: aws.String(i.resourceDelta.String())}},
+	})
+	if err != nil {
+		i.Log.Errorf("ec2.createtags %v: %v", id, err)
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/grailbio/reflow"
+	"github.com/grailbio/reflow/pool"
+)
+
+type testOffer struct {
+	pool.Offer
+	available reflow.Resources
+}
+
+func (o testOffer) Available() reflow.Resources {
+	return o.available
+}
+
+func TestResourceDelta(t *testing.T) {
+	const gib = 1 << 30
+	api := newLaunchMockEC2("i-123", "test.example.com")
+	tags := make(map[string]string)
+	api.CreateTagsFunc = func(input *ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error) {
+		for _, tag := range input.Tags {
+			tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+		}
+		return &ec2.CreateTagsOutput{}, nil
+	}
+	p := &testPool{OffersFunc: func() ([]pool.Offer, error) {
+		return []pool.Offer{
+			testOffer{available: reflow.Resources{Memory: 14 * gib, CPU: 4, Disk: 200 * gib}},
+			testOffer{available: reflow.Resources{Memory: 1 * gib, CPU: 1, Disk: 1 * gib}},
+		}, nil
+	}}
+	i := newLaunchTestInstance(api, p)
+	i.Config.Resources = reflow.Resources{Memory: 15 * gib, CPU: 4, Disk: 200 * gib}
+	i.Go(context.Background())
+	if err := i.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want := ResourceDelta{Memory: -gib}
+	if got := i.ResourceDelta(); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := tags[resourceDeltaTag], "mem -1073741824 cpu +0 disk +0"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// Deltas are summed across reflowlets.
+	offers := [][]pool.Offer{
+		{testOffer{available: reflow.Resources{Memory: 8 * gib, CPU: 2, Disk: 100 * gib}}},
+		{testOffer{available: reflow.Resources{Memory: 8 * gib, CPU: 2, Disk: 100 * gib}}},
+	}
+	got := resourceDelta(reflow.Resources{Memory: 15 * gib, CPU: 4, Disk: 250 * gib}, realizedResources(offers))
+	if want := (ResourceDelta{Memory: gib, Disk: -50 * gib}); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
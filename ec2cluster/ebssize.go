@@ -0,0 +1,90 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster
+
+import (
+	"math"
+	"sort"
+
+	"github.com/grailbio/reflow/errors"
+)
+
+// DiskUsageStore provides the historical disk usage of instances.
+type DiskUsageStore interface {
+	// DiskUsage returns the peak disk usage, in bytes, of each
+	// previously observed instance of the provided type.
+	DiskUsage(typ string) ([]uint64, error)
+}
+
+// EBSSizePolicy determines how EBS sizes are recommended from
+// observed disk usage.
+type EBSSizePolicy struct {
+	// Percentile is the percentile, in (0, 100], of observed usage
+	// that recommended sizes must accommodate.
+	Percentile float64
+	// Headroom is the fraction by which recommended sizes exceed
+	// the usage percentile.
+	Headroom float64
+	// Min and Max, if nonzero, bound the recommended sizes, in GiB.
+	Min, Max uint64
+}
+
+// EBSSizeRecommendation is an EBS size recommended for an instance
+// type.
+type EBSSizeRecommendation struct {
+	// Type is the instance type.
+	Type string
+	// Usage is the usage percentile, in bytes, on which the
+	// recommendation is based.
+	Usage uint64
+	// Samples is the number of observations from which Usage was
+	// computed.
+	Samples int
+	// Size is the recommended EBS size, in GiB.
+	Size uint64
+}
+
+// RecommendEBSSize recommends an EBS size for instances of the
+// provided type from their historical disk usage. RecommendEBSSize
+// returns a NotExist error if no usage has been observed for the type.
+func RecommendEBSSize(store DiskUsageStore, typ string, policy EBSSizePolicy) (EBSSizeRecommendation, error) {
+	rec := EBSSizeRecommendation{Type: typ}
+	if policy.Percentile <= 0 || policy.Percentile > 100 {
+		return rec, errors.E(errors.Invalid, errors.Errorf("invalid percentile %v", policy.Percentile))
+	}
+	if policy.Headroom < 0 {
+		return rec, errors.E(errors.Invalid, errors.Errorf("invalid headroom %v", policy.Headroom))
+	}
+	usage, err := store.DiskUsage(typ)
+	if err != nil {
+		return rec, err
+	}
+	if len(usage) == 0 {
+		return rec, errors.E(errors.NotExist, errors.Errorf("no disk usage observed for instance type %s", typ))
+	}
+	rec.Samples = len(usage)
+	rec.Usage = percentile(usage, policy.Percentile)
+	rec.Size = uint64(math.Ceil(float64(rec.Usage) * (1 + policy.Headroom) / (1 << 30)))
+	if rec.Size < policy.Min {
+		rec.Size = policy.Min
+	}
+	if policy.Max > 0 && rec.Size > policy.Max {
+		rec.Size = policy.Max
+	}
+	return rec, nil
+}
+
+// percentile returns the p'th percentile of the provided values,
+// using the nearest-rank method. The values must be nonempty.
+func percentile(values []uint64, p float64) uint64 {
+	sorted := make([]uint64, len(values))
+	copy(sorted, values)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
@@ -0,0 +1,63 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster
+
+import (
+	"testing"
+
+	"github.com/grailbio/reflow/errors"
+)
+
+type testDiskUsageStore map[string][]uint64
+
+func (s testDiskUsageStore) DiskUsage(typ string) ([]uint64, error) {
+	return s[typ], nil
+}
+
+func TestRecommendEBSSize(t *testing.T) {
+	const gib = 1 << 30
+	store := testDiskUsageStore{
+		// 10 observations: 10, 20, ..., 100 GiB, out of order.
+		"m4.xlarge": {30 * gib, 10 * gib, 100 * gib, 50 * gib, 20 * gib, 90 * gib, 40 * gib, 60 * gib, 80 * gib, 70 * gib},
+		"c4.large":  {5 * gib},
+	}
+	for _, c := range []struct {
+		typ    string
+		policy EBSSizePolicy
+		usage  uint64
+		size   uint64
+	}{
+		{"m4.xlarge", EBSSizePolicy{Percentile: 50}, 50 * gib, 50},
+		{"m4.xlarge", EBSSizePolicy{Percentile: 90, Headroom: 0.2}, 90 * gib, 108},
+		{"m4.xlarge", EBSSizePolicy{Percentile: 95, Headroom: 0.2}, 100 * gib, 120},
+		{"m4.xlarge", EBSSizePolicy{Percentile: 100, Headroom: 0.5, Max: 100}, 100 * gib, 100},
+		{"m4.xlarge", EBSSizePolicy{Percentile: 1}, 10 * gib, 10},
+		{"c4.large", EBSSizePolicy{Percentile: 90, Headroom: 0.1}, 5 * gib, 6},
+		{"c4.large", EBSSizePolicy{Percentile: 90, Min: 20}, 5 * gib, 20},
+	} {
+		rec, err := RecommendEBSSize(store, c.typ, c.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := rec.Usage, c.usage; got != want {
+			t.Errorf("%s %+v: got %v, want %v", c.typ, c.policy, got, want)
+		}
+		if got, want := rec.Size, c.size; got != want {
+			t.Errorf("%s %+v: got %v, want %v", c.typ, c.policy, got, want)
+		}
+		if got, want := rec.Samples, len(store[c.typ]); got != want {
+			t.Errorf("%s: got %v, want %v", c.typ, got, want)
+		}
+	}
+
+	if _, err := RecommendEBSSize(store, "r4.large", EBSSizePolicy{Percentile: 90}); !errors.Match(errors.NotExist, err) {
+		t.Errorf("expected NotExist error, got %v", err)
+	}
+	for _, p := range []float64{0, -1, 101} {
+		if _, err := RecommendEBSSize(store, "m4.xlarge", EBSSizePolicy{Percentile: p}); !errors.Match(errors.Invalid, err) {
+			t.Errorf("%v: expected Invalid error, got %v", p, err)
+		}
+	}
+}
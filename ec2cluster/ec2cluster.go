@@ -20,11 +20,14 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 	"github.com/grailbio/base/state"
 	"github.com/grailbio/reflow"
 	"github.com/grailbio/reflow/config"
@@ -62,10 +65,18 @@ type Cluster struct {
 	// File stores the cluster's state.
 	File *state.File
 	// EC2 is the EC2 API instance through which EC2 calls are made.
-	EC2 *ec2.EC2
+	EC2 ec2iface.EC2API
 	// Authenticator authenticates the ECR repository that stores the
 	// Reflowlet container.
 	Authenticator ecrauth.Interface
+	// CheckReflowletImage checks, at initialization, that
+	// ReflowletImage exists in its registry, so that a bad image
+	// fails fast rather than at instance boot.
+	CheckReflowletImage bool
+	// CheckConfigCompatibility checks, at initialization, that the
+	// reflowlet image accepts the cluster's configuration schema,
+	// as declared by the image's labels.
+	CheckConfigCompatibility bool
 	// Type specifies the instance types used for this cluster.
 	// If no type is specified, the cluster picks an instance type that
 	// best matches the resource requirements of the requested allocs.
@@ -76,10 +87,43 @@ type Cluster struct {
 	Labels pool.Labels
 	// Spot is set to true when a spot instance is desired.
 	Spot bool
+	// OnDemandFraction is the fraction of the cluster's instances
+	// that are launched on-demand when Spot is set. Each scale-up
+	// launches enough on-demand instances, first, to maintain the
+	// fraction across the cluster's live and pending instances, and
+	// fills the rest with spot instances. If zero, all instances are
+	// launched on the spot market.
+	OnDemandFraction float64
 	// SecurityGroup is the EC2 security group to use for cluster instances.
 	SecurityGroup string
+	// InstanceProfile is the ARN of the IAM instance profile of
+	// cluster instances.
+	InstanceProfile string
+	// InstanceProfiles, if set, are the ARNs of candidate IAM instance
+	// profiles of cluster instances, in order of preference. Each
+	// launch falls back to the next profile if EC2 rejects the
+	// previous one.
+	InstanceProfiles []string
+	// MinOffers and MinOfferResources, if nonzero, are the minimum
+	// number of offers, and minimum total resources of the offers,
+	// that each reflowlet must make before its instance is ready.
+	MinOffers         int
+	MinOfferResources reflow.Resources
+	// SecurityGroupName, if set (and SecurityGroup is not), is the name
+	// of a security group, managed by Reflow, that is used for cluster
+	// instances. It is created in SecurityGroupVPC (or the default
+	// VPC) if it does not exist, admitting reflowlet traffic from the
+	// group and from ControllerCIDR. See EnsureSecurityGroup.
+	SecurityGroupName string
+	SecurityGroupVPC  string
+	ControllerCIDR    string
 	// Region is the AWS availability region to use for launching new EC2 instances.
 	Region string
+	// FailoverRegions are the regions, in order of preference, into
+	// which instances are launched when the instance type selected
+	// for a launch, and every other type satisfying it, is unavailable
+	// in Region. They are useful for region-agnostic workloads.
+	FailoverRegions []FailoverRegion
 	// InstanceTypes stores the set of admissible instance types.
 	InstanceTypes map[string]bool
 	// ReflowletImage is the Docker URI of the image used for instance reflowlets.
@@ -87,26 +131,198 @@ type Cluster struct {
 	ReflowletImage string
 	// MaxInstances is the maximum number of concurrent instances permitted.
 	MaxInstances int
+	// CapacityProbeCount is the number of instances for which spot
+	// capacity is probed before each spot launch. If zero, a default
+	// of 20 is used.
+	CapacityProbeCount int
+	// CapacityTimeoutRetry retries capacity probes that time out,
+	// instead of taking them to mean that capacity is exhausted.
+	CapacityTimeoutRetry bool
+	// PreferStableSpot breaks ties among equally priced spot instance
+	// types in favor of those with lower interruption frequencies, as
+	// published by the EC2 Spot Instance Advisor.
+	PreferStableSpot bool
+	// ReapGracePeriod, if nonzero, enables the reaping of instances
+	// whose reflowlets have failed health probes for this long.
+	ReapGracePeriod time.Duration
+	// MaxSpotWaits, if nonzero, limits the number of spot requests
+	// that are concurrently awaiting fulfillment. Additional spot
+	// launches are queued until a slot is freed.
+	MaxSpotWaits int
+	// MinMemoryPerCPU and MaxMemoryPerCPU, if nonzero, bound the
+	// memory:vCPU ratio (in GiB per vCPU) of instance types selected
+	// by the cluster.
+	MinMemoryPerCPU, MaxMemoryPerCPU float64
+	// Deadline, if nonzero, is the time by which instances launched
+	// by the cluster must terminate, e.g., the deadline of the run it
+	// serves. It caps MaxInstanceLifetime.
+	Deadline time.Time
+	// Commitments are the discounts (fractions of the on-demand
+	// price) of capacity covered by Reserved Instances or Savings
+	// Plans, keyed by instance type or family. On-demand instance
+	// types are selected by their discounted prices.
+	Commitments map[string]float64
+	// CooldownStore, if set, persists the cluster's knowledge of
+	// unavailable and quarantined instance types across controller
+	// restarts.
+	CooldownStore CooldownStore
+	// MaxInstanceLifetime, if nonzero, is the maximum lifetime of
+	// instances launched by the cluster. Instances are terminated
+	// after this duration, regardless of their state, as a safety
+	// net against leaked instances.
+	MaxInstanceLifetime time.Duration
+	// NodeExporterImage, if set, is the Docker image, by tag or
+	// digest, of the node-exporter sidecar run on each instance.
+	NodeExporterImage string
+	// ReflowletsPerInstance is the number of reflowlets run on each
+	// instance, each offering an equal share of it. If zero, one
+	// reflowlet is run per instance.
+	ReflowletsPerInstance int
+	// PrePullImages are Docker images that are pulled on each
+	// instance at boot, after its reflowlet has started.
+	PrePullImages []string
+	// TargetGroupARN, if set, is the ARN of an Elastic Load Balancing
+	// target group with which instances are registered, at
+	// TargetGroupPort, through the ELBV2 client.
+	TargetGroupARN  string
+	TargetGroupPort int
+	ELBV2           ELBV2
+	// NFSMounts are the NFS shares (e.g., EFS file systems) that are
+	// mounted on each instance before its reflowlet starts.
+	NFSMounts []NFSMount
+	// CompressConfig compresses the configuration provided to
+	// instances in their user data.
+	CompressConfig bool
+	// AllowPrivateAddress permits reflowlets to be reached through
+	// their instances' private addresses when the instances have no
+	// public address.
+	AllowPrivateAddress bool
+	// RedactConfigKeys is the set of configuration keys that are
+	// removed from the configuration provided to instances, e.g.,
+	// because they are irrelevant or sensitive on workers.
+	RedactConfigKeys []string
+	// LogGroup, if set, is the CloudWatch Logs group to which the
+	// reflowlets' logs are forwarded. The instance profile's
+	// permission to write to it is validated, through IAM, when the
+	// cluster is initialized.
+	LogGroup string
+	// IAM is the IAM client used to validate the instance profile.
+	IAM IAM
+	// DataFilesystem ("ext4" or "xfs") and DataMountOptions, if set,
+	// configure the filesystem of each instance's data volume.
+	DataFilesystem   string
+	DataMountOptions string
 	// DiskType is the EBS disk type to use.
 	DiskType string
+	// RootEBSSize is the size, in GiB, of the root volume of each
+	// node. If zero, a default of 200 GiB is used.
+	RootEBSSize uint64
 	// DiskSpace is the number of GiB of disk space to allocate for each node.
 	DiskSpace int
 	// AMI is the VM image used to launch new instances.
 	AMI string
+	// ReflowletVersion, if set (and AMI is not), selects the newest
+	// AMI tagged with the given reflowlet version.
+	ReflowletVersion string
+	// CheckAMINetworking checks, when the cluster is initialized, that
+	// the AMI supports the enhanced networking (ENA or SR-IOV) of the
+	// configured instance types. Initialization fails if the AMI lacks
+	// ENA support required by any of them; other types whose network
+	// performance would be degraded are logged.
+	CheckAMINetworking bool
+	// AMIOwners are the owners (account IDs or aliases) of the AMIs
+	// that may be selected by ReflowletVersion. If empty, only the
+	// account's own AMIs are selected.
+	AMIOwners []string
 	// The config for this Reflow instantiation. Used to provide configs to
 	// EC2 instances.
 	Config config.Config
 	// User's public SSH key.
 	SshKey string
+	// SshCAKey, if set, is the public key of an SSH certificate
+	// authority whose user certificates are accepted by instances.
+	// It may be used together with, or instead of, SshKey.
+	SshCAKey string
 	// AWS key name for launching instances.
 	KeyName string
 
+	// MaxLaunchesPerType, if nonzero, is the maximum number of
+	// concurrent launches of each instance type. Demand in excess of
+	// it is diverted to the next-cheapest instance types that satisfy
+	// it, or else queued, so that launches are spread across types
+	// under load.
+	MaxLaunchesPerType int
+	// SpotInterruptionPollInterval, if nonzero, is the interval at
+	// which the spot requests of the cluster's spot instances are
+	// polled for interruption notices. Instances that have been
+	// issued notices are reported by InterruptionPending.
+	SpotInterruptionPollInterval time.Duration
+	// MetadataHopLimit is the metadata hop limit with which on-demand
+	// instances are launched; it defaults to 2 so that containers
+	// can reach the instance metadata service.
+	MetadataHopLimit int
+	// PostLaunch, if set, is called for each launched instance once
+	// it is running; see instance.PostLaunch.
+	PostLaunch func(context.Context, *ec2.Instance) error
+	// SpotPriceCeiling, if nonzero, is the spot market price, as a
+	// fraction of the on-demand price, above which the cluster's spot
+	// instances are relinquished: instances whose market price has
+	// exceeded the ceiling for SpotPriceSpikeDuration are reported by
+	// PriceSpiked, so that they may be drained and terminated.
+	SpotPriceCeiling float64
+	// SpotPriceSpikeDuration is the period for which the spot market
+	// price must exceed SpotPriceCeiling before instances are
+	// relinquished.
+	SpotPriceSpikeDuration time.Duration
+	// SpotPricePollInterval is the interval at which spot market
+	// prices are polled when SpotPriceCeiling is set. If zero,
+	// defaultSpotPricePollInterval is used.
+	SpotPricePollInterval time.Duration
+	// WarmPriceTolerance is the fraction of the cheapest suitable
+	// instance type's price by which a warm instance type, as set by
+	// SetWarmTypes, may be costlier and still be preferred to it.
+	WarmPriceTolerance float64
+
 	instanceState *instanceState
+	failover      []*regionTarget
 	pools         map[string]pool.Pool
 	pending       []*instance
 	wait          chan *waiter
+	spotWaits     *spotWaitLimiter
+	// cancel stops the cluster's maintenance goroutines.
+	cancel func()
+
+	mu sync.Mutex
+	// watched are the spot instances, keyed by ID, that are watched
+	// for interruption notices.
+	watched map[string]watchedInstance
+	// priced are the spot instances, keyed by ID, whose market
+	// prices are watched for spikes.
+	priced map[string]watchedInstance
+}
+
+// launched is an instance launched by the cluster, together with
+// the configuration selected for it. The instance's own configuration
+// differs if it was launched into a failover region.
+type launched struct {
+	*instance
+	config instanceConfig
+	// failover is set if the instance was launched into a failover
+	// region.
+	failover bool
 }
 
+// watchedInstance is a spot instance that is watched until cancel
+// is called.
+type watchedInstance struct {
+	*instance
+	cancel func()
+}
+
+// defaultSpotPricePollInterval is the default interval at which spot
+// market prices are polled.
+const defaultSpotPricePollInterval = 5 * time.Minute
+
 type waiter struct {
 	Min, Max reflow.Resources
 	ctx      context.Context
@@ -117,6 +333,30 @@ func (w *waiter) Notify() {
 	close(w.c)
 }
 
+// reflowlets returns the number of reflowlets per instance.
+func (c *Cluster) reflowlets() int {
+	if c.ReflowletsPerInstance < 1 {
+		return 1
+	}
+	return c.ReflowletsPerInstance
+}
+
+// reflowletKey returns the key of the pool of the k'th reflowlet of
+// the instance with the provided ID.
+func reflowletKey(id string, k int) string {
+	if k == 0 {
+		return id
+	}
+	return fmt.Sprintf("%s/%d", id, k)
+}
+
+// SpotWaits returns the number of spot requests that are awaiting
+// fulfillment, and the number of spot launches that are queued
+// behind them. Waits are queued only if MaxSpotWaits is set.
+func (c *Cluster) SpotWaits() (active, queued int) {
+	return c.spotWaits.Stats()
+}
+
 // Init initializes the cluster's data structures. It must be called
 // before use. Init also starts maintenance goroutines.
 func (c *Cluster) Init() error {
@@ -129,17 +369,60 @@ func (c *Cluster) Init() error {
 	if c.DiskSpace == 0 {
 		return errors.New("missing disk space parameter")
 	}
+	if c.AMI == "" && c.ReflowletVersion != "" {
+		ami, err := ResolveAMI(context.Background(), c.EC2, c.ReflowletVersion, c.AMIOwners...)
+		if err != nil {
+			return err
+		}
+		c.AMI = ami
+	}
 	if c.AMI == "" {
 		return errors.New("missing AMI parameter")
 	}
 	if c.Region == "" {
 		return errors.New("missing region parameter")
 	}
+	if c.CheckReflowletImage {
+		if err := CheckImage(context.Background(), http.DefaultClient, c.Authenticator, c.ReflowletImage); err != nil {
+			return err
+		}
+	}
+	if c.CheckConfigCompatibility {
+		if err := CheckConfigCompatibility(context.Background(), http.DefaultClient, c.Authenticator, c.ReflowletImage, c.Log); err != nil {
+			return err
+		}
+	}
+	if c.LogGroup != "" {
+		if err := c.checkLogForwarding(context.Background()); err != nil {
+			return err
+		}
+	}
+	if c.SecurityGroup == "" && c.SecurityGroupName != "" {
+		sg, err := EnsureSecurityGroup(context.Background(), c.EC2, c.SecurityGroupName, c.SecurityGroupVPC, c.ControllerCIDR)
+		if err != nil {
+			return err
+		}
+		c.SecurityGroup = sg
+	}
 	if c.SecurityGroup == "" {
 		return errors.New("missing EC2 security group")
 	}
+	if err := ValidateSecurityGroup(context.Background(), c.EC2, c.SecurityGroup, reflowletPorts(c.reflowlets())...); err != nil {
+		// Don't fail outright: the security group may not be describable
+		// with the cluster's credentials.
+		c.Log.Errorf("security group %s: %v", c.SecurityGroup, err)
+	}
 	c.pools = map[string]pool.Pool{}
 	c.wait = make(chan *waiter)
+	if c.MaxSpotWaits > 0 {
+		c.spotWaits = newSpotWaitLimiter(c.MaxSpotWaits)
+	}
+	// All EC2 calls made by the cluster share a single throttle, so
+	// that concurrent launches back off together when EC2 limits
+	// their request rate.
+	if client, ok := c.EC2.(*ec2.EC2); ok {
+		newThrottle().Install(&client.Handlers)
+	}
 
 	// Construct the set of legal instances and set available disk space.
 	var instances []instanceConfig
@@ -152,14 +435,99 @@ func (c *Cluster) Init() error {
 	if len(instances) == 0 {
 		return errors.New("no configured instance types")
 	}
+	if c.CheckAMINetworking {
+		types := make([]string, len(instances))
+		for i, config := range instances {
+			types[i] = config.Type
+		}
+		degraded, err := CheckEnhancedNetworking(context.Background(), c.EC2, c.AMI, types)
+		if err != nil {
+			return err
+		}
+		if len(degraded) > 0 {
+			c.Log.Printf("AMI %s does not support the enhanced networking of instance types %s; their network performance is degraded",
+				c.AMI, strings.Join(degraded, ", "))
+		}
+	}
 	c.instanceState = newInstanceState(instances, 5*time.Minute, c.Region)
+	c.instanceState.SetMemoryRatio(c.MinMemoryPerCPU, c.MaxMemoryPerCPU)
+	for key, discount := range c.Commitments {
+		if discount < 0 || discount >= 1 {
+			return errors.Errorf("commitment discount %v for %s is not in [0, 1)", discount, key)
+		}
+	}
+	c.instanceState.SetCommitments(c.Commitments)
+	for _, region := range c.FailoverRegions {
+		if region.Name == "" || region.EC2 == nil || region.AMI == "" {
+			return errors.Errorf("failover region %q: missing name, EC2 client, or AMI", region.Name)
+		}
+		state := newInstanceState(instances, 5*time.Minute, region.Name)
+		state.SetMemoryRatio(c.MinMemoryPerCPU, c.MaxMemoryPerCPU)
+		c.failover = append(c.failover, &regionTarget{
+			Name:          region.Name,
+			EC2:           region.EC2,
+			AMI:           region.AMI,
+			SecurityGroup: region.SecurityGroup,
+			Subnet:        region.Subnet,
+			state:         state,
+		})
+	}
+	if c.CooldownStore != nil {
+		if err := c.instanceState.SetStore(c.CooldownStore, c.Log); err != nil {
+			return errors.E("restore cooldowns", err)
+		}
+	}
+	if c.Spot && c.PreferStableSpot {
+		types := make([]string, len(instances))
+		for i, config := range instances {
+			types[i] = config.Type
+		}
+		if scores, err := InterruptionScores(context.Background(), c.Region, types); err != nil {
+			c.Log.Errorf("spot interruption scores: %v", err)
+		} else {
+			c.instanceState.SetTieBreak(preferInterruptionScore(scores))
+		}
+	}
 
 	c.update()
-	go c.maintain()
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	go c.maintain(ctx)
 	go c.loop()
+	if c.ReapGracePeriod > 0 {
+		// Instances are reaped in each region into which they are
+		// launched.
+		apis := []ec2iface.EC2API{c.EC2}
+		for _, region := range c.failover {
+			apis = append(apis, region.EC2)
+		}
+		for _, api := range apis {
+			reaper := &Reaper{
+				EC2:   api,
+				Tag:   c.Tag,
+				Grace: c.ReapGracePeriod,
+				Dial: func(baseurl string) (pool.Pool, error) {
+					return client.New(baseurl, c.HTTPClient, nil)
+				},
+				Log:                 c.Log,
+				AllowPrivateAddress: c.AllowPrivateAddress,
+				Reflowlets:          c.reflowlets(),
+			}
+			go reaper.Go(ctx, ec2PollInterval)
+		}
+	}
 	return nil
 }
 
+// Shutdown stops the cluster's maintenance goroutines, which
+// reconcile its state with EC2 and reap unhealthy instances. The
+// cluster's instances are not terminated.
+func (c *Cluster) Shutdown() {
+	if c.cancel != nil {
+		c.cancel()
+	}
+}
+
 // Allocate reserves an alloc with within the resource requirement
 // boundaries form this cluster. If an existing instance can serve
 // the request, it is returned immediately; otherwise new instance(s)
@@ -212,6 +580,29 @@ func (c *Cluster) Allocate(ctx context.Context, min, max reflow.Resources, label
 	}
 }
 
+// cheapest returns the cheapest available instance type that
+// satisfies need and whose pending launches, as counted by launching,
+// are fewer than MaxLaunchesPerType. If no instance type satisfies
+// need, the instance type selected by instanceState.MinAvailable is
+// considered instead.
+func (c *Cluster) cheapest(need reflow.Resources, launching map[string]int) (instanceConfig, bool) {
+	if c.MaxLaunchesPerType <= 0 {
+		return c.instanceState.MinAvailable(need, c.Spot)
+	}
+	candidates := c.instanceState.CheapestN(need, c.Spot, -1)
+	if len(candidates) == 0 {
+		if best, ok := c.instanceState.MinAvailable(need, c.Spot); ok {
+			candidates = []instanceConfig{best}
+		}
+	}
+	for _, config := range candidates {
+		if launching[config.Type] < c.MaxLaunchesPerType {
+			return config, true
+		}
+	}
+	return instanceConfig{}, false
+}
+
 func (c *Cluster) need(ctx context.Context, min, max reflow.Resources) <-chan struct{} {
 	w := &waiter{
 		Min: min,
@@ -230,30 +621,75 @@ func (c *Cluster) loop() {
 		waiters  []*waiter
 		pending  reflow.Resources
 		npending int
-		done     = make(chan *instance)
+		// npendingOnDemand is the number of pending on-demand
+		// launches.
+		npendingOnDemand int
+		done             = make(chan launched)
+		// launching stores the number of pending launches of each
+		// instance type.
+		launching = make(map[string]int)
 	)
-	launch := func(config instanceConfig, price float64) {
+	launch := func(config instanceConfig, price float64, spot bool) {
 		i := &instance{
-			HTTPClient:     c.HTTPClient,
-			ReflowConfig:   c.Config,
-			Config:         config,
-			Log:            c.Log,
-			Authenticator:  c.Authenticator,
-			EC2:            c.EC2,
-			Tag:            c.Tag,
-			Labels:         c.Labels,
-			Spot:           c.Spot,
-			SecurityGroup:  c.SecurityGroup,
-			ReflowletImage: c.ReflowletImage,
-			Price:          price,
-			EBSType:        c.DiskType,
-			EBSSize:        config.Resources.Disk >> 30,
-			AMI:            c.AMI,
-			SshKey:         c.SshKey,
-			KeyName:        c.KeyName,
+			HTTPClient:      c.HTTPClient,
+			ReflowConfig:    c.Config,
+			Config:          config,
+			Log:             c.Log,
+			Authenticator:   c.Authenticator,
+			EC2:             c.EC2,
+			Tag:             c.Tag,
+			InstanceProfile: c.InstanceProfile,
+			ClusterLabels:   c.Labels,
+			Spot:            spot,
+			SecurityGroup:   c.SecurityGroup,
+			ReflowletImage:  c.ReflowletImage,
+			Price:           price,
+			EBSType:         c.DiskType,
+			EBSSize:         config.Resources.Disk >> 30,
+			AMI:             c.AMI,
+			SshKey:          c.SshKey,
+			SshCAKey:        c.SshCAKey,
+			KeyName:         c.KeyName,
+
+			CapacityProbeCount: c.CapacityProbeCount,
+
+			CapacityTimeoutRetry: c.CapacityTimeoutRetry,
+			spotWaits:            c.spotWaits,
+			MaxLifetime:          c.MaxInstanceLifetime,
+			Deadline:             c.Deadline,
+			RedactKeys:           c.RedactConfigKeys,
+			NodeExporterImage:    c.NodeExporterImage,
+			PrePullImages:        c.PrePullImages,
+			Reflowlets:           c.ReflowletsPerInstance,
+			DataFilesystem:       c.DataFilesystem,
+			DataMountOptions:     c.DataMountOptions,
+			LogGroup:             c.LogGroup,
+			MetadataHopLimit:     c.MetadataHopLimit,
+			PostLaunch:           c.PostLaunch,
+			TargetGroupARN:       c.TargetGroupARN,
+			TargetGroupPort:      c.TargetGroupPort,
+			ELBV2:                c.ELBV2,
+			NFSMounts:            c.NFSMounts,
+			CompressConfig:       c.CompressConfig,
+
+			AllowPrivateAddress: c.AllowPrivateAddress,
+			InstanceProfiles:    c.InstanceProfiles,
+			MinOffers:           c.MinOffers,
+			MinOfferResources:   c.MinOfferResources,
+			RootEBSSize:         c.RootEBSSize,
 		}
 		i.Go(context.Background())
-		done <- i
+		var failover bool
+		if errors.Match(errors.Unavailable, i.Err()) && len(c.failover) > 0 {
+			c.Log.Printf("instance type %s unavailable in region %s: %v; failing over", config.Type, c.Region, i.Err())
+			if inst, err := launchWithFailover(context.Background(), c.failover, i, config.Resources); err != nil {
+				c.Log.Printf("failover launch: %v", err)
+			} else {
+				c.instanceState.Unavailable(config)
+				i, failover = inst, true
+			}
+		}
+		done <- launched{i, config, failover}
 	}
 
 	for {
@@ -262,6 +698,7 @@ func (c *Cluster) loop() {
 		n := len(instances)
 		var need reflow.Resources
 		var needPoll bool
+		var batch []instanceConfig
 		maxInstance, ok := c.instanceState.MaxAvailable(c.Spot)
 		if !ok {
 			c.Log.Printf("no instance types are currently available")
@@ -296,20 +733,36 @@ func (c *Cluster) loop() {
 					needPoll = true
 					break
 				}
+				if c.MaxLaunchesPerType > 0 && launching[best.Type] >= c.MaxLaunchesPerType {
+					// Queue the demand until pending launches complete.
+					break
+				}
 			} else {
 				// TODO(marius): set disk sizes dynamically
 				// TODO(marius): use a more sophisticated scoring scheme to pick instance types
-				best, ok = c.instanceState.MinAvailable(need, c.Spot)
+				best, ok = c.cheapest(need, launching)
 				if !ok {
+					if c.MaxLaunchesPerType > 0 && npending > 0 {
+						// Queue the demand until pending launches complete.
+						break
+					}
 					c.Log.Printf("no instance types matching requirements %s are currently available", need)
 					needPoll = true
 					break
 				}
 			}
+			launching[best.Type]++
 			pending = pending.Add(best.Resources)
 			npending++
-			c.Log.Debugf("launch %v need(%v) pending(%v)", best.Type, need, pending)
-			go launch(best, best.Price[c.Region])
+			batch = append(batch, best)
+		}
+		for k, spot := range spotMix(len(batch), c.Spot, c.OnDemandFraction, countOnDemand(instances)+npendingOnDemand, n+npending-len(batch)) {
+			best := batch[k]
+			if !spot {
+				npendingOnDemand++
+			}
+			c.Log.Debugf("launch %v spot(%v) need(%v) pending(%v)", best.Type, spot, need, pending)
+			go launch(best, best.Price[c.Region], spot)
 		}
 	sleep:
 		var pollch <-chan time.Time
@@ -318,11 +771,23 @@ func (c *Cluster) loop() {
 		}
 		select {
 		case <-pollch:
-		case inst := <-done:
-			pending = pending.Sub(inst.Config.Resources)
+		case l := <-done:
+			inst := l.instance
+			pending = pending.Sub(l.config.Resources)
 			npending--
+			if !inst.Spot {
+				npendingOnDemand--
+			}
+			launching[l.config.Type]--
 			switch {
 			case inst.Err() == nil:
+				if !l.failover {
+					c.instanceState.Booted(inst.Config.Type)
+				}
+			case inst.BootFailed():
+				c.Log.Printf("instance type %s failed to boot: %v", inst.Config.Type, inst.Err())
+				c.instanceState.BootFailed(inst.Config.Type)
+				continue
 			case errors.Match(errors.Unavailable, inst.Err()):
 				c.Log.Printf("instance type %s unavailable in region %s: %v", inst.Config.Type, c.Region, inst.Err())
 				c.instanceState.Unavailable(inst.Config)
@@ -330,6 +795,12 @@ func (c *Cluster) loop() {
 			default:
 				continue
 			}
+			if inst.Spot && c.SpotInterruptionPollInterval > 0 {
+				c.watchInterruption(inst)
+			}
+			if inst.Spot && c.SpotPriceCeiling > 0 {
+				c.watchPrice(inst)
+			}
 			c.add(inst.Instance())
 			var ws []*waiter
 			available := inst.Config.Resources
@@ -359,10 +830,111 @@ func (c *Cluster) loop() {
 	}
 }
 
-// maintain reconciles external state changes with local state.
-func (c *Cluster) maintain() {
+// checkLogForwarding checks that each of the cluster's candidate
+// instance profiles permits log forwarding to LogGroup, since
+// instances may be launched with any of them.
+func (c *Cluster) checkLogForwarding(ctx context.Context) error {
+	if c.IAM == nil {
+		return errors.New("log forwarding requires an IAM client")
+	}
+	profiles := c.InstanceProfiles
+	if len(profiles) == 0 {
+		profiles = []string{c.InstanceProfile}
+	}
+	for _, profile := range profiles {
+		if err := CheckLogForwarding(ctx, c.IAM, profile, c.LogGroup); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// watchInterruption watches the spot instance inst for interruption
+// notices until it is interrupted, is no longer running, or is
+// removed from the cluster.
+func (c *Cluster) watchInterruption(inst *instance) {
+	id := aws.StringValue(inst.Instance().InstanceId)
+	ctx, cancel := context.WithCancel(context.Background())
+	c.mu.Lock()
+	if c.watched == nil {
+		c.watched = make(map[string]watchedInstance)
+	}
+	c.watched[id] = watchedInstance{inst, cancel}
+	c.mu.Unlock()
+	go func() {
+		defer cancel()
+		inst.WatchInterruption(ctx, c.SpotInterruptionPollInterval)
+		if !inst.InterruptionPending() {
+			c.mu.Lock()
+			if w, ok := c.watched[id]; ok && w.instance == inst {
+				delete(c.watched, id)
+			}
+			c.mu.Unlock()
+		}
+	}()
+}
+
+// InterruptionPending tells whether EC2 has issued an interruption
+// notice for the cluster's spot instance with the provided ID, so
+// that it should be drained rather than filled. Interruption notices
+// are observed only if SpotInterruptionPollInterval is set.
+func (c *Cluster) InterruptionPending(id string) bool {
+	c.mu.Lock()
+	inst, ok := c.watched[id]
+	c.mu.Unlock()
+	return ok && inst.InterruptionPending()
+}
+
+// SetWarmTypes sets the instance types of which warm (stopped)
+// instances are currently available to the cluster. Instance type
+// selection prefers warm types within WarmPriceTolerance of the
+// cheapest suitable type, since warm instances start much faster.
+func (c *Cluster) SetWarmTypes(types []string) {
+	c.instanceState.SetWarm(types, c.WarmPriceTolerance)
+}
+
+// watchPrice watches the market price of the spot instance inst
+// for sustained spikes above the cluster's ceiling, until a spike is
+// observed or the instance is removed.
+func (c *Cluster) watchPrice(inst *instance) {
+	price, ok := inst.Config.Price[c.Region]
+	if !ok {
+		return
+	}
+	ceiling := price * c.SpotPriceCeiling
+	interval := c.SpotPricePollInterval
+	if interval <= 0 {
+		interval = defaultSpotPricePollInterval
+	}
+	id := aws.StringValue(inst.Instance().InstanceId)
+	ctx, cancel := context.WithCancel(context.Background())
+	c.mu.Lock()
+	if c.priced == nil {
+		c.priced = make(map[string]watchedInstance)
+	}
+	c.priced[id] = watchedInstance{inst, cancel}
+	c.mu.Unlock()
+	go inst.WatchPrice(ctx, interval, ceiling, c.SpotPriceSpikeDuration)
+}
+
+// PriceSpiked tells whether the spot market price of the cluster's
+// spot instance with the provided ID has exceeded SpotPriceCeiling
+// for a sustained period, so that it should be drained and
+// terminated.
+func (c *Cluster) PriceSpiked(id string) bool {
+	c.mu.Lock()
+	inst, ok := c.priced[id]
+	c.mu.Unlock()
+	return ok && inst.PriceSpiked()
+}
+
+// maintain reconciles external state changes with local state
+// until the provided context is done.
+func (c *Cluster) maintain(ctx context.Context) {
 	ec2Tick := time.NewTicker(ec2PollInterval)
+	defer ec2Tick.Stop()
 	updateTick := time.NewTicker(statePollInterval)
+	defer updateTick.Stop()
 	if err := c.reconcile(); err != nil {
 		c.Log.Printf("reconcile error: %v", err)
 	}
@@ -374,6 +946,8 @@ func (c *Cluster) maintain() {
 			}
 		case <-updateTick.C:
 			c.update()
+		case <-ctx.Done():
+			return
 		}
 	}
 }
@@ -399,11 +973,36 @@ func (c *Cluster) add(newInstances ...*ec2.Instance) {
 }
 
 func (c *Cluster) remove(instanceIds ...string) {
+	c.mu.Lock()
+	for _, id := range instanceIds {
+		if inst, ok := c.watched[id]; ok {
+			inst.cancel()
+			delete(c.watched, id)
+		}
+		if inst, ok := c.priced[id]; ok {
+			inst.cancel()
+			delete(c.priced, id)
+		}
+	}
+	c.mu.Unlock()
+	eips := make(map[string]ec2iface.EC2API)
 	c.updateState(func(instances map[string]*ec2.Instance) {
 		for _, id := range instanceIds {
+			if inst := instances[id]; inst != nil {
+				if eip := allocatedElasticIP(inst); eip != "" {
+					eips[eip] = regionEC2(c.failover, inst, c.EC2)
+				}
+			}
 			delete(instances, id)
 		}
 	})
+	// Elastic IP addresses allocated for removed instances are
+	// released so that they do not leak.
+	for eip, api := range eips {
+		if err := releaseAllocatedElasticIP(context.Background(), api, eip); err != nil {
+			c.Log.Errorf("release elastic IP %s: %v", eip, err)
+		}
+	}
 }
 
 func (c *Cluster) update() {
@@ -415,10 +1014,19 @@ func (c *Cluster) update() {
 		return
 	}
 	for id, inst := range instances {
-		if c.pools[id] == nil {
-			baseurl := fmt.Sprintf("https://%s:9000/v1/", *inst.PublicDnsName)
+		for k := 0; k < c.reflowlets(); k++ {
+			key := reflowletKey(id, k)
+			if c.pools[key] != nil {
+				continue
+			}
+			addr := instanceAddress(inst, c.AllowPrivateAddress)
+			if addr == "" {
+				c.Log.Printf("instance %s: no public DNS name or IP address", id)
+				break
+			}
+			baseurl := fmt.Sprintf("https://%s:%d/v1/", addr, reflowletPort+k)
 			var err error
-			c.pools[*inst.InstanceId], err = client.New(
+			c.pools[key], err = client.New(
 				baseurl,
 				c.HTTPClient, nil /*log.New(os.Stderr, "client: ", 0)*/)
 			if err != nil {
@@ -426,9 +1034,9 @@ func (c *Cluster) update() {
 			}
 		}
 	}
-	for id := range c.pools {
-		if instances[id] == nil {
-			delete(c.pools, id)
+	for key := range c.pools {
+		if id := strings.SplitN(key, "/", 2)[0]; instances[id] == nil {
+			delete(c.pools, key)
 		}
 	}
 	c.SetPools(vals(c.pools))
@@ -452,7 +1060,7 @@ func (c *Cluster) reconcile() error {
 		input := ec2.DescribeInstancesInput{
 			InstanceIds: []*string{aws.String(id)},
 		}
-		resp, err := c.EC2.DescribeInstances(&input)
+		resp, err := regionEC2(c.failover, instances[id], c.EC2).DescribeInstances(&input)
 		if err != nil {
 			if err, ok := err.(awserr.Error); ok && err.Code() == "InvalidInstanceID.NotFound" {
 				c.Log.Printf("marking instance %s down: not found", id)
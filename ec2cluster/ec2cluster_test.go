@@ -0,0 +1,32 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestClusterShutdown(t *testing.T) {
+	file, cleanup := newTestStateFile(t)
+	defer cleanup()
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Cluster{File: file, cancel: cancel}
+	done := make(chan struct{})
+	go func() {
+		c.maintain(ctx)
+		close(done)
+	}()
+	c.Shutdown()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("maintenance did not stop")
+	}
+	// Shutdown is idempotent, and safe on uninitialized clusters.
+	c.Shutdown()
+	new(Cluster).Shutdown()
+}
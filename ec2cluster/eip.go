@@ -0,0 +1,189 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/grailbio/reflow/errors"
+)
+
+// elasticIPAllocationTag is the instance tag recording the allocation
+// ID of an Elastic IP address that was allocated by Reflow for the
+// instance.
+const elasticIPAllocationTag = "reflow:eip-allocation"
+
+// elasticIP describes an Elastic IP address used by an instance.
+type elasticIP struct {
+	// AllocationID is the EC2 allocation ID of the address.
+	AllocationID string
+	// PublicIP is the public IPv4 address.
+	PublicIP string
+	// AssociationID is the EC2 ID of the address's association with
+	// an instance, if any.
+	AssociationID string
+	// Allocated is true when the address was allocated by Reflow,
+	// and should thus also be released by it.
+	Allocated bool
+}
+
+// allocateElasticIP returns the Elastic IP address with the given
+// allocation ID. If allocationID is empty, a new VPC address is
+// allocated.
+func allocateElasticIP(ctx context.Context, api ec2iface.EC2API, allocationID string) (elasticIP, error) {
+	if allocationID == "" {
+		resp, err := api.AllocateAddressWithContext(ctx, &ec2.AllocateAddressInput{
+			Domain: aws.String(ec2.DomainTypeVpc),
+		})
+		if err != nil {
+			return elasticIP{}, err
+		}
+		return elasticIP{
+			AllocationID: aws.StringValue(resp.AllocationId),
+			PublicIP:     aws.StringValue(resp.PublicIp),
+			Allocated:    true,
+		}, nil
+	}
+	resp, err := api.DescribeAddressesWithContext(ctx, &ec2.DescribeAddressesInput{
+		AllocationIds: []*string{aws.String(allocationID)},
+	})
+	if err != nil {
+		return elasticIP{}, err
+	}
+	if n := len(resp.Addresses); n != 1 {
+		return elasticIP{}, errors.Errorf("ec2.describeaddresses %s: got %d entries, want 1", allocationID, n)
+	}
+	return elasticIP{
+		AllocationID: allocationID,
+		PublicIP:     aws.StringValue(resp.Addresses[0].PublicIp),
+	}, nil
+}
+
+// associateElasticIP associates the provided address with the
+// instance with the given ID, recording the association in eip.
+func associateElasticIP(ctx context.Context, api ec2iface.EC2API, instanceID string, eip *elasticIP) error {
+	resp, err := api.AssociateAddressWithContext(ctx, &ec2.AssociateAddressInput{
+		AllocationId: aws.String(eip.AllocationID),
+		InstanceId:   aws.String(instanceID),
+	})
+	if err != nil {
+		return err
+	}
+	eip.AssociationID = aws.StringValue(resp.AssociationId)
+	return nil
+}
+
+// releaseElasticIP releases the provided address if it was
+// allocated by Reflow; otherwise it is left untouched. Associated
+// addresses are first disassociated, as EC2 does not release
+// addresses that are in use.
+func releaseElasticIP(ctx context.Context, api ec2iface.EC2API, eip elasticIP) error {
+	if !eip.Allocated {
+		return nil
+	}
+	if eip.AssociationID != "" {
+		_, err := api.DisassociateAddressWithContext(ctx, &ec2.DisassociateAddressInput{
+			AssociationId: aws.String(eip.AssociationID),
+		})
+		if err != nil && !isAWSErrorCode(err, "InvalidAssociationID.NotFound") {
+			return err
+		}
+	}
+	_, err := api.ReleaseAddressWithContext(ctx, &ec2.ReleaseAddressInput{
+		AllocationId: aws.String(eip.AllocationID),
+	})
+	return err
+}
+
+// releaseAllocatedElasticIP releases the Reflow-allocated address
+// with the given allocation ID, as recorded in an instance's
+// elasticIPAllocationTag. Addresses that no longer exist are
+// ignored.
+func releaseAllocatedElasticIP(ctx context.Context, api ec2iface.EC2API, allocationID string) error {
+	resp, err := api.DescribeAddressesWithContext(ctx, &ec2.DescribeAddressesInput{
+		AllocationIds: []*string{aws.String(allocationID)},
+	})
+	if isAWSErrorCode(err, "InvalidAllocationID.NotFound") {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	eip := elasticIP{AllocationID: allocationID, Allocated: true}
+	for _, addr := range resp.Addresses {
+		eip.AssociationID = aws.StringValue(addr.AssociationId)
+	}
+	return releaseElasticIP(ctx, api, eip)
+}
+
+// setupElasticIP allocates (or looks up) and associates an Elastic
+// IP address with the instance with the given ID. If association
+// fails, addresses allocated by setupElasticIP are released.
+func (i *instance) setupElasticIP(ctx context.Context, id string) error {
+	eip, err := allocateElasticIP(ctx, i.EC2, i.ElasticIPAllocationID)
+	if err != nil {
+		return err
+	}
+	if err := associateElasticIP(ctx, i.EC2, id, &eip); err != nil {
+		if rerr := releaseElasticIP(ctx, i.EC2, eip); rerr != nil {
+			i.Log.Errorf("release elastic IP %s: %v", eip.AllocationID, rerr)
+		}
+		return err
+	}
+	i.eip = eip
+	if eip.Allocated {
+		i.recordElasticIP(ctx, id)
+	}
+	return nil
+}
+
+// recordElasticIP records the allocation ID of the instance's
+// Reflow-allocated address in its elasticIPAllocationTag, so that
+// the address can be released when the instance is removed from
+// the cluster. Tagging errors are logged.
+func (i *instance) recordElasticIP(ctx context.Context, id string) {
+	tag := &ec2.Tag{Key: aws.String(elasticIPAllocationTag), Value: aws.String(i.eip.AllocationID)}
+	if i.ec2inst != nil {
+		i.ec2inst.Tags = append(i.ec2inst.Tags, tag)
+	}
+	if i.SkipTagging {
+		return
+	}
+	_, err := i.EC2.CreateTagsWithContext(ctx, &ec2.CreateTagsInput{
+		Resources: []*string{aws.String(id)},
+		Tags:      []*ec2.Tag{tag},
+	})
+	if err != nil {
+		i.Log.Errorf("ec2.createtags %v: %v", id, err)
+	}
+}
+
+// allocatedElasticIP returns the allocation ID of the
+// Reflow-allocated address recorded on the provided instance, if any.
+func allocatedElasticIP(inst *ec2.Instance) string {
+	for _, tag := range inst.Tags {
+		if aws.StringValue(tag.Key) == elasticIPAllocationTag {
+			return aws.StringValue(tag.Value)
+		}
+	}
+	return ""
+}
+
+// ReleaseElasticIP releases the Elastic IP address associated with
+// this instance, if it was allocated by Reflow. It should be called
+// when the instance is torn down.
+func (i *instance) ReleaseElasticIP(ctx context.Context) error {
+	if i.eip.AllocationID == "" {
+		return nil
+	}
+	if err := releaseElasticIP(ctx, i.EC2, i.eip); err != nil {
+		return err
+	}
+	i.eip = elasticIP{}
+	return nil
+}
@@ -0,0 +1,228 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/grailbio/base/state"
+	"github.com/grailbio/reflow/pool"
+)
+
+func TestElasticIP(t *testing.T) {
+	var (
+		associated = map[string]string{}
+		released   []string
+	)
+	api := &mockEC2{
+		AllocateAddressFunc: func(input *ec2.AllocateAddressInput) (*ec2.AllocateAddressOutput, error) {
+			return &ec2.AllocateAddressOutput{
+				AllocationId: aws.String("eipalloc-new"),
+				PublicIp:     aws.String("1.2.3.4"),
+			}, nil
+		},
+		DescribeAddressesFunc: func(input *ec2.DescribeAddressesInput) (*ec2.DescribeAddressesOutput, error) {
+			return &ec2.DescribeAddressesOutput{
+				Addresses: []*ec2.Address{{
+					AllocationId: input.AllocationIds[0],
+					PublicIp:     aws.String("5.6.7.8"),
+				}},
+			}, nil
+		},
+		AssociateAddressFunc: func(input *ec2.AssociateAddressInput) (*ec2.AssociateAddressOutput, error) {
+			associated[aws.StringValue(input.AllocationId)] = aws.StringValue(input.InstanceId)
+			return &ec2.AssociateAddressOutput{}, nil
+		},
+		CreateTagsFunc: func(input *ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error) {
+			return &ec2.CreateTagsOutput{}, nil
+		},
+		ReleaseAddressFunc: func(input *ec2.ReleaseAddressInput) (*ec2.ReleaseAddressOutput, error) {
+			released = append(released, aws.StringValue(input.AllocationId))
+			return &ec2.ReleaseAddressOutput{}, nil
+		},
+	}
+	ctx := context.Background()
+
+	// Allocated by reflow.
+	i := &instance{EC2: api, ElasticIP: true}
+	if err := i.setupElasticIP(ctx, "i-1"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := i.eip.PublicIP, "1.2.3.4"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := associated["eipalloc-new"], "i-1"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if err := i.ReleaseElasticIP(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(released), 1; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got, want := released[0], "eipalloc-new"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Provided by the user.
+	released = nil
+	i = &instance{EC2: api, ElasticIP: true, ElasticIPAllocationID: "eipalloc-user"}
+	if err := i.setupElasticIP(ctx, "i-2"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := i.eip.PublicIP, "5.6.7.8"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := associated["eipalloc-user"], "i-2"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if err := i.ReleaseElasticIP(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(released) != 0 {
+		t.Errorf("user-provided address was released: %v", released)
+	}
+
+	// Failed associations release allocated addresses.
+	api.AssociateAddressFunc = func(input *ec2.AssociateAddressInput) (*ec2.AssociateAddressOutput, error) {
+		return nil, awserr.New("InvalidInstanceID", "invalid instance", nil)
+	}
+	i = &instance{EC2: api, ElasticIP: true}
+	if err := i.setupElasticIP(ctx, "i-3"); err == nil {
+		t.Fatal("expected error")
+	}
+	if got, want := released, []string{"eipalloc-new"}; len(got) != 1 || got[0] != want[0] {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestElasticIPTeardown(t *testing.T) {
+	var (
+		disassociated, released []string
+		tagged                  = map[string]string{}
+	)
+	api := &mockEC2{
+		AllocateAddressFunc: func(input *ec2.AllocateAddressInput) (*ec2.AllocateAddressOutput, error) {
+			return &ec2.AllocateAddressOutput{
+				AllocationId: aws.String("eipalloc-new"),
+				PublicIp:     aws.String("1.2.3.4"),
+			}, nil
+		},
+		DescribeAddressesFunc: func(input *ec2.DescribeAddressesInput) (*ec2.DescribeAddressesOutput, error) {
+			return &ec2.DescribeAddressesOutput{
+				Addresses: []*ec2.Address{{
+					AllocationId:  input.AllocationIds[0],
+					AssociationId: aws.String("eipassoc-" + aws.StringValue(input.AllocationIds[0])),
+					PublicIp:      aws.String("5.6.7.8"),
+				}},
+			}, nil
+		},
+		AssociateAddressFunc: func(input *ec2.AssociateAddressInput) (*ec2.AssociateAddressOutput, error) {
+			return &ec2.AssociateAddressOutput{
+				AssociationId: aws.String("eipassoc-" + aws.StringValue(input.AllocationId)),
+			}, nil
+		},
+		CreateTagsFunc: func(input *ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error) {
+			for _, tag := range input.Tags {
+				if aws.StringValue(tag.Key) == elasticIPAllocationTag {
+					tagged[aws.StringValue(input.Resources[0])] = aws.StringValue(tag.Value)
+				}
+			}
+			return &ec2.CreateTagsOutput{}, nil
+		},
+		DisassociateAddressFunc: func(input *ec2.DisassociateAddressInput) (*ec2.DisassociateAddressOutput, error) {
+			disassociated = append(disassociated, aws.StringValue(input.AssociationId))
+			return &ec2.DisassociateAddressOutput{}, nil
+		},
+		ReleaseAddressFunc: func(input *ec2.ReleaseAddressInput) (*ec2.ReleaseAddressOutput, error) {
+			released = append(released, aws.StringValue(input.AllocationId))
+			return &ec2.ReleaseAddressOutput{}, nil
+		},
+		TerminateInstancesFunc: func(input *ec2.TerminateInstancesInput) (*ec2.TerminateInstancesOutput, error) {
+			return &ec2.TerminateInstancesOutput{}, nil
+		},
+	}
+	ctx := context.Background()
+
+	// Terminated instances release the addresses allocated for them,
+	// but not those provided by the user.
+	for _, c := range []struct {
+		allocationID string
+		released     []string
+	}{
+		{"", []string{"eipalloc-new"}},
+		{"eipalloc-user", nil},
+	} {
+		disassociated, released = nil, nil
+		i := &instance{EC2: api, ElasticIP: true, ElasticIPAllocationID: c.allocationID}
+		if err := i.setupElasticIP(ctx, "i-1"); err != nil {
+			t.Fatal(err)
+		}
+		i.terminate(ctx, "i-1")
+		if got, want := released, c.released; !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: got %v, want %v", c.allocationID, got, want)
+		}
+		if got, want := len(disassociated), len(c.released); got != want {
+			t.Errorf("%q: got %v, want %v", c.allocationID, got, want)
+		}
+	}
+
+	// The cluster releases the allocated addresses of the instances it
+	// removes.
+	file, cleanup := newTestStateFile(t)
+	defer cleanup()
+	var instances []*ec2.Instance
+	for _, c := range []struct{ id, allocationID string }{
+		{"i-1", ""},
+		{"i-2", "eipalloc-user"},
+	} {
+		i := &instance{EC2: api, ElasticIP: true, ElasticIPAllocationID: c.allocationID}
+		i.ec2inst = &ec2.Instance{InstanceId: aws.String(c.id)}
+		if err := i.setupElasticIP(ctx, c.id); err != nil {
+			t.Fatal(err)
+		}
+		instances = append(instances, i.Instance())
+	}
+	if got, want := tagged, map[string]string{"i-1": "eipalloc-new"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	c := &Cluster{EC2: api, File: file, pools: make(map[string]pool.Pool)}
+	c.add(instances...)
+	disassociated, released = nil, nil
+	c.remove("i-1", "i-2")
+	if got, want := released, []string{"eipalloc-new"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := disassociated, []string{"eipassoc-eipalloc-new"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// newTestStateFile returns a cluster state file in a temporary
+// directory, which is removed by the returned cleanup function.
+func newTestStateFile(t *testing.T) (*state.File, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := state.Open(filepath.Join(dir, "state"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return file, func() {
+		file.Close()
+		os.RemoveAll(dir)
+	}
+}
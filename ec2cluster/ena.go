@@ -0,0 +1,118 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/grailbio/reflow/errors"
+)
+
+// Enhanced networking requirements of instance types.
+const (
+	// networkingBasic instance types do not use enhanced networking.
+	networkingBasic = iota
+	// networkingSRIOV instance types use the Intel 82599 Virtual
+	// Function interface, if the AMI supports it.
+	networkingSRIOV
+	// networkingENA instance types use the Elastic Network Adapter,
+	// if the AMI supports it.
+	networkingENA
+	// networkingENARequired instance types (those built on the Nitro
+	// system) cannot be launched from AMIs that do not support the
+	// Elastic Network Adapter.
+	networkingENARequired
+)
+
+// enaRequiredFamilies are the instance families that require ENA.
+var enaRequiredFamilies = map[string]bool{
+	"a1": true, "c5": true, "c5d": true, "c5n": true, "g4dn": true,
+	"i3en": true, "m5": true, "m5a": true, "m5ad": true, "m5d": true,
+	"m5dn": true, "m5n": true, "p3dn": true, "r5": true, "r5a": true,
+	"r5ad": true, "r5d": true, "r5dn": true, "r5n": true, "t3": true,
+	"t3a": true, "z1d": true,
+}
+
+// enaFamilies are the instance families that support, but do not
+// require, ENA.
+var enaFamilies = map[string]bool{
+	"f1": true, "g3": true, "h1": true, "i3": true, "p2": true,
+	"p3": true, "x1": true, "x1e": true,
+}
+
+// sriovFamilies are the instance families that support SR-IOV
+// enhanced networking.
+var sriovFamilies = map[string]bool{
+	"c3": true, "c4": true, "d2": true, "i2": true, "m4": true, "r3": true,
+}
+
+// enhancedNetworking returns the enhanced networking requirement of
+// the instance type typ.
+func enhancedNetworking(typ string) int {
+	family := strings.SplitN(typ, ".", 2)[0]
+	switch {
+	case enaRequiredFamilies[family]:
+		return networkingENARequired
+	case enaFamilies[family], typ == "m4.16xlarge":
+		return networkingENA
+	case sriovFamilies[family]:
+		return networkingSRIOV
+	default:
+		return networkingBasic
+	}
+}
+
+// CheckEnhancedNetworking checks that the AMI supports the enhanced
+// networking used by the provided instance types. Instance types that
+// require ENA cannot be launched from AMIs that do not support it:
+// CheckEnhancedNetworking returns an errors.NotSupported error naming
+// them. Other instance types may be launched, but their network
+// performance is degraded without enhanced networking; they are
+// returned so that callers may warn about them.
+func CheckEnhancedNetworking(ctx context.Context, api ec2iface.EC2API, ami string, types []string) (degraded []string, err error) {
+	resp, err := api.DescribeImagesWithContext(ctx, &ec2.DescribeImagesInput{
+		ImageIds: []*string{aws.String(ami)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Images) != 1 {
+		return nil, errors.E(errors.NotExist, errors.Errorf("ec2.describeimages %s: image not found", ami))
+	}
+	var (
+		image       = resp.Images[0]
+		ena         = aws.BoolValue(image.EnaSupport)
+		sriov       = aws.StringValue(image.SriovNetSupport) == "simple"
+		unsupported []string
+	)
+	for _, typ := range types {
+		switch enhancedNetworking(typ) {
+		case networkingENARequired:
+			if !ena {
+				unsupported = append(unsupported, typ)
+			}
+		case networkingENA:
+			if !ena {
+				degraded = append(degraded, typ)
+			}
+		case networkingSRIOV:
+			if !sriov {
+				degraded = append(degraded, typ)
+			}
+		}
+	}
+	sort.Strings(degraded)
+	if len(unsupported) > 0 {
+		sort.Strings(unsupported)
+		return degraded, errors.E("check enhanced networking", ami, errors.NotSupported,
+			errors.Errorf("image does not support ENA, which is required by instance types %s", strings.Join(unsupported, ", ")))
+	}
+	return degraded, nil
+}
@@ -0,0 +1,66 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/grailbio/reflow/errors"
+)
+
+func TestCheckEnhancedNetworking(t *testing.T) {
+	images := map[string]*ec2.Image{
+		"ami-basic": {ImageId: aws.String("ami-basic")},
+		"ami-sriov": {ImageId: aws.String("ami-sriov"), SriovNetSupport: aws.String("simple")},
+		"ami-ena":   {ImageId: aws.String("ami-ena"), EnaSupport: aws.Bool(true), SriovNetSupport: aws.String("simple")},
+	}
+	api := &mockEC2{
+		DescribeImagesFunc: func(input *ec2.DescribeImagesInput) (*ec2.DescribeImagesOutput, error) {
+			out := new(ec2.DescribeImagesOutput)
+			if image := images[aws.StringValue(input.ImageIds[0])]; image != nil {
+				out.Images = []*ec2.Image{image}
+			}
+			return out, nil
+		},
+	}
+	ctx := context.Background()
+	types := []string{"t2.large", "c4.xlarge", "m4.16xlarge", "x1.32xlarge", "r5.2xlarge", "c5.9xlarge"}
+
+	// ENA-required types cannot be launched from the non-ENA AMI.
+	degraded, err := CheckEnhancedNetworking(ctx, api, "ami-sriov", types)
+	if !errors.Match(errors.NotSupported, err) {
+		t.Fatalf("expected not supported error, got %v", err)
+	}
+	if got, want := err.Error(), "check enhanced networking ami-sriov: operation not supported: image does not support ENA, which is required by instance types c5.9xlarge, r5.2xlarge"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := degraded, []string{"m4.16xlarge", "x1.32xlarge"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	degraded, err = CheckEnhancedNetworking(ctx, api, "ami-basic", types[:4])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := degraded, []string{"c4.xlarge", "m4.16xlarge", "x1.32xlarge"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	degraded, err = CheckEnhancedNetworking(ctx, api, "ami-ena", types)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(degraded) != 0 {
+		t.Errorf("unexpected degraded types %v", degraded)
+	}
+
+	if _, err := CheckEnhancedNetworking(ctx, api, "ami-missing", types); !errors.Match(errors.NotExist, err) {
+		t.Errorf("expected not exist error, got %v", err)
+	}
+}
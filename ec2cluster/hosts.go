@@ -0,0 +1,66 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/grailbio/reflow/errors"
+)
+
+// hostPoolTag is the tag key used to identify dedicated hosts that
+// are managed by Reflow. Its value is the pool name.
+const hostPoolTag = "reflow:hostpool"
+
+// selectHost returns the ID of a dedicated host in the given host
+// pool that has available capacity for an instance of type typ in
+// availability zone az. If no such host exists, a new host is
+// allocated and added to the pool.
+func selectHost(ctx context.Context, api ec2iface.EC2API, pool, typ, az string) (string, error) {
+	resp, err := api.DescribeHostsWithContext(ctx, &ec2.DescribeHostsInput{
+		Filter: []*ec2.Filter{
+			{Name: aws.String("tag:" + hostPoolTag), Values: []*string{aws.String(pool)}},
+			{Name: aws.String("availability-zone"), Values: []*string{aws.String(az)}},
+			{Name: aws.String("state"), Values: []*string{aws.String(ec2.AllocationStateAvailable)}},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	for _, host := range resp.Hosts {
+		if host.AvailableCapacity == nil {
+			continue
+		}
+		for _, c := range host.AvailableCapacity.AvailableInstanceCapacity {
+			if aws.StringValue(c.InstanceType) == typ && aws.Int64Value(c.AvailableCapacity) > 0 {
+				return aws.StringValue(host.HostId), nil
+			}
+		}
+	}
+	alloc, err := api.AllocateHostsWithContext(ctx, &ec2.AllocateHostsInput{
+		AvailabilityZone: aws.String(az),
+		InstanceType:     aws.String(typ),
+		Quantity:         aws.Int64(1),
+		AutoPlacement:    aws.String(ec2.AutoPlacementOff),
+	})
+	if err != nil {
+		return "", err
+	}
+	if n := len(alloc.HostIds); n != 1 {
+		return "", errors.Errorf("ec2.allocatehosts: got %d hosts, want 1", n)
+	}
+	id := aws.StringValue(alloc.HostIds[0])
+	_, err = api.CreateTagsWithContext(ctx, &ec2.CreateTagsInput{
+		Resources: []*string{aws.String(id)},
+		Tags:      []*ec2.Tag{{Key: aws.String(hostPoolTag), Value: aws.String(pool)}},
+	})
+	if err != nil {
+		return "", errors.E("tagging dedicated host "+id, err)
+	}
+	return id, nil
+}
@@ -0,0 +1,87 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func testHost(id, typ string, available int64) *ec2.Host {
+	return &ec2.Host{
+		HostId: aws.String(id),
+		AvailableCapacity: &ec2.AvailableCapacity{
+			AvailableInstanceCapacity: []*ec2.InstanceCapacity{{
+				InstanceType:      aws.String(typ),
+				AvailableCapacity: aws.Int64(available),
+			}},
+		},
+	}
+}
+
+func TestSelectHost(t *testing.T) {
+	var (
+		input     *ec2.RunInstancesInput
+		allocated int
+		tagged    = map[string]string{}
+	)
+	api := newLaunchMockEC2("i-123", "test.example.com")
+	api.RunInstancesFunc = func(in *ec2.RunInstancesInput) (*ec2.Reservation, error) {
+		input = in
+		return &ec2.Reservation{Instances: []*ec2.Instance{{InstanceId: aws.String("i-123")}}}, nil
+	}
+	api.DescribeHostsFunc = func(in *ec2.DescribeHostsInput) (*ec2.DescribeHostsOutput, error) {
+		return &ec2.DescribeHostsOutput{Hosts: []*ec2.Host{
+			testHost("h-full", "m4.xlarge", 0),
+			testHost("h-free", "m4.xlarge", 2),
+		}}, nil
+	}
+	api.AllocateHostsFunc = func(in *ec2.AllocateHostsInput) (*ec2.AllocateHostsOutput, error) {
+		allocated++
+		return &ec2.AllocateHostsOutput{HostIds: []*string{aws.String("h-new")}}, nil
+	}
+	api.CreateTagsFunc = func(in *ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error) {
+		tagged[aws.StringValue(in.Resources[0])] = aws.StringValue(in.Tags[0].Value)
+		return &ec2.CreateTagsOutput{}, nil
+	}
+	i := newLaunchTestInstance(api, nil)
+	i.AvailabilityZone = "us-west-2a"
+	i.HostPool = "pool"
+	ctx := context.Background()
+	if _, err := i.launch(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := aws.StringValue(input.Placement.HostId), "h-free"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := aws.StringValue(input.Placement.Tenancy), ec2.TenancyHost; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if allocated != 0 {
+		t.Errorf("unexpected host allocation")
+	}
+
+	api.DescribeHostsFunc = func(in *ec2.DescribeHostsInput) (*ec2.DescribeHostsOutput, error) {
+		return &ec2.DescribeHostsOutput{Hosts: []*ec2.Host{
+			testHost("h-full", "m4.xlarge", 0),
+			testHost("h-other", "c4.large", 4),
+		}}, nil
+	}
+	if _, err := i.launch(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := aws.StringValue(input.Placement.HostId), "h-new"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := allocated, 1; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := tagged["h-new"], "pool"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,303 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"text/template"
+
+	"github.com/grailbio/reflow/errors"
+)
+
+// ignitionVersion is the Ignition specification version of the
+// configs rendered by renderIgnition. It is supported by Flatcar.
+const ignitionVersion = "2.3.0"
+
+// The following types model the subset of the Ignition
+// specification that is used to boot instances.
+
+type ignitionConfig struct {
+	Ignition struct {
+		Version string `json:"version"`
+	} `json:"ignition"`
+	Storage struct {
+		Files []ignitionFile `json:"files,omitempty"`
+	} `json:"storage"`
+	Systemd struct {
+		Units []ignitionUnit `json:"units,omitempty"`
+	} `json:"systemd"`
+	Passwd struct {
+		Users []ignitionUser `json:"users,omitempty"`
+	} `json:"passwd"`
+}
+
+type ignitionFile struct {
+	Filesystem string `json:"filesystem"`
+	Path       string `json:"path"`
+	Mode       int    `json:"mode"`
+	Contents   struct {
+		Source string `json:"source"`
+	} `json:"contents"`
+}
+
+type ignitionUnit struct {
+	Name     string `json:"name"`
+	Enabled  *bool  `json:"enabled,omitempty"`
+	Mask     bool   `json:"mask,omitempty"`
+	Contents string `json:"contents,omitempty"`
+}
+
+type ignitionUser struct {
+	Name              string   `json:"name"`
+	SSHAuthorizedKeys []string `json:"sshAuthorizedKeys,omitempty"`
+}
+
+// ignitionUnitTmpl contains the templates for the systemd units in
+// Ignition configs. They are equivalent to the units in ec2UserData.
+var ignitionUnitTmpl = template.Must(template.New("units").Parse(`
+{{define "format"}}[Unit]
+Description=Format /dev/{{.DeviceName}}
+After=dev-{{.DeviceName}}.device
+Requires=dev-{{.DeviceName}}.device
+[Service]
+Type=oneshot
+RemainAfterExit=yes
+ExecStart=/usr/sbin/wipefs -f /dev/{{.DeviceName}}
+ExecStart={{.DataMkfs}} /dev/{{.DeviceName}}
+[Install]
+WantedBy=multi-user.target
+{{end}}
+{{define "mount"}}[Unit]
+{{if .SkipFormat}}After=dev-{{.DeviceName}}.device
+Requires=dev-{{.DeviceName}}.device
+{{else}}After=format-{{.DeviceName}}.service
+Requires=format-{{.DeviceName}}.service
+{{end}}[Mount]
+What=/dev/{{.DeviceName}}
+Where=/mnt/data
+Type={{.DataFilesystem}}
+{{if .DataMountOptions}}Options={{.DataMountOptions}}
+{{end}}[Install]
+WantedBy=multi-user.target
+{{end}}
+{{define "reflowlet"}}[Unit]
+Description=reflowlet
+Requires=network.target
+After=network.target
+{{range .NFSMounts}}Requires={{.Unit}}
+After={{.Unit}}
+{{end}}{{if .Reflowlet.OnFailure}}OnFailure={{.Reflowlet.OnFailure}}
+OnFailureJobMode=replace-irreversibly
+{{end}}
+[Service]
+Type=oneshot
+ExecStartPre=-/usr/bin/docker stop %n
+ExecStartPre=-/usr/bin/docker rm %n
+ExecStartPre=-/bin/bash -c 'sleep $[( $RANDOM % {{.Count}} ) ]'
+ExecStartPre=/bin/bash /etc/ecrlogin
+ExecStartPre=/bin/bash -c 'for n in $$(seq 1 {{.PullRetries}}); do timeout {{.PullTimeout}} /usr/bin/docker pull {{.ReflowletImage}} && exit 0; sleep $$((n * 10)); done; exit 1'
+ExecStart=/usr/bin/docker run --rm --name %n --net=host \
+{{if .LogGroup}}  --log-driver=awslogs --log-opt awslogs-region={{.Region}} --log-opt awslogs-group={{.LogGroup}} --log-opt awslogs-stream={{.LogStream}} \
+{{end}}{{if .ReflowletCPUs}}  --cpus={{.ReflowletCPUs}} \
+{{end}}{{if .ReflowletMemory}}  --memory={{.ReflowletMemory}} \
+{{end}}  -v /:/host \
+  -v /var/run/docker.sock:/var/run/docker.sock \
+  -v '/etc/ssl/certs/ca-certificates.crt:/etc/ssl/certs/ca-certificates.crt' \
+  {{.ReflowletImage}} -prefix /host -ec2cluster -ndigest 60 -config /host/etc/reflowconfig{{.Reflowlet.Flags}}
+
+[Install]
+WantedBy=multi-user.target
+{{end}}
+{{define "reflowlet-exit"}}[Unit]
+Description=Power off once all reflowlets have exited
+[Service]
+Type=oneshot
+ExecStart=/bin/bash -c 'for u in {{.ReflowletUnits}}; do case $$(systemctl is-active $$u) in active|activating|reloading) exit 0;; esac; done; /usr/bin/systemctl --no-block poweroff'
+{{end}}
+{{define "node-exporter"}}[Unit]
+Description=node-exporter
+Requires=network.target
+After=network.target
+After=mnt-data.mount
+{{if .Mortal}}PartOf={{range $k, $r := .Reflowlets}}{{if $k}} {{end}}{{$r.Unit}}{{end}}
+Conflicts=poweroff.target
+Before=poweroff.target
+{{end}}[Service]
+Restart=always
+TimeoutStartSec=infinity
+RestartSec=10s
+StartLimitInterval=0
+ExecStartPre=-/usr/bin/docker stop %n
+ExecStartPre=-/usr/bin/docker rm %n
+ExecStartPre=/usr/bin/docker pull {{.NodeExporterImage}}
+ExecStart=/usr/bin/docker run --rm --name %n -p 9100:9100 -v /proc:/host/proc -v /sys:/host/sys -v /:/rootfs --net=host {{.NodeExporterImage}} -collector.procfs /host/proc -collector.sysfs /host/proc -collector.filesystem.ignored-mount-points "^/(sys|proc|dev|host|etc)($|/)"
+[Install]
+WantedBy=multi-user.target
+{{end}}
+{{define "prepull"}}[Unit]
+Description=Pre-pull Docker images
+Requires=docker.service
+After=docker.service
+[Service]
+Type=oneshot
+RemainAfterExit=yes
+ExecStartPre=/bin/bash -c 'until /usr/bin/docker inspect reflowlet.service >/dev/null 2>&1; do sleep 5; done'
+{{range .PrePullImages}}ExecStart=-/usr/bin/timeout {{$.PullTimeout}} /usr/bin/docker pull {{.}}
+{{end}}[Install]
+WantedBy=multi-user.target
+{{end}}
+{{define "nfs"}}[Unit]
+Description=Mount {{.Source}} at {{.Path}}
+Requires=network-online.target
+After=network-online.target
+[Mount]
+What={{.Source}}
+Where={{.Path}}
+Type=nfs4
+Options={{.Options}}
+[Install]
+WantedBy=multi-user.target
+{{end}}
+{{define "max-lifetime-service"}}[Unit]
+Description=Power off after the instance's maximum lifetime
+[Service]
+Type=oneshot
+ExecStart=/usr/bin/systemctl --no-block poweroff
+{{end}}
+{{define "max-lifetime-timer"}}[Unit]
+Description=Power off after {{.MaxLifetime}}s
+[Timer]
+OnBootSec={{.MaxLifetime}}s
+{{if .Deadline}}OnCalendar={{.Deadline}}
+{{end}}AccuracySec=1s
+[Install]
+WantedBy=timers.target
+{{end}}
+`))
+
+// renderIgnition renders an Ignition config, equivalent to the
+// cloud-config rendered from ec2UserData, from the provided
+// arguments. Encrypted configurations and dedicated Docker volumes
+// are not yet supported.
+func renderIgnition(args userDataArgs) ([]byte, error) {
+	if args.EncryptedConfig != "" {
+		return nil, errors.E(errors.NotSupported, errors.New("ignition: encrypted configurations are not supported"))
+	}
+	if args.DockerDevice != "" {
+		return nil, errors.E(errors.NotSupported, errors.New("ignition: docker volumes are not supported"))
+	}
+	var config ignitionConfig
+	config.Ignition.Version = ignitionVersion
+	config.Storage.Files = []ignitionFile{
+		newIgnitionFile("/etc/ecrlogin", 0644, args.LoginCommand+"\n"),
+		newIgnitionFile("/etc/reflowconfig", 0644, args.ReflowConfig),
+		newIgnitionFile("/etc/flatcar/update.conf", 0644, "REBOOT_STRATEGY="+args.RebootStrategy+"\n"),
+	}
+	if args.SshCAKey != "" {
+		config.Storage.Files = append(config.Storage.Files,
+			newIgnitionFile(args.SshCAKeysPath, 0644, args.SshCAKey),
+			newIgnitionFile("/etc/ssh/sshd_config", 0600, args.SshdConfig),
+		)
+	}
+	if args.RebootStrategy == "off" {
+		config.Systemd.Units = append(config.Systemd.Units,
+			ignitionUnit{Name: "update-engine.service", Mask: true},
+			ignitionUnit{Name: "locksmithd.service", Mask: true},
+		)
+	}
+	for _, mount := range args.NFSMounts {
+		var b bytes.Buffer
+		if err := ignitionUnitTmpl.ExecuteTemplate(&b, "nfs", mount); err != nil {
+			return nil, err
+		}
+		enabled := true
+		config.Systemd.Units = append(config.Systemd.Units, ignitionUnit{
+			Name:     mount.Unit,
+			Enabled:  &enabled,
+			Contents: b.String(),
+		})
+	}
+	// Reflowlet units are rendered with the parameters of their
+	// reflowlet.
+	type reflowletUnitArgs struct {
+		userDataArgs
+		Reflowlet reflowletArgs
+	}
+	type unit struct {
+		name, tmpl string
+		args       interface{}
+	}
+	var units []unit
+	if !args.SkipFormat {
+		units = append(units, unit{"format-" + args.DeviceName + ".service", "format", args})
+	}
+	units = append(units, unit{"mnt-data.mount", "mount", args})
+	for _, r := range args.Reflowlets {
+		units = append(units, unit{r.Unit, "reflowlet", reflowletUnitArgs{args, r}})
+	}
+	units = append(units, unit{"node-exporter.service", "node-exporter", args})
+	for _, unit := range units {
+		var b bytes.Buffer
+		if err := ignitionUnitTmpl.ExecuteTemplate(&b, unit.tmpl, unit.args); err != nil {
+			return nil, err
+		}
+		enabled := true
+		config.Systemd.Units = append(config.Systemd.Units, ignitionUnit{
+			Name:     unit.name,
+			Enabled:  &enabled,
+			Contents: b.String(),
+		})
+	}
+	if len(args.PrePullImages) > 0 {
+		var b bytes.Buffer
+		if err := ignitionUnitTmpl.ExecuteTemplate(&b, "prepull", args); err != nil {
+			return nil, err
+		}
+		enabled := true
+		config.Systemd.Units = append(config.Systemd.Units, ignitionUnit{
+			Name:     "prepull.service",
+			Enabled:  &enabled,
+			Contents: b.String(),
+		})
+	}
+	if args.ReflowletUnits != "" {
+		var b bytes.Buffer
+		if err := ignitionUnitTmpl.ExecuteTemplate(&b, "reflowlet-exit", args); err != nil {
+			return nil, err
+		}
+		config.Systemd.Units = append(config.Systemd.Units, ignitionUnit{
+			Name:     reflowletExitUnit,
+			Contents: b.String(),
+		})
+	}
+	if args.MaxLifetime > 0 {
+		var service, timer bytes.Buffer
+		if err := ignitionUnitTmpl.ExecuteTemplate(&service, "max-lifetime-service", args); err != nil {
+			return nil, err
+		}
+		if err := ignitionUnitTmpl.ExecuteTemplate(&timer, "max-lifetime-timer", args); err != nil {
+			return nil, err
+		}
+		enabled := true
+		config.Systemd.Units = append(config.Systemd.Units,
+			ignitionUnit{Name: "max-lifetime.service", Contents: service.String()},
+			ignitionUnit{Name: "max-lifetime.timer", Enabled: &enabled, Contents: timer.String()},
+		)
+	}
+	if args.SshKey != "" {
+		config.Passwd.Users = []ignitionUser{{Name: "core", SSHAuthorizedKeys: []string{args.SshKey}}}
+	}
+	return json.Marshal(config)
+}
+
+// newIgnitionFile returns an Ignition file entry with the provided
+// path, mode, and contents. The contents are embedded in a data URL.
+func newIgnitionFile(path string, mode int, contents string) ignitionFile {
+	f := ignitionFile{Filesystem: "root", Path: path, Mode: mode}
+	f.Contents.Source = "data:;base64," + base64.StdEncoding.EncodeToString([]byte(contents))
+	return f
+}
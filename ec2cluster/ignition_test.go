@@ -0,0 +1,90 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/reflow/errors"
+)
+
+func TestIgnition(t *testing.T) {
+	i := newTestInstance()
+	i.BootConfig = bootConfigIgnition
+	b, err := i.renderUserData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config ignitionConfig
+	if err := json.Unmarshal(b, &config); err != nil {
+		t.Fatalf("invalid ignition config: %v\n%s", err, b)
+	}
+	if got, want := config.Ignition.Version, ignitionVersion; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	files := make(map[string]string)
+	for _, f := range config.Storage.Files {
+		const prefix = "data:;base64,"
+		if !strings.HasPrefix(f.Contents.Source, prefix) {
+			t.Fatalf("%s: invalid source %s", f.Path, f.Contents.Source)
+		}
+		contents, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(f.Contents.Source, prefix))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Path] = string(contents)
+	}
+	for _, path := range []string{"/etc/ecrlogin", "/etc/reflowconfig"} {
+		if _, ok := files[path]; !ok {
+			t.Errorf("missing file %s", path)
+		}
+	}
+	if got, want := files["/etc/flatcar/update.conf"], "REBOOT_STRATEGY=off\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	units := make(map[string]ignitionUnit)
+	for _, u := range config.Systemd.Units {
+		units[u.Name] = u
+	}
+	for _, name := range []string{"update-engine.service", "locksmithd.service"} {
+		if !units[name].Mask {
+			t.Errorf("expected unit %s to be masked", name)
+		}
+	}
+	for name, want := range map[string]string{
+		"format-xvdb.service":   "ExecStart=/usr/sbin/mkfs.ext4 -F /dev/xvdb",
+		"mnt-data.mount":        "Where=/mnt/data",
+		"reflowlet.service":     "reflowlet:test -prefix /host -ec2cluster",
+		"node-exporter.service": "prom/node-exporter",
+	} {
+		u, ok := units[name]
+		if !ok {
+			t.Errorf("missing unit %s", name)
+			continue
+		}
+		if u.Enabled == nil || !*u.Enabled {
+			t.Errorf("unit %s is not enabled", name)
+		}
+		if !strings.Contains(u.Contents, want) {
+			t.Errorf("unit %s: expected %q, got:\n%s", name, want, u.Contents)
+		}
+	}
+	if got, want := len(config.Passwd.Users), 1; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got, want := strings.Join(config.Passwd.Users[0].SSHAuthorizedKeys, ","), "ssh-rsa test"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	i.DockerEBSSize = 100
+	if _, err := i.renderUserData(); !errors.Match(errors.NotSupported, err) {
+		t.Errorf("expected not supported error, got %v", err)
+	}
+}
@@ -0,0 +1,289 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/docker/engine-api/types"
+	"github.com/grailbio/reflow/errors"
+	"github.com/grailbio/reflow/internal/ecrauth"
+	"github.com/grailbio/reflow/log"
+)
+
+// dockerHubRegistry is the registry of images that do not name one.
+const dockerHubRegistry = "registry-1.docker.io"
+
+// manifestMediaTypes are the image manifest media types accepted
+// when checking for the existence of an image.
+var manifestMediaTypes = []string{
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.oci.image.index.v1+json",
+}
+
+// CheckImage checks that the Docker image (by tag or digest) exists
+// in its registry and is accessible, so that it may be pulled by
+// instances. Images that are authenticated by the provided
+// authenticator (e.g., those in ECR) are checked with its
+// credentials; others are checked anonymously. CheckImage returns an
+// errors.NotExist error if the image does not exist, and an
+// errors.NotAllowed error if it is inaccessible.
+func CheckImage(ctx context.Context, client *http.Client, auth ecrauth.Interface, image string) error {
+	registry, repo, ref := parseImage(image)
+	cfg, err := registryAuth(ctx, auth, image)
+	if err != nil {
+		return errors.E("check image", image, err)
+	}
+	u := fmt.Sprintf("https://%s/v2/%s/manifests/%s", registry, repo, ref)
+	resp, err := registryDo(ctx, client, "HEAD", u, repo, manifestMediaTypes, &cfg)
+	if err != nil {
+		return errors.E("check image", image, err)
+	}
+	resp.Body.Close()
+	return registryStatus("check image", image, resp)
+}
+
+// imageManifestMediaTypes are the media types of the (single
+// platform) image manifests from which image labels are read.
+var imageManifestMediaTypes = []string{
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+}
+
+// ImageLabels returns the labels of the Docker image (by tag or
+// digest), as read from the image's configuration in its registry.
+// Registry credentials are obtained as in CheckImage.
+func ImageLabels(ctx context.Context, client *http.Client, auth ecrauth.Interface, image string) (map[string]string, error) {
+	registry, repo, ref := parseImage(image)
+	cfg, err := registryAuth(ctx, auth, image)
+	if err != nil {
+		return nil, errors.E("image labels", image, err)
+	}
+	u := fmt.Sprintf("https://%s/v2/%s/manifests/%s", registry, repo, ref)
+	var manifest struct {
+		Config struct {
+			Digest string `json:"digest"`
+		} `json:"config"`
+	}
+	if err := registryGetJSON(ctx, client, u, repo, image, imageManifestMediaTypes, &cfg, &manifest); err != nil {
+		return nil, err
+	}
+	if manifest.Config.Digest == "" {
+		return nil, errors.E("image labels", image, errors.NotSupported, errors.New("manifest does not name an image configuration"))
+	}
+	u = fmt.Sprintf("https://%s/v2/%s/blobs/%s", registry, repo, manifest.Config.Digest)
+	var config struct {
+		Config struct {
+			Labels map[string]string
+		} `json:"config"`
+	}
+	if err := registryGetJSON(ctx, client, u, repo, image, nil, &cfg, &config); err != nil {
+		return nil, err
+	}
+	return config.Config.Labels, nil
+}
+
+// registryGetJSON retrieves the registry resource at URL u and
+// decodes it as JSON into v.
+func registryGetJSON(ctx context.Context, client *http.Client, u, repo, image string, accept []string, cfg *types.AuthConfig, v interface{}) error {
+	resp, err := registryDo(ctx, client, "GET", u, repo, accept, cfg)
+	if err != nil {
+		return errors.E("image labels", image, err)
+	}
+	defer resp.Body.Close()
+	if err := registryStatus("image labels", image, resp); err != nil {
+		return err
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return errors.E("image labels", image, err)
+	}
+	return nil
+}
+
+// configSchemaLabel is the label of reflowlet images that names the
+// version of the configuration schema that the reflowlet accepts.
+const configSchemaLabel = "com.grail.reflow.config-schema"
+
+// configSchemaVersion is the version of the configuration schema of
+// the configuration that the cluster provides to its reflowlets.
+const configSchemaVersion = "1"
+
+// CheckConfigCompatibility checks that the reflowlet image accepts
+// the configuration schema of this cluster, as declared by the
+// image's configSchemaLabel. Images that do not declare a schema
+// are accepted with a warning, logged to the provided logger.
+// CheckConfigCompatibility returns an errors.NotSupported error if
+// the image declares a different schema.
+func CheckConfigCompatibility(ctx context.Context, client *http.Client, auth ecrauth.Interface, image string, log *log.Logger) error {
+	labels, err := ImageLabels(ctx, client, auth, image)
+	if err != nil {
+		return err
+	}
+	version, ok := labels[configSchemaLabel]
+	switch {
+	case !ok:
+		log.Printf("reflowlet image %s does not declare its configuration schema (label %s); assuming version %s",
+			image, configSchemaLabel, configSchemaVersion)
+		return nil
+	case version != configSchemaVersion:
+		return errors.E("check config compatibility", image, errors.NotSupported,
+			errors.Errorf("reflowlet image accepts configuration schema %s, but the cluster provides schema %s", version, configSchemaVersion))
+	}
+	return nil
+}
+
+// registryAuth returns the registry credentials for the provided
+// image: those of the authenticator, if it authenticates the image,
+// or else empty credentials.
+func registryAuth(ctx context.Context, auth ecrauth.Interface, image string) (types.AuthConfig, error) {
+	var cfg types.AuthConfig
+	if auth == nil {
+		return cfg, nil
+	}
+	ok, err := auth.Authenticates(ctx, image)
+	if err != nil || !ok {
+		return cfg, err
+	}
+	err = auth.Authenticate(ctx, &cfg)
+	return cfg, err
+}
+
+// registryStatus interprets the status of the registry response
+// for the provided image.
+func registryStatus(op, image string, resp *http.Response) error {
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return errors.E(op, image, errors.NotExist, errors.New("image does not exist"))
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return errors.E(op, image, errors.NotAllowed, errors.Errorf("image is inaccessible: %s", resp.Status))
+	default:
+		return errors.E(op, image, errors.Errorf("registry: %s", resp.Status))
+	}
+}
+
+// registryDo issues a request for the registry resource at URL u in
+// the provided repository, authenticated by the credentials in cfg.
+// If the registry requires a bearer token, the request is retried
+// with one. The caller must close the response's body.
+func registryDo(ctx context.Context, client *http.Client, method, u, repo string, accept []string, cfg *types.AuthConfig) (*http.Response, error) {
+	resp, err := registryRequest(ctx, client, method, u, accept, cfg, "")
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	// The registry may require a bearer token, which is issued by
+	// the service named in its challenge.
+	token, err := registryToken(ctx, client, resp.Header.Get("Www-Authenticate"), repo, cfg)
+	if err != nil || token == "" {
+		return resp, err
+	}
+	resp.Body.Close()
+	return registryRequest(ctx, client, method, u, accept, cfg, token)
+}
+
+// registryRequest issues a request for the registry resource at URL
+// u, authenticated by the provided bearer token, or else by the
+// credentials in cfg, if any.
+func registryRequest(ctx context.Context, client *http.Client, method, u string, accept []string, cfg *types.AuthConfig, token string) (*http.Response, error) {
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if len(accept) > 0 {
+		req.Header.Set("Accept", strings.Join(accept, ", "))
+	}
+	switch {
+	case token != "":
+		req.Header.Set("Authorization", "Bearer "+token)
+	case cfg.Username != "":
+		req.SetBasicAuth(cfg.Username, cfg.Password)
+	}
+	return client.Do(req)
+}
+
+// registryToken obtains a pull token for the repository from the
+// token service named in the provided bearer challenge. It returns
+// an empty token if the challenge is not a bearer challenge.
+func registryToken(ctx context.Context, client *http.Client, challenge, repo string, cfg *types.AuthConfig) (string, error) {
+	const prefix = "Bearer "
+	if !strings.HasPrefix(challenge, prefix) {
+		return "", nil
+	}
+	params := make(map[string]string)
+	for _, param := range strings.Split(challenge[len(prefix):], ",") {
+		parts := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(parts) == 2 {
+			params[parts[0]] = strings.Trim(parts[1], `"`)
+		}
+	}
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Scheme == "" {
+		return "", errors.Errorf("invalid bearer challenge %q", challenge)
+	}
+	q := realm.Query()
+	if service := params["service"]; service != "" {
+		q.Set("service", service)
+	}
+	q.Set("scope", "repository:"+repo+":pull")
+	realm.RawQuery = q.Encode()
+	req, err := http.NewRequest("GET", realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	if cfg.Username != "" {
+		req.SetBasicAuth(cfg.Username, cfg.Password)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.E(errors.NotAllowed, errors.Errorf("token service %s: %s", realm.Host, resp.Status))
+	}
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", errors.E("token service", realm.Host, err)
+	}
+	if body.Token == "" {
+		return body.AccessToken, nil
+	}
+	return body.Token, nil
+}
+
+// parseImage parses the provided Docker image reference into its
+// registry, repository, and reference (tag or digest) components.
+// Images without a registry are in Docker Hub; those without a
+// reference are tagged "latest".
+func parseImage(image string) (registry, repo, ref string) {
+	if i := strings.Index(image, "@"); i >= 0 {
+		image, ref = image[:i], image[i+1:]
+	} else if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image, ref = image[:i], image[i+1:]
+	} else {
+		ref = "latest"
+	}
+	parts := strings.SplitN(image, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		return parts[0], parts[1], ref
+	}
+	if len(parts) == 1 {
+		image = "library/" + image
+	}
+	return dockerHubRegistry, image, ref
+}
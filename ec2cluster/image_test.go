@@ -0,0 +1,173 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/reflow/errors"
+	"github.com/grailbio/reflow/log"
+)
+
+func TestParseImage(t *testing.T) {
+	for _, c := range []struct {
+		image, registry, repo, ref string
+	}{
+		{"ubuntu", dockerHubRegistry, "library/ubuntu", "latest"},
+		{"ubuntu:16.04", dockerHubRegistry, "library/ubuntu", "16.04"},
+		{"grailbio/reflowlet:1.0", dockerHubRegistry, "grailbio/reflowlet", "1.0"},
+		{"123.dkr.ecr.us-west-2.amazonaws.com/reflowlet:1.0", "123.dkr.ecr.us-west-2.amazonaws.com", "reflowlet", "1.0"},
+		{"localhost:5000/a/b@sha256:abcd", "localhost:5000", "a/b", "sha256:abcd"},
+		{"localhost/reflowlet", "localhost", "reflowlet", "latest"},
+	} {
+		registry, repo, ref := parseImage(c.image)
+		if registry != c.registry || repo != c.repo || ref != c.ref {
+			t.Errorf("%s: got %s, %s, %s, want %s, %s, %s", c.image, registry, repo, ref, c.registry, c.repo, c.ref)
+		}
+	}
+}
+
+func TestCheckImage(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "user" || pass != "password" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Method != "HEAD" {
+			t.Errorf("unexpected method %s", r.Method)
+		}
+		switch r.URL.Path {
+		case "/v2/reflowlet/manifests/1.0", "/v2/reflowlet/manifests/sha256:abcd":
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	registry := strings.TrimPrefix(srv.URL, "https://")
+	ctx := context.Background()
+	for _, c := range []struct {
+		image string
+		kind  errors.Kind
+	}{
+		{registry + "/reflowlet:1.0", errors.Other},
+		{registry + "/reflowlet@sha256:abcd", errors.Other},
+		{registry + "/reflowlet:1.1", errors.NotExist},
+		{registry + "/reflowlet", errors.NotExist},
+	} {
+		err := CheckImage(ctx, srv.Client(), testAuthenticator{}, c.image)
+		if c.kind == errors.Other {
+			if err != nil {
+				t.Errorf("%s: %v", c.image, err)
+			}
+			continue
+		}
+		if !errors.Match(c.kind, err) {
+			t.Errorf("%s: got %v, want %v", c.image, err, c.kind)
+		}
+	}
+	// Images are inaccessible without credentials.
+	if err := CheckImage(ctx, srv.Client(), nil, registry+"/reflowlet:1.0"); !errors.Match(errors.NotAllowed, err) {
+		t.Errorf("got %v, want %v", err, errors.NotAllowed)
+	}
+}
+
+func TestCheckImageBearer(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			if got, want := r.URL.Query().Get("scope"), "repository:grailbio/reflowlet:pull"; got != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			w.Write([]byte(`{"token": "secret"}`))
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.Header().Set("Www-Authenticate", `Bearer realm="`+srv.URL+`/token",service="registry.test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/v2/grailbio/reflowlet/manifests/1.0" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	registry := strings.TrimPrefix(srv.URL, "https://")
+	ctx := context.Background()
+	if err := CheckImage(ctx, srv.Client(), nil, registry+"/grailbio/reflowlet:1.0"); err != nil {
+		t.Error(err)
+	}
+	if err := CheckImage(ctx, srv.Client(), nil, registry+"/grailbio/reflowlet:typo"); !errors.Match(errors.NotExist, err) {
+		t.Errorf("got %v, want %v", err, errors.NotExist)
+	}
+}
+
+func TestCheckConfigCompatibility(t *testing.T) {
+	labels := map[string]string{
+		"/v2/reflowlet/blobs/sha256:compatible":   `{"config": {"Labels": {"com.grail.reflow.config-schema": "1"}}}`,
+		"/v2/reflowlet/blobs/sha256:incompatible": `{"config": {"Labels": {"com.grail.reflow.config-schema": "2"}}}`,
+		"/v2/reflowlet/blobs/sha256:unlabeled":    `{"config": {}}`,
+	}
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "user" || pass != "password" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/v2/reflowlet/manifests/") {
+			if !strings.Contains(r.Header.Get("Accept"), "application/vnd.docker.distribution.manifest.v2+json") {
+				t.Errorf("unexpected accept header %q", r.Header.Get("Accept"))
+			}
+			tag := strings.TrimPrefix(r.URL.Path, "/v2/reflowlet/manifests/")
+			if _, ok := labels["/v2/reflowlet/blobs/sha256:"+tag]; !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write([]byte(`{"schemaVersion": 2, "config": {"digest": "sha256:` + tag + `"}}`))
+			return
+		}
+		config, ok := labels[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(config))
+	}))
+	defer srv.Close()
+	registry := strings.TrimPrefix(srv.URL, "https://")
+	ctx := context.Background()
+
+	got, err := ImageLabels(ctx, srv.Client(), testAuthenticator{}, registry+"/reflowlet:incompatible")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := got[configSchemaLabel], "2"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	for _, c := range []struct {
+		tag  string
+		kind errors.Kind
+	}{
+		{"compatible", errors.Other},
+		{"unlabeled", errors.Other},
+		{"incompatible", errors.NotSupported},
+		{"missing", errors.NotExist},
+	} {
+		err := CheckConfigCompatibility(ctx, srv.Client(), testAuthenticator{}, registry+"/reflowlet:"+c.tag, log.Std)
+		if c.kind == errors.Other {
+			if err != nil {
+				t.Errorf("%s: %v", c.tag, err)
+			}
+			continue
+		}
+		if !errors.Match(c.kind, err) {
+			t.Errorf("%s: got %v, want %v", c.tag, err, c.kind)
+		}
+	}
+}
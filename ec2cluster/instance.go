@@ -8,14 +8,18 @@ package ec2cluster
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"text/template"
 	"time"
 
@@ -23,6 +27,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 	"github.com/grailbio/base/data"
 	"github.com/grailbio/reflow"
 	"github.com/grailbio/reflow/config"
@@ -39,7 +44,43 @@ import (
 // by the reflowlet.
 const memoryDiscount = 0.05
 
-var ec2UserDataTmpl = template.Must(template.New("ec2userdata").Parse(ec2UserData))
+// defaultCapacityProbeCount is the default number of instances for
+// which spot capacity is probed before launching; 20 instances should
+// be a good margin for spot.
+const defaultCapacityProbeCount = 20
+
+// The default number of attempts and per-attempt timeout for
+// pulling the reflowlet image at boot.
+const (
+	defaultPullRetries = 5
+	defaultPullTimeout = 10 * time.Minute
+)
+
+// defaultDataFilesystem is the default filesystem of the data volume.
+const defaultDataFilesystem = "ext4"
+
+// dataFilesystems are the supported data volume filesystems, with
+// the commands used to create them and their default mount options.
+var dataFilesystems = map[string]struct{ mkfs, options string }{
+	"ext4": {"/usr/sbin/mkfs.ext4 -F", "data=writeback"},
+	"xfs":  {"/usr/sbin/mkfs.xfs -f", ""},
+}
+
+// bootFailureQuarantine is the amount of time for which instance
+// types whose instances failed to boot are not selected.
+const bootFailureQuarantine = 6 * time.Hour
+
+// bootFailureThreshold is the number of consecutive boot failures
+// of an instance type after which it is quarantined.
+const bootFailureThreshold = 3
+
+// defaultNodeExporterImage is the default Docker image of the
+// node-exporter sidecar.
+const defaultNodeExporterImage = "prom/node-exporter:0.12.0"
+
+var ec2UserDataTmpl = template.Must(template.New("ec2userdata").
+	Funcs(template.FuncMap{"yaml": yamlQuote}).
+	Parse(ec2UserData))
 
 const ec2UserData = `#cloud-config
 write_files:
@@ -49,23 +90,47 @@ write_files:
     content: |
       {{.LoginCommand}}
 
-  - path: "/etc/reflowconfig"
+{{if .EncryptedConfig}}
+  - path: "/etc/reflowconfig.enc"
+    permissions: "0600"
+    owner: "root"
+    content: |
+      {{.EncryptedConfig}}
+{{else if .CompressedConfig}}
+  - path: "/etc/reflowconfig.gz.b64"
     permissions: "0644"
     owner: "root"
     content: |
-      {{.ReflowConfig}}
+      {{.CompressedConfig}}
+{{else}}
+  - path: "/etc/reflowconfig"
+    permissions: "0644"
+    owner: "root"
+    content: {{yaml .ReflowConfig}}
+{{end}}{{if .SshCAKey}}
+  - path: "{{.SshCAKeysPath}}"
+    permissions: "0644"
+    owner: "root"
+    content: {{yaml .SshCAKey}}
+
+  - path: "/etc/ssh/sshd_config"
+    permissions: "0600"
+    owner: "root"
+    content: {{yaml .SshdConfig}}
+{{end}}
 
 coreos:
   update:
-    reboot-strategy: "off"
+    reboot-strategy: "{{.RebootStrategy}}"
 
   units:
+{{if eq .RebootStrategy "off"}}
   - name: update-engine.service
     command: stop
 
   - name: locksmithd.service
     command: stop
-
+{{end}}{{if not .SkipFormat}}
   - name: format-{{.DeviceName}}.service
     command: start
     content: |
@@ -77,18 +142,94 @@ coreos:
       Type=oneshot
       RemainAfterExit=yes
       ExecStart=/usr/sbin/wipefs -f /dev/{{.DeviceName}}
-      ExecStart=/usr/sbin/mkfs.ext4 -F /dev/{{.DeviceName}}
-
+      ExecStart={{.DataMkfs}} /dev/{{.DeviceName}}
+{{end}}
   - name: mnt-data.mount
     command: start
     content: |
-      [Mount]
+{{if .SkipFormat}}      [Unit]
+      After=dev-{{.DeviceName}}.device
+      Requires=dev-{{.DeviceName}}.device
+{{end}}      [Mount]
       What=/dev/{{.DeviceName}}
       Where=/mnt/data
+      Type={{.DataFilesystem}}
+{{if .DataMountOptions}}      Options={{.DataMountOptions}}
+{{end}}{{if .DockerDevice}}
+  - name: format-{{.DockerDevice}}.service
+    command: start
+    content: |
+      [Unit]
+      Description=Format /dev/{{.DockerDevice}}
+      After=dev-{{.DockerDevice}}.device
+      Requires=dev-{{.DockerDevice}}.device
+      [Service]
+      Type=oneshot
+      RemainAfterExit=yes
+      ExecStart=/usr/sbin/wipefs -f /dev/{{.DockerDevice}}
+      ExecStart=/usr/sbin/mkfs.ext4 -F /dev/{{.DockerDevice}}
+
+  - name: var-lib-docker.mount
+    command: start
+    content: |
+      [Unit]
+      Before=docker.service
+      After=format-{{.DockerDevice}}.service
+      Requires=format-{{.DockerDevice}}.service
+      [Mount]
+      What=/dev/{{.DockerDevice}}
+      Where=/var/lib/docker
       Type=ext4
-      Options=data=writeback
 
-  - name: reflowlet.service
+  - name: docker.service
+    drop-ins:
+      - name: 10-docker-data.conf
+        content: |
+          [Unit]
+          After=var-lib-docker.mount
+          Requires=var-lib-docker.mount
+{{end}}
+{{if .EncryptedConfig}}
+  - name: reflowconfig.service
+    command: start
+    content: |
+      [Unit]
+      Description=Decrypt the Reflow configuration
+      Requires=docker.service
+      After=docker.service network-online.target
+      [Service]
+      Type=oneshot
+      RemainAfterExit=yes
+      ExecStart=/bin/bash -c 'set -o pipefail; umask 077; base64 -d /etc/reflowconfig.enc > /etc/reflowconfig.bin && /usr/bin/docker run --rm --net=host -v /etc/reflowconfig.bin:/reflowconfig.bin:ro {{.KMSDecryptImage}} kms decrypt --region {{.Region}} --ciphertext-blob fileb:///reflowconfig.bin --output text --query Plaintext | base64 -d > /etc/reflowconfig'
+      ExecStartPost=/usr/bin/rm -f /etc/reflowconfig.bin
+{{else if .CompressedConfig}}
+  - name: reflowconfig.service
+    command: start
+    content: |
+      [Unit]
+      Description=Decompress the Reflow configuration
+      [Service]
+      Type=oneshot
+      RemainAfterExit=yes
+      ExecStart=/bin/bash -c 'set -o pipefail; base64 -d /etc/reflowconfig.gz.b64 | gunzip > /etc/reflowconfig'
+{{end}}{{range .NFSMounts}}
+  - name: {{.Unit}}
+    command: start
+    content: |
+      [Unit]
+      Description=Mount {{.Source}} at {{.Path}}
+      Requires=network-online.target
+      After=network-online.target
+      [Mount]
+      What={{.Source}}
+      Where={{.Path}}
+      Type=nfs4
+      Options={{.Options}}
+      [Install]
+      WantedBy=multi-user.target
+{{end}}
+{{range .Reflowlets}}
+  - name: {{.Unit}}
     enable: true
     command: start
     content: |
@@ -96,8 +237,14 @@ coreos:
       Description=reflowlet
       Requires=network.target
       After=network.target
-{{if .Mortal}}
-      OnFailure=poweroff.target
+{{if or $.EncryptedConfig $.CompressedConfig}}
+      Requires=reflowconfig.service
+      After=reflowconfig.service
+{{end}}{{range $.NFSMounts}}
+      Requires={{.Unit}}
+      After={{.Unit}}
+{{end}}{{if .OnFailure}}
+      OnFailure={{.OnFailure}}
       OnFailureJobMode=replace-irreversibly
 {{end}}
       
@@ -105,18 +252,29 @@ coreos:
       Type=oneshot
       ExecStartPre=-/usr/bin/docker stop %n
       ExecStartPre=-/usr/bin/docker rm %n
-      ExecStartPre=-/bin/bash -c 'sleep $[( $RANDOM % {{.Count}} ) ]'
+      ExecStartPre=-/bin/bash -c 'sleep $[( $RANDOM % {{$.Count}} ) ]'
       ExecStartPre=/bin/bash /etc/ecrlogin
-      ExecStartPre=/usr/bin/docker pull {{.ReflowletImage}}
+      ExecStartPre=/bin/bash -c 'for n in $$(seq 1 {{$.PullRetries}}); do timeout {{$.PullTimeout}} /usr/bin/docker pull {{$.ReflowletImage}} && exit 0; sleep $$((n * 10)); done; exit 1'
       ExecStart=/usr/bin/docker run --rm --name %n --net=host \
-        -v /:/host \
+{{if $.LogGroup}}        --log-driver=awslogs --log-opt awslogs-region={{$.Region}} --log-opt awslogs-group={{$.LogGroup}} --log-opt awslogs-stream={{$.LogStream}} \
+{{end}}{{if $.ReflowletCPUs}}        --cpus={{$.ReflowletCPUs}} \
+{{end}}{{if $.ReflowletMemory}}        --memory={{$.ReflowletMemory}} \
+{{end}}        -v /:/host \
         -v /var/run/docker.sock:/var/run/docker.sock \
         -v '/etc/ssl/certs/ca-certificates.crt:/etc/ssl/certs/ca-certificates.crt' \
-        {{.ReflowletImage}} -prefix /host -ec2cluster -ndigest 60 -config /host/etc/reflowconfig
+        {{$.ReflowletImage}} -prefix /host -ec2cluster -ndigest 60 -config /host/etc/reflowconfig{{.Flags}}
       
       [Install]
       WantedBy=multi-user.target
-
+{{end}}{{if .ReflowletUnits}}
+  - name: reflowlet-exit.service
+    content: |
+      [Unit]
+      Description=Power off once all reflowlets have exited
+      [Service]
+      Type=oneshot
+      ExecStart=/bin/bash -c 'for u in {{.ReflowletUnits}}; do case $$(systemctl is-active $$u) in active|activating|reloading) exit 0;; esac; done; /usr/bin/systemctl --no-block poweroff'
+{{end}}
   - name: "node-exporter.service"
     enable: true
     command: "start"
@@ -126,21 +284,55 @@ coreos:
       Requires=network.target
       After=network.target
       After=mnt-data.mount
-      [Service]
+{{if .Mortal}}      PartOf={{range $k, $r := .Reflowlets}}{{if $k}} {{end}}{{$r.Unit}}{{end}}
+      Conflicts=poweroff.target
+      Before=poweroff.target
+{{end}}      [Service]
       Restart=always
       TimeoutStartSec=infinity
       RestartSec=10s
       StartLimitInterval=0
       ExecStartPre=-/usr/bin/docker stop %n
       ExecStartPre=-/usr/bin/docker rm %n
-      ExecStartPre=/usr/bin/docker pull prom/node-exporter:0.12.0
-      ExecStart=/usr/bin/docker run --rm --name %n -p 9100:9100 -v /proc:/host/proc -v /sys:/host/sys -v /:/rootfs --net=host prom/node-exporter:0.12.0 -collector.procfs /host/proc -collector.sysfs /host/proc -collector.filesystem.ignored-mount-points "^/(sys|proc|dev|host|etc)($|/)"
+      ExecStartPre=/usr/bin/docker pull {{.NodeExporterImage}}
+      ExecStart=/usr/bin/docker run --rm --name %n -p 9100:9100 -v /proc:/host/proc -v /sys:/host/sys -v /:/rootfs --net=host {{.NodeExporterImage}} -collector.procfs /host/proc -collector.sysfs /host/proc -collector.filesystem.ignored-mount-points "^/(sys|proc|dev|host|etc)($|/)"
       [Install]
       WantedBy=multi-user.target
+{{if .PrePullImages}}
+  - name: prepull.service
+    command: start
+    content: |
+      [Unit]
+      Description=Pre-pull Docker images
+      Requires=docker.service
+      After=docker.service
+      [Service]
+      Type=oneshot
+      RemainAfterExit=yes
+      ExecStartPre=/bin/bash -c 'until /usr/bin/docker inspect reflowlet.service >/dev/null 2>&1; do sleep 5; done'
+{{range .PrePullImages}}      ExecStart=-/usr/bin/timeout {{$.PullTimeout}} /usr/bin/docker pull {{.}}
+{{end}}{{end}}{{if .MaxLifetime}}
+  - name: max-lifetime.service
+    content: |
+      [Unit]
+      Description=Power off after the instance's maximum lifetime
+      [Service]
+      Type=oneshot
+      ExecStart=/usr/bin/systemctl --no-block poweroff
 
+  - name: max-lifetime.timer
+    command: start
+    content: |
+      [Unit]
+      Description=Power off after {{.MaxLifetime}}s
+      [Timer]
+      OnBootSec={{.MaxLifetime}}s
+{{if .Deadline}}      OnCalendar={{.Deadline}}
+{{end}}      AccuracySec=1s
+{{end}}{{if .SshKey}}
 ssh-authorized-keys:
   - {{.SshKey}}
-`
+{{end}}`
 
 // instanceConfig represents a instance configuration.
 type instanceConfig struct {
@@ -149,15 +341,68 @@ type instanceConfig struct {
 
 	// EBSOptimized is true if we should request an EBS optimized instance.
 	EBSOptimized bool
+	// EBSOptimizedByDefault is true if the instance type is EBS
+	// optimized by default; such instance types may not accept
+	// an explicit EBS optimization flag.
+	EBSOptimizedByDefault bool
 	// Resources holds the Reflow resources that are presented by this configuration.
 	// It does not include disk sizes; they are dynamic.
 	Resources reflow.Resources
+	// TotalMemory is the total amount of memory of this instance type,
+	// in bytes. Resources.Memory is discounted from it.
+	TotalMemory uint64
 	// Price is the on-demand price for this instance type in fractional dollars, in available regions.
 	Price map[string]float64
 	// SpotOk tells whether spot is supported for this instance type.
 	SpotOk bool
 	// NVMe specifies whether EBS is exposed as NVMe devices.
 	NVMe bool
+	// GPU specifies whether the instance type has GPUs.
+	GPU bool
+	// NetworkBandwidth is the (approximate) network bandwidth of the
+	// instance type, in Gbps.
+	NetworkBandwidth float64
+	// EBSThroughput is the baseline EBS throughput of the instance
+	// type, in MB/s.
+	EBSThroughput float64
+}
+
+// networkBandwidth returns the approximate network bandwidth, in
+// Gbps, of the EC2 network performance description perf. Burstable
+// ("Up to") bandwidths are taken at their peak. Unknown descriptions
+// are assigned zero bandwidth.
+func networkBandwidth(perf string) float64 {
+	switch perf {
+	case "Very Low":
+		return 0.05
+	case "Low":
+		return 0.3
+	case "Low to Moderate":
+		return 0.5
+	case "Moderate":
+		return 0.8
+	case "High":
+		return 2
+	}
+	perf = strings.TrimPrefix(perf, "Up to ")
+	if !strings.HasSuffix(perf, " Gigabit") {
+		return 0
+	}
+	gbps, err := strconv.ParseFloat(strings.TrimSuffix(perf, " Gigabit"), 64)
+	if err != nil {
+		return 0
+	}
+	return gbps
+}
+
+// gpuFamilies is the set of instance families that have GPUs.
+var gpuFamilies = map[string]bool{
+	"cg1": true,
+	"g2":  true,
+	"g3":  true,
+	"g4":  true,
+	"p2":  true,
+	"p3":  true,
 }
 
 var (
@@ -168,9 +413,11 @@ var (
 func init() {
 	for _, typ := range instances.Types {
 		instanceTypes[typ.Name] = instanceConfig{
-			Type:         typ.Name,
-			EBSOptimized: typ.EBSOptimized,
-			Price:        typ.Price,
+			Type:                  typ.Name,
+			EBSOptimized:          typ.EBSOptimized,
+			EBSOptimizedByDefault: typ.EBSOptimizedByDefault,
+			Price:                 typ.Price,
+			TotalMemory:           uint64(typ.Memory * 1024 * 1024 * 1024),
 			Resources: reflow.Resources{
 				CPU:    uint16(typ.VCPU),
 				Memory: uint64((1 - memoryDiscount) * typ.Memory * 1024 * 1024 * 1024),
@@ -179,8 +426,99 @@ func init() {
 			// instances not supported by spot.
 			SpotOk: typ.Generation == "current" && !strings.HasPrefix(typ.Name, "t2."),
 			NVMe:   typ.NVMe,
+			GPU:    gpuFamilies[strings.SplitN(typ.Name, ".", 2)[0]],
+
+			NetworkBandwidth: networkBandwidth(typ.NetworkPerformance),
+			EBSThroughput:    typ.EBSThroughput,
+		}
+	}
+}
+
+// WithMemoryDiscount returns a copy of this configuration whose
+// advertised memory is discounted (i.e., reserved for the reflowlet
+// and system) by the given fraction, instead of memoryDiscount.
+func (c instanceConfig) WithMemoryDiscount(discount float64) instanceConfig {
+	total := float64(c.TotalMemory)
+	if total == 0 {
+		total = float64(c.Resources.Memory) / (1 - memoryDiscount)
+	}
+	c.Resources.Memory = uint64((1 - discount) * total)
+	return c
+}
+
+// Fits tells whether need fits in the resources advertised by this
+// configuration. Note that advertised memory is discounted from the
+// instance type's total memory (see memoryDiscount), so a need may
+// not fit even if it is within the instance type's nominal memory.
+func (c instanceConfig) Fits(need reflow.Resources) bool {
+	return need.LessEqualAll(c.Resources)
+}
+
+// Misfit explains why need does not fit in the resources advertised
+// by this configuration, naming each dimension that is exceeded.
+// Misfit returns an empty string if need fits.
+func (c instanceConfig) Misfit(need reflow.Resources) string {
+	var reasons []string
+	if need.Memory > c.Resources.Memory {
+		reason := fmt.Sprintf("memory: need %s, have %s", data.Size(need.Memory), data.Size(c.Resources.Memory))
+		if c.TotalMemory > c.Resources.Memory {
+			reason += fmt.Sprintf(" (%s total, less %s reserved)",
+				data.Size(c.TotalMemory), data.Size(c.TotalMemory-c.Resources.Memory))
 		}
+		reasons = append(reasons, reason)
 	}
+	if need.CPU > c.Resources.CPU {
+		reasons = append(reasons, fmt.Sprintf("cpu: need %d, have %d", need.CPU, c.Resources.CPU))
+	}
+	if need.Disk > c.Resources.Disk {
+		reasons = append(reasons, fmt.Sprintf("disk: need %s, have %s", data.Size(need.Disk), data.Size(c.Resources.Disk)))
+	}
+	return strings.Join(reasons, "; ")
+}
+
+// PriceInAZ returns the price of this instance configuration in the
+// given availability zone of the given region. On-demand prices are
+// uniform across availability zones, and the regional price is
+// returned; spot prices are the latest spot price reported by EC2
+// for the zone.
+func (c instanceConfig) PriceInAZ(ctx context.Context, api ec2iface.EC2API, region, az string, spot bool) (float64, error) {
+	if !spot {
+		price, ok := c.Price[region]
+		if !ok {
+			return 0, errors.Errorf("no price for instance type %s in region %s", c.Type, region)
+		}
+		return price, nil
+	}
+	resp, err := api.DescribeSpotPriceHistoryWithContext(ctx, &ec2.DescribeSpotPriceHistoryInput{
+		AvailabilityZone:    aws.String(az),
+		InstanceTypes:       []*string{aws.String(c.Type)},
+		ProductDescriptions: []*string{aws.String("Linux/UNIX")},
+		StartTime:           aws.Time(time.Now()),
+	})
+	if err != nil {
+		return 0, err
+	}
+	var (
+		latest time.Time
+		price  string
+	)
+	for _, p := range resp.SpotPriceHistory {
+		if aws.StringValue(p.AvailabilityZone) != az || aws.StringValue(p.InstanceType) != c.Type {
+			continue
+		}
+		if ts := aws.TimeValue(p.Timestamp); price == "" || ts.After(latest) {
+			latest = ts
+			price = aws.StringValue(p.SpotPrice)
+		}
+	}
+	if price == "" {
+		return 0, errors.Errorf("no spot price for instance type %s in zone %s", c.Type, az)
+	}
+	f, err := strconv.ParseFloat(price, 64)
+	if err != nil {
+		return 0, errors.Errorf("invalid spot price %q for instance type %s: %v", price, c.Type, err)
+	}
+	return f, nil
 }
 
 // instanceState stores everything we know about EC2 instances,
@@ -191,16 +529,53 @@ type instanceState struct {
 	sleepTime time.Duration
 	region    string
 
+	// minRatio and maxRatio, if nonzero, bound the memory:vCPU ratio
+	// (in GiB per vCPU) of instance types selected by MinAvailable.
+	minRatio, maxRatio float64
+
+	// now is the time source used for cooldowns.
+	now func() time.Time
+
+	// prefer, if set, breaks ties among equally priced candidates in
+	// MinAvailable: it tells whether a is preferred to b.
+	prefer func(a, b instanceConfig) bool
+
+	// commitments are the commitment discounts, keyed by instance
+	// type or family, applied to on-demand prices in MinAvailable.
+	commitments map[string]float64
+
+	// warm are the instance types of which warm (stopped) instances
+	// are available. MinAvailable prefers warm types whose prices are
+	// within warmTolerance (a fraction) of the cheapest candidate's.
+	warm          map[string]bool
+	warmTolerance float64
+
 	mu          sync.Mutex
 	unavailable map[string]time.Time
+	quarantined map[string]time.Time
+	failures    map[string]int
+	spotPrices  map[string]float64
+	// bootFailures counts the consecutive boot failures of each
+	// instance type since it last booted.
+	bootFailures map[string]int
+
+	// store, if set, persists the state's cooldowns; errors saving
+	// them are logged to log.
+	store CooldownStore
+	log   *log.Logger
 }
 
 func newInstanceState(configs []instanceConfig, sleep time.Duration, region string) *instanceState {
 	s := &instanceState{
-		configs:     make([]instanceConfig, len(configs)),
-		unavailable: make(map[string]time.Time),
-		sleepTime:   sleep,
-		region:      region,
+		configs:      make([]instanceConfig, len(configs)),
+		unavailable:  make(map[string]time.Time),
+		quarantined:  make(map[string]time.Time),
+		failures:     make(map[string]int),
+		bootFailures: make(map[string]int),
+		spotPrices:   make(map[string]float64),
+		sleepTime:    sleep,
+		region:       region,
+		now:          time.Now,
 	}
 	copy(s.configs, configs)
 	sort.Slice(s.configs, func(i, j int) bool {
@@ -212,10 +587,46 @@ func newInstanceState(configs []instanceConfig, sleep time.Duration, region stri
 // Unavailable marks the given instance config as busy.
 func (s *instanceState) Unavailable(config instanceConfig) {
 	s.mu.Lock()
-	s.unavailable[config.Type] = time.Now()
+	s.unavailable[config.Type] = s.now()
+	s.failures[config.Type]++
+	s.save()
+	s.mu.Unlock()
+}
+
+// BootFailed records that an instance of type typ failed to boot its
+// reflowlet. Types that fail to boot bootFailureThreshold times in a
+// row are quarantined for bootFailureQuarantine. Unlike
+// unavailability, repeated boot failures tend to persist (e.g.,
+// because the type is incompatible with the AMI), so quarantined
+// types are not selected for much longer.
+func (s *instanceState) BootFailed(typ string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bootFailures[typ]++
+	if s.bootFailures[typ] < bootFailureThreshold {
+		return
+	}
+	delete(s.bootFailures, typ)
+	s.quarantined[typ] = s.now()
+	s.save()
+}
+
+// Booted records that an instance of type typ booted its reflowlet,
+// resetting the type's count of consecutive boot failures.
+func (s *instanceState) Booted(typ string) {
+	s.mu.Lock()
+	delete(s.bootFailures, typ)
 	s.mu.Unlock()
 }
 
+// coolingDown tells whether the instance type typ was marked
+// unavailable within the last sleepTime, or quarantined within the
+// last bootFailureQuarantine. It must be called with s.mu held.
+func (s *instanceState) coolingDown(typ string) bool {
+	now := s.now()
+	return now.Sub(s.unavailable[typ]) < s.sleepTime || now.Sub(s.quarantined[typ]) < bootFailureQuarantine
+}
+
 // Max returns the maximum instance config that could
 // ever be available.
 func (s *instanceState) Max() instanceConfig {
@@ -229,7 +640,7 @@ func (s *instanceState) MaxAvailable(spot bool) (instanceConfig, bool) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	for _, config := range s.configs {
-		if time.Since(s.unavailable[config.Type]) < s.sleepTime || (spot && !config.SpotOk) {
+		if s.coolingDown(config.Type) || (spot && !config.SpotOk) {
 			continue
 		}
 		return config, true
@@ -242,82 +653,942 @@ func (s *instanceState) MaxAvailable(spot bool) (instanceConfig, bool) {
 // available. Spot restricts instances to those that may be launched
 // via EC2 spot market.
 func (s *instanceState) MinAvailable(need reflow.Resources, spot bool) (instanceConfig, bool) {
+	best, _, ok := s.MinAvailableExplain(need, spot)
+	return best, ok
+}
+
+// Rationale explains the selection of an instance type.
+type Rationale struct {
+	// Reason explains why the instance type was chosen.
+	Reason string
+	// Skipped lists the instance types that were not chosen,
+	// together with the reasons they were skipped.
+	Skipped []SkippedType
+}
+
+// SkippedType is an instance type that was not selected.
+type SkippedType struct {
+	Type, Reason string
+}
+
+// String renders the rationale, e.g., "cheapest available type that
+// satisfies the need; skipped: m4.large (cooling down after being
+// unavailable), ...".
+func (r Rationale) String() string {
+	if len(r.Skipped) == 0 {
+		return r.Reason
+	}
+	skipped := make([]string, len(r.Skipped))
+	for i, t := range r.Skipped {
+		skipped[i] = fmt.Sprintf("%s (%s)", t.Type, t.Reason)
+	}
+	return r.Reason + "; skipped: " + strings.Join(skipped, ", ")
+}
+
+// MinAvailableExplain is like MinAvailable, but also returns the
+// rationale of the selection, including the reasons each of the
+// other instance types was skipped.
+func (s *instanceState) MinAvailableExplain(need reflow.Resources, spot bool) (instanceConfig, Rationale, bool) {
+	var rationale Rationale
 	best, ok := s.MaxAvailable(spot)
 	if !ok {
-		return instanceConfig{}, ok
+		rationale.Reason = "no instance types are available"
+		return instanceConfig{}, rationale, ok
 	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	// If the maximum instance type is outside of the permitted memory
+	// ratio, any permitted candidate is preferable to it.
+	var (
+		permitted = s.permitsRatio(best)
+		eligible  []instanceConfig
+		fits      bool
+		now       = s.now()
+	)
 	for _, candidate := range s.configs {
-		if time.Since(s.unavailable[candidate.Type]) < s.sleepTime {
-			continue
+		var reason string
+		price := s.effectivePrice(candidate, spot)
+		switch {
+		case now.Sub(s.quarantined[candidate.Type]) < bootFailureQuarantine:
+			reason = "quarantined after failing to boot"
+		case s.coolingDown(candidate.Type):
+			reason = "cooling down after being unavailable"
+		case !s.permitsRatio(candidate):
+			reason = "memory:vCPU ratio is not permitted"
+		case price == 0:
+			reason = "no price in region " + s.region
+		case spot && !candidate.SpotOk:
+			reason = "not spot-eligible"
+		case !need.LessEqualAll(candidate.Resources):
+			reason = "insufficient resources: " + candidate.Misfit(need)
 		}
-		price := candidate.Price[s.region]
-		if price == 0 {
+		if reason != "" {
+			rationale.Skipped = append(rationale.Skipped, SkippedType{candidate.Type, reason})
 			continue
 		}
-		if (!spot || candidate.SpotOk) && need.LessEqualAll(candidate.Resources) && price < best.Price[s.region] {
+		eligible = append(eligible, candidate)
+		bestPrice := s.effectivePrice(best, spot)
+		if !permitted || price < bestPrice || price == bestPrice && s.prefer != nil && s.prefer(candidate, best) {
 			best = candidate
+			permitted = true
+			fits = true
+		} else if candidate.Type == best.Type {
+			fits = true
+		}
+	}
+	var warm bool
+	if fits && len(s.warm) > 0 && !s.warm[best.Type] {
+		// Warm instances start much faster than new ones, so a warm
+		// type is preferred if it is only marginally costlier.
+		limit := s.effectivePrice(best, spot) * (1 + s.warmTolerance)
+		for _, candidate := range eligible {
+			price := s.effectivePrice(candidate, spot)
+			if !s.warm[candidate.Type] || price > limit {
+				continue
+			}
+			if !warm || price < s.effectivePrice(best, spot) {
+				best = candidate
+				warm = true
+			}
+		}
+	}
+	bestPrice := s.effectivePrice(best, spot)
+	for _, candidate := range eligible {
+		if candidate.Type == best.Type {
+			continue
+		}
+		price := s.effectivePrice(candidate, spot)
+		reason := fmt.Sprintf("costlier than %s ($%.4f vs $%.4f)", best.Type, price, bestPrice)
+		switch {
+		case price == bestPrice:
+			reason = "tie broken in favor of " + best.Type
+		case price < bestPrice:
+			reason = fmt.Sprintf("not warm; %s is warm and costs at most %g%% more ($%.4f vs $%.4f)",
+				best.Type, s.warmTolerance*100, bestPrice, price)
+		}
+		rationale.Skipped = append(rationale.Skipped, SkippedType{candidate.Type, reason})
+	}
+	market := "on-demand"
+	if spot {
+		market = "spot-eligible"
+	}
+	switch {
+	case warm:
+		rationale.Reason = fmt.Sprintf("%s is the cheapest warm %s type that satisfies %s within %g%% of the cheapest type", best.Type, market, need, s.warmTolerance*100)
+	case fits:
+		rationale.Reason = fmt.Sprintf("%s is the cheapest available %s type that satisfies %s", best.Type, market, need)
+	default:
+		// Skipped types are reported only for types other than the
+		// chosen one.
+		skipped := rationale.Skipped[:0]
+		for _, t := range rationale.Skipped {
+			if t.Type != best.Type {
+				skipped = append(skipped, t)
+			}
 		}
+		rationale.Skipped = skipped
+		rationale.Reason = fmt.Sprintf("no available %s type satisfies %s; %s is the largest available type", market, need, best.Type)
 	}
-	return best, true
+	return best, rationale, true
 }
 
-func (s *instanceState) Type(typ string) (instanceConfig, bool) {
+// CheapestN returns up to n of the instance types that are currently
+// believed to be available and that satisfy need, in increasing order
+// of price. Spot restricts instances to those that may be launched
+// via EC2 spot market. If n is negative, all such types are returned.
+func (s *instanceState) CheapestN(need reflow.Resources, spot bool, n int) []instanceConfig {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if time.Since(s.unavailable[typ]) < s.sleepTime {
-		return instanceConfig{}, false
+	var candidates []instanceConfig
+	for _, config := range s.configs {
+		if s.coolingDown(config.Type) || !s.permitsRatio(config) {
+			continue
+		}
+		if spot && !config.SpotOk || !need.LessEqualAll(config.Resources) {
+			continue
+		}
+		if s.effectivePrice(config, spot) == 0 {
+			continue
+		}
+		candidates = append(candidates, config)
+	}
+	// Configs are ordered by decreasing memory, so that ties are
+	// broken in favor of larger types, as in MinAvailable.
+	sort.SliceStable(candidates, func(i, j int) bool {
+		pi, pj := s.effectivePrice(candidates[i], spot), s.effectivePrice(candidates[j], spot)
+		if pi == pj && s.prefer != nil {
+			return s.prefer(candidates[i], candidates[j])
+		}
+		return pi < pj
+	})
+	if n >= 0 && len(candidates) > n {
+		candidates = candidates[:n]
+	}
+	return candidates
+}
+
+// SetTieBreak sets the function used to break ties among equally
+// priced candidates in MinAvailable: prefer(a, b) tells whether a is
+// preferred to b. If no tie-break function is set, ties are broken
+// in favor of the larger (by memory) instance type.
+func (s *instanceState) SetTieBreak(prefer func(a, b instanceConfig) bool) {
+	s.mu.Lock()
+	s.prefer = prefer
+	s.mu.Unlock()
+}
+
+// SetWarm sets the instance types of which warm (stopped) instances
+// are available, e.g., in a warm pool. Because warm instances start
+// much faster than new ones, MinAvailable prefers a warm type to the
+// cheapest candidate if the warm type's price exceeds the cheapest
+// candidate's by at most the provided tolerance, a fraction.
+func (s *instanceState) SetWarm(types []string, tolerance float64) {
+	warm := make(map[string]bool)
+	for _, typ := range types {
+		warm[typ] = true
+	}
+	s.mu.Lock()
+	s.warm, s.warmTolerance = warm, tolerance
+	s.mu.Unlock()
+}
+
+// SetCommitments sets the discounts, as fractions of the on-demand
+// price, that apply to capacity covered by commitments such as
+// Reserved Instances or Savings Plans. Discounts are keyed by
+// instance type (e.g., "m5.xlarge") or family (e.g., "m5"); type
+// discounts take precedence. MinAvailable compares on-demand
+// candidates by their discounted prices, so that committed types are
+// preferred when they are effectively cheaper. Commitments do not
+// apply to spot instances.
+func (s *instanceState) SetCommitments(discounts map[string]float64) {
+	s.mu.Lock()
+	s.commitments = discounts
+	s.mu.Unlock()
+}
+
+// effectivePrice returns the on-demand price of the provided config
+// in the state's region, net of any commitment discount if spot is
+// not set.
+func (s *instanceState) effectivePrice(config instanceConfig, spot bool) float64 {
+	price := config.Price[s.region]
+	if spot {
+		return price
+	}
+	discount, ok := s.commitments[config.Type]
+	if !ok {
+		discount = s.commitments[strings.SplitN(config.Type, ".", 2)[0]]
+	}
+	return price * (1 - discount)
+}
+
+// SetMemoryRatio restricts the instance types selected by
+// MinAvailable to those whose memory:vCPU ratio, in GiB per vCPU, is
+// within [min, max]. Zero values impose no bound.
+func (s *instanceState) SetMemoryRatio(min, max float64) {
+	s.mu.Lock()
+	s.minRatio, s.maxRatio = min, max
+	s.mu.Unlock()
+}
+
+// permitsRatio tells whether the memory:vCPU ratio of the provided
+// config is within the configured bounds.
+func (s *instanceState) permitsRatio(config instanceConfig) bool {
+	if s.minRatio == 0 && s.maxRatio == 0 {
+		return true
+	}
+	if config.Resources.CPU == 0 {
+		return false
+	}
+	ratio := float64(config.Resources.Memory) / (1 << 30) / float64(config.Resources.CPU)
+	return (s.minRatio == 0 || ratio >= s.minRatio) && (s.maxRatio == 0 || ratio <= s.maxRatio)
+}
+
+// Filter returns all instance configs, in order of decreasing
+// memory, that satisfy the predicate pred.
+func (s *instanceState) Filter(pred func(instanceConfig) bool) []instanceConfig {
+	return s.filter(pred, false)
+}
+
+// FilterAvailable returns all instance configs, in order of
+// decreasing memory, that satisfy the predicate pred and are also
+// believed to be currently available.
+func (s *instanceState) FilterAvailable(pred func(instanceConfig) bool) []instanceConfig {
+	return s.filter(pred, true)
+}
+
+func (s *instanceState) filter(pred func(instanceConfig) bool, available bool) []instanceConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var configs []instanceConfig
+	for _, config := range s.configs {
+		if available && s.coolingDown(config.Type) {
+			continue
+		}
+		if pred(config) {
+			configs = append(configs, config)
+		}
+	}
+	return configs
+}
+
+// FractionOf returns the resources of the given fraction (in (0,
+// 1]) of the instance type typ. It can be used to compute resource
+// needs relative to an instance type. FractionOf returns false if
+// the instance type is unknown or the fraction is invalid.
+func (s *instanceState) FractionOf(typ string, frac float64) (reflow.Resources, bool) {
+	if frac <= 0 || frac > 1 {
+		return reflow.Resources{}, false
 	}
 	for _, config := range s.configs {
 		if config.Type == typ {
-			return config, true
+			return config.Resources.Scale(frac), true
 		}
 	}
-	return instanceConfig{}, false
+	return reflow.Resources{}, false
 }
 
-// instance represents a concrete instance; it is launched from an instanceConfig
-// and additional parameters.
-type instance struct {
-	HTTPClient      *http.Client
-	Config          instanceConfig
-	ReflowConfig    config.Config
-	Log             *log.Logger
-	Authenticator   ecrauth.Interface
-	EC2             *ec2.EC2
-	Tag             string
-	Labels          pool.Labels
-	Spot            bool
-	InstanceProfile string
-	SecurityGroup   string
-	Region          string
-	ReflowletImage  string
-	Price           float64
-	EBSType         string
-	EBSSize         uint64
-	AMI             string
-	KeyName         string
-	SshKey          string
+// CapabilityQuery describes the capabilities required of an
+// instance type.
+type CapabilityQuery struct {
+	// MinCPU is the minimum number of vCPUs.
+	MinCPU uint16
+	// MinMemory is the minimum amount of (advertised) memory, in bytes.
+	MinMemory uint64
+	// GPU requires instance types with GPUs.
+	GPU bool
+	// NVMe requires instance types that expose EBS volumes as NVMe
+	// devices.
+	NVMe bool
+	// Spot requires instance types that may be launched via the EC2
+	// spot market.
+	Spot bool
+	// MinNetworkBandwidth is the minimum network bandwidth, in Gbps,
+	// e.g., for network-bound needs.
+	MinNetworkBandwidth float64
+	// MinEBSThroughput is the minimum baseline EBS throughput, in
+	// MB/s, e.g., for I/O-bound needs.
+	MinEBSThroughput float64
+}
 
-	userData string
-	err      error
-	ec2inst  *ec2.Instance
+// Matches tells whether the instance config satisfies the query.
+func (q CapabilityQuery) Matches(config instanceConfig) bool {
+	return config.Resources.CPU >= q.MinCPU &&
+		config.Resources.Memory >= q.MinMemory &&
+		(!q.GPU || config.GPU) &&
+		(!q.NVMe || config.NVMe) &&
+		(!q.Spot || config.SpotOk) &&
+		config.NetworkBandwidth >= q.MinNetworkBandwidth &&
+		config.EBSThroughput >= q.MinEBSThroughput
 }
 
-// Err returns any error that occured while launching the instance.
-func (i *instance) Err() error {
-	return i.err
+// Query returns the cheapest instance type that satisfies the
+// provided capability query and is also believed to be currently
+// available. Query returns false if there is no such instance type.
+func (s *instanceState) Query(q CapabilityQuery) (instanceConfig, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var (
+		best      instanceConfig
+		bestPrice float64
+	)
+	for _, config := range s.configs {
+		if s.coolingDown(config.Type) || !s.permitsRatio(config) || !q.Matches(config) {
+			continue
+		}
+		price := config.Price[s.region]
+		if price == 0 {
+			continue
+		}
+		if bestPrice == 0 || price < bestPrice {
+			best, bestPrice = config, price
+		}
+	}
+	return best, bestPrice > 0
 }
 
-// Instance returns the EC2 instance metadata returned by a successful launch.
-func (i *instance) Instance() *ec2.Instance {
-	return i.ec2inst
+// SetSpotPrice records the current spot price of the given
+// instance type.
+func (s *instanceState) SetSpotPrice(typ string, price float64) {
+	s.mu.Lock()
+	s.spotPrices[typ] = price
+	s.mu.Unlock()
 }
 
-// Go launches an instance, and returns when it fails or the context is done.
-// On success (i.Err() == nil), the returned instance is in running state.
-func (i *instance) Go(ctx context.Context) {
+// EstimateCost returns the estimated hourly cost, in dollars, of
+// launching the instance configurations in plan. On-demand
+// instances are priced at their on-demand price in the region. Spot
+// instances are priced at their last known spot price, or else at
+// their bid (which is the on-demand price), which bounds their cost.
+func (s *instanceState) EstimateCost(plan []instanceConfig, spot bool) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var cost float64
+	for _, config := range plan {
+		price := config.Price[s.region]
+		if spot {
+			if spotPrice := s.spotPrices[config.Type]; spotPrice > 0 {
+				price = spotPrice
+			}
+		}
+		cost += price
+	}
+	return cost
+}
+
+// PriceDiff returns the instance types whose on-demand prices in the
+// state's region differ between s and other, e.g., before and after
+// pricing data is refreshed. Each type's prices are returned as
+// [before, after], where the price before is that of s. Types that
+// are missing from one of the states are priced at zero in it.
+func (s *instanceState) PriceDiff(other *instanceState) map[string][2]float64 {
+	prices := func(s *instanceState) map[string]float64 {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		m := make(map[string]float64)
+		for _, config := range s.configs {
+			m[config.Type] = config.Price[s.region]
+		}
+		return m
+	}
+	before, after := prices(s), prices(other)
+	diff := make(map[string][2]float64)
+	for typ, price := range before {
+		if after[typ] != price {
+			diff[typ] = [2]float64{price, after[typ]}
+		}
+	}
+	for typ, price := range after {
+		if _, ok := before[typ]; !ok {
+			diff[typ] = [2]float64{0, price}
+		}
+	}
+	return diff
+}
+
+// SpotSavings returns the savings, as a percentage of the on-demand
+// price, of the cheapest spot-eligible instance type that satisfies
+// need over the cheapest on-demand instance type that does. Only
+// instance types with known (current) spot prices are considered
+// for spot. SpotSavings returns false if no instance type satisfies
+// need for either market.
+func (s *instanceState) SpotSavings(need reflow.Resources) (savings float64, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var demand, spot float64
+	for _, config := range s.configs {
+		if !need.LessEqualAll(config.Resources) {
+			continue
+		}
+		if price := config.Price[s.region]; price > 0 && (demand == 0 || price < demand) {
+			demand = price
+		}
+		if !config.SpotOk {
+			continue
+		}
+		if price := s.spotPrices[config.Type]; price > 0 && (spot == 0 || price < spot) {
+			spot = price
+		}
+	}
+	if demand == 0 || spot == 0 {
+		return 0, false
+	}
+	if spot >= demand {
+		return 0, true
+	}
+	return 100 * (demand - spot) / demand, true
+}
+
+func (s *instanceState) Type(typ string) (instanceConfig, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.coolingDown(typ) {
+		return instanceConfig{}, false
+	}
+	for _, config := range s.configs {
+		if config.Type == typ {
+			return config, true
+		}
+	}
+	return instanceConfig{}, false
+}
+
+// instance represents a concrete instance; it is launched from an instanceConfig
+// and additional parameters.
+type instance struct {
+	HTTPClient    *http.Client
+	Config        instanceConfig
+	ReflowConfig  config.Config
+	Log           *log.Logger
+	Authenticator ecrauth.Interface
+	EC2           ec2iface.EC2API
+	Tag           string
+	// ClusterLabels, RunLabels, and Labels are the cluster-, run-, and
+	// instance-level labels with which the instance is tagged. They are
+	// merged in increasing order of precedence.
+	ClusterLabels   pool.Labels
+	RunLabels       pool.Labels
+	Labels          pool.Labels
+	Spot            bool
+	InstanceProfile string
+	SecurityGroup   string
+	Region          string
+	ReflowletImage  string
+	Price           float64
+	EBSType         string
+	// EBSTypes, if set, is an ordered list of acceptable data volume
+	// types; it overrides EBSType. Each type is tried in turn until
+	// the launch no longer fails because of the volume type.
+	EBSTypes []string
+	EBSSize  uint64
+	AMI      string
+	KeyName  string
+	SshKey   string
+	// SshCAKey, if set, is the public key of an SSH certificate
+	// authority. The instance's SSH daemon accepts any user
+	// certificate signed by the authority, in addition to SshKey.
+	SshCAKey string
+	// RebootStrategy is the CoreOS update reboot strategy (e.g.,
+	// "etcd-lock", "reboot"). If empty, "off" is used, and the update
+	// engine and locksmith are stopped.
+	RebootStrategy string
+	// ReflowletCPUFraction and ReflowletMemoryFraction limit the
+	// reflowlet container to the given fraction of the instance's CPU
+	// and memory resources. Zero values impose no limits.
+	ReflowletCPUFraction    float64
+	ReflowletMemoryFraction float64
+	// ElasticIP determines whether an Elastic IP address is associated
+	// with the instance after launch; the address is then used to
+	// communicate with the reflowlet. If ElasticIPAllocationID is set,
+	// the given address is used; otherwise one is allocated.
+	ElasticIP             bool
+	ElasticIPAllocationID string
+	// OffersGracePeriod is the amount of time to wait after the
+	// instance is running before polling the reflowlet for offers.
+	OffersGracePeriod time.Duration
+	// LoginCommand is the (cached) Docker login command used to
+	// authenticate the reflowlet image repository. If empty, the login
+	// command is computed using Authenticator.
+	LoginCommand string
+	// AvailabilityZone, if set, is the availability zone into which
+	// the instance is launched.
+	AvailabilityZone string
+	// Subnet, if set, is the ID of the VPC subnet into which the
+	// instance is launched. The subnet must reside in
+	// AvailabilityZone, if set.
+	Subnet string
+	// PullRetries is the number of times the reflowlet image pull is
+	// attempted at boot; PullTimeout bounds each attempt. Defaults are
+	// used when these are zero.
+	PullRetries int
+	PullTimeout time.Duration
+	// HostPool, if set, launches the (on-demand) instance onto a
+	// dedicated host in the named pool, allocating new hosts as
+	// needed. AvailabilityZone must also be set.
+	HostPool string
+	// SpotInterruptionBehavior is the behavior of spot instances when
+	// they are interrupted: one of "terminate" (the default), "stop",
+	// or "hibernate".
+	SpotInterruptionBehavior string
+	// InstanceProfiles, if set, are the ARNs of candidate IAM instance
+	// profiles, in order of preference. The instance is launched with
+	// the first profile, and subsequent ones are tried in turn while
+	// EC2 rejects the launch because of the profile; InstanceProfile
+	// is set to the profile last tried.
+	InstanceProfiles []string
+	// MinOffers and MinOfferResources, if nonzero, are the minimum
+	// number of offers, and minimum total resources of the offers,
+	// that each of the instance's reflowlets must make before the
+	// instance is considered ready. Reflowlets may make partial
+	// offers while they are still initializing.
+	MinOffers         int
+	MinOfferResources reflow.Resources
+	// MetadataHopLimit is the maximum number of network hops that
+	// instance metadata responses may travel. Containers sit one hop
+	// behind the instance, so the limit defaults to
+	// defaultMetadataHopLimit. The limit applies to on-demand
+	// instances only: spot requests do not accept metadata options.
+	MetadataHopLimit int
+	// SpotInstanceIDRetries is the number of times the description
+	// of a fulfilled spot request is retried while it does not name
+	// the request's instance. If zero, defaultSpotInstanceIDRetries
+	// is used; if negative, descriptions are not retried.
+	SpotInstanceIDRetries int
+	// PostLaunch, if set, is called with the description of the
+	// instance once it is running, before its reflowlet is awaited.
+	// It may be used to register the instance with external
+	// systems. If PostLaunch returns an error, the launch fails and
+	// the instance is terminated.
+	PostLaunch func(context.Context, *ec2.Instance) error
+	// SkipTagging disables instance tagging. It is useful in
+	// environments where the IAM role is permitted to launch, but
+	// not to tag, instances.
+	SkipTagging bool
+	// UniqueNames appends a short suffix, derived from the instance
+	// ID, to the instance's Name tag, so that instances sharing a Tag
+	// remain distinguishable.
+	UniqueNames bool
+	// ClientToken, if set, is the client token of the instance's
+	// on-demand launch requests, so that EC2 launches at most one
+	// instance for retried requests, e.g., after a request timed out
+	// ambiguously. It should be unique to the launch (e.g., derived
+	// from its run and attempt). When EBSTypes are tried in turn, each
+	// type's requests use a distinct token derived from it. If empty,
+	// a fresh token is used for each request.
+	ClientToken string
+	// RootEBSSize is the size (in GiB) of the instance's root volume,
+	// which holds, e.g., Docker images unless DockerEBSSize is set.
+	// If zero, defaultRootEBSSize is used. A nonzero size is checked
+	// against the size of the AMI's root snapshot before launch.
+	RootEBSSize uint64
+	// DockerEBSSize, if nonzero, is the size (in GiB) of a dedicated
+	// EBS volume that is mounted at /var/lib/docker, so that Docker
+	// image storage is isolated from the root device. DockerEBSType
+	// is the volume's type; gp2 is used if it is empty.
+	DockerEBSSize uint64
+	DockerEBSType string
+
+	// ConfigKMSKey, if set, is the ID (or ARN or alias) of the KMS key
+	// with which the Reflow configuration is encrypted before it is
+	// embedded in the instance's user data; it is decrypted at boot
+	// using the instance profile's credentials, which must thus permit
+	// kms:Decrypt with the key. KMS is used for encryption, and
+	// KMSDecryptImage (default amazon/aws-cli) for decryption. As KMS
+	// encrypts at most 4 KiB, larger configurations cannot be
+	// encrypted.
+	ConfigKMSKey    string
+	KMS             KMS
+	KMSDecryptImage string
+
+	// CapacityProbeCount is the number of instances for which spot
+	// capacity is probed (with a dry-run launch) before the instance
+	// is launched. It should reflect the intended size of the
+	// scale-up. If zero, defaultCapacityProbeCount is used.
+	CapacityProbeCount int
+	// CapacityTimeoutRetry treats capacity probes that time out as
+	// inconclusive, so that they are retried. By default, a timeout
+	// is taken to mean that capacity is exhausted.
+	CapacityTimeoutRetry bool
+
+	// ReadyTimeout, if nonzero, bounds the total time from launching
+	// the instance to its reflowlet becoming available. Instances that
+	// are not ready within this time are terminated.
+	ReadyTimeout time.Duration
+
+	// BootConfig is the format of the instance's user data: either
+	// "cloud-config" (the default), for CoreOS, or "ignition", for
+	// Flatcar.
+	BootConfig string
+
+	// MemoryDiscount, if set, overrides the fraction of the instance's
+	// memory that is reserved (and thus not advertised in its
+	// resources).
+	MemoryDiscount *float64
+
+	// SecondaryIPs is the number of secondary private IP addresses
+	// that are assigned to the instance's primary network interface.
+	SecondaryIPs int
+
+	// NetworkInterfaceID, if set, is the ID of an existing network
+	// interface that is attached to the instance as its primary
+	// interface. The instance's subnet and security groups are those
+	// of the interface, which is not deleted when the instance
+	// terminates.
+	NetworkInterfaceID string
+
+	// TargetGroupARN, if set, is the ARN of an Elastic Load Balancing
+	// target group with which the instance is registered once it is
+	// running. It is deregistered when the instance is terminated.
+	// Registration requires an ELBV2 client.
+	TargetGroupARN string
+	// TargetGroupPort is the port at which the instance is
+	// registered. If zero, the target group's port is used.
+	TargetGroupPort int
+	// ELBV2 is the Elastic Load Balancing client used to register
+	// the instance with TargetGroupARN.
+	ELBV2 ELBV2
+
+	// spotWaits, if set, limits the number of concurrent spot
+	// fulfillment waits among the instances that share it.
+	spotWaits *spotWaitLimiter
+
+	// AllowPrivateAddress permits the reflowlet to be reached through
+	// the instance's private DNS name (or IP address) when it has no
+	// public address, e.g., in private subnets.
+	AllowPrivateAddress bool
+
+	// CompressConfig stores the Reflow configuration gzip-compressed
+	// in the instance's user data; it is decompressed at boot. This
+	// extends the size of the configuration that may be embedded in
+	// user data. It applies only to unencrypted configurations in the
+	// cloud-config format.
+	CompressConfig bool
+
+	// NFSMounts are the NFS shares (e.g., EFS file systems) that are
+	// mounted on the instance before its reflowlet starts.
+	NFSMounts []NFSMount
+
+	// NodeExporterImage is the Docker image (by tag or digest) of the
+	// node-exporter sidecar. If empty, defaultNodeExporterImage is
+	// used.
+	NodeExporterImage string
+
+	// DataFilesystem is the filesystem ("ext4" or "xfs") of the data
+	// volume. If empty, defaultDataFilesystem is used.
+	DataFilesystem string
+	// DataMountOptions are the mount options of the data volume. If
+	// empty, the filesystem's defaults are used.
+	DataMountOptions string
+	// SkipFormat skips the formatting of the data volume, which is
+	// mounted as is. It must be set only if the volume is known to
+	// be formatted with DataFilesystem, e.g., because it was created
+	// from a snapshot; formatting destroys the volume's contents.
+	SkipFormat bool
+
+	// PrePullImages are Docker images that are pulled at boot, once
+	// the reflowlet has started, to warm the instance's image cache.
+	// This trades instance boot time for the latency of the first
+	// tasks that use these images.
+	PrePullImages []string
+
+	// RedactKeys is the set of configuration keys, in addition to
+	// the cluster key, that are removed from the Reflow configuration
+	// before it is embedded in the instance's user data.
+	RedactKeys []string
+
+	// MaxLifetime, if nonzero, is the maximum lifetime of the
+	// instance: it is powered off (and thus terminated) this long
+	// after boot, regardless of the state of its reflowlet.
+	MaxLifetime time.Duration
+
+	// Reflowlets is the number of reflowlets that are run on the
+	// instance, each serving on its own port (starting at
+	// reflowletPort) and offering an equal share of the instance's
+	// resources. This permits very large instances to be used more
+	// efficiently. The instance is powered off once all of its
+	// reflowlets have exited. If zero, a single reflowlet is run.
+	Reflowlets int
+
+	// Deadline, if nonzero, is the time by which the instance must be
+	// terminated, e.g., the deadline of the run for which it was
+	// launched. The instance's lifetime is capped accordingly.
+	Deadline time.Time
+
+	// LogGroup, if set, is the CloudWatch Logs group to which the
+	// reflowlet's logs are forwarded, through Docker's awslogs log
+	// driver. Each reflowlet logs to its own stream, named by the
+	// instance's tag, its hostname, and the reflowlet's unit. The
+	// instance's profile must permit it to write to the group.
+	LogGroup string
+
+	// dialPool, if set, is used instead of the reflowlet client
+	// to construct pools. It is used for testing.
+	dialPool func(baseurl string) (pool.Pool, error)
+
+	userData string
+	err      error
+	ec2inst  *ec2.Instance
+	eip      elasticIP
+	hostID   string
+
+	spotHeadroom float64
+	bootFailed   bool
+	launchErr    *LaunchError
+
+	// spotRequestID is the ID of the instance's spot request, if any.
+	spotRequestID string
+	// interruptionPending is set (to 1) when EC2 has issued an
+	// interruption notice for the instance.
+	interruptionPending int32
+	// priceSpiked is set (to 1) when the spot market price of the
+	// instance has exceeded its ceiling for a sustained period.
+	priceSpiked int32
+	// profileIndex is the index, in InstanceProfiles, of the profile
+	// with which the instance is being launched.
+	profileIndex int
+	// resourceDelta is the difference between the instance's
+	// realized and selected resources.
+	resourceDelta ResourceDelta
+}
+
+// Err returns any error that occured while launching the instance.
+func (i *instance) Err() error {
+	return i.err
+}
+
+// LaunchError returns the error that occurred while launching the
+// instance, annotated with the phase of the launch that failed, or
+// nil if the launch succeeded. The kind of the underlying error is
+// retained by Err.
+func (i *instance) LaunchError() *LaunchError {
+	return i.launchErr
+}
+
+// LaunchPhase is a phase of an instance launch.
+type LaunchPhase int
+
+const (
+	// PhaseCapacity is the spot capacity check.
+	PhaseCapacity LaunchPhase = iota
+	// PhaseLaunch is the launch of the instance via EC2.
+	PhaseLaunch
+	// PhaseTag is the tagging of the instance.
+	PhaseTag
+	// PhaseWait waits for the instance to enter running state.
+	PhaseWait
+	// PhaseDescribe is the description of the running instance.
+	PhaseDescribe
+	// PhasePostLaunch is the invocation of the instance's
+	// post-launch hook.
+	PhasePostLaunch
+	// PhaseElasticIP is the association of the instance's Elastic
+	// IP address.
+	PhaseElasticIP
+	// PhaseTargetGroup is the registration of the instance with its
+	// target group.
+	PhaseTargetGroup
+	// PhaseOffers waits for the instance's reflowlet to become
+	// available.
+	PhaseOffers
+)
+
+var launchPhases = [...]string{
+	PhaseCapacity:    "capacity",
+	PhaseLaunch:      "launch",
+	PhaseTag:         "tag",
+	PhaseWait:        "wait",
+	PhaseDescribe:    "describe",
+	PhasePostLaunch:  "postlaunch",
+	PhaseElasticIP:   "elasticip",
+	PhaseTargetGroup: "targetgroup",
+	PhaseOffers:      "offers",
+}
+
+// String returns the phase's name.
+func (p LaunchPhase) String() string {
+	if p < 0 || int(p) >= len(launchPhases) {
+		return fmt.Sprintf("LaunchPhase(%d)", int(p))
+	}
+	return launchPhases[p]
+}
+
+// LaunchError is an error that occurred while launching an instance.
+// It records the phase in which the launch failed and the ID of the
+// instance, if one was created.
+type LaunchError struct {
+	// Phase is the phase of the launch that failed.
+	Phase LaunchPhase
+	// InstanceID is the ID of the EC2 instance, or empty if the
+	// launch failed before the instance was created.
+	InstanceID string
+	// Err is the underlying error.
+	Err error
+}
+
+// Error implements error.
+func (e *LaunchError) Error() string {
+	if e.InstanceID == "" {
+		return fmt.Sprintf("launch %s: %v", e.Phase, e.Err)
+	}
+	return fmt.Sprintf("launch %s %s: %v", e.Phase, e.InstanceID, e.Err)
+}
+
+// BootFailed tells whether the instance failed because its
+// reflowlet never responded, even though the instance itself was
+// launched and running. Such failures suggest that the instance
+// type is incompatible with the instance's image, rather than a
+// shortage of capacity.
+func (i *instance) BootFailed() bool {
+	return i.bootFailed
+}
+
+// UserDataSize returns the size, in bytes, of the (base64-encoded)
+// user data with which the instance was launched. EC2 limits user
+// data to 16 KiB. UserDataSize returns 0 if the instance has not yet
+// been launched.
+func (i *instance) UserDataSize() int {
+	return len(i.userData)
+}
+
+// Instance returns the EC2 instance metadata returned by a successful launch.
+func (i *instance) Instance() *ec2.Instance {
+	return i.ec2inst
+}
+
+// LaunchTime returns the time at which the instance was launched, as
+// reported by EC2. LaunchTime returns the zero time if the instance
+// has not been described.
+func (i *instance) LaunchTime() time.Time {
+	if i.ec2inst == nil {
+		return time.Time{}
+	}
+	return aws.TimeValue(i.ec2inst.LaunchTime)
+}
+
+// Uptime returns the time elapsed since the instance was launched,
+// or zero if its launch time is unknown.
+func (i *instance) Uptime() time.Duration {
+	launched := i.LaunchTime()
+	if launched.IsZero() {
+		return 0
+	}
+	return time.Since(launched)
+}
+
+// SpotHeadroom returns the difference, in dollars per hour, between
+// the price of the fulfilled spot request with which the instance was
+// launched and the spot market price at the time of fulfillment. Over
+// time, it can be used to lower bids toward the market price.
+// SpotHeadroom returns 0 for on-demand instances, or if the market
+// price could not be determined.
+func (i *instance) SpotHeadroom() float64 {
+	return i.spotHeadroom
+}
+
+// computeSpotHeadroom computes the headroom of the provided
+// fulfilled spot request over the current market price in the zone
+// in which the instance was launched. Failures are logged: headroom
+// is informational.
+func (i *instance) computeSpotHeadroom(ctx context.Context, req *ec2.SpotInstanceRequest) {
+	bid, err := strconv.ParseFloat(aws.StringValue(req.SpotPrice), 64)
+	if err != nil {
+		i.Log.Debugf("spot request %s: invalid price %q", aws.StringValue(req.SpotInstanceRequestId), aws.StringValue(req.SpotPrice))
+		return
+	}
+	az := aws.StringValue(req.LaunchedAvailabilityZone)
+	market, err := i.Config.PriceInAZ(ctx, i.EC2, i.Region, az, true)
+	if err != nil {
+		i.Log.Debugf("spot market price of %s in %s: %v", i.Config.Type, az, err)
+		return
+	}
+	i.spotHeadroom = bid - market
+}
+
+// instanceAddress returns the address through which the reflowlet
+// on the provided instance is reached: its public DNS name, or else
+// its public IP address. If private is set, the instance's private
+// DNS name and private IP address are used as a last resort.
+// instanceAddress returns an empty string if the instance has no
+// usable address.
+func instanceAddress(inst *ec2.Instance, private bool) string {
+	addrs := []*string{inst.PublicDnsName, inst.PublicIpAddress}
+	if private {
+		addrs = append(addrs, inst.PrivateDnsName, inst.PrivateIpAddress)
+	}
+	for _, addr := range addrs {
+		if a := aws.StringValue(addr); a != "" {
+			return a
+		}
+	}
+	return ""
+}
+
+// retryDelay is the initial delay between retries of failed
+// launch steps; it is doubled on each successive retry.
+var retryDelay = 5 * time.Second
+
+// Go launches an instance, and returns when it fails or the context is done.
+// On success (i.Err() == nil), the returned instance is in running state.
+func (i *instance) Go(ctx context.Context) {
 	const maxTries = 5
 	type stateT int
 	const (
@@ -331,17 +1602,58 @@ func (i *instance) Go(ctx context.Context) {
 		stateWait
 		// Describe the instance via EC2.
 		stateDescribe
+		// Run the post-launch hook.
+		statePostLaunch
+		// Associate an Elastic IP address with the instance.
+		stateElasticIP
+		// Register the instance with its target group.
+		stateTargetGroup
 		// Wait for offers to appear--i.e., the Reflowlet is live.
 		stateOffers
 		stateDone
 	)
 	var (
-		state stateT
-		id    string
-		dns   string
-		n     int
-		d     = 5 * time.Second
+		state  stateT
+		id     string
+		dns    string
+		n      int
+		d      = retryDelay
+		graced bool
+		// responded is set when a reflowlet of the instance has
+		// responded to an offers request.
+		responded bool
+		parent    = ctx
+		ready     *time.Timer
+		// expired is set (to 1) when the instance was not ready
+		// within ReadyTimeout.
+		expired int32
+		phases  = [...]LaunchPhase{
+			stateCapacity:    PhaseCapacity,
+			stateLaunch:      PhaseLaunch,
+			stateTag:         PhaseTag,
+			stateWait:        PhaseWait,
+			stateDescribe:    PhaseDescribe,
+			statePostLaunch:  PhasePostLaunch,
+			stateElasticIP:   PhaseElasticIP,
+			stateTargetGroup: PhaseTargetGroup,
+			stateOffers:      PhaseOffers,
+		}
 	)
+	defer func() {
+		if i.err != nil && state < stateDone {
+			i.launchErr = &LaunchError{Phase: phases[state], InstanceID: id, Err: i.err}
+		}
+	}()
+	if i.MemoryDiscount != nil {
+		i.Config = i.Config.WithMemoryDiscount(*i.MemoryDiscount)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer func() {
+		if ready != nil {
+			ready.Stop()
+		}
+	}()
 	// TODO(marius): propagate context to the underlying AWS calls
 	for state < stateDone && ctx.Err() == nil {
 		switch state {
@@ -349,16 +1661,29 @@ func (i *instance) Go(ctx context.Context) {
 			if !i.Spot {
 				break
 			}
-			// 20 instances should be a good margin for spot.
+			n := i.CapacityProbeCount
+			if n <= 0 {
+				n = defaultCapacityProbeCount
+			}
 			var ok bool
-			ok, i.err = i.ec2HasCapacity(ctx, 20)
+			ok, i.err = i.ec2HasCapacity(ctx, n)
 			if i.err == nil && !ok {
 				i.err = errors.E(errors.Unavailable, errors.New("ec2 capacity is likely exhausted"))
 			}
 		case stateLaunch:
+			if i.ReadyTimeout > 0 && ready == nil {
+				ready = time.AfterFunc(i.ReadyTimeout, func() {
+					atomic.StoreInt32(&expired, 1)
+					cancel()
+				})
+			}
 			id, i.err = i.launch(ctx)
 			if i.err != nil {
 				i.Log.Errorf("instance launch error: %v", i.err)
+				if i.Spot && isPriceTooLow(i.err) {
+					i.Price *= 1 + spotBidIncrease
+					i.Log.Printf("raising spot bid for instance type %s to %.3f", i.Config.Type, i.Price)
+				}
 			} else {
 				spot := ""
 				if i.Spot {
@@ -373,53 +1698,109 @@ func (i *instance) Go(ctx context.Context) {
 			}
 
 		case stateTag:
+			if i.SkipTagging {
+				break
+			}
 			input := &ec2.CreateTagsInput{
 				Resources: []*string{aws.String(id)},
-				Tags:      []*ec2.Tag{{Key: aws.String("Name"), Value: aws.String(i.Tag)}},
+				Tags: []*ec2.Tag{
+					{Key: aws.String("Name"), Value: aws.String(i.name(id))},
+					{Key: aws.String(clusterTag), Value: aws.String(i.Tag)},
+				},
 			}
-			for k, v := range i.Labels {
+			for k, v := range pool.MergeLabels(i.ClusterLabels, i.RunLabels, i.Labels) {
 				input.Tags = append(input.Tags, &ec2.Tag{Key: aws.String(k), Value: aws.String(v)})
 			}
-			_, i.err = i.EC2.CreateTags(input)
+			// Tags are informational: a failure to tag an instance
+			// should not cause us to abandon an otherwise healthy one.
+			if _, err := i.EC2.CreateTags(input); err != nil {
+				i.Log.Errorf("ec2.createtags %v: %v", id, err)
+			}
 		case stateWait:
-			i.err = i.EC2.WaitUntilInstanceRunning(&ec2.DescribeInstancesInput{
+			i.err = i.EC2.WaitUntilInstanceRunningWithContext(ctx, &ec2.DescribeInstancesInput{
 				InstanceIds: []*string{aws.String(id)},
 			})
 		case stateDescribe:
-			var resp *ec2.DescribeInstancesOutput
-			resp, i.err = i.EC2.DescribeInstances(&ec2.DescribeInstancesInput{
-				InstanceIds: []*string{aws.String(id)},
-			})
-			if len(resp.Reservations) != 1 || len(resp.Reservations[0].Instances) != 1 {
-				i.err = errors.Errorf("ec2.describeinstances %v: invalid output", id)
-			}
+			i.ec2inst, i.err = i.describeInstance(ctx, id)
 			if i.err == nil {
-				i.ec2inst = resp.Reservations[0].Instances[0]
-				if i.ec2inst.PublicDnsName == nil || *i.ec2inst.PublicDnsName == "" {
-					i.err = errors.Errorf("ec2.describeinstances %v: no public DNS name", id)
-				} else {
-					dns = *i.ec2inst.PublicDnsName
+				if dns = instanceAddress(i.ec2inst, i.AllowPrivateAddress); dns == "" {
+					i.err = errors.Errorf("ec2.describeinstances %v: no public DNS name or IP address", id)
 				}
 			}
-		case stateOffers:
-			var pool pool.Pool
-			pool, i.err = client.New(fmt.Sprintf("https://%s:9000/v1/", dns), i.HTTPClient, nil /*log.New(os.Stderr, "client: ", 0)*/)
-			if i.err != nil {
-				i.err = errors.E(errors.Fatal, i.err)
+		case statePostLaunch:
+			if i.PostLaunch == nil {
+				break
+			}
+			if err := i.PostLaunch(ctx, i.ec2inst); err != nil {
+				// The instance may not be used, so we don't keep it.
+				i.terminate(parent, id)
+				i.err = errors.E(errors.Fatal, "postlaunch", id, err)
+			}
+		case stateElasticIP:
+			if !i.ElasticIP {
+				break
+			}
+			if i.err = i.setupElasticIP(ctx, id); i.err == nil {
+				dns = i.eip.PublicIP
+			}
+		case stateTargetGroup:
+			if i.TargetGroupARN == "" {
 				break
 			}
-			ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
-			_, i.err = pool.Offers(ctx)
-			if i.err != nil && strings.HasSuffix(i.err.Error(), "connection refused") {
-				i.err = errors.E(errors.Temporary, i.err)
+			if i.ELBV2 == nil {
+				i.err = errors.E(errors.Fatal, errors.New("target group registration requires an ELBV2 client"))
+				break
+			}
+			i.err = i.ELBV2.RegisterTargets(ctx, i.TargetGroupARN, id, i.TargetGroupPort)
+		case stateOffers:
+			if !graced && i.OffersGracePeriod > 0 {
+				// Give the reflowlet a chance to start before we begin polling.
+				graced = true
+				select {
+				case <-time.After(i.OffersGracePeriod):
+				case <-ctx.Done():
+					continue
+				}
+			}
+			// All of the instance's reflowlets must be available.
+			var offers [][]pool.Offer
+			for _, port := range i.reflowletPorts() {
+				var (
+					p     pool.Pool
+					avail []pool.Offer
+				)
+				p, i.err = i.reflowletPool(fmt.Sprintf("https://%s:%d/v1/", dns, port))
+				if i.err != nil {
+					i.err = errors.E(errors.Fatal, i.err)
+					break
+				}
+				ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+				avail, i.err = p.Offers(ctx)
+				cancel()
+				if i.err == nil {
+					responded = true
+				}
+				if i.err != nil {
+					if strings.HasSuffix(i.err.Error(), "connection refused") {
+						i.err = errors.E(errors.Temporary, i.err)
+					}
+					break
+				}
+				if i.err = i.checkOffers(avail); i.err != nil {
+					i.err = errors.E(errors.Temporary, errors.Errorf("reflowlet on port %d: %v", port, i.err))
+					break
+				}
+				offers = append(offers, avail)
+			}
+			if i.err == nil {
+				i.recordResourceDelta(ctx, id, offers)
 			}
-			cancel()
 		default:
 			panic("unknown state")
 		}
 		if i.err == nil {
 			n = 0
-			d = 5 * time.Second
+			d = retryDelay
 			state++
 			continue
 		}
@@ -449,111 +1830,761 @@ func (i *instance) Go(ctx context.Context) {
 		case !errors.Recover(i.err).Timeout() && !errors.Recover(i.err).Temporary():
 			i.Log.Errorf("instance error: %v", i.err)
 		}
-		time.Sleep(d)
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+		}
 		n++
 		d *= time.Duration(2)
 	}
+	// The instance is running, but its reflowlet never responded,
+	// even after every retry. Reflowlets that respond with
+	// insufficient offers, or that are merely slow to start (see
+	// ReadyTimeout), have not failed to boot.
+	i.bootFailed = state == stateOffers && parent.Err() == nil && !responded && atomic.LoadInt32(&expired) == 0
+	if state < stateDone && atomic.LoadInt32(&expired) == 1 && parent.Err() == nil {
+		// Don't leave behind an instance that we've given up on.
+		i.terminate(parent, id)
+		i.err = errors.E(errors.Unavailable,
+			errors.E(errors.Timeout, errors.Errorf("instance %s was not ready after %s", id, i.ReadyTimeout)))
+		return
+	}
 	if i.err != nil {
 		return
 	}
 	i.err = ctx.Err()
 }
 
+// checkOffers checks that the provided offers of one of the
+// instance's reflowlets satisfy MinOffers and MinOfferResources.
+func (i *instance) checkOffers(offers []pool.Offer) error {
+	if n := len(offers); n < i.MinOffers {
+		return errors.Errorf("got %d offers, want at least %d", n, i.MinOffers)
+	}
+	var total reflow.Resources
+	for _, offer := range offers {
+		total = total.Add(offer.Available())
+	}
+	if !i.MinOfferResources.LessEqualAll(total) {
+		return errors.Errorf("offers total %s, want at least %s", total, i.MinOfferResources)
+	}
+	return nil
+}
+
+// terminate terminates the instance with the given ID, if any,
+// first deregistering it from its target group, releasing its
+// Reflow-allocated Elastic IP address, and canceling its persistent
+// spot request. Errors are logged.
+func (i *instance) terminate(ctx context.Context, id string) {
+	if id == "" {
+		return
+	}
+	if i.TargetGroupARN != "" && i.ELBV2 != nil {
+		if err := i.ELBV2.DeregisterTargets(ctx, i.TargetGroupARN, id, i.TargetGroupPort); err != nil {
+			i.Log.Errorf("elbv2.deregistertargets %s: %v", id, err)
+		}
+	}
+	if eip := i.eip.AllocationID; eip != "" {
+		if err := i.ReleaseElasticIP(ctx); err != nil {
+			i.Log.Errorf("release elastic IP %s: %v", eip, err)
+		}
+	}
+	// Otherwise EC2 relaunches the instance.
+	i.cancelSpotRequest(ctx)
+	_, err := i.EC2.TerminateInstancesWithContext(ctx, &ec2.TerminateInstancesInput{
+		InstanceIds: []*string{aws.String(id)},
+	})
+	if err != nil {
+		i.Log.Errorf("ec2.terminateinstances %s: %v", id, err)
+	}
+}
+
+// name returns the Name tag of the instance with the given ID.
+func (i *instance) name(id string) string {
+	if !i.UniqueNames {
+		return i.Tag
+	}
+	suffix := strings.TrimPrefix(id, "i-")
+	if len(suffix) > uniqueNameSuffixLen {
+		suffix = suffix[len(suffix)-uniqueNameSuffixLen:]
+	}
+	return i.Tag + "-" + suffix
+}
+
+// uniqueNameSuffixLen is the length of the instance ID suffix
+// appended to the Name tags of uniquely named instances.
+const uniqueNameSuffixLen = 8
+
+// clusterTag is the EC2 tag key under which an instance's Reflow
+// tag is recorded. Unlike the Name tag, its value is the cluster's
+// tag verbatim, regardless of whether the instance is uniquely named.
+const clusterTag = "reflow:cluster"
+
+// reflowletPool returns a pool client for the reflowlet at the
+// provided base URL.
+func (i *instance) reflowletPool(baseurl string) (pool.Pool, error) {
+	if i.dialPool != nil {
+		return i.dialPool(baseurl)
+	}
+	return client.New(baseurl, i.HTTPClient, nil /*log.New(os.Stderr, "client: ", 0)*/)
+}
+
+// describeNotFoundRetries and describeNotFoundInterval bound
+// the number of (fixed interval) retries that are performed by
+// describeInstance while an instance is not yet visible through
+// the EC2 API.
+var (
+	describeNotFoundRetries  = 5
+	describeNotFoundInterval = 2 * time.Second
+)
+
+// describeInstance describes the instance with the provided ID.
+// Because the EC2 API is eventually consistent, a newly launched
+// instance may not yet be visible; describeInstance retries these
+// cases at a short, fixed interval, and returns an error of kind
+// errors.Temporary if the instance still cannot be found.
+func (i *instance) describeInstance(ctx context.Context, id string) (*ec2.Instance, error) {
+	for n := 0; ; n++ {
+		resp, err := i.EC2.DescribeInstancesWithContext(ctx, &ec2.DescribeInstancesInput{
+			InstanceIds: []*string{aws.String(id)},
+		})
+		switch {
+		case err == nil:
+			if inst := findInstance(resp, id); inst != nil {
+				return inst, nil
+			}
+			err = errors.E(errors.Temporary, errors.Errorf("ec2.describeinstances %v: instance not found", id))
+		case isAWSErrorCode(err, "InvalidInstanceID.NotFound"):
+			err = errors.E(errors.Temporary, err)
+		default:
+			return nil, err
+		}
+		if n == describeNotFoundRetries {
+			return nil, err
+		}
+		select {
+		case <-time.After(describeNotFoundInterval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// findInstance returns the instance with the provided ID among
+// those described by resp, or nil if there is none. The response may
+// describe any number of reservations and instances, e.g., when
+// instances are launched or described in batches.
+func findInstance(resp *ec2.DescribeInstancesOutput, id string) *ec2.Instance {
+	for _, r := range resp.Reservations {
+		for _, inst := range r.Instances {
+			if aws.StringValue(inst.InstanceId) == id {
+				return inst
+			}
+		}
+	}
+	return nil
+}
+
+// isAWSErrorCode tells whether err is an AWS error with the provided code.
+func isAWSErrorCode(err error, code string) bool {
+	awserr, ok := err.(awserr.Error)
+	return ok && awserr.Code() == code
+}
+
 func (i *instance) launch(ctx context.Context) (string, error) {
-	args := struct {
-		Count          int
-		LoginCommand   string
-		Mortal         bool
-		ReflowConfig   string
-		ReflowletImage string
-		SshKey         string
-		DeviceName     string
-	}{}
+	if i.NetworkInterfaceID != "" && (i.Subnet != "" || i.SecondaryIPs > 0) {
+		return "", errors.E(errors.Fatal, errors.New("an existing network interface cannot be combined with a subnet or secondary IPs"))
+	}
+	if err := i.checkPlacement(ctx); err != nil {
+		return "", err
+	}
+	if err := i.checkRootEBSSize(ctx); err != nil {
+		return "", err
+	}
+	if i.HostPool != "" {
+		if i.Spot {
+			return "", errors.E(errors.Fatal, errors.New("spot instances cannot be launched onto dedicated hosts"))
+		}
+		if i.AvailabilityZone == "" {
+			return "", errors.E(errors.Fatal, errors.New("dedicated hosts require an availability zone"))
+		}
+		var err error
+		i.hostID, err = selectHost(ctx, i.EC2, i.HostPool, i.Config.Type, i.AvailabilityZone)
+		if err != nil {
+			return "", err
+		}
+	}
+	userData, err := i.renderUserData()
+	if err != nil {
+		return "", err
+	}
+	i.userData = base64.StdEncoding.EncodeToString(userData)
+	profiles := i.InstanceProfiles
+	if len(profiles) == 0 {
+		profiles = []string{i.InstanceProfile}
+	}
+	for n, profile := range profiles {
+		i.InstanceProfile = profile
+		i.profileIndex = n
+		id, err := i.launchVolumes(ctx)
+		if err == nil || n == len(profiles)-1 || !isInstanceProfileError(err) {
+			return id, err
+		}
+		i.Log.Printf("instance profile %s cannot be used: %v; trying %s", profile, err, profiles[n+1])
+	}
+	panic("not reached")
+}
+
+// launchVolumes launches the instance with each of its EBS volume
+// types in turn, until the launch succeeds or fails for reasons other
+// than the volume type.
+func (i *instance) launchVolumes(ctx context.Context) (string, error) {
+	types := i.EBSTypes
+	if len(types) == 0 {
+		types = []string{i.EBSType}
+	}
+	for n, typ := range types {
+		i.EBSType = typ
+		var (
+			id  string
+			err error
+		)
+		if i.Spot {
+			id, err = i.ec2RunSpotInstance(ctx)
+		} else {
+			id, err = i.ec2RunInstance(ctx)
+		}
+		if err == nil || n == len(types)-1 || !isVolumeTypeError(err) {
+			return id, err
+		}
+		i.Log.Printf("volume type %s is not available: %v; trying %s", typ, err, types[n+1])
+	}
+	panic("not reached")
+}
+
+// isInstanceProfileError tells whether err indicates that the
+// requested IAM instance profile is invalid, or that it may not be
+// passed to the instance.
+func isInstanceProfileError(err error) bool {
+	awserr, ok := err.(awserr.Error)
+	if !ok {
+		return false
+	}
+	msg := strings.ToLower(awserr.Message())
+	switch awserr.Code() {
+	case "InvalidParameterValue", "InvalidParameterCombination":
+		return strings.Contains(msg, "iaminstanceprofile") || strings.Contains(msg, "iam instance profile")
+	case "UnauthorizedOperation":
+		return strings.Contains(msg, "iam:passrole")
+	}
+	return false
+}
+
+// isVolumeTypeError tells whether err indicates that the requested
+// EBS volume type is not available or not valid.
+func isVolumeTypeError(err error) bool {
+	awserr, ok := err.(awserr.Error)
+	if !ok {
+		return false
+	}
+	switch awserr.Code() {
+	case "VolumeTypeNotAvailableInZone", "VolumeTypeNotAvailableInRegion", "UnsupportedVolumeType":
+		return true
+	case "InvalidParameterValue", "InvalidParameterCombination", "ValidationError":
+		return strings.Contains(strings.ToLower(awserr.Message()), "volume type")
+	}
+	return false
+}
+
+// checkPlacement checks that the instance's availability zone is
+// consistent with its region and subnet.
+func (i *instance) checkPlacement(ctx context.Context) error {
+	if i.AvailabilityZone == "" {
+		return nil
+	}
+	if i.Region != "" && !strings.HasPrefix(i.AvailabilityZone, i.Region) {
+		return errors.E(errors.Fatal,
+			errors.Errorf("availability zone %s is not in region %s", i.AvailabilityZone, i.Region))
+	}
+	if i.Subnet == "" {
+		return nil
+	}
+	resp, err := i.EC2.DescribeSubnetsWithContext(ctx, &ec2.DescribeSubnetsInput{
+		SubnetIds: []*string{aws.String(i.Subnet)},
+	})
+	if err != nil {
+		return err
+	}
+	if n := len(resp.Subnets); n != 1 {
+		return errors.Errorf("ec2.describesubnets %s: got %d entries, want 1", i.Subnet, n)
+	}
+	if az := aws.StringValue(resp.Subnets[0].AvailabilityZone); az != i.AvailabilityZone {
+		return errors.E(errors.Fatal,
+			errors.Errorf("availability zone %s does not match zone %s of subnet %s", i.AvailabilityZone, az, i.Subnet))
+	}
+	return nil
+}
+
+// Boot configuration formats.
+const (
+	// bootConfigCloudConfig is the CoreOS cloud-config format.
+	bootConfigCloudConfig = "cloud-config"
+	// bootConfigIgnition is the Ignition format used by Flatcar.
+	bootConfigIgnition = "ignition"
+)
+
+// userDataArgs are the parameters from which instance user data
+// are rendered.
+type userDataArgs struct {
+	Count           int
+	LoginCommand    string
+	Mortal          bool
+	ReflowConfig    string
+	ReflowletImage  string
+	SshKey          string
+	SshCAKey        string
+	SshCAKeysPath   string
+	SshdConfig      string
+	DeviceName      string
+	RebootStrategy  string
+	ReflowletCPUs   string
+	ReflowletMemory uint64
+	PullRetries     int
+	PullTimeout     int
+	DockerDevice    string
+	EncryptedConfig string
+	KMSDecryptImage string
+	Region          string
+	MaxLifetime     int
+	Deadline        string
+
+	NodeExporterImage string
+	NFSMounts         []nfsMountArgs
+	CompressedConfig  string
+	PrePullImages     []string
+	Reflowlets        []reflowletArgs
+	ReflowletUnits    string
+	DataFilesystem    string
+	DataMkfs          string
+	DataMountOptions  string
+	SkipFormat        bool
+	LogGroup          string
+	LogStream         string
+}
+
+// reflowletExitUnit is the systemd unit that powers off an instance
+// running multiple reflowlets once all of them have exited.
+const reflowletExitUnit = "reflowlet-exit.service"
+
+// reflowletArgs are the user data parameters for a reflowlet.
+type reflowletArgs struct {
+	// Unit is the name of the reflowlet's systemd unit.
+	Unit string
+	// Port is the port on which the reflowlet serves.
+	Port int
+	// Flags are additional flags to the reflowlet.
+	Flags string
+	// OnFailure is the unit started when the reflowlet exits, if any.
+	OnFailure string
+}
+
+// reflowletPorts returns the ports on which the instance's
+// reflowlets serve.
+func (i *instance) reflowletPorts() []int {
+	return reflowletPorts(i.Reflowlets)
+}
+
+// reflowletPorts returns the ports on which n reflowlets serve.
+// Instances run at least one reflowlet.
+func reflowletPorts(n int) []int {
+	if n < 1 {
+		n = 1
+	}
+	ports := make([]int, n)
+	for k := range ports {
+		ports[k] = reflowletPort + k
+	}
+	return ports
+}
+
+// renderUserData renders the user data used to boot this instance,
+// in the format given by BootConfig.
+func (i *instance) renderUserData() ([]byte, error) {
+	args, err := i.userDataArgs()
+	if err != nil {
+		return nil, err
+	}
+	switch i.BootConfig {
+	case "", bootConfigCloudConfig:
+		var userdataBuf bytes.Buffer
+		if err := ec2UserDataTmpl.Execute(&userdataBuf, args); err != nil {
+			return nil, err
+		}
+		return userdataBuf.Bytes(), nil
+	case bootConfigIgnition:
+		return renderIgnition(args)
+	default:
+		return nil, errors.E(errors.Fatal, errors.Errorf("unknown boot config format %q", i.BootConfig))
+	}
+}
+
+// userDataArgs computes the user data parameters for this instance.
+func (i *instance) userDataArgs() (userDataArgs, error) {
+	var args userDataArgs
 	args.Count = 1
 	args.Mortal = true
 
 	keys := make(config.Keys)
 	if err := i.ReflowConfig.Marshal(keys); err != nil {
-		return "", err
+		return args, err
 	}
 	// The remote side does not need a cluster implementation.
 	delete(keys, config.Cluster)
+	for _, key := range i.RedactKeys {
+		delete(keys, key)
+	}
 	b, err := yaml.Marshal(keys)
 	if err != nil {
-		return "", err
+		return args, err
 	}
-	args.ReflowConfig = string(b)
-	// This ugly hack is required to properly embed the (YAML) configuration
-	// inside another YAML file.
-	args.ReflowConfig = strings.Replace(args.ReflowConfig, "\n", "\n      ", -1)
-	args.LoginCommand, err = ecrauth.Login(context.TODO(), i.Authenticator)
-	if err != nil {
-		return "", err
+	if i.ConfigKMSKey != "" {
+		if i.KMS == nil {
+			return args, errors.E(errors.Fatal, errors.New("config encryption requires a KMS client"))
+		}
+		if len(b) > kmsMaxPlaintext {
+			return args, errors.E(errors.Fatal, errors.Errorf("reflow configuration is %d bytes; KMS encrypts at most %d bytes", len(b), kmsMaxPlaintext))
+		}
+		ciphertext, err := i.KMS.Encrypt(context.TODO(), i.ConfigKMSKey, b)
+		if err != nil {
+			return args, err
+		}
+		args.EncryptedConfig = base64.StdEncoding.EncodeToString(ciphertext)
+		args.Region = i.Region
+		args.KMSDecryptImage = i.KMSDecryptImage
+		if args.KMSDecryptImage == "" {
+			args.KMSDecryptImage = defaultKMSDecryptImage
+		}
+	} else {
+		args.ReflowConfig = string(b)
+		if i.CompressConfig && i.BootConfig != bootConfigIgnition {
+			var gz bytes.Buffer
+			w := gzip.NewWriter(&gz)
+			if _, err := w.Write(b); err != nil {
+				return args, err
+			}
+			if err := w.Close(); err != nil {
+				return args, err
+			}
+			args.CompressedConfig = base64.StdEncoding.EncodeToString(gz.Bytes())
+		}
+	}
+	args.LoginCommand = i.LoginCommand
+	if args.LoginCommand == "" {
+		args.LoginCommand, err = ecrauth.Login(context.TODO(), i.Authenticator)
+		if err != nil {
+			return args, err
+		}
 	}
 	args.ReflowletImage = i.ReflowletImage
 	args.SshKey = i.SshKey
-	if args.SshKey == "" {
+	if i.SshCAKey != "" {
+		args.SshCAKey = strings.TrimSpace(i.SshCAKey) + "\n"
+		args.SshCAKeysPath = sshCAKeysPath
+		args.SshdConfig = sshdConfig
+	}
+	if args.SshKey == "" && args.SshCAKey == "" {
 		i.Log.Debugf("instance launch: missing public SSH key")
 	}
 	args.DeviceName = "xvdb"
 	if i.Config.NVMe {
 		args.DeviceName = "nvme1n1"
 	}
+	if i.DockerEBSSize > 0 {
+		args.DockerDevice = "xvdc"
+		if i.Config.NVMe {
+			args.DockerDevice = "nvme2n1"
+		}
+	}
+	args.RebootStrategy = i.RebootStrategy
+	if args.RebootStrategy == "" {
+		args.RebootStrategy = "off"
+	}
+	args.PullRetries = i.PullRetries
+	if args.PullRetries <= 0 {
+		args.PullRetries = defaultPullRetries
+	}
+	pullTimeout := i.PullTimeout
+	if pullTimeout <= 0 {
+		pullTimeout = defaultPullTimeout
+	}
+	args.PullTimeout = int(pullTimeout.Seconds())
+	ports := i.reflowletPorts()
+	// Each reflowlet is given an equal share of the instance.
+	share := 1 / float64(len(ports))
+	if i.ReflowletCPUFraction > 0 {
+		args.ReflowletCPUs = fmt.Sprintf("%.2f", share*i.ReflowletCPUFraction*float64(i.Config.Resources.CPU))
+	}
+	if i.ReflowletMemoryFraction > 0 {
+		args.ReflowletMemory = uint64(share * i.ReflowletMemoryFraction * float64(i.Config.Resources.Memory))
+	}
+	// A lone reflowlet powers off the instance when it exits. When
+	// there are several, the instance is powered off only once all of
+	// them have exited, so that idle reflowlets do not take down busy
+	// ones.
+	var units []string
+	for k, port := range ports {
+		r := reflowletArgs{Unit: "reflowlet.service", Port: port}
+		if args.Mortal {
+			r.OnFailure = "poweroff.target"
+			if len(ports) > 1 {
+				r.OnFailure = reflowletExitUnit
+			}
+		}
+		if len(ports) > 1 {
+			r.Flags = fmt.Sprintf(" -addr :%d -share %.4f", port, share)
+		}
+		if k > 0 {
+			r.Unit = fmt.Sprintf("reflowlet-%d.service", k)
+			r.Flags += fmt.Sprintf(" -dir /mnt/data/reflow-%d", k)
+		}
+		args.Reflowlets = append(args.Reflowlets, r)
+		units = append(units, r.Unit)
+	}
+	if args.Mortal && len(units) > 1 {
+		args.ReflowletUnits = strings.Join(units, " ")
+	}
+	args.DataFilesystem = i.DataFilesystem
+	if args.DataFilesystem == "" {
+		args.DataFilesystem = defaultDataFilesystem
+	}
+	fs, ok := dataFilesystems[args.DataFilesystem]
+	if !ok {
+		return args, errors.E(errors.Fatal, errors.Errorf("unsupported data volume filesystem %q", args.DataFilesystem))
+	}
+	args.DataMkfs = fs.mkfs
+	args.SkipFormat = i.SkipFormat
+	args.DataMountOptions = i.DataMountOptions
+	if args.DataMountOptions == "" {
+		args.DataMountOptions = fs.options
+	}
+	if strings.ContainsAny(args.DataMountOptions, " \t\n") {
+		return args, errors.E(errors.Fatal, errors.Errorf("invalid data volume mount options %q", args.DataMountOptions))
+	}
+	if i.LogGroup != "" {
+		if !logGroupName.MatchString(i.LogGroup) {
+			return args, errors.E(errors.Fatal, errors.Errorf("invalid log group name %q", i.LogGroup))
+		}
+		args.LogGroup = i.LogGroup
+		args.Region = i.Region
+		args.LogStream = logStreamPrefix(i.Tag) + "/%H/%n"
+	}
+	args.NFSMounts, err = newNFSMountArgs(i.NFSMounts)
+	if err != nil {
+		return args, err
+	}
+	args.NodeExporterImage = i.NodeExporterImage
+	if args.NodeExporterImage == "" {
+		args.NodeExporterImage = defaultNodeExporterImage
+	}
+	for _, image := range i.PrePullImages {
+		if image == "" || strings.ContainsAny(image, " \t\n'\"$;") {
+			return args, errors.E(errors.Fatal, errors.Errorf("invalid pre-pull image %q", image))
+		}
+	}
+	args.PrePullImages = i.PrePullImages
+	lifetime := i.MaxLifetime
+	if !i.Deadline.IsZero() {
+		remaining := time.Until(i.Deadline)
+		if remaining <= 0 {
+			return args, errors.E(errors.Fatal, errors.Errorf("instance deadline %s has passed", i.Deadline))
+		}
+		if lifetime == 0 || remaining < lifetime {
+			lifetime = remaining
+		}
+		// The lifetime is measured from boot, which follows rendering;
+		// the deadline is thus also enforced on the wall clock.
+		args.Deadline = i.Deadline.UTC().Format("2006-01-02 15:04:05 UTC")
+	}
+	if lifetime > 0 {
+		args.MaxLifetime = int(lifetime.Seconds())
+		if args.MaxLifetime == 0 {
+			args.MaxLifetime = 1
+		}
+	}
+	return args, nil
+}
 
-	var userdataBuf bytes.Buffer
-	if err := ec2UserDataTmpl.Execute(&userdataBuf, args); err != nil {
-		return "", err
+// sshCAKeysPath is the path of the file containing the SSH
+// certificate authority keys trusted by instances.
+const sshCAKeysPath = "/etc/ssh/trusted-user-ca-keys.pem"
+
+// sshdConfig is the SSH daemon configuration of instances that trust
+// an SSH certificate authority. It replaces the distribution's
+// default configuration, which cannot be extended in place.
+const sshdConfig = `UsePrivilegeSeparation sandbox
+Subsystem sftp internal-sftp
+ClientAliveInterval 180
+UseDNS no
+UsePAM yes
+PrintLastLog no
+PrintMotd no
+PasswordAuthentication no
+ChallengeResponseAuthentication no
+TrustedUserCAKeys ` + sshCAKeysPath + `
+`
+
+// yamlQuote returns s as a YAML double-quoted scalar. Any string
+// can be represented this way, regardless of its content or the
+// indentation of the surrounding document, and thus embedded
+// verbatim in another YAML document. The JSON string encoding
+// is a valid YAML double-quoted scalar.
+func yamlQuote(s string) string {
+	b, err := json.Marshal(s)
+	if err != nil {
+		// Strings are always marshalable.
+		panic(err)
+	}
+	return string(b)
+}
+
+// defaultRootEBSSize is the default size, in GiB, of instance root
+// volumes.
+const defaultRootEBSSize = 200
+
+func (i *instance) rootEBSSize() uint64 {
+	if i.RootEBSSize == 0 {
+		return defaultRootEBSSize
+	}
+	return i.RootEBSSize
+}
+
+// checkRootEBSSize checks that the instance's root volume is at
+// least as large as the root snapshot of its AMI; EC2 otherwise
+// rejects the launch. The default size is not checked.
+func (i *instance) checkRootEBSSize(ctx context.Context) error {
+	if i.RootEBSSize == 0 {
+		return nil
 	}
-	i.userData = base64.StdEncoding.EncodeToString(userdataBuf.Bytes())
-	if i.Spot {
-		return i.ec2RunSpotInstance(ctx)
+	resp, err := i.EC2.DescribeImagesWithContext(ctx, &ec2.DescribeImagesInput{
+		ImageIds: []*string{aws.String(i.AMI)},
+	})
+	if err != nil {
+		return err
+	}
+	if len(resp.Images) != 1 {
+		return errors.E(errors.NotExist, errors.Errorf("ec2.describeimages %s: image not found", i.AMI))
+	}
+	image := resp.Images[0]
+	for _, m := range image.BlockDeviceMappings {
+		if aws.StringValue(m.DeviceName) != aws.StringValue(image.RootDeviceName) || m.Ebs == nil {
+			continue
+		}
+		if size := aws.Int64Value(m.Ebs.VolumeSize); uint64(size) > i.RootEBSSize {
+			return errors.E(errors.Fatal, errors.Errorf("root volume size %dGiB is smaller than the %dGiB snapshot of AMI %s", i.RootEBSSize, size, i.AMI))
+		}
 	}
-	return i.ec2RunInstance()
+	return nil
+}
+
+// blockDeviceMappings returns the block device mappings with which
+// the instance is launched.
+func (i *instance) blockDeviceMappings() []*ec2.BlockDeviceMapping {
+	mappings := []*ec2.BlockDeviceMapping{
+		{
+			// The root device for the OS, Docker images, etc.
+			DeviceName: aws.String("/dev/xvda"),
+			Ebs: &ec2.EbsBlockDevice{
+				DeleteOnTermination: aws.Bool(true),
+				VolumeSize:          aws.Int64(int64(i.rootEBSSize())),
+				VolumeType:          aws.String("gp2"),
+			},
+		},
+		{
+			// The data device used for all Reflow data.
+			DeviceName: aws.String("/dev/xvdb"),
+			Ebs: &ec2.EbsBlockDevice{
+				DeleteOnTermination: aws.Bool(true),
+				VolumeSize:          aws.Int64(int64(i.EBSSize)),
+				VolumeType:          aws.String(i.EBSType),
+			},
+		},
+	}
+	if i.DockerEBSSize > 0 {
+		typ := i.DockerEBSType
+		if typ == "" {
+			typ = "gp2"
+		}
+		mappings = append(mappings, &ec2.BlockDeviceMapping{
+			// The device used for Docker image storage (/var/lib/docker).
+			DeviceName: aws.String("/dev/xvdc"),
+			Ebs: &ec2.EbsBlockDevice{
+				DeleteOnTermination: aws.Bool(true),
+				VolumeSize:          aws.Int64(int64(i.DockerEBSSize)),
+				VolumeType:          aws.String(typ),
+			},
+		})
+	}
+	return mappings
 }
 
 func (i *instance) ec2RunSpotInstance(ctx context.Context) (string, error) {
 	i.Log.Debugf("generating ec2 spot instance request for instance type %v", i.Config.Type)
 	// First make a spot instance request.
 	params := &ec2.RequestSpotInstancesInput{
-		ValidUntil: aws.Time(time.Now().Add(time.Minute)),
+		ValidUntil: aws.Time(i.spotRequestValidUntil(time.Now())),
 		SpotPrice:  aws.String(fmt.Sprintf("%.3f", i.Price)),
 
 		LaunchSpecification: &ec2.RequestSpotLaunchSpecification{
 			ImageId:      aws.String(i.AMI),
-			EbsOptimized: aws.Bool(i.Config.EBSOptimized),
+			EbsOptimized: i.ebsOptimized(),
 			InstanceType: aws.String(i.Config.Type),
 
-			BlockDeviceMappings: []*ec2.BlockDeviceMapping{
-				{
-					// The root device for the OS, Docker images, etc.
-					DeviceName: aws.String("/dev/xvda"),
-					Ebs: &ec2.EbsBlockDevice{
-						DeleteOnTermination: aws.Bool(true),
-						VolumeSize:          aws.Int64(200),
-						VolumeType:          aws.String("gp2"),
-					},
-				},
-				{
-					// The data device used for all Reflow data.
-					DeviceName: aws.String("/dev/xvdb"),
-					Ebs: &ec2.EbsBlockDevice{
-						DeleteOnTermination: aws.Bool(true),
-						VolumeSize:          aws.Int64(int64(i.EBSSize)),
-						VolumeType:          aws.String(i.EBSType),
-					},
-				},
-			},
+			BlockDeviceMappings: i.blockDeviceMappings(),
 
 			KeyName:  nonemptyString(i.KeyName),
 			UserData: aws.String(i.userData),
+			SubnetId: nonemptyString(i.Subnet),
 
 			SecurityGroupIds: []*string{aws.String(i.SecurityGroup)},
 		},
 	}
-	resp, err := i.EC2.RequestSpotInstances(params)
-	if err != nil {
+	if i.InstanceProfile != "" {
+		params.LaunchSpecification.IamInstanceProfile = &ec2.IamInstanceProfileSpecification{
+			Arn: aws.String(i.InstanceProfile),
+		}
+	}
+	if i.AvailabilityZone != "" {
+		params.LaunchSpecification.Placement = &ec2.SpotPlacement{
+			AvailabilityZone: aws.String(i.AvailabilityZone),
+		}
+	}
+	if ifaces := i.networkInterfaces(); ifaces != nil {
+		params.LaunchSpecification.NetworkInterfaces = ifaces
+		params.LaunchSpecification.SubnetId = nil
+		params.LaunchSpecification.SecurityGroupIds = nil
+	}
+	if err := checkSpotInterruptionBehavior(i.SpotInterruptionBehavior, i.Config); err != nil {
+		return "", err
+	}
+	var opts []request.Option
+	if i.persistentSpot() {
+		b := i.SpotInterruptionBehavior
+		// Instances can only be stopped or hibernated if they
+		// belong to persistent spot requests.
+		params.Type = aws.String(ec2.SpotInstanceTypePersistent)
+		// The SDK does not yet model the interruption behavior.
+		opts = append(opts, withQueryParam("InstanceInterruptionBehavior", b))
+	}
+	// Spot requests are valid only briefly, so we wait for a slot
+	// before placing them.
+	if err := i.spotWaits.Acquire(ctx); err != nil {
 		return "", err
 	}
+	defer i.spotWaits.Release()
+	resp, err := i.EC2.RequestSpotInstancesWithContext(ctx, params, opts...)
+	if err != nil {
+		return "", classifySpotError(awsErrorCode(err), err)
+	}
 	if n := len(resp.SpotInstanceRequests); n != 1 {
 		return "", errors.Errorf("ec2.requestspotinstances: got %v entries, want 1", n)
 	}
@@ -561,37 +2592,87 @@ func (i *instance) ec2RunSpotInstance(ctx context.Context) (string, error) {
 	if reqid == "" {
 		return "", errors.Errorf("ec2.requestspotinstances: empty request id")
 	}
+	i.spotRequestID = reqid
+	i.tagSpotRequest(ctx, reqid)
 	i.Log.Debugf("waiting for spot fullfillment for instance type %v: %s", i.Config.Type, reqid)
 	// Also set a timeout context in case the AWS API is stuck.
 	toctx, cancel := context.WithTimeout(ctx, time.Minute+10*time.Second)
 	defer cancel()
-	if err := i.ec2WaitForSpotFulfillment(toctx, reqid); err != nil {
+	if code, message, err := i.ec2WaitForSpotFulfillment(toctx, reqid); err != nil {
+		// Classify the failure by the request's last status.
+		if code != "" {
+			if cerr := classifySpotError(code, errors.Errorf("spot request %s: %s: %s", reqid, code, message)); errors.Recover(cerr).Kind != errors.Other {
+				i.cancelSpotRequest(ctx)
+				return "", cerr
+			}
+		}
 		// If we're not fulfilled by our deadline, we consider spot instances
 		// unavailable. Boot this up to the caller so they can pick a different
 		// instance types.
+		i.cancelSpotRequest(ctx)
 		return "", errors.E(errors.Unavailable, err)
 	}
-	describe, err := i.EC2.DescribeSpotInstanceRequests(&ec2.DescribeSpotInstanceRequestsInput{
-		SpotInstanceRequestIds: []*string{aws.String(reqid)},
-	})
+	req, err := i.describeFulfilledSpotRequest(ctx, reqid)
 	if err != nil {
+		i.cancelSpotRequest(ctx)
 		return "", err
 	}
-	if n := len(describe.SpotInstanceRequests); n != 1 {
-		return "", errors.Errorf("ec2.describespotinstancerequests: got %v entries, want 1", n)
+	i.computeSpotHeadroom(ctx, req)
+	i.Log.Debugf("ec2 spot request %s fulfilled", reqid)
+	return aws.StringValue(req.InstanceId), nil
+}
+
+// defaultSpotInstanceIDRetries is the default number of retries of
+// spot request descriptions that lack an instance ID.
+const defaultSpotInstanceIDRetries = 5
+
+// spotInstanceIDRetryDelay is the delay between retried descriptions
+// of fulfilled spot requests that do not yet name their instance.
+var spotInstanceIDRetryDelay = time.Second
+
+// describeFulfilledSpotRequest describes the fulfilled spot request
+// with the provided ID. Because EC2 is eventually consistent, the
+// description may momentarily lack the request's instance ID; such
+// descriptions are retried up to SpotInstanceIDRetries times.
+func (i *instance) describeFulfilledSpotRequest(ctx context.Context, reqid string) (*ec2.SpotInstanceRequest, error) {
+	retries := i.SpotInstanceIDRetries
+	if retries == 0 {
+		retries = defaultSpotInstanceIDRetries
 	}
-	id := aws.StringValue(describe.SpotInstanceRequests[0].InstanceId)
-	if id == "" {
-		return "", errors.Errorf("ec2.describespotinstancerequests: missing instance ID")
+	for n := 0; ; n++ {
+		describe, err := i.EC2.DescribeSpotInstanceRequestsWithContext(ctx, &ec2.DescribeSpotInstanceRequestsInput{
+			SpotInstanceRequestIds: []*string{aws.String(reqid)},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if k := len(describe.SpotInstanceRequests); k != 1 {
+			return nil, errors.Errorf("ec2.describespotinstancerequests: got %v entries, want 1", k)
+		}
+		req := describe.SpotInstanceRequests[0]
+		if aws.StringValue(req.InstanceId) != "" {
+			return req, nil
+		}
+		if n >= retries {
+			return nil, errors.Errorf("ec2.describespotinstancerequests %s: missing instance ID after %d tries", reqid, n+1)
+		}
+		i.Log.Debugf("ec2 spot request %s: missing instance ID; retrying", reqid)
+		select {
+		case <-time.After(spotInstanceIDRetryDelay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 	}
-	i.Log.Debugf("ec2 spot request %s fulfilled", reqid)
-	return id, nil
 }
 
 // ec2WaitForSpotFulfillment waits until the spot request spotID has been fulfilled.
 // It differs from (*ec2.EC2).WaitUntilSpotInstanceRequestFulfilledWithContext
 // in that it request-cancelled-and-instance-running as a success.
-func (i *instance) ec2WaitForSpotFulfillment(ctx context.Context, spotID string) error {
+// If the wait fails, ec2WaitForSpotFulfillment returns the last
+// observed status code and message of the request, e.g., the
+// terminal status that failed it.
+func (i *instance) ec2WaitForSpotFulfillment(ctx context.Context, spotID string) (code, message string, err error) {
+	var last *ec2.DescribeSpotInstanceRequestsOutput
 	w := request.Waiter{
 		Name:        "ec2WaitForSpotFulfillment",
 		MaxAttempts: 40,                                            // default from SDK
@@ -627,17 +2708,30 @@ func (i *instance) ec2WaitForSpotFulfillment(ctx context.Context, spotID string)
 				Matcher: request.PathAnyWaiterMatch, Argument: "SpotInstanceRequests[].Status.Code",
 				Expected: "system-error",
 			},
+			{
+				State:   request.FailureWaiterState,
+				Matcher: request.PathAnyWaiterMatch, Argument: "SpotInstanceRequests[].Status.Code",
+				Expected: "price-too-low",
+			},
 		},
 		NewRequest: func(opts []request.Option) (*request.Request, error) {
-			req, _ := i.EC2.DescribeSpotInstanceRequestsRequest(&ec2.DescribeSpotInstanceRequestsInput{
+			req, out := i.EC2.DescribeSpotInstanceRequestsRequest(&ec2.DescribeSpotInstanceRequestsInput{
 				SpotInstanceRequestIds: []*string{aws.String(spotID)},
 			})
 			req.SetContext(ctx)
 			req.ApplyOptions(opts...)
+			last = out
 			return req, nil
 		},
 	}
-	return w.WaitWithContext(ctx)
+	if err := w.WaitWithContext(ctx); err != nil {
+		if last != nil && len(last.SpotInstanceRequests) == 1 && last.SpotInstanceRequests[0].Status != nil {
+			status := last.SpotInstanceRequests[0].Status
+			code, message = aws.StringValue(status.Code), aws.StringValue(status.Message)
+		}
+		return code, message, err
+	}
+	return "", "", nil
 }
 
 func (i *instance) ec2HasCapacity(ctx context.Context, n int) (bool, error) {
@@ -653,50 +2747,76 @@ func (i *instance) ec2HasCapacity(ctx context.Context, n int) (bool, error) {
 	_, err := i.EC2.RunInstancesWithContext(ctx, params)
 	if err == nil {
 		return false, errors.New("did not expect succesful response")
+	} else if ctx.Err() == context.DeadlineExceeded || isDeadlineExceeded(err) {
+		// The SDK reports timeouts as canceled requests, so they must
+		// be handled before other AWS errors.
+		if i.CapacityTimeoutRetry {
+			return false, errors.E(errors.Temporary, "capacity probe", i.Config.Type, err)
+		}
+		// We'll take an API timeout as a negative answer: this seems to
+		// the case empirically.
+		return false, nil
 	} else if awserr, ok := err.(awserr.Error); ok {
 		if awserr.Code() == "DryRunOperation" {
 			return true, nil
 		}
 		return false, awserr
-	} else if err == context.DeadlineExceeded {
-		// We'll take an API timeout as a negative answer: this seems to
-		// the case empirically.
-		return false, nil
 	} else if err := ctx.Err(); err != nil {
 		return false, err
 	}
 	return false, fmt.Errorf("expected awserr.Error or context error, got %T", err)
 }
 
-func (i *instance) ec2RunInstance() (string, error) {
+// isDeadlineExceeded tells whether err reports an exceeded context
+// deadline, either directly or as a request canceled by the AWS SDK.
+func isDeadlineExceeded(err error) bool {
+	if err == context.DeadlineExceeded {
+		return true
+	}
+	awserr, ok := err.(awserr.Error)
+	return ok && awserr.Code() == request.CanceledErrorCode && awserr.OrigErr() == context.DeadlineExceeded
+}
+
+// clientToken returns the client token of the instance's next
+// on-demand launch request.
+func (i *instance) clientToken() string {
+	if i.ClientToken == "" {
+		return newID()
+	}
+	// EC2 rejects requests that reuse a token with different
+	// parameters.
+	token := i.ClientToken
+	if len(i.EBSTypes) > 1 {
+		token += "-" + i.EBSType
+	}
+	if len(i.InstanceProfiles) > 1 {
+		token += fmt.Sprintf("-p%d", i.profileIndex)
+	}
+	return token
+}
+
+// defaultMetadataHopLimit is the metadata hop limit with which
+// instances are launched by default, permitting containers to reach
+// the instance metadata service.
+const defaultMetadataHopLimit = 2
+
+func (i *instance) metadataHopLimit() int {
+	if i.MetadataHopLimit <= 0 {
+		return defaultMetadataHopLimit
+	}
+	return i.MetadataHopLimit
+}
+
+func (i *instance) ec2RunInstance(ctx context.Context) (string, error) {
 	params := &ec2.RunInstancesInput{
-		ImageId:  aws.String(i.AMI),
-		MaxCount: aws.Int64(int64(1)),
-		MinCount: aws.Int64(int64(1)),
-		BlockDeviceMappings: []*ec2.BlockDeviceMapping{
-			{
-				// The root device for the OS, Docker images, etc.
-				DeviceName: aws.String("/dev/xvda"),
-				Ebs: &ec2.EbsBlockDevice{
-					DeleteOnTermination: aws.Bool(true),
-					VolumeSize:          aws.Int64(200),
-					VolumeType:          aws.String("gp2"),
-				},
-			},
-			{
-				// The data device used for all Reflow data.
-				DeviceName: aws.String("/dev/xvdb"),
-				Ebs: &ec2.EbsBlockDevice{
-					DeleteOnTermination: aws.Bool(true),
-					VolumeSize:          aws.Int64(int64(i.EBSSize)),
-					VolumeType:          aws.String(i.EBSType),
-				},
-			},
-		},
-		ClientToken:           aws.String(newID()),
+		ImageId:               aws.String(i.AMI),
+		MaxCount:              aws.Int64(int64(1)),
+		MinCount:              aws.Int64(int64(1)),
+		BlockDeviceMappings:   i.blockDeviceMappings(),
+		ClientToken:           aws.String(i.clientToken()),
 		DisableApiTermination: aws.Bool(false),
 		DryRun:                aws.Bool(false),
-		EbsOptimized:          aws.Bool(i.Config.EBSOptimized),
+		EbsOptimized:          i.ebsOptimized(),
 		IamInstanceProfile: &ec2.IamInstanceProfileSpecification{
 			Arn: aws.String(i.InstanceProfile),
 		},
@@ -708,8 +2828,27 @@ func (i *instance) ec2RunInstance() (string, error) {
 		KeyName:          nonemptyString(i.KeyName),
 		UserData:         aws.String(i.userData),
 		SecurityGroupIds: []*string{aws.String(i.SecurityGroup)},
+		SubnetId:         nonemptyString(i.Subnet),
 	}
-	resv, err := i.EC2.RunInstances(params)
+	if i.AvailabilityZone != "" {
+		params.Placement = &ec2.Placement{
+			AvailabilityZone: aws.String(i.AvailabilityZone),
+		}
+	}
+	if i.hostID != "" {
+		params.Placement.Tenancy = aws.String(ec2.TenancyHost)
+		params.Placement.HostId = aws.String(i.hostID)
+	}
+	if ifaces := i.networkInterfaces(); ifaces != nil {
+		// Subnets and security groups must be specified by the
+		// network interface instead.
+		params.NetworkInterfaces = ifaces
+		params.SubnetId = nil
+		params.SecurityGroupIds = nil
+	}
+	// The SDK does not yet model instance metadata options.
+	hops := withQueryParam("MetadataOptions.HttpPutResponseHopLimit", fmt.Sprint(i.metadataHopLimit()))
+	resv, err := i.EC2.RunInstancesWithContext(ctx, params, hops)
 	if err != nil {
 		return "", err
 	}
@@ -719,6 +2858,40 @@ func (i *instance) ec2RunInstance() (string, error) {
 	return *resv.Instances[0].InstanceId, nil
 }
 
+// networkInterfaces returns the network interface specification
+// with which the instance is launched, or nil if the default
+// interface should be used.
+func (i *instance) networkInterfaces() []*ec2.InstanceNetworkInterfaceSpecification {
+	if i.NetworkInterfaceID != "" {
+		return []*ec2.InstanceNetworkInterfaceSpecification{{
+			DeviceIndex:         aws.Int64(0),
+			NetworkInterfaceId:  aws.String(i.NetworkInterfaceID),
+			DeleteOnTermination: aws.Bool(false),
+		}}
+	}
+	if i.SecondaryIPs <= 0 {
+		return nil
+	}
+	return []*ec2.InstanceNetworkInterfaceSpecification{{
+		DeviceIndex:                    aws.Int64(0),
+		AssociatePublicIpAddress:       aws.Bool(true),
+		DeleteOnTermination:            aws.Bool(true),
+		Groups:                         []*string{aws.String(i.SecurityGroup)},
+		SubnetId:                       nonemptyString(i.Subnet),
+		SecondaryPrivateIpAddressCount: aws.Int64(int64(i.SecondaryIPs)),
+	}}
+}
+
+// ebsOptimized returns the EBS optimization flag to use when
+// launching the instance. The flag is omitted for instance types
+// that are EBS optimized by default.
+func (i *instance) ebsOptimized() *bool {
+	if i.Config.EBSOptimizedByDefault {
+		return nil
+	}
+	return aws.Bool(i.Config.EBSOptimized)
+}
+
 func newID() string {
 	var b [8]byte
 	_, err := rand.Read(b[:])
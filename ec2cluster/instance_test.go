@@ -0,0 +1,2589 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/docker/engine-api/types"
+	"github.com/grailbio/reflow"
+	"github.com/grailbio/reflow/config"
+	"github.com/grailbio/reflow/errors"
+	"github.com/grailbio/reflow/pool"
+	yaml "gopkg.in/yaml.v2"
+)
+
+type testAuthenticator struct{}
+
+func (testAuthenticator) Authenticates(ctx context.Context, image string) (bool, error) {
+	return true, nil
+}
+
+func (testAuthenticator) Authenticate(ctx context.Context, cfg *types.AuthConfig) error {
+	cfg.Username = "user"
+	cfg.Password = "password"
+	cfg.ServerAddress = "registry.example.com"
+	return nil
+}
+
+type errorAuthenticator struct{}
+
+func (errorAuthenticator) Authenticates(ctx context.Context, image string) (bool, error) {
+	return false, errors.New("unexpected call to Authenticates")
+}
+
+func (errorAuthenticator) Authenticate(ctx context.Context, cfg *types.AuthConfig) error {
+	return errors.New("unexpected call to Authenticate")
+}
+
+func newTestInstance() *instance {
+	return &instance{
+		ReflowConfig:   config.Base{},
+		Authenticator:  testAuthenticator{},
+		ReflowletImage: "reflowlet:test",
+		SshKey:         "ssh-rsa test",
+	}
+}
+
+// newLaunchTestInstance returns an instance that is launched
+// through the provided mock EC2 client, and whose reflowlet is
+// served by the provided pool.
+func newLaunchTestInstance(api *mockEC2, p pool.Pool) *instance {
+	i := newTestInstance()
+	i.Config = instanceConfig{Type: "m4.xlarge"}
+	i.EC2 = api
+	i.dialPool = func(baseurl string) (pool.Pool, error) { return p, nil }
+	return i
+}
+
+func renderUserData(t *testing.T, i *instance) string {
+	t.Helper()
+	b, err := i.renderUserData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestUserDataRebootStrategy(t *testing.T) {
+	i := newTestInstance()
+	ud := renderUserData(t, i)
+	if !strings.Contains(ud, `reboot-strategy: "off"`) {
+		t.Errorf("expected reboot strategy off, got:\n%s", ud)
+	}
+	for _, unit := range []string{"update-engine.service", "locksmithd.service"} {
+		if !strings.Contains(ud, unit) {
+			t.Errorf("expected %s to be stopped", unit)
+		}
+	}
+
+	i.RebootStrategy = "etcd-lock"
+	ud = renderUserData(t, i)
+	if !strings.Contains(ud, `reboot-strategy: "etcd-lock"`) {
+		t.Errorf("expected reboot strategy etcd-lock, got:\n%s", ud)
+	}
+	for _, unit := range []string{"update-engine.service", "locksmithd.service"} {
+		if strings.Contains(ud, unit) {
+			t.Errorf("did not expect %s to be stopped", unit)
+		}
+	}
+}
+
+func TestPriceInAZ(t *testing.T) {
+	now := time.Now()
+	api := &mockEC2{
+		DescribeSpotPriceHistoryFunc: func(input *ec2.DescribeSpotPriceHistoryInput) (*ec2.DescribeSpotPriceHistoryOutput, error) {
+			return &ec2.DescribeSpotPriceHistoryOutput{
+				SpotPriceHistory: []*ec2.SpotPrice{
+					{AvailabilityZone: aws.String("us-west-2a"), InstanceType: aws.String("m4.xlarge"), SpotPrice: aws.String("0.050"), Timestamp: aws.Time(now.Add(-time.Hour))},
+					{AvailabilityZone: aws.String("us-west-2a"), InstanceType: aws.String("m4.xlarge"), SpotPrice: aws.String("0.065"), Timestamp: aws.Time(now)},
+					{AvailabilityZone: aws.String("us-west-2b"), InstanceType: aws.String("m4.xlarge"), SpotPrice: aws.String("0.090"), Timestamp: aws.Time(now)},
+				},
+			}, nil
+		},
+	}
+	config := instanceConfig{Type: "m4.xlarge", Price: map[string]float64{"us-west-2": 0.2}}
+	ctx := context.Background()
+	price, err := config.PriceInAZ(ctx, api, "us-west-2", "us-west-2a", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := price, 0.2; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	price, err = config.PriceInAZ(ctx, api, "us-west-2", "us-west-2a", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := price, 0.065; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if _, err := config.PriceInAZ(ctx, api, "us-west-2", "us-west-2c", true); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestUserDataReflowletLimits(t *testing.T) {
+	i := newTestInstance()
+	i.Config = instanceConfig{
+		Type:      "m4.xlarge",
+		Resources: reflow.Resources{CPU: 4, Memory: 16 << 30},
+	}
+	ud := renderUserData(t, i)
+	if strings.Contains(ud, "--cpus") || strings.Contains(ud, "--memory") {
+		t.Errorf("did not expect resource limits, got:\n%s", ud)
+	}
+	i.ReflowletCPUFraction = 0.5
+	i.ReflowletMemoryFraction = 0.25
+	ud = renderUserData(t, i)
+	for _, flag := range []string{"--cpus=2.00 \\\n", "--memory=4294967296 \\\n"} {
+		if !strings.Contains(ud, flag) {
+			t.Errorf("expected flag %q, got:\n%s", flag, ud)
+		}
+	}
+}
+
+func TestDescribeInstanceNotFound(t *testing.T) {
+	defer func(interval time.Duration) { describeNotFoundInterval = interval }(describeNotFoundInterval)
+	describeNotFoundInterval = time.Millisecond
+
+	var n int
+	api := &mockEC2{
+		DescribeInstancesFunc: func(input *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
+			n++
+			switch n {
+			case 1:
+				return nil, awserr.New("InvalidInstanceID.NotFound", "instance not found", nil)
+			case 2:
+				return &ec2.DescribeInstancesOutput{}, nil
+			default:
+				return &ec2.DescribeInstancesOutput{
+					Reservations: []*ec2.Reservation{{
+						Instances: []*ec2.Instance{{InstanceId: input.InstanceIds[0]}},
+					}},
+				}, nil
+			}
+		},
+	}
+	i := &instance{EC2: api}
+	inst, err := i.describeInstance(context.Background(), "i-123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := aws.StringValue(inst.InstanceId), "i-123"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := n, 3; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	n = 0
+	api.DescribeInstancesFunc = func(input *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
+		n++
+		return nil, awserr.New("InvalidInstanceID.NotFound", "instance not found", nil)
+	}
+	_, err = i.describeInstance(context.Background(), "i-123")
+	if !errors.Match(errors.Temporary, err) {
+		t.Errorf("expected temporary error, got %v", err)
+	}
+	if got, want := n, describeNotFoundRetries+1; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	n = 0
+	api.DescribeInstancesFunc = func(input *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
+		n++
+		return nil, awserr.New("UnauthorizedOperation", "not authorized", nil)
+	}
+	_, err = i.describeInstance(context.Background(), "i-123")
+	if err == nil || errors.Match(errors.Temporary, err) {
+		t.Errorf("expected non-temporary error, got %v", err)
+	}
+	if got, want := n, 1; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestDescribeInstanceBatch(t *testing.T) {
+	api := &mockEC2{
+		DescribeInstancesFunc: func(input *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
+			return &ec2.DescribeInstancesOutput{
+				Reservations: []*ec2.Reservation{
+					{Instances: []*ec2.Instance{
+						{InstanceId: aws.String("i-1"), PublicDnsName: aws.String("one.example.com")},
+						{InstanceId: aws.String("i-2"), PublicDnsName: aws.String("two.example.com")},
+					}},
+					{Instances: []*ec2.Instance{
+						{InstanceId: aws.String("i-3"), PublicDnsName: aws.String("three.example.com")},
+					}},
+				},
+			}, nil
+		},
+	}
+	i := &instance{EC2: api}
+	for id, dns := range map[string]string{"i-1": "one.example.com", "i-2": "two.example.com", "i-3": "three.example.com"} {
+		inst, err := i.describeInstance(context.Background(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := aws.StringValue(inst.PublicDnsName), dns; got != want {
+			t.Errorf("%s: got %v, want %v", id, got, want)
+		}
+	}
+
+	defer func(interval time.Duration) { describeNotFoundInterval = interval }(describeNotFoundInterval)
+	describeNotFoundInterval = time.Millisecond
+	if _, err := i.describeInstance(context.Background(), "i-4"); !errors.Match(errors.Temporary, err) {
+		t.Errorf("expected temporary error, got %v", err)
+	}
+}
+
+func TestOffersGracePeriod(t *testing.T) {
+	const grace = 100 * time.Millisecond
+	var polled time.Time
+	p := &testPool{OffersFunc: func() ([]pool.Offer, error) {
+		if polled.IsZero() {
+			polled = time.Now()
+		}
+		return nil, nil
+	}}
+	i := newLaunchTestInstance(newLaunchMockEC2("i-123", "test.example.com"), p)
+	i.OffersGracePeriod = grace
+	start := time.Now()
+	i.Go(context.Background())
+	if err := i.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if polled.IsZero() {
+		t.Fatal("pool was never polled")
+	}
+	if elapsed := polled.Sub(start); elapsed < grace {
+		t.Errorf("pool polled after %s, before grace period %s", elapsed, grace)
+	}
+}
+
+func TestEBSOptimized(t *testing.T) {
+	var input *ec2.RunInstancesInput
+	api := newLaunchMockEC2("i-123", "test.example.com")
+	api.RunInstancesFunc = func(in *ec2.RunInstancesInput) (*ec2.Reservation, error) {
+		input = in
+		return &ec2.Reservation{Instances: []*ec2.Instance{{InstanceId: aws.String("i-123")}}}, nil
+	}
+	for _, c := range []struct {
+		typ  string
+		want *bool
+	}{
+		{"m4.xlarge", nil},
+		{"c5.large", nil},
+		{"r3.xlarge", aws.Bool(true)},
+		{"t2.micro", aws.Bool(false)},
+	} {
+		config, ok := instanceTypes[c.typ]
+		if !ok {
+			t.Fatalf("unknown instance type %s", c.typ)
+		}
+		i := &instance{EC2: api, Config: config}
+		if _, err := i.ec2RunInstance(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		got := input.EbsOptimized
+		switch {
+		case c.want == nil && got != nil:
+			t.Errorf("%s: expected EbsOptimized to be omitted, got %v", c.typ, *got)
+		case c.want != nil && (got == nil || *got != *c.want):
+			t.Errorf("%s: got %v, want %v", c.typ, aws.BoolValue(got), *c.want)
+		}
+	}
+}
+
+func TestUserDataLoginCommand(t *testing.T) {
+	i := newTestInstance()
+	i.Authenticator = errorAuthenticator{}
+	if _, err := i.renderUserData(); err == nil {
+		t.Fatal("expected error")
+	}
+	i.LoginCommand = "docker login -u cached -p cached https://registry.example.com"
+	ud := renderUserData(t, i)
+	if !strings.Contains(ud, i.LoginCommand) {
+		t.Errorf("expected login command %q, got:\n%s", i.LoginCommand, ud)
+	}
+}
+
+func TestAvailabilityZone(t *testing.T) {
+	var input *ec2.RunInstancesInput
+	api := newLaunchMockEC2("i-123", "test.example.com")
+	api.RunInstancesFunc = func(in *ec2.RunInstancesInput) (*ec2.Reservation, error) {
+		input = in
+		return &ec2.Reservation{Instances: []*ec2.Instance{{InstanceId: aws.String("i-123")}}}, nil
+	}
+	api.DescribeSubnetsFunc = func(in *ec2.DescribeSubnetsInput) (*ec2.DescribeSubnetsOutput, error) {
+		return &ec2.DescribeSubnetsOutput{
+			Subnets: []*ec2.Subnet{{SubnetId: in.SubnetIds[0], AvailabilityZone: aws.String("us-west-2b")}},
+		}, nil
+	}
+	i := newLaunchTestInstance(api, nil)
+	i.Region = "us-west-2"
+	i.AvailabilityZone = "us-west-2a"
+	ctx := context.Background()
+	if _, err := i.launch(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if input.Placement == nil {
+		t.Fatal("missing placement")
+	}
+	if got, want := aws.StringValue(input.Placement.AvailabilityZone), "us-west-2a"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	i.Subnet = "subnet-123"
+	input = nil
+	_, err := i.launch(ctx)
+	if !errors.Match(errors.Fatal, err) {
+		t.Errorf("expected fatal error, got %v", err)
+	}
+	if input != nil {
+		t.Error("instance launched despite mismatched subnet")
+	}
+	i.AvailabilityZone = "us-west-2b"
+	if _, err := i.launch(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := aws.StringValue(input.SubnetId), "subnet-123"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	i.Subnet = ""
+	i.AvailabilityZone = "us-east-1a"
+	if _, err := i.launch(ctx); !errors.Match(errors.Fatal, err) {
+		t.Errorf("expected fatal error, got %v", err)
+	}
+}
+
+func TestUserDataPullRetry(t *testing.T) {
+	i := newTestInstance()
+	ud := renderUserData(t, i)
+	if want := "for n in $$(seq 1 5); do timeout 600 /usr/bin/docker pull reflowlet:test && exit 0;"; !strings.Contains(ud, want) {
+		t.Errorf("expected default pull retry %q, got:\n%s", want, ud)
+	}
+	i.PullRetries = 3
+	i.PullTimeout = 2 * time.Minute
+	ud = renderUserData(t, i)
+	if want := "for n in $$(seq 1 3); do timeout 120 /usr/bin/docker pull reflowlet:test && exit 0;"; !strings.Contains(ud, want) {
+		t.Errorf("expected pull retry %q, got:\n%s", want, ud)
+	}
+}
+
+func TestSkipTagging(t *testing.T) {
+	api := newLaunchMockEC2("i-123", "test.example.com")
+	api.CreateTagsFunc = func(input *ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error) {
+		t.Error("unexpected call to CreateTags")
+		return &ec2.CreateTagsOutput{}, nil
+	}
+	p := &testPool{OffersFunc: func() ([]pool.Offer, error) { return nil, nil }}
+	i := newLaunchTestInstance(api, p)
+	i.SkipTagging = true
+	i.Go(context.Background())
+	if err := i.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClusterTag(t *testing.T) {
+	api := newLaunchMockEC2("i-0123456789abcdef0", "test.example.com")
+	tags := make(map[string]string)
+	api.CreateTagsFunc = func(input *ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error) {
+		for _, tag := range input.Tags {
+			tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+		}
+		return &ec2.CreateTagsOutput{}, nil
+	}
+	p := &testPool{OffersFunc: func() ([]pool.Offer, error) { return nil, nil }}
+	i := newLaunchTestInstance(api, p)
+	i.Tag = "test (reflow)"
+	i.UniqueNames = true
+	i.Go(context.Background())
+	if err := i.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := tags["Name"], "test (reflow)-9abcdef0"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := tags[clusterTag], "test (reflow)"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestTagErrorNonFatal(t *testing.T) {
+	api := newLaunchMockEC2("i-123", "test.example.com")
+	var n int
+	api.CreateTagsFunc = func(input *ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error) {
+		n++
+		return nil, awserr.New("UnauthorizedOperation", "not authorized to perform ec2:CreateTags", nil)
+	}
+	p := &testPool{OffersFunc: func() ([]pool.Offer, error) { return nil, nil }}
+	i := newLaunchTestInstance(api, p)
+	i.Go(context.Background())
+	if err := i.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := n, 1; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if i.Instance() == nil {
+		t.Error("expected a described instance")
+	}
+}
+
+func TestDockerVolume(t *testing.T) {
+	i := newTestInstance()
+	ud := renderUserData(t, i)
+	if strings.Contains(ud, "var-lib-docker.mount") {
+		t.Errorf("unexpected docker volume mount:\n%s", ud)
+	}
+	if got, want := len(i.blockDeviceMappings()), 2; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	i.DockerEBSSize = 500
+	ud = renderUserData(t, i)
+	for _, want := range []string{
+		"ExecStart=/usr/sbin/mkfs.ext4 -F /dev/xvdc",
+		"- name: var-lib-docker.mount",
+		"What=/dev/xvdc\n      Where=/var/lib/docker",
+		"- name: 10-docker-data.conf",
+		"Requires=var-lib-docker.mount",
+	} {
+		if !strings.Contains(ud, want) {
+			t.Errorf("expected %q, got:\n%s", want, ud)
+		}
+	}
+	mappings := i.blockDeviceMappings()
+	if got, want := len(mappings), 3; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	m := mappings[2]
+	if got, want := aws.StringValue(m.DeviceName), "/dev/xvdc"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := aws.Int64Value(m.Ebs.VolumeSize), int64(500); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := aws.StringValue(m.Ebs.VolumeType), "gp2"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	i.Config.NVMe = true
+	ud = renderUserData(t, i)
+	if want := "What=/dev/nvme2n1\n      Where=/var/lib/docker"; !strings.Contains(ud, want) {
+		t.Errorf("expected %q, got:\n%s", want, ud)
+	}
+}
+
+func TestSpotSavings(t *testing.T) {
+	const region = "us-west-2"
+	configs := []instanceConfig{
+		{Type: "small", SpotOk: true, Price: map[string]float64{region: 1},
+			Resources: reflow.Resources{CPU: 2, Memory: 4 << 30}},
+		{Type: "large", SpotOk: true, Price: map[string]float64{region: 4},
+			Resources: reflow.Resources{CPU: 8, Memory: 32 << 30}},
+		{Type: "large-od", Price: map[string]float64{region: 3},
+			Resources: reflow.Resources{CPU: 8, Memory: 32 << 30}},
+	}
+	s := newInstanceState(configs, time.Minute, region)
+	need := reflow.Resources{CPU: 4, Memory: 8 << 30}
+	if _, ok := s.SpotSavings(need); ok {
+		t.Error("expected no savings without spot prices")
+	}
+	for _, c := range []struct {
+		price, want float64
+	}{
+		{0.6, 80},
+		{2.7, 10},
+		{3, 0},
+		{3.5, 0},
+	} {
+		s.SetSpotPrice("large", c.price)
+		savings, ok := s.SpotSavings(need)
+		if !ok {
+			t.Fatalf("spot price %v: expected savings", c.price)
+		}
+		if math.Abs(savings-c.want) > 1e-9 {
+			t.Errorf("spot price %v: got %v, want %v", c.price, savings, c.want)
+		}
+	}
+	// The on-demand-only type is never considered for spot.
+	s.SetSpotPrice("large-od", 0.1)
+	if savings, _ := s.SpotSavings(need); savings != 0 {
+		t.Errorf("got %v, want 0", savings)
+	}
+	if _, ok := s.SpotSavings(reflow.Resources{CPU: 64}); ok {
+		t.Error("expected no savings for unsatisfiable resources")
+	}
+}
+
+func TestEBSTypeFallback(t *testing.T) {
+	api := newLaunchMockEC2("i-123", "test.example.com")
+	var types []string
+	api.RunInstancesFunc = func(in *ec2.RunInstancesInput) (*ec2.Reservation, error) {
+		typ := aws.StringValue(in.BlockDeviceMappings[1].Ebs.VolumeType)
+		types = append(types, typ)
+		if typ == "gp3" {
+			return nil, awserr.New("InvalidParameterValue", "Invalid value 'gp3' for volume type", nil)
+		}
+		return &ec2.Reservation{Instances: []*ec2.Instance{{InstanceId: aws.String("i-123")}}}, nil
+	}
+	i := newLaunchTestInstance(api, nil)
+	i.EBSTypes = []string{"gp3", "gp2"}
+	id, err := i.launch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := id, "i-123"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := strings.Join(types, ","), "gp3,gp2"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Errors unrelated to the volume type are returned immediately.
+	types = nil
+	api.RunInstancesFunc = func(in *ec2.RunInstancesInput) (*ec2.Reservation, error) {
+		types = append(types, aws.StringValue(in.BlockDeviceMappings[1].Ebs.VolumeType))
+		return nil, awserr.New("InsufficientInstanceCapacity", "no capacity", nil)
+	}
+	i.EBSTypes = []string{"gp3", "gp2"}
+	if _, err := i.launch(context.Background()); err == nil {
+		t.Fatal("expected error")
+	}
+	if got, want := strings.Join(types, ","), "gp3"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestInstanceProfileFallback(t *testing.T) {
+	api := newLaunchMockEC2("i-123", "test.example.com")
+	var (
+		profiles []string
+		tokens   []string
+	)
+	api.RunInstancesFunc = func(in *ec2.RunInstancesInput) (*ec2.Reservation, error) {
+		profile := aws.StringValue(in.IamInstanceProfile.Arn)
+		profiles = append(profiles, profile)
+		tokens = append(tokens, aws.StringValue(in.ClientToken))
+		if profile == "arn:aws:iam::123:instance-profile/missing" {
+			return nil, awserr.New("InvalidParameterValue",
+				"Value (arn:aws:iam::123:instance-profile/missing) for parameter iamInstanceProfile.arn is invalid. Invalid IAM Instance Profile ARN", nil)
+		}
+		return &ec2.Reservation{Instances: []*ec2.Instance{{InstanceId: aws.String("i-123")}}}, nil
+	}
+	i := newLaunchTestInstance(api, nil)
+	i.ClientToken = "token"
+	i.InstanceProfiles = []string{"arn:aws:iam::123:instance-profile/missing", "arn:aws:iam::123:instance-profile/reflow"}
+	id, err := i.launch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := id, "i-123"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := profiles, i.InstanceProfiles; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := i.InstanceProfile, "arn:aws:iam::123:instance-profile/reflow"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := strings.Join(tokens, ","), "token-p0,token-p1"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Fallback ends with the last profile.
+	profiles = nil
+	i.InstanceProfiles = []string{"arn:aws:iam::123:instance-profile/missing", "arn:aws:iam::123:instance-profile/missing"}
+	if _, err := i.launch(context.Background()); !isInstanceProfileError(err) {
+		t.Errorf("expected instance profile error, got %v", err)
+	}
+	if got, want := len(profiles), 2; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Other errors do not cause fallback.
+	profiles = nil
+	api.RunInstancesFunc = func(in *ec2.RunInstancesInput) (*ec2.Reservation, error) {
+		profiles = append(profiles, aws.StringValue(in.IamInstanceProfile.Arn))
+		return nil, awserr.New("InsufficientInstanceCapacity", "no capacity", nil)
+	}
+	i.InstanceProfiles = []string{"arn:aws:iam::123:instance-profile/a", "arn:aws:iam::123:instance-profile/b"}
+	if _, err := i.launch(context.Background()); err == nil {
+		t.Fatal("expected error")
+	}
+	if got, want := len(profiles), 1; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if !isInstanceProfileError(awserr.New("UnauthorizedOperation", "You are not authorized to perform: iam:PassRole on resource", nil)) {
+		t.Error("expected PassRole errors to be instance profile errors")
+	}
+
+	// Spot requests are made with each candidate profile in turn.
+	profiles = nil
+	api.RequestSpotInstancesFunc = func(in *ec2.RequestSpotInstancesInput) (*ec2.RequestSpotInstancesOutput, error) {
+		var profile string
+		if spec := in.LaunchSpecification.IamInstanceProfile; spec != nil {
+			profile = aws.StringValue(spec.Arn)
+		}
+		profiles = append(profiles, profile)
+		if profile == "arn:aws:iam::123:instance-profile/missing" {
+			return nil, awserr.New("InvalidParameterValue",
+				"Value (arn:aws:iam::123:instance-profile/missing) for parameter iamInstanceProfile.arn is invalid. Invalid IAM Instance Profile ARN", nil)
+		}
+		return nil, awserr.New("InsufficientInstanceCapacity", "no capacity", nil)
+	}
+	i.Spot = true
+	i.InstanceProfiles = []string{"arn:aws:iam::123:instance-profile/missing", "arn:aws:iam::123:instance-profile/reflow"}
+	if _, err := i.launch(context.Background()); err == nil {
+		t.Fatal("expected error")
+	}
+	if got, want := profiles, i.InstanceProfiles; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestClientToken(t *testing.T) {
+	api := newLaunchMockEC2("i-123", "test.example.com")
+	var tokens []string
+	api.RunInstancesFunc = func(in *ec2.RunInstancesInput) (*ec2.Reservation, error) {
+		tokens = append(tokens, aws.StringValue(in.ClientToken))
+		return &ec2.Reservation{Instances: []*ec2.Instance{{InstanceId: aws.String("i-123")}}}, nil
+	}
+	i := newLaunchTestInstance(api, nil)
+	for n := 0; n < 2; n++ {
+		if _, err := i.launch(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if tokens[0] == "" || tokens[0] == tokens[1] {
+		t.Errorf("expected distinct generated tokens, got %v", tokens)
+	}
+
+	// Provided tokens are reused across requests.
+	tokens = nil
+	i.ClientToken = "run-1234-attempt-1"
+	for n := 0; n < 2; n++ {
+		if _, err := i.launch(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := strings.Join(tokens, ","), "run-1234-attempt-1,run-1234-attempt-1"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Each volume type has its own token.
+	tokens = nil
+	api.RunInstancesFunc = func(in *ec2.RunInstancesInput) (*ec2.Reservation, error) {
+		tokens = append(tokens, aws.StringValue(in.ClientToken))
+		if typ := aws.StringValue(in.BlockDeviceMappings[1].Ebs.VolumeType); typ == "gp3" {
+			return nil, awserr.New("InvalidParameterValue", "Invalid value 'gp3' for volume type", nil)
+		}
+		return &ec2.Reservation{Instances: []*ec2.Instance{{InstanceId: aws.String("i-123")}}}, nil
+	}
+	i.EBSTypes = []string{"gp3", "gp2"}
+	if _, err := i.launch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(tokens, ","), "run-1234-attempt-1-gp3,run-1234-attempt-1-gp2"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestUniqueNames(t *testing.T) {
+	var names []string
+	for _, id := range []string{"i-0123456789abcdef0", "i-0123456789abcdef1"} {
+		api := newLaunchMockEC2(id, "test.example.com")
+		api.CreateTagsFunc = func(input *ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error) {
+			for _, tag := range input.Tags {
+				if aws.StringValue(tag.Key) == "Name" {
+					names = append(names, aws.StringValue(tag.Value))
+				}
+			}
+			return &ec2.CreateTagsOutput{}, nil
+		}
+		p := &testPool{OffersFunc: func() ([]pool.Offer, error) { return nil, nil }}
+		i := newLaunchTestInstance(api, p)
+		i.Tag = "reflow"
+		i.UniqueNames = true
+		i.Go(context.Background())
+		if err := i.Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := len(names), 2; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if names[0] == names[1] {
+		t.Errorf("expected distinct names, got %v", names)
+	}
+	for _, name := range names {
+		if !strings.HasPrefix(name, "reflow-") {
+			t.Errorf("name %s does not have the common prefix", name)
+		}
+	}
+	if got, want := names[0], "reflow-9abcdef0"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestInstanceStateFilter(t *testing.T) {
+	configs := []instanceConfig{
+		{Type: "small", Resources: reflow.Resources{Memory: 4 << 30}},
+		{Type: "large", Resources: reflow.Resources{Memory: 32 << 30}},
+		{Type: "medium", Resources: reflow.Resources{Memory: 16 << 30}},
+	}
+	s := newInstanceState(configs, time.Minute, "us-west-2")
+	atLeast := func(mem uint64) func(instanceConfig) bool {
+		return func(c instanceConfig) bool { return c.Resources.Memory >= mem }
+	}
+	types := func(configs []instanceConfig) string {
+		var types []string
+		for _, c := range configs {
+			types = append(types, c.Type)
+		}
+		return strings.Join(types, ",")
+	}
+	if got, want := types(s.Filter(atLeast(16<<30))), "large,medium"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := s.Filter(atLeast(64 << 30)); len(got) != 0 {
+		t.Errorf("got %v, want none", got)
+	}
+	s.Unavailable(configs[1])
+	if got, want := types(s.Filter(atLeast(16<<30))), "large,medium"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := types(s.FilterAvailable(atLeast(16<<30))), "medium"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// The returned slice is a copy.
+	filtered := s.Filter(atLeast(0))
+	filtered[0].Type = "modified"
+	if got, want := s.Max().Type, "large"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestMinAvailableMemoryRatio(t *testing.T) {
+	const region = "us-west-2"
+	configs := []instanceConfig{
+		// Compute optimized: 2 GiB/vCPU.
+		{Type: "c.4xlarge", Price: map[string]float64{region: 0.8},
+			Resources: reflow.Resources{CPU: 16, Memory: 32 << 30}},
+		// Balanced: 4 GiB/vCPU.
+		{Type: "m.2xlarge", Price: map[string]float64{region: 0.9},
+			Resources: reflow.Resources{CPU: 8, Memory: 32 << 30}},
+		// Memory optimized: 8 GiB/vCPU.
+		{Type: "r.4xlarge", Price: map[string]float64{region: 2},
+			Resources: reflow.Resources{CPU: 16, Memory: 128 << 30}},
+	}
+	s := newInstanceState(configs, time.Minute, region)
+	need := reflow.Resources{CPU: 2, Memory: 24 << 30}
+	best, ok := s.MinAvailable(need, false)
+	if !ok {
+		t.Fatal("no instance available")
+	}
+	if got, want := best.Type, "c.4xlarge"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	s.SetMemoryRatio(3, 6)
+	best, ok = s.MinAvailable(need, false)
+	if !ok {
+		t.Fatal("no instance available")
+	}
+	if got, want := best.Type, "m.2xlarge"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestUserDataConfigEmbedding(t *testing.T) {
+	i := newTestInstance()
+	i.ReflowConfig = config.Base{
+		"cert":     "-----BEGIN CERTIFICATE-----\nMIIB\n  indented\n\ttabbed\n-----END CERTIFICATE-----\n",
+		"trailing": "value with trailing space \n\n",
+		"newline":  "\n",
+		"unicode":  "line\u2028separator",
+		"leading":  "  leading space\nsecond line",
+		"quotes":   `"quoted" 'single' \backslash: {}`,
+	}
+	ud := renderUserData(t, i)
+	var cloudConfig struct {
+		WriteFiles []struct {
+			Path    string
+			Content string
+		} `yaml:"write_files"`
+	}
+	if err := yaml.Unmarshal([]byte(ud), &cloudConfig); err != nil {
+		t.Fatalf("invalid user data: %v\n%s", err, ud)
+	}
+	var content string
+	for _, f := range cloudConfig.WriteFiles {
+		if f.Path == "/etc/reflowconfig" {
+			content = f.Content
+		}
+	}
+	keys := make(config.Keys)
+	if err := yaml.Unmarshal([]byte(content), keys); err != nil {
+		t.Fatalf("invalid embedded config: %v\n%s", err, content)
+	}
+	for k, v := range i.ReflowConfig.(config.Base) {
+		if got, want := keys[k], v; got != want {
+			t.Errorf("%s: got %q, want %q", k, got, want)
+		}
+	}
+}
+
+func TestCapacityProbeCount(t *testing.T) {
+	for _, c := range []struct {
+		count, want int
+	}{
+		{0, 20},
+		{100, 100},
+		{2, 2},
+	} {
+		var count int64
+		api := &mockEC2{
+			RunInstancesFunc: func(in *ec2.RunInstancesInput) (*ec2.Reservation, error) {
+				if !aws.BoolValue(in.DryRun) {
+					t.Fatal("unexpected launch")
+				}
+				count = aws.Int64Value(in.MinCount)
+				return nil, awserr.New("InsufficientInstanceCapacity", "no capacity", nil)
+			},
+		}
+		i := newLaunchTestInstance(api, nil)
+		i.Spot = true
+		i.CapacityProbeCount = c.count
+		i.Go(context.Background())
+		if err := i.Err(); !errors.Match(errors.Unavailable, err) {
+			t.Errorf("expected unavailable error, got %v", err)
+		}
+		if got, want := count, int64(c.want); got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestReadyTimeout(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	api := newLaunchMockEC2("i-123", "test.example.com")
+	api.WaitUntilInstanceRunningFunc = func(ctx aws.Context, input *ec2.DescribeInstancesInput) error {
+		// The instance never enters running state.
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	var terminated []string
+	api.TerminateInstancesFunc = func(input *ec2.TerminateInstancesInput) (*ec2.TerminateInstancesOutput, error) {
+		terminated = append(terminated, aws.StringValue(input.InstanceIds[0]))
+		return &ec2.TerminateInstancesOutput{}, nil
+	}
+	i := newLaunchTestInstance(api, nil)
+	i.ReadyTimeout = timeout
+	start := time.Now()
+	i.Go(context.Background())
+	if elapsed := time.Since(start); elapsed > timeout+time.Second {
+		t.Errorf("launch returned after %s, timeout %s", elapsed, timeout)
+	}
+	err := i.Err()
+	if !errors.Match(errors.Unavailable, err) {
+		t.Errorf("expected unavailable error, got %v", err)
+	}
+	if !errors.Match(errors.Timeout, errors.Recover(err).Err) {
+		t.Errorf("expected timeout error, got %v", err)
+	}
+	if got, want := strings.Join(terminated, ","), "i-123"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestUserDataSize(t *testing.T) {
+	var userData string
+	api := newLaunchMockEC2("i-123", "test.example.com")
+	api.RunInstancesFunc = func(in *ec2.RunInstancesInput) (*ec2.Reservation, error) {
+		userData = aws.StringValue(in.UserData)
+		return &ec2.Reservation{Instances: []*ec2.Instance{{InstanceId: aws.String("i-123")}}}, nil
+	}
+	i := newLaunchTestInstance(api, nil)
+	if got := i.UserDataSize(); got != 0 {
+		t.Errorf("got %v, want 0", got)
+	}
+	if _, err := i.launch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	b, err := i.renderUserData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := i.UserDataSize(), len(userData); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := i.UserDataSize(), base64.StdEncoding.EncodedLen(len(b)); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestMemoryDiscount(t *testing.T) {
+	config := instanceTypes["m4.xlarge"]
+	if got, want := config.TotalMemory, uint64(16<<30); got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	launch := func(discount *float64) uint64 {
+		p := &testPool{OffersFunc: func() ([]pool.Offer, error) { return nil, nil }}
+		i := newLaunchTestInstance(newLaunchMockEC2("i-123", "test.example.com"), p)
+		i.Config = config
+		i.MemoryDiscount = discount
+		i.Go(context.Background())
+		if err := i.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return i.Config.Resources.Memory
+	}
+	discounted := func(discount float64) uint64 {
+		return uint64((1 - discount) * float64(16<<30))
+	}
+	if got, want := launch(nil), discounted(memoryDiscount); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := launch(aws.Float64(0.01)), discounted(0.01); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := launch(aws.Float64(0.25)), uint64(12<<30); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// The instance type's configuration is unaffected.
+	if got, want := instanceTypes["m4.xlarge"].Resources.Memory, discounted(memoryDiscount); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestSecondaryIPs(t *testing.T) {
+	var input *ec2.RunInstancesInput
+	api := newLaunchMockEC2("i-123", "test.example.com")
+	api.RunInstancesFunc = func(in *ec2.RunInstancesInput) (*ec2.Reservation, error) {
+		input = in
+		return &ec2.Reservation{Instances: []*ec2.Instance{{InstanceId: aws.String("i-123")}}}, nil
+	}
+	i := newLaunchTestInstance(api, nil)
+	i.SecurityGroup = "sg-123"
+	i.Subnet = "subnet-123"
+	ctx := context.Background()
+	if _, err := i.launch(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if input.NetworkInterfaces != nil {
+		t.Errorf("unexpected network interfaces %v", input.NetworkInterfaces)
+	}
+
+	i.SecondaryIPs = 4
+	if _, err := i.launch(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(input.NetworkInterfaces), 1; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	iface := input.NetworkInterfaces[0]
+	if got, want := aws.Int64Value(iface.SecondaryPrivateIpAddressCount), int64(4); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := aws.StringValue(iface.SubnetId), "subnet-123"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := aws.StringValue(iface.Groups[0]), "sg-123"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if input.SubnetId != nil || input.SecurityGroupIds != nil {
+		t.Error("subnet and security groups must be specified by the network interface")
+	}
+}
+
+func TestFractionOf(t *testing.T) {
+	config := instanceTypes["m4.16xlarge"]
+	config.Resources.Disk = 1000 << 30
+	s := newInstanceState([]instanceConfig{config, instanceTypes["m4.xlarge"]}, time.Minute, "us-west-2")
+	half, ok := s.FractionOf("m4.16xlarge", 0.5)
+	if !ok {
+		t.Fatal("unknown instance type")
+	}
+	if got, want := half.CPU, uint16(32); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := half.Memory, config.Resources.Memory/2; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := half.Disk, uint64(500<<30); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	best, ok := s.MinAvailable(half, false)
+	if !ok {
+		t.Fatal("no instance available")
+	}
+	if got, want := best.Type, "m4.16xlarge"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if all, _ := s.FractionOf("m4.16xlarge", 1); all != config.Resources {
+		t.Errorf("got %v, want %v", all, config.Resources)
+	}
+	for _, frac := range []float64{0, -0.5, 1.5} {
+		if _, ok := s.FractionOf("m4.16xlarge", frac); ok {
+			t.Errorf("expected fraction %v to be invalid", frac)
+		}
+	}
+	if _, ok := s.FractionOf("x9.huge", 0.5); ok {
+		t.Error("expected unknown instance type")
+	}
+}
+
+func TestMaxLifetime(t *testing.T) {
+	i := newTestInstance()
+	if ud := renderUserData(t, i); strings.Contains(ud, "max-lifetime") {
+		t.Errorf("unexpected max-lifetime units:\n%s", ud)
+	}
+	i.MaxLifetime = 6 * time.Hour
+	ud := renderUserData(t, i)
+	for _, want := range []string{
+		"- name: max-lifetime.timer",
+		"OnBootSec=21600s",
+		"ExecStart=/usr/bin/systemctl --no-block poweroff",
+	} {
+		if !strings.Contains(ud, want) {
+			t.Errorf("expected %q, got:\n%s", want, ud)
+		}
+	}
+	var config struct {
+		Coreos struct {
+			Units []struct{ Name string }
+		}
+	}
+	if err := yaml.Unmarshal([]byte(ud), &config); err != nil {
+		t.Fatalf("invalid cloud-config: %v", err)
+	}
+	var names []string
+	for _, unit := range config.Coreos.Units {
+		names = append(names, unit.Name)
+	}
+	if got, want := strings.Join(names, ","), "max-lifetime.service,max-lifetime.timer"; !strings.HasSuffix(got, want) {
+		t.Errorf("got units %v, want suffix %v", got, want)
+	}
+
+	i.BootConfig = bootConfigIgnition
+	if ud := renderUserData(t, i); !strings.Contains(ud, "max-lifetime.timer") {
+		t.Errorf("ignition config is missing the max-lifetime timer:\n%s", ud)
+	}
+
+	// The instance must terminate when it powers itself off.
+	var behavior string
+	api := newLaunchMockEC2("i-123", "test.example.com")
+	api.RunInstancesFunc = func(in *ec2.RunInstancesInput) (*ec2.Reservation, error) {
+		behavior = aws.StringValue(in.InstanceInitiatedShutdownBehavior)
+		return &ec2.Reservation{Instances: []*ec2.Instance{{InstanceId: aws.String("i-123")}}}, nil
+	}
+	i = newLaunchTestInstance(api, nil)
+	i.MaxLifetime = time.Hour
+	if _, err := i.launch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := behavior, "terminate"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	configs := []instanceConfig{
+		{Type: "small", Resources: reflow.Resources{CPU: 2, Memory: 4 << 30}, Price: map[string]float64{"us-west-2": 0.1}, SpotOk: true},
+		{Type: "large", Resources: reflow.Resources{CPU: 16, Memory: 64 << 30}, Price: map[string]float64{"us-west-2": 0.8}, SpotOk: true},
+		{Type: "ondemand", Resources: reflow.Resources{CPU: 16, Memory: 64 << 30}, Price: map[string]float64{"us-west-2": 0.5}},
+		{Type: "nvme", Resources: reflow.Resources{CPU: 16, Memory: 64 << 30}, Price: map[string]float64{"us-west-2": 0.9}, SpotOk: true, NVMe: true},
+		{Type: "gpu", Resources: reflow.Resources{CPU: 8, Memory: 60 << 30}, Price: map[string]float64{"us-west-2": 0.9}, SpotOk: true, GPU: true},
+		{Type: "gpunvme", Resources: reflow.Resources{CPU: 32, Memory: 240 << 30}, Price: map[string]float64{"us-west-2": 3.0}, SpotOk: true, GPU: true, NVMe: true},
+		{Type: "elsewhere", Resources: reflow.Resources{CPU: 64, Memory: 512 << 30}, Price: map[string]float64{"us-east-1": 0.01}, SpotOk: true},
+	}
+	s := newInstanceState(configs, time.Minute, "us-west-2")
+	for _, c := range []struct {
+		q    CapabilityQuery
+		want string
+	}{
+		{CapabilityQuery{}, "small"},
+		{CapabilityQuery{MinCPU: 4}, "ondemand"},
+		{CapabilityQuery{MinMemory: 8 << 30}, "ondemand"},
+		{CapabilityQuery{MinCPU: 4, Spot: true}, "large"},
+		{CapabilityQuery{NVMe: true}, "nvme"},
+		{CapabilityQuery{GPU: true}, "gpu"},
+		{CapabilityQuery{GPU: true, MinMemory: 100 << 30}, "gpunvme"},
+		{CapabilityQuery{GPU: true, NVMe: true}, "gpunvme"},
+		{CapabilityQuery{MinCPU: 64}, ""},
+	} {
+		config, ok := s.Query(c.q)
+		if got, want := ok, c.want != ""; got != want {
+			t.Errorf("%+v: got %v, want %v", c.q, got, want)
+			continue
+		}
+		if got, want := config.Type, c.want; got != want {
+			t.Errorf("%+v: got %v, want %v", c.q, got, want)
+		}
+	}
+	s.Unavailable(configs[4])
+	if config, ok := s.Query(CapabilityQuery{GPU: true}); !ok || config.Type != "gpunvme" {
+		t.Errorf("got %v, want gpunvme", config.Type)
+	}
+
+	if !instanceTypes["p2.xlarge"].GPU || instanceTypes["m4.xlarge"].GPU {
+		t.Error("GPU instance types are misclassified")
+	}
+}
+
+func TestUserDataRedactKeys(t *testing.T) {
+	i := newTestInstance()
+	i.ReflowConfig = config.Base{
+		"cluster":   "ec2cluster",
+		"assertion": "generator",
+		"localpath": "/Users/someone/reflow",
+		"user":      "someone@example.com",
+	}
+	i.RedactKeys = []string{"assertion", "localpath", "missing"}
+	ud := renderUserData(t, i)
+	var cloudConfig struct {
+		WriteFiles []struct {
+			Path    string
+			Content string
+		} `yaml:"write_files"`
+	}
+	if err := yaml.Unmarshal([]byte(ud), &cloudConfig); err != nil {
+		t.Fatalf("invalid user data: %v\n%s", err, ud)
+	}
+	var content string
+	for _, f := range cloudConfig.WriteFiles {
+		if f.Path == "/etc/reflowconfig" {
+			content = f.Content
+		}
+	}
+	keys := make(config.Keys)
+	if err := yaml.Unmarshal([]byte(content), keys); err != nil {
+		t.Fatalf("invalid embedded config: %v\n%s", err, content)
+	}
+	for _, key := range []string{"cluster", "assertion", "localpath"} {
+		if _, ok := keys[key]; ok {
+			t.Errorf("key %s was not redacted", key)
+		}
+	}
+	if got, want := keys["user"], "someone@example.com"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestInstanceStateCooldown(t *testing.T) {
+	configs := []instanceConfig{
+		{Type: "small", Resources: reflow.Resources{CPU: 2, Memory: 4 << 30}, Price: map[string]float64{"us-west-2": 0.1}, SpotOk: true},
+		{Type: "large", Resources: reflow.Resources{CPU: 16, Memory: 64 << 30}, Price: map[string]float64{"us-west-2": 0.8}, SpotOk: true},
+	}
+	s := newInstanceState(configs, time.Minute, "us-west-2")
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	s.Unavailable(configs[1])
+	s.Unavailable(configs[0])
+	now = now.Add(30 * time.Second)
+	if _, ok := s.MaxAvailable(false); ok {
+		t.Error("expected no instance types to be available")
+	}
+	if _, ok := s.MinAvailable(reflow.Resources{CPU: 1}, false); ok {
+		t.Error("expected no instance types to be available")
+	}
+	if _, ok := s.Type("small"); ok {
+		t.Error("expected small to be unavailable")
+	}
+
+	now = now.Add(time.Minute)
+	if config, ok := s.MaxAvailable(false); !ok || config.Type != "large" {
+		t.Errorf("got %v, want large", config.Type)
+	}
+	if config, ok := s.MinAvailable(reflow.Resources{CPU: 1}, false); !ok || config.Type != "small" {
+		t.Errorf("got %v, want small", config.Type)
+	}
+	if _, ok := s.Type("small"); !ok {
+		t.Error("expected small to be available")
+	}
+}
+
+func TestInstanceStateBootFailed(t *testing.T) {
+	configs := []instanceConfig{
+		{Type: "small", Resources: reflow.Resources{CPU: 2, Memory: 4 << 30}, Price: map[string]float64{"us-west-2": 0.1}, SpotOk: true},
+		{Type: "large", Resources: reflow.Resources{CPU: 16, Memory: 64 << 30}, Price: map[string]float64{"us-west-2": 0.8}, SpotOk: true},
+	}
+	s := newInstanceState(configs, time.Minute, "us-west-2")
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	// Isolated boot failures do not quarantine a type, and successful
+	// boots reset the count.
+	for k := 0; k < bootFailureThreshold-1; k++ {
+		s.BootFailed("small")
+	}
+	s.Booted("small")
+	for k := 0; k < bootFailureThreshold-1; k++ {
+		s.BootFailed("small")
+	}
+	if config, ok := s.MinAvailable(reflow.Resources{CPU: 1}, false); !ok || config.Type != "small" {
+		t.Errorf("got %v, want small", config.Type)
+	}
+	s.BootFailed("small")
+	// Quarantines outlast unavailability cooldowns.
+	now = now.Add(time.Hour)
+	if config, ok := s.MinAvailable(reflow.Resources{CPU: 1}, false); !ok || config.Type != "large" {
+		t.Errorf("got %v, want large", config.Type)
+	}
+	if _, ok := s.Type("small"); ok {
+		t.Error("expected small to be quarantined")
+	}
+	now = now.Add(bootFailureQuarantine)
+	if config, ok := s.MinAvailable(reflow.Resources{CPU: 1}, false); !ok || config.Type != "small" {
+		t.Errorf("got %v, want small", config.Type)
+	}
+}
+
+func TestInstanceBootFailed(t *testing.T) {
+	defer func(d time.Duration) { retryDelay = d }(retryDelay)
+	retryDelay = time.Millisecond
+	p := &testPool{OffersFunc: func() ([]pool.Offer, error) {
+		return nil, errors.New("reflowlet is not running")
+	}}
+	api := newLaunchMockEC2("i-123", "test.example.com")
+	api.TerminateInstancesFunc = func(input *ec2.TerminateInstancesInput) (*ec2.TerminateInstancesOutput, error) {
+		return &ec2.TerminateInstancesOutput{}, nil
+	}
+	i := newLaunchTestInstance(api, p)
+	i.Go(context.Background())
+	if i.Err() == nil {
+		t.Fatal("expected error")
+	}
+	if !i.BootFailed() {
+		t.Errorf("expected boot failure, got %v", i.Err())
+	}
+
+	// Instances that are not ready within ReadyTimeout may merely be
+	// slow to boot.
+	slow := &testPool{OffersFunc: func() ([]pool.Offer, error) {
+		time.Sleep(20 * time.Millisecond)
+		return nil, errors.New("reflowlet is not running")
+	}}
+	i = newLaunchTestInstance(api, slow)
+	i.ReadyTimeout = 10 * time.Millisecond
+	i.Go(context.Background())
+	if i.Err() == nil {
+		t.Fatal("expected error")
+	}
+	if i.BootFailed() {
+		t.Errorf("unexpected boot failure: %v", i.Err())
+	}
+
+	// Reflowlets whose offers are insufficient have booted.
+	insufficient := &testPool{OffersFunc: func() ([]pool.Offer, error) { return nil, nil }}
+	i = newLaunchTestInstance(api, insufficient)
+	i.MinOffers = 1
+	i.Go(context.Background())
+	if i.Err() == nil {
+		t.Fatal("expected error")
+	}
+	if i.BootFailed() {
+		t.Errorf("unexpected boot failure: %v", i.Err())
+	}
+
+	// Instances that never run did not fail to boot.
+	api.WaitUntilInstanceRunningFunc = func(ctx aws.Context, input *ec2.DescribeInstancesInput) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	i = newLaunchTestInstance(api, p)
+	i.ReadyTimeout = 100 * time.Millisecond
+	i.Go(context.Background())
+	if i.Err() == nil {
+		t.Fatal("expected error")
+	}
+	if i.BootFailed() {
+		t.Errorf("unexpected boot failure: %v", i.Err())
+	}
+}
+
+func TestInstanceConfigFits(t *testing.T) {
+	config := instanceTypes["m4.xlarge"]
+	need := reflow.Resources{CPU: 4, Memory: 16 << 30}
+	if need.Memory > config.TotalMemory {
+		t.Fatal("need does not fit in raw memory")
+	}
+	if config.Fits(need) {
+		t.Errorf("need %v fits in %v", need, config.Resources)
+	}
+	misfit := config.Misfit(need)
+	if !strings.HasPrefix(misfit, "memory: need 16.0GiB, have 15.2GiB") || !strings.Contains(misfit, "16.0GiB total") {
+		t.Errorf("unexpected misfit %q", misfit)
+	}
+	if strings.Contains(misfit, "cpu") {
+		t.Errorf("unexpected cpu misfit %q", misfit)
+	}
+
+	need.Memory = config.Resources.Memory
+	if !config.Fits(need) {
+		t.Errorf("need %v does not fit in %v", need, config.Resources)
+	}
+	if misfit := config.Misfit(need); misfit != "" {
+		t.Errorf("unexpected misfit %q", misfit)
+	}
+
+	need.CPU = 8
+	if got, want := config.Misfit(need), "cpu: need 8, have 4"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestUserDataNodeExporterImage(t *testing.T) {
+	i := newTestInstance()
+	ud := renderUserData(t, i)
+	if !strings.Contains(ud, "/usr/bin/docker pull "+defaultNodeExporterImage+"\n") {
+		t.Errorf("expected default node-exporter image, got:\n%s", ud)
+	}
+	for _, image := range []string{
+		"quay.io/prometheus/node-exporter:v0.18.1",
+		"prom/node-exporter@sha256:b630fb29d99b3483c73a2a7db5fc01a967392a3d7ad754c8eccf9f4a67e7ee31",
+	} {
+		i.NodeExporterImage = image
+		for _, boot := range []string{bootConfigCloudConfig, bootConfigIgnition} {
+			i.BootConfig = boot
+			ud := renderUserData(t, i)
+			if boot == bootConfigIgnition {
+				// Unit contents are JSON-encoded.
+				ud = strings.Replace(ud, `\n`, "\n", -1)
+			}
+			for _, want := range []string{
+				"/usr/bin/docker pull " + image + "\n",
+				"--net=host " + image + " -collector.procfs",
+			} {
+				if !strings.Contains(ud, want) {
+					t.Errorf("%s: expected %q, got:\n%s", boot, want, ud)
+				}
+			}
+			if strings.Contains(ud, defaultNodeExporterImage) {
+				t.Errorf("%s: unexpected default node-exporter image:\n%s", boot, ud)
+			}
+		}
+	}
+}
+
+func TestNetworkInterfaceReuse(t *testing.T) {
+	var input *ec2.RunInstancesInput
+	api := newLaunchMockEC2("i-123", "test.example.com")
+	api.RunInstancesFunc = func(in *ec2.RunInstancesInput) (*ec2.Reservation, error) {
+		input = in
+		return &ec2.Reservation{Instances: []*ec2.Instance{{InstanceId: aws.String("i-123")}}}, nil
+	}
+	i := newLaunchTestInstance(api, nil)
+	i.SecurityGroup = "sg-123"
+	i.NetworkInterfaceID = "eni-123"
+	ctx := context.Background()
+	if _, err := i.launch(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(input.NetworkInterfaces), 1; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	iface := input.NetworkInterfaces[0]
+	if got, want := aws.StringValue(iface.NetworkInterfaceId), "eni-123"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := aws.Int64Value(iface.DeviceIndex), int64(0); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if aws.BoolValue(iface.DeleteOnTermination) {
+		t.Error("existing network interface must not be deleted on termination")
+	}
+	if iface.SubnetId != nil || iface.Groups != nil || iface.AssociatePublicIpAddress != nil {
+		t.Errorf("unexpected interface parameters %v", iface)
+	}
+	if input.SubnetId != nil || input.SecurityGroupIds != nil {
+		t.Error("subnet and security groups must not be specified with an existing network interface")
+	}
+
+	input = nil
+	i.SecondaryIPs = 2
+	if _, err := i.launch(ctx); !errors.Match(errors.Fatal, err) {
+		t.Errorf("expected fatal error, got %v", err)
+	}
+	i.SecondaryIPs = 0
+	i.Subnet = "subnet-123"
+	if _, err := i.launch(ctx); !errors.Match(errors.Fatal, err) {
+		t.Errorf("expected fatal error, got %v", err)
+	}
+	if input != nil {
+		t.Error("instance launched with conflicting network parameters")
+	}
+}
+
+func TestEstimateCost(t *testing.T) {
+	small := instanceConfig{Type: "small", Price: map[string]float64{"us-west-2": 0.1}, SpotOk: true}
+	large := instanceConfig{Type: "large", Price: map[string]float64{"us-west-2": 0.8}, SpotOk: true}
+	s := newInstanceState([]instanceConfig{small, large}, time.Minute, "us-west-2")
+	plan := []instanceConfig{small, large, large, small, small}
+	approx := func(got, want float64) {
+		t.Helper()
+		if math.Abs(got-want) > 1e-9 {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+	approx(s.EstimateCost(plan, false), 1.9)
+	// Without spot prices, spot instances are priced at their bids.
+	approx(s.EstimateCost(plan, true), 1.9)
+	s.SetSpotPrice("large", 0.25)
+	approx(s.EstimateCost(plan, true), 0.8)
+	approx(s.EstimateCost(plan, false), 1.9)
+	approx(s.EstimateCost(nil, true), 0)
+}
+
+func TestNetworkBandwidth(t *testing.T) {
+	for _, c := range []struct {
+		perf string
+		gbps float64
+	}{
+		{"Moderate", 0.8},
+		{"High", 2},
+		{"10 Gigabit", 10},
+		{"Up to 10 Gigabit", 10},
+		{"25 Gigabit", 25},
+		{"", 0},
+		{"Fast", 0},
+	} {
+		if got, want := networkBandwidth(c.perf), c.gbps; got != want {
+			t.Errorf("%q: got %v, want %v", c.perf, got, want)
+		}
+	}
+}
+
+func TestQueryIO(t *testing.T) {
+	resources := reflow.Resources{CPU: 16, Memory: 64 << 30}
+	configs := []instanceConfig{
+		{Type: "cheap", Resources: resources, Price: map[string]float64{"us-west-2": 0.5}, NetworkBandwidth: 2, EBSThroughput: 250},
+		{Type: "network", Resources: resources, Price: map[string]float64{"us-west-2": 0.8}, NetworkBandwidth: 25, EBSThroughput: 250},
+		{Type: "ebs", Resources: resources, Price: map[string]float64{"us-west-2": 0.9}, NetworkBandwidth: 10, EBSThroughput: 1750},
+	}
+	s := newInstanceState(configs, time.Minute, "us-west-2")
+	for _, c := range []struct {
+		q    CapabilityQuery
+		want string
+	}{
+		{CapabilityQuery{MinCPU: 16}, "cheap"},
+		{CapabilityQuery{MinCPU: 16, MinNetworkBandwidth: 10}, "network"},
+		{CapabilityQuery{MinCPU: 16, MinEBSThroughput: 1000}, "ebs"},
+		{CapabilityQuery{MinNetworkBandwidth: 25, MinEBSThroughput: 1000}, ""},
+	} {
+		config, ok := s.Query(c.q)
+		if got, want := ok, c.want != ""; got != want {
+			t.Errorf("%+v: got %v, want %v", c.q, got, want)
+			continue
+		}
+		if got, want := config.Type, c.want; got != want {
+			t.Errorf("%+v: got %v, want %v", c.q, got, want)
+		}
+	}
+}
+
+func TestInstanceTypesIO(t *testing.T) {
+	for _, c := range []struct {
+		typ  string
+		gbps float64
+		mbps float64
+	}{
+		{"c5.large", 10, 81.25},
+		{"m4.xlarge", 2, 93.75},
+		{"r4.16xlarge", 25, 1750},
+		{"t2.micro", 0.5, 0},
+	} {
+		config, ok := instanceTypes[c.typ]
+		if !ok {
+			t.Fatalf("unknown instance type %s", c.typ)
+		}
+		if got, want := config.NetworkBandwidth, c.gbps; got != want {
+			t.Errorf("%s: got %v, want %v", c.typ, got, want)
+		}
+		if got, want := config.EBSThroughput, c.mbps; got != want {
+			t.Errorf("%s: got %v, want %v", c.typ, got, want)
+		}
+	}
+	// Capability queries are satisfied by the known instance types.
+	var configs []instanceConfig
+	for _, config := range instanceTypes {
+		configs = append(configs, config)
+	}
+	s := newInstanceState(configs, time.Minute, "us-west-2")
+	config, ok := s.Query(CapabilityQuery{MinNetworkBandwidth: 25, MinEBSThroughput: 1000})
+	if !ok {
+		t.Fatal("no instance type satisfies the query")
+	}
+	if config.NetworkBandwidth < 25 || config.EBSThroughput < 1000 {
+		t.Errorf("%s does not satisfy the query", config.Type)
+	}
+}
+
+func TestLaunchTime(t *testing.T) {
+	launched := time.Now().Add(-time.Hour).Truncate(time.Second)
+	api := newLaunchMockEC2("i-123", "test.example.com")
+	api.DescribeInstancesFunc = func(input *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
+		return &ec2.DescribeInstancesOutput{
+			Reservations: []*ec2.Reservation{{
+				Instances: []*ec2.Instance{{
+					InstanceId:    aws.String("i-123"),
+					PublicDnsName: aws.String("test.example.com"),
+					LaunchTime:    aws.Time(launched),
+				}},
+			}},
+		}, nil
+	}
+	p := &testPool{OffersFunc: func() ([]pool.Offer, error) { return nil, nil }}
+	i := newLaunchTestInstance(api, p)
+	if !i.LaunchTime().IsZero() || i.Uptime() != 0 {
+		t.Errorf("unexpected launch time %v, uptime %v", i.LaunchTime(), i.Uptime())
+	}
+	i.Go(context.Background())
+	if err := i.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := i.LaunchTime(), launched; !got.Equal(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if uptime := i.Uptime(); uptime < time.Hour || uptime > time.Hour+time.Minute {
+		t.Errorf("unexpected uptime %v", uptime)
+	}
+}
+
+func TestMinAvailableTieBreak(t *testing.T) {
+	configs := []instanceConfig{
+		{Type: "a.large", Resources: reflow.Resources{CPU: 8, Memory: 64 << 30}, Price: map[string]float64{"us-west-2": 0.5}, SpotOk: true},
+		{Type: "b.large", Resources: reflow.Resources{CPU: 8, Memory: 60 << 30}, Price: map[string]float64{"us-west-2": 0.5}, SpotOk: true},
+		{Type: "c.large", Resources: reflow.Resources{CPU: 8, Memory: 32 << 30}, Price: map[string]float64{"us-west-2": 0.6}, SpotOk: true},
+	}
+	need := reflow.Resources{CPU: 4, Memory: 16 << 30}
+	s := newInstanceState(configs, time.Minute, "us-west-2")
+	if best, _ := s.MinAvailable(need, true); best.Type != "a.large" {
+		t.Errorf("got %v, want a.large", best.Type)
+	}
+	s.SetTieBreak(preferInterruptionScore(map[string]int{"a.large": 3, "b.large": 0, "c.large": 0}))
+	if best, _ := s.MinAvailable(need, true); best.Type != "b.large" {
+		t.Errorf("got %v, want b.large", best.Type)
+	}
+	// Tie-breaks never override price.
+	s.SetTieBreak(preferInterruptionScore(map[string]int{"a.large": 3, "b.large": 2, "c.large": 0}))
+	if best, _ := s.MinAvailable(need, true); best.Type != "b.large" {
+		t.Errorf("got %v, want b.large", best.Type)
+	}
+	// Types without scores are least preferred.
+	s.SetTieBreak(preferInterruptionScore(map[string]int{"a.large": 3}))
+	if best, _ := s.MinAvailable(need, true); best.Type != "a.large" {
+		t.Errorf("got %v, want a.large", best.Type)
+	}
+}
+
+func TestMaxLifetimeDeadline(t *testing.T) {
+	i := newTestInstance()
+	i.MaxLifetime = 24 * time.Hour
+	i.Deadline = time.Now().Add(time.Hour)
+	calendar := "OnCalendar=" + i.Deadline.UTC().Format("2006-01-02 15:04:05 UTC") + "\n"
+	for _, boot := range []string{bootConfigCloudConfig, bootConfigIgnition} {
+		i.BootConfig = boot
+		ud := renderUserData(t, i)
+		if boot == bootConfigIgnition {
+			ud = strings.Replace(ud, `\n`, "\n", -1)
+		}
+		if !strings.Contains(ud, calendar) {
+			t.Errorf("%s: expected %q, got:\n%s", boot, calendar, ud)
+		}
+		m := regexp.MustCompile(`OnBootSec=([0-9]+)s`).FindStringSubmatch(ud)
+		if m == nil {
+			t.Fatalf("%s: missing OnBootSec:\n%s", boot, ud)
+		}
+		secs, err := strconv.Atoi(m[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if secs > 3600 || secs < 3500 {
+			t.Errorf("%s: lifetime %ds does not respect the deadline", boot, secs)
+		}
+	}
+	// A deadline later than the maximum lifetime does not extend it.
+	i.BootConfig = ""
+	i.MaxLifetime = time.Hour
+	i.Deadline = time.Now().Add(24 * time.Hour)
+	if ud := renderUserData(t, i); !strings.Contains(ud, "OnBootSec=3600s") {
+		t.Errorf("expected maximum lifetime, got:\n%s", ud)
+	}
+	// The deadline alone suffices.
+	i.MaxLifetime = 0
+	if ud := renderUserData(t, i); !strings.Contains(ud, "max-lifetime.timer") {
+		t.Errorf("expected max-lifetime timer, got:\n%s", ud)
+	}
+	i.Deadline = time.Now().Add(-time.Minute)
+	if _, err := i.renderUserData(); !errors.Match(errors.Fatal, err) {
+		t.Errorf("expected fatal error, got %v", err)
+	}
+}
+
+func TestMinAvailableCommitments(t *testing.T) {
+	configs := []instanceConfig{
+		{Type: "m5.2xlarge", Resources: reflow.Resources{CPU: 8, Memory: 32 << 30}, Price: map[string]float64{"us-west-2": 0.384}, SpotOk: true},
+		{Type: "c5.2xlarge", Resources: reflow.Resources{CPU: 8, Memory: 16 << 30}, Price: map[string]float64{"us-west-2": 0.34}, SpotOk: true},
+		{Type: "r5.2xlarge", Resources: reflow.Resources{CPU: 8, Memory: 64 << 30}, Price: map[string]float64{"us-west-2": 0.504}, SpotOk: true},
+	}
+	need := reflow.Resources{CPU: 4, Memory: 8 << 30}
+	s := newInstanceState(configs, time.Minute, "us-west-2")
+	if best, _ := s.MinAvailable(need, false); best.Type != "c5.2xlarge" {
+		t.Errorf("got %v, want c5.2xlarge", best.Type)
+	}
+	// A 20% commitment discount makes the m5 family effectively cheaper.
+	s.SetCommitments(map[string]float64{"m5": 0.2})
+	if best, _ := s.MinAvailable(need, false); best.Type != "m5.2xlarge" {
+		t.Errorf("got %v, want m5.2xlarge", best.Type)
+	}
+	// Type discounts take precedence over family discounts.
+	s.SetCommitments(map[string]float64{"m5": 0.2, "m5.2xlarge": 0.05})
+	if best, _ := s.MinAvailable(need, false); best.Type != "c5.2xlarge" {
+		t.Errorf("got %v, want c5.2xlarge", best.Type)
+	}
+	// Commitments do not apply to spot instances.
+	s.SetCommitments(map[string]float64{"m5": 0.2})
+	if best, _ := s.MinAvailable(need, true); best.Type != "c5.2xlarge" {
+		t.Errorf("got %v, want c5.2xlarge", best.Type)
+	}
+}
+
+func TestUserDataCompressedConfig(t *testing.T) {
+	i := newTestInstance()
+	base := config.Base{}
+	for k := 0; k < 500; k++ {
+		base[fmt.Sprintf("key%d", k)] = strings.Repeat("value ", 10)
+	}
+	i.ReflowConfig = base
+	plain := renderUserData(t, i)
+	i.CompressConfig = true
+	ud := renderUserData(t, i)
+	if len(ud) >= len(plain)/4 {
+		t.Errorf("compressed user data is %d bytes, plaintext %d bytes", len(ud), len(plain))
+	}
+	var cloudConfig struct {
+		WriteFiles []struct {
+			Path    string
+			Content string
+		} `yaml:"write_files"`
+	}
+	if err := yaml.Unmarshal([]byte(ud), &cloudConfig); err != nil {
+		t.Fatalf("invalid user data: %v\n%s", err, ud)
+	}
+	var content string
+	for _, f := range cloudConfig.WriteFiles {
+		switch f.Path {
+		case "/etc/reflowconfig":
+			t.Error("plaintext configuration embedded in user data")
+		case "/etc/reflowconfig.gz.b64":
+			content = f.Content
+		}
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make(config.Keys)
+	if err := yaml.Unmarshal(b, keys); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(keys), len(base); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for _, want := range []string{
+		"Description=Decompress the Reflow configuration",
+		"base64 -d /etc/reflowconfig.gz.b64 | gunzip > /etc/reflowconfig",
+		"Requires=reflowconfig.service",
+	} {
+		if !strings.Contains(ud, want) {
+			t.Errorf("expected %q in user data", want)
+		}
+	}
+}
+
+func TestInstanceAddress(t *testing.T) {
+	for _, c := range []struct {
+		inst    ec2.Instance
+		private bool
+		want    string
+	}{
+		{ec2.Instance{PublicDnsName: aws.String("ec2-1-2-3-4.compute.amazonaws.com"), PublicIpAddress: aws.String("1.2.3.4")}, false, "ec2-1-2-3-4.compute.amazonaws.com"},
+		{ec2.Instance{PublicDnsName: aws.String(""), PublicIpAddress: aws.String("1.2.3.4"), PrivateDnsName: aws.String("ip-10-0-0-1.internal")}, true, "1.2.3.4"},
+		{ec2.Instance{PublicDnsName: aws.String(""), PrivateDnsName: aws.String("ip-10-0-0-1.internal"), PrivateIpAddress: aws.String("10.0.0.1")}, false, ""},
+		{ec2.Instance{PublicDnsName: aws.String(""), PrivateDnsName: aws.String("ip-10-0-0-1.internal"), PrivateIpAddress: aws.String("10.0.0.1")}, true, "ip-10-0-0-1.internal"},
+		{ec2.Instance{PrivateIpAddress: aws.String("10.0.0.1")}, true, "10.0.0.1"},
+	} {
+		if got, want := instanceAddress(&c.inst, c.private), c.want; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestUserDataPrePullImages(t *testing.T) {
+	i := newTestInstance()
+	if ud := renderUserData(t, i); strings.Contains(ud, "prepull.service") {
+		t.Errorf("unexpected pre-pull unit:\n%s", ud)
+	}
+	images := []string{
+		"ubuntu:16.04",
+		"grailbio/base@sha256:b630fb29d99b3483c73a2a7db5fc01a967392a3d7ad754c8eccf9f4a67e7ee31",
+	}
+	i.PrePullImages = images
+	for _, boot := range []string{bootConfigCloudConfig, bootConfigIgnition} {
+		i.BootConfig = boot
+		ud := renderUserData(t, i)
+		if boot == bootConfigIgnition {
+			ud = strings.Replace(ud, `\n`, "\n", -1)
+		}
+		for _, want := range []string{
+			"prepull.service",
+			"until /usr/bin/docker inspect reflowlet.service",
+			"ExecStart=-/usr/bin/timeout 600 /usr/bin/docker pull " + images[0] + "\n",
+			"ExecStart=-/usr/bin/timeout 600 /usr/bin/docker pull " + images[1] + "\n",
+		} {
+			if !strings.Contains(ud, want) {
+				t.Errorf("%s: expected %q, got:\n%s", boot, want, ud)
+			}
+		}
+	}
+	i.BootConfig = ""
+	i.PrePullImages = []string{"ubuntu; rm -rf /"}
+	if _, err := i.renderUserData(); !errors.Match(errors.Fatal, err) {
+		t.Errorf("expected fatal error, got %v", err)
+	}
+}
+
+func TestUserDataDataFilesystem(t *testing.T) {
+	i := newTestInstance()
+	ud := renderUserData(t, i)
+	for _, want := range []string{
+		"ExecStart=/usr/sbin/mkfs.ext4 -F /dev/xvdb\n",
+		"Type=ext4\n",
+		"Options=data=writeback\n",
+	} {
+		if !strings.Contains(ud, want) {
+			t.Errorf("expected %q, got:\n%s", want, ud)
+		}
+	}
+	i.DataFilesystem = "xfs"
+	i.DataMountOptions = "noatime,nobarrier"
+	for _, boot := range []string{bootConfigCloudConfig, bootConfigIgnition} {
+		i.BootConfig = boot
+		ud := renderUserData(t, i)
+		if boot == bootConfigIgnition {
+			ud = strings.Replace(ud, `\n`, "\n", -1)
+		}
+		for _, want := range []string{
+			"ExecStart=/usr/sbin/mkfs.xfs -f /dev/xvdb\n",
+			"Type=xfs\n",
+			"Options=noatime,nobarrier\n",
+		} {
+			if !strings.Contains(ud, want) {
+				t.Errorf("%s: expected %q, got:\n%s", boot, want, ud)
+			}
+		}
+		if strings.Contains(ud, "mkfs.ext4 -F /dev/xvdb") || strings.Contains(ud, "data=writeback") {
+			t.Errorf("%s: unexpected ext4 configuration:\n%s", boot, ud)
+		}
+	}
+	i.BootConfig = ""
+	i.DataFilesystem = "btrfs"
+	if _, err := i.renderUserData(); !errors.Match(errors.Fatal, err) {
+		t.Errorf("expected fatal error, got %v", err)
+	}
+}
+
+func TestCapacityProbeTimeout(t *testing.T) {
+	// The SDK reports timeouts as canceled requests.
+	for _, timeout := range []error{
+		awserr.New(request.CanceledErrorCode, "request context canceled", context.DeadlineExceeded),
+		context.DeadlineExceeded,
+	} {
+		api := &mockEC2{
+			RunInstancesFunc: func(input *ec2.RunInstancesInput) (*ec2.Reservation, error) {
+				if !aws.BoolValue(input.DryRun) {
+					t.Error("expected dry run")
+				}
+				return nil, timeout
+			},
+		}
+		i := newTestInstance()
+		i.EC2 = api
+		i.Config = instanceConfig{Type: "m4.xlarge"}
+		ctx := context.Background()
+		// By default, a timeout means that capacity is exhausted.
+		ok, err := i.ec2HasCapacity(ctx, 1)
+		if err != nil {
+			t.Fatalf("%v: %v", timeout, err)
+		}
+		if ok {
+			t.Error("expected no capacity")
+		}
+		// Otherwise, the probe is inconclusive and should be retried.
+		i.CapacityTimeoutRetry = true
+		ok, err = i.ec2HasCapacity(ctx, 1)
+		if !errors.Match(errors.Temporary, err) {
+			t.Errorf("%v: expected temporary error, got %v", timeout, err)
+		}
+		if ok {
+			t.Error("expected no capacity")
+		}
+	}
+	// Other canceled requests are not timeouts.
+	api := &mockEC2{
+		RunInstancesFunc: func(input *ec2.RunInstancesInput) (*ec2.Reservation, error) {
+			return nil, awserr.New(request.CanceledErrorCode, "request context canceled", context.Canceled)
+		},
+	}
+	i := newTestInstance()
+	i.EC2 = api
+	i.Config = instanceConfig{Type: "m4.xlarge"}
+	i.CapacityTimeoutRetry = true
+	if _, err := i.ec2HasCapacity(context.Background(), 1); err == nil || errors.Match(errors.Temporary, err) {
+		t.Errorf("expected non-temporary error, got %v", err)
+	}
+}
+
+func TestMultipleReflowlets(t *testing.T) {
+	i := newTestInstance()
+	i.Config = instanceConfig{Type: "x1.32xlarge", Resources: reflow.Resources{CPU: 128, Memory: 1 << 40}}
+	i.Reflowlets = 2
+	i.ReflowletCPUFraction = 0.5
+	for _, boot := range []string{bootConfigCloudConfig, bootConfigIgnition} {
+		i.BootConfig = boot
+		ud := renderUserData(t, i)
+		if boot == bootConfigIgnition {
+			ud = strings.Replace(ud, `\n`, "\n", -1)
+		}
+		for _, want := range []string{
+			"reflowlet.service",
+			"-config /host/etc/reflowconfig -addr :9000 -share 0.5000\n",
+			"reflowlet-1.service",
+			"-config /host/etc/reflowconfig -addr :9001 -share 0.5000 -dir /mnt/data/reflow-1\n",
+			"--cpus=32.00",
+		} {
+			if !strings.Contains(ud, want) {
+				t.Errorf("%s: expected %q, got:\n%s", boot, want, ud)
+			}
+		}
+		// The instance is powered off only once every reflowlet has
+		// exited.
+		if strings.Contains(ud, "OnFailure=poweroff.target") {
+			t.Errorf("%s: reflowlet powers off the instance:\n%s", boot, ud)
+		}
+		if got, want := strings.Count(ud, "OnFailure=reflowlet-exit.service"), 2; got != want {
+			t.Errorf("%s: got %v, want %v", boot, got, want)
+		}
+		if want := "for u in reflowlet.service reflowlet-1.service; do"; !strings.Contains(ud, want) {
+			t.Errorf("%s: expected %q, got:\n%s", boot, want, ud)
+		}
+	}
+	// A lone reflowlet powers off the instance directly.
+	i.Reflowlets = 1
+	for _, boot := range []string{bootConfigCloudConfig, bootConfigIgnition} {
+		i.BootConfig = boot
+		ud := renderUserData(t, i)
+		if got, want := strings.Count(ud, "OnFailure=poweroff.target"), 1; got != want {
+			t.Errorf("%s: got %v, want %v", boot, got, want)
+		}
+		if strings.Contains(ud, "reflowlet-exit") {
+			t.Errorf("%s: unexpected reflowlet-exit unit:\n%s", boot, ud)
+		}
+	}
+	i.Reflowlets = 2
+	i.BootConfig = ""
+	var config struct {
+		Coreos struct {
+			Units []struct{ Name string }
+		}
+	}
+	if err := yaml.Unmarshal([]byte(renderUserData(t, i)), &config); err != nil {
+		t.Fatalf("invalid cloud-config: %v", err)
+	}
+
+	// The instance is ready only once both reflowlets are.
+	var (
+		dialed []string
+		ready  = map[string]bool{"https://test.example.com:9000/v1/": true}
+	)
+	api := newLaunchMockEC2("i-123", "test.example.com")
+	api.TerminateInstancesFunc = func(input *ec2.TerminateInstancesInput) (*ec2.TerminateInstancesOutput, error) {
+		return &ec2.TerminateInstancesOutput{}, nil
+	}
+	i = newLaunchTestInstance(api, nil)
+	i.Reflowlets = 2
+	i.ReadyTimeout = 100 * time.Millisecond
+	i.dialPool = func(baseurl string) (pool.Pool, error) {
+		dialed = append(dialed, baseurl)
+		return &testPool{OffersFunc: func() ([]pool.Offer, error) {
+			if !ready[baseurl] {
+				return nil, errors.New("reflowlet is not running")
+			}
+			return nil, nil
+		}}, nil
+	}
+	i.Go(context.Background())
+	if i.Err() == nil {
+		t.Fatal("expected error")
+	}
+	ready["https://test.example.com:9001/v1/"] = true
+	dialed = nil
+	dial := i.dialPool
+	i = newLaunchTestInstance(api, nil)
+	i.Reflowlets = 2
+	i.dialPool = dial
+	i.Go(context.Background())
+	if err := i.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(dialed, ","), "https://test.example.com:9000/v1/,https://test.example.com:9001/v1/"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestUserDataSkipFormat(t *testing.T) {
+	i := newTestInstance()
+	i.SkipFormat = true
+	for _, boot := range []string{bootConfigCloudConfig, bootConfigIgnition} {
+		i.BootConfig = boot
+		ud := renderUserData(t, i)
+		if boot == bootConfigIgnition {
+			ud = strings.Replace(ud, `\n`, "\n", -1)
+		}
+		for _, unwanted := range []string{"format-xvdb.service", "wipefs", "mkfs"} {
+			if strings.Contains(ud, unwanted) {
+				t.Errorf("%s: unexpected %q:\n%s", boot, unwanted, ud)
+			}
+		}
+		for _, want := range []string{
+			"mnt-data.mount",
+			"Requires=dev-xvdb.device\n",
+			"What=/dev/xvdb\n",
+			"Type=ext4\n",
+		} {
+			if !strings.Contains(ud, want) {
+				t.Errorf("%s: expected %q, got:\n%s", boot, want, ud)
+			}
+		}
+	}
+	i.BootConfig = ""
+	var config struct {
+		Coreos struct {
+			Units []struct{ Name, Content string }
+		}
+	}
+	if err := yaml.Unmarshal([]byte(renderUserData(t, i)), &config); err != nil {
+		t.Fatalf("invalid cloud-config: %v", err)
+	}
+	for _, unit := range config.Coreos.Units {
+		if unit.Name == "mnt-data.mount" && !strings.HasPrefix(unit.Content, "[Unit]\nAfter=dev-xvdb.device\n") {
+			t.Errorf("unexpected mount unit:\n%s", unit.Content)
+		}
+	}
+}
+
+func TestLaunchError(t *testing.T) {
+	fatal := errors.E(errors.Fatal, errors.New("failed"))
+	for _, c := range []struct {
+		phase LaunchPhase
+		id    string
+		fail  func(api *mockEC2, i *instance)
+	}{
+		{PhaseCapacity, "", func(api *mockEC2, i *instance) {
+			i.Spot = true
+			api.RunInstancesFunc = func(input *ec2.RunInstancesInput) (*ec2.Reservation, error) {
+				return nil, awserr.New("InsufficientInstanceCapacity", "no capacity", nil)
+			}
+		}},
+		{PhaseLaunch, "", func(api *mockEC2, i *instance) {
+			api.RunInstancesFunc = func(input *ec2.RunInstancesInput) (*ec2.Reservation, error) {
+				return nil, fatal
+			}
+		}},
+		{PhaseWait, "i-123", func(api *mockEC2, i *instance) {
+			api.WaitUntilInstanceRunningFunc = func(ctx aws.Context, input *ec2.DescribeInstancesInput) error {
+				return fatal
+			}
+		}},
+		{PhaseDescribe, "i-123", func(api *mockEC2, i *instance) {
+			api.DescribeInstancesFunc = func(input *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
+				return nil, fatal
+			}
+		}},
+		{PhasePostLaunch, "i-123", func(api *mockEC2, i *instance) {
+			i.PostLaunch = func(ctx context.Context, inst *ec2.Instance) error { return fatal }
+			api.TerminateInstancesFunc = func(input *ec2.TerminateInstancesInput) (*ec2.TerminateInstancesOutput, error) {
+				return &ec2.TerminateInstancesOutput{}, nil
+			}
+		}},
+		{PhaseElasticIP, "i-123", func(api *mockEC2, i *instance) {
+			i.ElasticIP = true
+			api.AllocateAddressFunc = func(input *ec2.AllocateAddressInput) (*ec2.AllocateAddressOutput, error) {
+				return nil, fatal
+			}
+		}},
+		{PhaseTargetGroup, "i-123", func(api *mockEC2, i *instance) {
+			// Registration requires an ELBV2 client.
+			i.TargetGroupARN = "arn:tg"
+		}},
+		{PhaseOffers, "i-123", func(api *mockEC2, i *instance) {
+			i.ReadyTimeout = 100 * time.Millisecond
+			api.TerminateInstancesFunc = func(input *ec2.TerminateInstancesInput) (*ec2.TerminateInstancesOutput, error) {
+				return &ec2.TerminateInstancesOutput{}, nil
+			}
+		}},
+	} {
+		p := &testPool{OffersFunc: func() ([]pool.Offer, error) {
+			if c.phase == PhaseOffers {
+				return nil, errors.New("reflowlet is not running")
+			}
+			return nil, nil
+		}}
+		api := newLaunchMockEC2("i-123", "test.example.com")
+		i := newLaunchTestInstance(api, p)
+		c.fail(api, i)
+		i.Go(context.Background())
+		if i.Err() == nil {
+			t.Errorf("%s: expected error", c.phase)
+			continue
+		}
+		lerr := i.LaunchError()
+		if lerr == nil {
+			t.Errorf("%s: expected launch error", c.phase)
+			continue
+		}
+		if got, want := lerr.Phase, c.phase; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		if got, want := lerr.InstanceID, c.id; got != want {
+			t.Errorf("%s: got %v, want %v", c.phase, got, want)
+		}
+		if lerr.Err != i.Err() {
+			t.Errorf("%s: got %v, want %v", c.phase, lerr.Err, i.Err())
+		}
+	}
+
+	// Successful launches have no launch errors.
+	i := newLaunchTestInstance(newLaunchMockEC2("i-123", "test.example.com"),
+		&testPool{OffersFunc: func() ([]pool.Offer, error) { return nil, nil }})
+	i.Go(context.Background())
+	if err := i.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if lerr := i.LaunchError(); lerr != nil {
+		t.Errorf("unexpected launch error %v", lerr)
+	}
+}
+
+func TestPriceDiff(t *testing.T) {
+	before := newInstanceState([]instanceConfig{
+		{Type: "small", Price: map[string]float64{"us-west-2": 0.1, "us-east-1": 0.2}},
+		{Type: "medium", Price: map[string]float64{"us-west-2": 0.4}},
+		{Type: "large", Price: map[string]float64{"us-west-2": 0.8}},
+	}, time.Minute, "us-west-2")
+	after := newInstanceState([]instanceConfig{
+		{Type: "small", Price: map[string]float64{"us-west-2": 0.1, "us-east-1": 0.3}},
+		{Type: "medium", Price: map[string]float64{"us-west-2": 0.35}},
+		{Type: "xlarge", Price: map[string]float64{"us-west-2": 1.6}},
+	}, time.Minute, "us-west-2")
+	diff := before.PriceDiff(after)
+	want := map[string][2]float64{
+		"medium": {0.4, 0.35},
+		"large":  {0.8, 0},
+		"xlarge": {0, 1.6},
+	}
+	if !reflect.DeepEqual(diff, want) {
+		t.Errorf("got %v, want %v", diff, want)
+	}
+	if diff := before.PriceDiff(before); len(diff) != 0 {
+		t.Errorf("unexpected diff %v", diff)
+	}
+}
+
+func TestCheapestN(t *testing.T) {
+	configs := []instanceConfig{
+		{Type: "small", Resources: reflow.Resources{CPU: 2, Memory: 4 << 30}, Price: map[string]float64{"us-west-2": 0.1}},
+		{Type: "medium", Resources: reflow.Resources{CPU: 8, Memory: 32 << 30}, Price: map[string]float64{"us-west-2": 0.4}},
+		{Type: "large", Resources: reflow.Resources{CPU: 16, Memory: 64 << 30}, Price: map[string]float64{"us-west-2": 0.8}},
+	}
+	s := newInstanceState(configs, time.Minute, "us-west-2")
+	types := func(configs []instanceConfig) string {
+		var types []string
+		for _, config := range configs {
+			types = append(types, config.Type)
+		}
+		return strings.Join(types, ",")
+	}
+	need := reflow.Resources{CPU: 2, Memory: 4 << 30}
+	if got, want := types(s.CheapestN(need, false, -1)), "small,medium,large"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := types(s.CheapestN(need, false, 2)), "small,medium"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := types(s.CheapestN(reflow.Resources{CPU: 8}, false, -1)), "medium,large"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	s.Unavailable(configs[1])
+	if got, want := types(s.CheapestN(need, false, 2)), "small,large"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestMaxLaunchesPerType(t *testing.T) {
+	configs := []instanceConfig{
+		{Type: "small", Resources: reflow.Resources{CPU: 2, Memory: 4 << 30}, Price: map[string]float64{"us-west-2": 0.1}},
+		{Type: "medium", Resources: reflow.Resources{CPU: 8, Memory: 32 << 30}, Price: map[string]float64{"us-west-2": 0.4}},
+		{Type: "large", Resources: reflow.Resources{CPU: 16, Memory: 64 << 30}, Price: map[string]float64{"us-west-2": 0.8}},
+	}
+	c := &Cluster{instanceState: newInstanceState(configs, time.Minute, "us-west-2")}
+	need := reflow.Resources{CPU: 2, Memory: 4 << 30}
+	launching := make(map[string]int)
+	// Without a cap, all demand goes to the cheapest type.
+	for n := 0; n < 3; n++ {
+		if best, ok := c.cheapest(need, launching); !ok || best.Type != "small" {
+			t.Errorf("got %v, want small", best.Type)
+		}
+	}
+
+	// Excess demand spills over to the next-cheapest types.
+	c.MaxLaunchesPerType = 2
+	var types []string
+	for {
+		best, ok := c.cheapest(need, launching)
+		if !ok {
+			break
+		}
+		types = append(types, best.Type)
+		launching[best.Type]++
+	}
+	if got, want := strings.Join(types, ","), "small,small,medium,medium,large,large"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// Capacity is released as launches complete.
+	launching["medium"]--
+	if best, ok := c.cheapest(need, launching); !ok || best.Type != "medium" {
+		t.Errorf("got %v, want medium", best.Type)
+	}
+}
+
+func TestMinAvailableExplain(t *testing.T) {
+	configs := []instanceConfig{
+		{Type: "small", Resources: reflow.Resources{CPU: 2, Memory: 4 << 30}, Price: map[string]float64{"us-west-2": 0.1}, SpotOk: true},
+		{Type: "medium", Resources: reflow.Resources{CPU: 8, Memory: 32 << 30}, Price: map[string]float64{"us-west-2": 0.4}, SpotOk: true},
+		{Type: "gpu", Resources: reflow.Resources{CPU: 8, Memory: 32 << 30}, Price: map[string]float64{"us-west-2": 0.9}},
+		{Type: "large", Resources: reflow.Resources{CPU: 16, Memory: 64 << 30}, Price: map[string]float64{"us-west-2": 0.8}, SpotOk: true},
+		{Type: "xlarge", Resources: reflow.Resources{CPU: 32, Memory: 128 << 30}, Price: map[string]float64{"us-west-2": 1.6}, SpotOk: true},
+		{Type: "elsewhere", Resources: reflow.Resources{CPU: 32, Memory: 128 << 30}, Price: map[string]float64{"us-east-1": 1.6}, SpotOk: true},
+	}
+	s := newInstanceState(configs, time.Minute, "us-west-2")
+	s.Unavailable(configs[1])
+	best, rationale, ok := s.MinAvailableExplain(reflow.Resources{CPU: 4, Memory: 8 << 30}, true)
+	if !ok {
+		t.Fatal("expected an instance type")
+	}
+	if got, want := best.Type, "large"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := rationale.Reason, "large is the cheapest available spot-eligible type that satisfies mem 8589934592 cpu 4 disk 0"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	reasons := make(map[string]string)
+	for _, skipped := range rationale.Skipped {
+		reasons[skipped.Type] = skipped.Reason
+	}
+	for typ, want := range map[string]string{
+		"small":     "insufficient resources: memory: need 8.0GiB, have 4.0GiB; cpu: need 4, have 2",
+		"medium":    "cooling down after being unavailable",
+		"gpu":       "not spot-eligible",
+		"xlarge":    "costlier than large ($1.6000 vs $0.8000)",
+		"elsewhere": "no price in region us-west-2",
+	} {
+		if got := reasons[typ]; got != want {
+			t.Errorf("%s: got %q, want %q", typ, got, want)
+		}
+	}
+	if _, ok := reasons["large"]; ok {
+		t.Error("chosen type should not be skipped")
+	}
+	if got, want := len(rationale.Skipped), 5; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if !strings.Contains(rationale.String(), "skipped: ") {
+		t.Errorf("expected skipped types in %q", rationale)
+	}
+	// MinAvailable agrees.
+	if config, ok := s.MinAvailable(reflow.Resources{CPU: 4, Memory: 8 << 30}, true); !ok || config.Type != best.Type {
+		t.Errorf("got %v, want %v", config.Type, best.Type)
+	}
+
+	// Needs that cannot be satisfied select the largest type.
+	best, rationale, _ = s.MinAvailableExplain(reflow.Resources{CPU: 64}, true)
+	if got, want := best.Type, "xlarge"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := rationale.Reason, "no available spot-eligible type satisfies mem 0 cpu 64 disk 0; xlarge is the largest available type"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestPostLaunch(t *testing.T) {
+	api := newLaunchMockEC2("i-123", "test.example.com")
+	var terminated []string
+	api.TerminateInstancesFunc = func(input *ec2.TerminateInstancesInput) (*ec2.TerminateInstancesOutput, error) {
+		terminated = append(terminated, aws.StringValueSlice(input.InstanceIds)...)
+		return &ec2.TerminateInstancesOutput{}, nil
+	}
+	i := newLaunchTestInstance(api, &testPool{OffersFunc: func() ([]pool.Offer, error) { return nil, nil }})
+	var called string
+	i.PostLaunch = func(ctx context.Context, inst *ec2.Instance) error {
+		called = aws.StringValue(inst.InstanceId)
+		return errors.New("not registered")
+	}
+	i.Go(context.Background())
+	if got, want := called, "i-123"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if !errors.Match(errors.Fatal, i.Err()) {
+		t.Errorf("expected fatal error, got %v", i.Err())
+	}
+	if got, want := terminated, []string{"i-123"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// A successful hook does not interfere with the launch.
+	terminated = nil
+	i = newLaunchTestInstance(api, &testPool{OffersFunc: func() ([]pool.Offer, error) { return nil, nil }})
+	i.PostLaunch = func(ctx context.Context, inst *ec2.Instance) error { return nil }
+	i.Go(context.Background())
+	if err := i.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(terminated) != 0 {
+		t.Errorf("unexpected terminations: %v", terminated)
+	}
+}
+
+func TestNodeExporterStop(t *testing.T) {
+	directives := []string{
+		"PartOf=reflowlet.service",
+		"Conflicts=poweroff.target",
+		"Before=poweroff.target",
+	}
+	i := newTestInstance()
+	ud := renderUserData(t, i)
+	start := strings.Index(ud, `name: "node-exporter.service"`)
+	if start < 0 {
+		t.Fatalf("missing node-exporter unit:\n%s", ud)
+	}
+	unit := ud[start:]
+	unit = unit[:strings.Index(unit, "[Service]")]
+	for _, d := range directives {
+		if !strings.Contains(unit, "      "+d+"\n") {
+			t.Errorf("node-exporter unit: expected %q, got:\n%s", d, unit)
+		}
+	}
+
+	i.BootConfig = bootConfigIgnition
+	b, err := i.renderUserData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config ignitionConfig
+	if err := json.Unmarshal(b, &config); err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range config.Systemd.Units {
+		if u.Name != "node-exporter.service" {
+			continue
+		}
+		unit := u.Contents[:strings.Index(u.Contents, "[Service]")]
+		for _, d := range directives {
+			if !strings.Contains(unit, d+"\n") {
+				t.Errorf("node-exporter unit: expected %q, got:\n%s", d, unit)
+			}
+		}
+		return
+	}
+	t.Error("missing node-exporter unit")
+}
+
+func TestNodeExporterPartOfReflowlets(t *testing.T) {
+	const want = "PartOf=reflowlet.service reflowlet-1.service reflowlet-2.service\n"
+	i := newTestInstance()
+	i.Reflowlets = 3
+	ud := renderUserData(t, i)
+	start := strings.Index(ud, `name: "node-exporter.service"`)
+	if start < 0 {
+		t.Fatalf("missing node-exporter unit:\n%s", ud)
+	}
+	if unit := ud[start:]; !strings.Contains(unit[:strings.Index(unit, "[Service]")], "      "+want) {
+		t.Errorf("node-exporter unit: expected %q, got:\n%s", want, unit)
+	}
+
+	i.BootConfig = bootConfigIgnition
+	b, err := i.renderUserData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config ignitionConfig
+	if err := json.Unmarshal(b, &config); err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range config.Systemd.Units {
+		if u.Name == "node-exporter.service" {
+			if !strings.Contains(u.Contents, want) {
+				t.Errorf("node-exporter unit: expected %q, got:\n%s", want, u.Contents)
+			}
+			return
+		}
+	}
+	t.Error("missing node-exporter unit")
+}
+
+func TestUserDataSshCA(t *testing.T) {
+	const caKey = "ssh-rsa AAAACA ca@example.com"
+	i := newTestInstance()
+	ud := renderUserData(t, i)
+	if strings.Contains(ud, "TrustedUserCAKeys") {
+		t.Errorf("unexpected CA configuration:\n%s", ud)
+	}
+
+	i.SshCAKey = caKey
+	ud = renderUserData(t, i)
+	for _, want := range []string{
+		`path: "/etc/ssh/trusted-user-ca-keys.pem"`,
+		`content: "` + caKey + `\n"`,
+		`path: "/etc/ssh/sshd_config"`,
+		`TrustedUserCAKeys /etc/ssh/trusted-user-ca-keys.pem\n`,
+		"ssh-authorized-keys:\n  - ssh-rsa test",
+	} {
+		if !strings.Contains(ud, want) {
+			t.Errorf("expected %q, got:\n%s", want, ud)
+		}
+	}
+
+	// Static keys are optional when a CA is trusted.
+	i.SshKey = ""
+	ud = renderUserData(t, i)
+	if strings.Contains(ud, "ssh-authorized-keys") {
+		t.Errorf("unexpected authorized keys:\n%s", ud)
+	}
+
+	i.BootConfig = bootConfigIgnition
+	b, err := i.renderUserData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config ignitionConfig
+	if err := json.Unmarshal(b, &config); err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	for _, f := range config.Storage.Files {
+		contents, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(f.Contents.Source, "data:;base64,"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Path] = string(contents)
+	}
+	if got, want := files["/etc/ssh/trusted-user-ca-keys.pem"], caKey+"\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if !strings.Contains(files["/etc/ssh/sshd_config"], "TrustedUserCAKeys /etc/ssh/trusted-user-ca-keys.pem\n") {
+		t.Errorf("missing CA configuration: %q", files["/etc/ssh/sshd_config"])
+	}
+	if len(config.Passwd.Users) != 0 {
+		t.Errorf("unexpected users: %v", config.Passwd.Users)
+	}
+}
+
+func TestMinAvailableWarm(t *testing.T) {
+	configs := []instanceConfig{
+		{Type: "cheap", Resources: reflow.Resources{CPU: 8, Memory: 32 << 30}, Price: map[string]float64{"us-west-2": 1.00}},
+		{Type: "warm", Resources: reflow.Resources{CPU: 8, Memory: 30 << 30}, Price: map[string]float64{"us-west-2": 1.04}},
+		{Type: "pricey", Resources: reflow.Resources{CPU: 16, Memory: 64 << 30}, Price: map[string]float64{"us-west-2": 2.00}},
+	}
+	need := reflow.Resources{CPU: 4, Memory: 16 << 30}
+	s := newInstanceState(configs, time.Minute, "us-west-2")
+	if best, ok := s.MinAvailable(need, false); !ok || best.Type != "cheap" {
+		t.Fatalf("got %v, want cheap", best.Type)
+	}
+
+	s.SetWarm([]string{"warm", "pricey"}, 0.05)
+	best, rationale, ok := s.MinAvailableExplain(need, false)
+	if !ok {
+		t.Fatal("expected an instance type")
+	}
+	if got, want := best.Type, "warm"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if !strings.HasPrefix(rationale.Reason, "warm is the cheapest warm on-demand type") {
+		t.Errorf("unexpected reason %q", rationale.Reason)
+	}
+	for _, skipped := range rationale.Skipped {
+		if skipped.Type == "cheap" && !strings.HasPrefix(skipped.Reason, "not warm") {
+			t.Errorf("unexpected reason %q", skipped.Reason)
+		}
+	}
+
+	// Warm types beyond the tolerance are not preferred.
+	s.SetWarm([]string{"warm", "pricey"}, 0.01)
+	if best, _ := s.MinAvailable(need, false); best.Type != "cheap" {
+		t.Errorf("got %v, want cheap", best.Type)
+	}
+	// Nor are warm types that do not satisfy the need.
+	s.SetWarm([]string{"warm"}, 0.05)
+	if best, _ := s.MinAvailable(reflow.Resources{CPU: 4, Memory: 31 << 30}, false); best.Type != "cheap" {
+		t.Errorf("got %v, want cheap", best.Type)
+	}
+}
+
+func TestMinOffers(t *testing.T) {
+	defer func(d time.Duration) { retryDelay = d }(retryDelay)
+	retryDelay = time.Millisecond
+	const gib = 1 << 30
+	var (
+		n      int
+		offers = [][]pool.Offer{
+			{},
+			{testOffer{available: reflow.Resources{Memory: 4 * gib, CPU: 1}}},
+			{testOffer{available: reflow.Resources{Memory: 4 * gib, CPU: 1}}, testOffer{available: reflow.Resources{Memory: 4 * gib, CPU: 1}}},
+			{testOffer{available: reflow.Resources{Memory: 12 * gib, CPU: 3}}, testOffer{available: reflow.Resources{Memory: 4 * gib, CPU: 1}}},
+		}
+	)
+	p := &testPool{OffersFunc: func() ([]pool.Offer, error) {
+		o := offers[n]
+		if n < len(offers)-1 {
+			n++
+		}
+		return o, nil
+	}}
+	i := newLaunchTestInstance(newLaunchMockEC2("i-123", "test.example.com"), p)
+	i.MinOffers = 2
+	i.MinOfferResources = reflow.Resources{Memory: 16 * gib, CPU: 4}
+	i.Go(context.Background())
+	if err := i.Err(); err != nil {
+		t.Fatal(err)
+	}
+	// The instance is ready only once both the count and the resource
+	// thresholds are met.
+	if got, want := n, 3; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Insufficient offers eventually fail the launch.
+	n = 0
+	offers = offers[:1]
+	i = newLaunchTestInstance(newLaunchMockEC2("i-123", "test.example.com"), p)
+	i.MinOffers = 1
+	i.Go(context.Background())
+	if err := i.Err(); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestRootEBSSize(t *testing.T) {
+	rootSize := func(mappings []*ec2.BlockDeviceMapping) int64 {
+		for _, m := range mappings {
+			if aws.StringValue(m.DeviceName) == "/dev/xvda" {
+				return aws.Int64Value(m.Ebs.VolumeSize)
+			}
+		}
+		t.Fatalf("missing root device mapping: %v", mappings)
+		return 0
+	}
+	api := newLaunchMockEC2("i-123", "test.example.com")
+	var mappings []*ec2.BlockDeviceMapping
+	api.RunInstancesFunc = func(in *ec2.RunInstancesInput) (*ec2.Reservation, error) {
+		mappings = in.BlockDeviceMappings
+		return &ec2.Reservation{Instances: []*ec2.Instance{{InstanceId: aws.String("i-123")}}}, nil
+	}
+	api.RequestSpotInstancesFunc = func(in *ec2.RequestSpotInstancesInput) (*ec2.RequestSpotInstancesOutput, error) {
+		mappings = in.LaunchSpecification.BlockDeviceMappings
+		return nil, awserr.New("InvalidParameterValue", "stop here", nil)
+	}
+	api.DescribeImagesFunc = func(in *ec2.DescribeImagesInput) (*ec2.DescribeImagesOutput, error) {
+		return &ec2.DescribeImagesOutput{Images: []*ec2.Image{{
+			ImageId:        in.ImageIds[0],
+			RootDeviceName: aws.String("/dev/xvda"),
+			BlockDeviceMappings: []*ec2.BlockDeviceMapping{{
+				DeviceName: aws.String("/dev/xvda"),
+				Ebs:        &ec2.EbsBlockDevice{VolumeSize: aws.Int64(300)},
+			}},
+		}}}, nil
+	}
+	ctx := context.Background()
+
+	i := newLaunchTestInstance(api, nil)
+	if _, err := i.launch(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := rootSize(mappings), int64(200); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	for _, spot := range []bool{false, true} {
+		mappings = nil
+		i := newLaunchTestInstance(api, nil)
+		i.Spot = spot
+		i.RootEBSSize = 400
+		i.launch(ctx)
+		if got, want := rootSize(mappings), int64(400); got != want {
+			t.Errorf("spot %v: got %v, want %v", spot, got, want)
+		}
+		// The data volume is unaffected.
+		if got, want := aws.StringValue(mappings[1].DeviceName), "/dev/xvdb"; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		if got, want := aws.Int64Value(mappings[1].Ebs.VolumeSize), int64(i.EBSSize); got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+
+	// Root volumes smaller than the AMI's snapshot are rejected
+	// before launch.
+	mappings = nil
+	i = newLaunchTestInstance(api, nil)
+	i.RootEBSSize = 100
+	if _, err := i.launch(ctx); !errors.Match(errors.Fatal, err) {
+		t.Errorf("expected fatal error, got %v", err)
+	}
+	if mappings != nil {
+		t.Error("unexpected launch request")
+	}
+}
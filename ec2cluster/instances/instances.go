@@ -8,6 +8,8 @@ type Type struct {
 	Name string
 	// EBSOptimized is set to true if the instance type permits EBS optimization.
 	EBSOptimized bool
+	// EBSOptimizedByDefault is set to true if the instance type is EBS optimized by default.
+	EBSOptimizedByDefault bool
 	// VCPU stores the number of VCPUs provided by this instance type.
 	VCPU uint
 	// Memory stores the number of (fractional) GiB of memory provided by this instance type.
@@ -20,15 +22,20 @@ type Type struct {
 	Virt string
 	// NVMe specifies whether EBS block devices are exposed as NVMe volumes.
 	NVMe bool
+	// NetworkPerformance stores the network performance of this instance type, e.g., "High" or "10 Gigabit".
+	NetworkPerformance string
+	// EBSThroughput stores the baseline EBS throughput of this instance type, in MB/s.
+	EBSThroughput float64
 }
 
 // Types stores known EC2 instance types.
 var Types = []Type{
 	{
-		Name:         "cc2.8xlarge",
-		EBSOptimized: false,
-		VCPU:         32,
-		Memory:       60.500000,
+		Name:                  "cc2.8xlarge",
+		EBSOptimized:          false,
+		EBSOptimizedByDefault: false,
+		VCPU:                  32,
+		Memory:                60.500000,
 		Price: map[string]float64{
 			"ap-northeast-1": 2.349,
 			"eu-west-1":      2.25,
@@ -36,28 +43,34 @@ var Types = []Type{
 			"us-gov-west-1":  2.25,
 			"us-west-2":      2,
 		},
-		Generation: "previous",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "previous",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "10 Gigabit",
+		EBSThroughput:      0.000000,
 	},
 	{
-		Name:         "cg1.4xlarge",
-		EBSOptimized: false,
-		VCPU:         16,
-		Memory:       22.500000,
+		Name:                  "cg1.4xlarge",
+		EBSOptimized:          false,
+		EBSOptimizedByDefault: false,
+		VCPU:                  16,
+		Memory:                22.500000,
 		Price: map[string]float64{
 			"eu-west-1": 2.36,
 			"us-east-1": 2.1,
 		},
-		Generation: "previous",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "previous",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "10 Gigabit",
+		EBSThroughput:      0.000000,
 	},
 	{
-		Name:         "i2.xlarge",
-		EBSOptimized: true,
-		VCPU:         4,
-		Memory:       30.500000,
+		Name:                  "i2.xlarge",
+		EBSOptimized:          true,
+		EBSOptimizedByDefault: false,
+		VCPU:                  4,
+		Memory:                30.500000,
 		Price: map[string]float64{
 			"ap-northeast-1": 1.001,
 			"ap-northeast-2": 1.001,
@@ -72,15 +85,18 @@ var Types = []Type{
 			"us-west-1":      0.938,
 			"us-west-2":      0.853,
 		},
-		Generation: "previous",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "previous",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "Moderate",
+		EBSThroughput:      62.500000,
 	},
 	{
-		Name:         "i2.2xlarge",
-		EBSOptimized: true,
-		VCPU:         8,
-		Memory:       61.000000,
+		Name:                  "i2.2xlarge",
+		EBSOptimized:          true,
+		EBSOptimizedByDefault: false,
+		VCPU:                  8,
+		Memory:                61.000000,
 		Price: map[string]float64{
 			"ap-northeast-1": 2.001,
 			"ap-northeast-2": 2.001,
@@ -95,15 +111,18 @@ var Types = []Type{
 			"us-west-1":      1.876,
 			"us-west-2":      1.705,
 		},
-		Generation: "previous",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "previous",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "High",
+		EBSThroughput:      125.000000,
 	},
 	{
-		Name:         "i2.4xlarge",
-		EBSOptimized: true,
-		VCPU:         16,
-		Memory:       122.000000,
+		Name:                  "i2.4xlarge",
+		EBSOptimized:          true,
+		EBSOptimizedByDefault: false,
+		VCPU:                  16,
+		Memory:                122.000000,
 		Price: map[string]float64{
 			"ap-northeast-1": 4.002,
 			"ap-northeast-2": 4.002,
@@ -118,15 +137,18 @@ var Types = []Type{
 			"us-west-1":      3.751,
 			"us-west-2":      3.41,
 		},
-		Generation: "previous",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "previous",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "High",
+		EBSThroughput:      250.000000,
 	},
 	{
-		Name:         "i2.8xlarge",
-		EBSOptimized: true,
-		VCPU:         32,
-		Memory:       244.000000,
+		Name:                  "i2.8xlarge",
+		EBSOptimized:          true,
+		EBSOptimizedByDefault: false,
+		VCPU:                  32,
+		Memory:                244.000000,
 		Price: map[string]float64{
 			"ap-northeast-1": 8.004,
 			"ap-northeast-2": 8.004,
@@ -141,30 +163,36 @@ var Types = []Type{
 			"us-west-1":      7.502,
 			"us-west-2":      6.82,
 		},
-		Generation: "previous",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "previous",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "10 Gigabit",
+		EBSThroughput:      0.000000,
 	},
 	{
-		Name:         "hi1.4xlarge",
-		EBSOptimized: false,
-		VCPU:         16,
-		Memory:       60.500000,
+		Name:                  "hi1.4xlarge",
+		EBSOptimized:          false,
+		EBSOptimizedByDefault: false,
+		VCPU:                  16,
+		Memory:                60.500000,
 		Price: map[string]float64{
 			"ap-northeast-1": 3.276,
 			"eu-west-1":      3.1,
 			"us-east-1":      3.1,
 			"us-west-2":      3.1,
 		},
-		Generation: "previous",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "previous",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "10 Gigabit",
+		EBSThroughput:      0.000000,
 	},
 	{
-		Name:         "hs1.8xlarge",
-		EBSOptimized: false,
-		VCPU:         16,
-		Memory:       117.000000,
+		Name:                  "hs1.8xlarge",
+		EBSOptimized:          false,
+		EBSOptimizedByDefault: false,
+		VCPU:                  16,
+		Memory:                117.000000,
 		Price: map[string]float64{
 			"ap-northeast-1": 5.4,
 			"ap-southeast-1": 5.57,
@@ -174,15 +202,18 @@ var Types = []Type{
 			"us-gov-west-1":  5.52,
 			"us-west-2":      4.6,
 		},
-		Generation: "previous",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "previous",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "10 Gigabit",
+		EBSThroughput:      0.000000,
 	},
 	{
-		Name:         "t2.nano",
-		EBSOptimized: false,
-		VCPU:         1,
-		Memory:       0.500000,
+		Name:                  "t2.nano",
+		EBSOptimized:          false,
+		EBSOptimizedByDefault: false,
+		VCPU:                  1,
+		Memory:                0.500000,
 		Price: map[string]float64{
 			"ap-northeast-1": 0.0076,
 			"ap-northeast-2": 0.0072,
@@ -200,15 +231,18 @@ var Types = []Type{
 			"us-west-1":      0.0069,
 			"us-west-2":      0.0058,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "Low",
+		EBSThroughput:      0.000000,
 	},
 	{
-		Name:         "t2.micro",
-		EBSOptimized: false,
-		VCPU:         1,
-		Memory:       1.000000,
+		Name:                  "t2.micro",
+		EBSOptimized:          false,
+		EBSOptimizedByDefault: false,
+		VCPU:                  1,
+		Memory:                1.000000,
 		Price: map[string]float64{
 			"ap-northeast-1": 0.0152,
 			"ap-northeast-2": 0.0144,
@@ -226,15 +260,18 @@ var Types = []Type{
 			"us-west-1":      0.0138,
 			"us-west-2":      0.0116,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "Low to Moderate",
+		EBSThroughput:      0.000000,
 	},
 	{
-		Name:         "t2.small",
-		EBSOptimized: false,
-		VCPU:         1,
-		Memory:       2.000000,
+		Name:                  "t2.small",
+		EBSOptimized:          false,
+		EBSOptimizedByDefault: false,
+		VCPU:                  1,
+		Memory:                2.000000,
 		Price: map[string]float64{
 			"ap-northeast-1": 0.0304,
 			"ap-northeast-2": 0.0288,
@@ -252,15 +289,18 @@ var Types = []Type{
 			"us-west-1":      0.0276,
 			"us-west-2":      0.023,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "Low to Moderate",
+		EBSThroughput:      0.000000,
 	},
 	{
-		Name:         "t2.medium",
-		EBSOptimized: false,
-		VCPU:         2,
-		Memory:       4.000000,
+		Name:                  "t2.medium",
+		EBSOptimized:          false,
+		EBSOptimizedByDefault: false,
+		VCPU:                  2,
+		Memory:                4.000000,
 		Price: map[string]float64{
 			"ap-northeast-1": 0.0608,
 			"ap-northeast-2": 0.0576,
@@ -278,15 +318,18 @@ var Types = []Type{
 			"us-west-1":      0.0552,
 			"us-west-2":      0.0464,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "Low to Moderate",
+		EBSThroughput:      0.000000,
 	},
 	{
-		Name:         "t2.large",
-		EBSOptimized: false,
-		VCPU:         2,
-		Memory:       8.000000,
+		Name:                  "t2.large",
+		EBSOptimized:          false,
+		EBSOptimizedByDefault: false,
+		VCPU:                  2,
+		Memory:                8.000000,
 		Price: map[string]float64{
 			"ap-northeast-1": 0.1216,
 			"ap-northeast-2": 0.1152,
@@ -304,15 +347,18 @@ var Types = []Type{
 			"us-west-1":      0.1104,
 			"us-west-2":      0.0928,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "Low to Moderate",
+		EBSThroughput:      0.000000,
 	},
 	{
-		Name:         "t2.xlarge",
-		EBSOptimized: false,
-		VCPU:         4,
-		Memory:       16.000000,
+		Name:                  "t2.xlarge",
+		EBSOptimized:          false,
+		EBSOptimizedByDefault: false,
+		VCPU:                  4,
+		Memory:                16.000000,
 		Price: map[string]float64{
 			"ap-northeast-1": 0.2432,
 			"ap-northeast-2": 0.2304,
@@ -330,15 +376,18 @@ var Types = []Type{
 			"us-west-1":      0.2208,
 			"us-west-2":      0.1856,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "Moderate",
+		EBSThroughput:      0.000000,
 	},
 	{
-		Name:         "t2.2xlarge",
-		EBSOptimized: false,
-		VCPU:         8,
-		Memory:       32.000000,
+		Name:                  "t2.2xlarge",
+		EBSOptimized:          false,
+		EBSOptimizedByDefault: false,
+		VCPU:                  8,
+		Memory:                32.000000,
 		Price: map[string]float64{
 			"ap-northeast-1": 0.4864,
 			"ap-northeast-2": 0.4608,
@@ -356,15 +405,18 @@ var Types = []Type{
 			"us-west-1":      0.4416,
 			"us-west-2":      0.3712,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "Moderate",
+		EBSThroughput:      0.000000,
 	},
 	{
-		Name:         "m4.large",
-		EBSOptimized: true,
-		VCPU:         2,
-		Memory:       8.000000,
+		Name:                  "m4.large",
+		EBSOptimized:          true,
+		EBSOptimizedByDefault: true,
+		VCPU:                  2,
+		Memory:                8.000000,
 		Price: map[string]float64{
 			"ap-northeast-1": 0.129,
 			"ap-northeast-2": 0.123,
@@ -382,15 +434,18 @@ var Types = []Type{
 			"us-west-1":      0.117,
 			"us-west-2":      0.1,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "Moderate",
+		EBSThroughput:      56.250000,
 	},
 	{
-		Name:         "m4.xlarge",
-		EBSOptimized: true,
-		VCPU:         4,
-		Memory:       16.000000,
+		Name:                  "m4.xlarge",
+		EBSOptimized:          true,
+		EBSOptimizedByDefault: true,
+		VCPU:                  4,
+		Memory:                16.000000,
 		Price: map[string]float64{
 			"ap-northeast-1": 0.258,
 			"ap-northeast-2": 0.246,
@@ -408,15 +463,18 @@ var Types = []Type{
 			"us-west-1":      0.234,
 			"us-west-2":      0.2,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "High",
+		EBSThroughput:      93.750000,
 	},
 	{
-		Name:         "m4.2xlarge",
-		EBSOptimized: true,
-		VCPU:         8,
-		Memory:       32.000000,
+		Name:                  "m4.2xlarge",
+		EBSOptimized:          true,
+		EBSOptimizedByDefault: true,
+		VCPU:                  8,
+		Memory:                32.000000,
 		Price: map[string]float64{
 			"ap-northeast-1": 0.516,
 			"ap-northeast-2": 0.492,
@@ -434,15 +492,18 @@ var Types = []Type{
 			"us-west-1":      0.468,
 			"us-west-2":      0.4,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "High",
+		EBSThroughput:      125.000000,
 	},
 	{
-		Name:         "m4.4xlarge",
-		EBSOptimized: true,
-		VCPU:         16,
-		Memory:       64.000000,
+		Name:                  "m4.4xlarge",
+		EBSOptimized:          true,
+		EBSOptimizedByDefault: true,
+		VCPU:                  16,
+		Memory:                64.000000,
 		Price: map[string]float64{
 			"ap-northeast-1": 1.032,
 			"ap-northeast-2": 0.984,
@@ -460,15 +521,18 @@ var Types = []Type{
 			"us-west-1":      0.936,
 			"us-west-2":      0.8,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "High",
+		EBSThroughput:      250.000000,
 	},
 	{
-		Name:         "m4.10xlarge",
-		EBSOptimized: true,
-		VCPU:         40,
-		Memory:       160.000000,
+		Name:                  "m4.10xlarge",
+		EBSOptimized:          true,
+		EBSOptimizedByDefault: true,
+		VCPU:                  40,
+		Memory:                160.000000,
 		Price: map[string]float64{
 			"ap-northeast-1": 2.58,
 			"ap-northeast-2": 2.46,
@@ -486,15 +550,18 @@ var Types = []Type{
 			"us-west-1":      2.34,
 			"us-west-2":      2,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "10 Gigabit",
+		EBSThroughput:      500.000000,
 	},
 	{
-		Name:         "m4.16xlarge",
-		EBSOptimized: true,
-		VCPU:         64,
-		Memory:       256.000000,
+		Name:                  "m4.16xlarge",
+		EBSOptimized:          true,
+		EBSOptimizedByDefault: true,
+		VCPU:                  64,
+		Memory:                256.000000,
 		Price: map[string]float64{
 			"ap-northeast-1": 4.128,
 			"ap-northeast-2": 3.936,
@@ -512,15 +579,18 @@ var Types = []Type{
 			"us-west-1":      3.744,
 			"us-west-2":      3.2,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "25 Gigabit",
+		EBSThroughput:      1250.000000,
 	},
 	{
-		Name:         "m3.medium",
-		EBSOptimized: false,
-		VCPU:         1,
-		Memory:       3.750000,
+		Name:                  "m3.medium",
+		EBSOptimized:          false,
+		EBSOptimizedByDefault: false,
+		VCPU:                  1,
+		Memory:                3.750000,
 		Price: map[string]float64{
 			"ap-northeast-1": 0.096,
 			"ap-southeast-1": 0.098,
@@ -533,15 +603,18 @@ var Types = []Type{
 			"us-west-1":      0.077,
 			"us-west-2":      0.067,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "Moderate",
+		EBSThroughput:      0.000000,
 	},
 	{
-		Name:         "m3.large",
-		EBSOptimized: false,
-		VCPU:         2,
-		Memory:       7.500000,
+		Name:                  "m3.large",
+		EBSOptimized:          false,
+		EBSOptimizedByDefault: false,
+		VCPU:                  2,
+		Memory:                7.500000,
 		Price: map[string]float64{
 			"ap-northeast-1": 0.193,
 			"ap-southeast-1": 0.196,
@@ -554,15 +627,18 @@ var Types = []Type{
 			"us-west-1":      0.154,
 			"us-west-2":      0.133,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "Moderate",
+		EBSThroughput:      0.000000,
 	},
 	{
-		Name:         "m3.xlarge",
-		EBSOptimized: true,
-		VCPU:         4,
-		Memory:       15.000000,
+		Name:                  "m3.xlarge",
+		EBSOptimized:          true,
+		EBSOptimizedByDefault: false,
+		VCPU:                  4,
+		Memory:                15.000000,
 		Price: map[string]float64{
 			"ap-northeast-1": 0.385,
 			"ap-southeast-1": 0.392,
@@ -575,15 +651,18 @@ var Types = []Type{
 			"us-west-1":      0.308,
 			"us-west-2":      0.266,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "High",
+		EBSThroughput:      62.500000,
 	},
 	{
-		Name:         "m3.2xlarge",
-		EBSOptimized: true,
-		VCPU:         8,
-		Memory:       30.000000,
+		Name:                  "m3.2xlarge",
+		EBSOptimized:          true,
+		EBSOptimizedByDefault: false,
+		VCPU:                  8,
+		Memory:                30.000000,
 		Price: map[string]float64{
 			"ap-northeast-1": 0.77,
 			"ap-southeast-1": 0.784,
@@ -596,99 +675,120 @@ var Types = []Type{
 			"us-west-1":      0.616,
 			"us-west-2":      0.532,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "High",
+		EBSThroughput:      125.000000,
 	},
 	{
-		Name:         "c5.large",
-		EBSOptimized: true,
-		VCPU:         2,
-		Memory:       4.000000,
+		Name:                  "c5.large",
+		EBSOptimized:          true,
+		EBSOptimizedByDefault: true,
+		VCPU:                  2,
+		Memory:                4.000000,
 		Price: map[string]float64{
 			"eu-west-1": 0.096,
 			"us-east-1": 0.085,
 			"us-west-2": 0.085,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       true,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               true,
+		NetworkPerformance: "Up to 10 Gigabit",
+		EBSThroughput:      81.250000,
 	},
 	{
-		Name:         "c5.xlarge",
-		EBSOptimized: true,
-		VCPU:         4,
-		Memory:       8.000000,
+		Name:                  "c5.xlarge",
+		EBSOptimized:          true,
+		EBSOptimizedByDefault: true,
+		VCPU:                  4,
+		Memory:                8.000000,
 		Price: map[string]float64{
 			"eu-west-1": 0.192,
 			"us-east-1": 0.17,
 			"us-west-2": 0.17,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       true,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               true,
+		NetworkPerformance: "Up to 10 Gigabit",
+		EBSThroughput:      143.750000,
 	},
 	{
-		Name:         "c5.2xlarge",
-		EBSOptimized: true,
-		VCPU:         8,
-		Memory:       16.000000,
+		Name:                  "c5.2xlarge",
+		EBSOptimized:          true,
+		EBSOptimizedByDefault: true,
+		VCPU:                  8,
+		Memory:                16.000000,
 		Price: map[string]float64{
 			"eu-west-1": 0.384,
 			"us-east-1": 0.34,
 			"us-west-2": 0.34,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       true,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               true,
+		NetworkPerformance: "Up to 10 Gigabit",
+		EBSThroughput:      287.500000,
 	},
 	{
-		Name:         "c5.4xlarge",
-		EBSOptimized: true,
-		VCPU:         16,
-		Memory:       32.000000,
+		Name:                  "c5.4xlarge",
+		EBSOptimized:          true,
+		EBSOptimizedByDefault: true,
+		VCPU:                  16,
+		Memory:                32.000000,
 		Price: map[string]float64{
 			"eu-west-1": 0.768,
 			"us-east-1": 0.68,
 			"us-west-2": 0.68,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       true,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               true,
+		NetworkPerformance: "Up to 10 Gigabit",
+		EBSThroughput:      593.750000,
 	},
 	{
-		Name:         "c5.9xlarge",
-		EBSOptimized: true,
-		VCPU:         36,
-		Memory:       72.000000,
+		Name:                  "c5.9xlarge",
+		EBSOptimized:          true,
+		EBSOptimizedByDefault: true,
+		VCPU:                  36,
+		Memory:                72.000000,
 		Price: map[string]float64{
 			"eu-west-1": 1.728,
 			"us-east-1": 1.53,
 			"us-west-2": 1.53,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       true,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               true,
+		NetworkPerformance: "10 Gigabit",
+		EBSThroughput:      1187.500000,
 	},
 	{
-		Name:         "c5.18xlarge",
-		EBSOptimized: true,
-		VCPU:         72,
-		Memory:       144.000000,
+		Name:                  "c5.18xlarge",
+		EBSOptimized:          true,
+		EBSOptimizedByDefault: true,
+		VCPU:                  72,
+		Memory:                144.000000,
 		Price: map[string]float64{
 			"eu-west-1": 3.456,
 			"us-east-1": 3.06,
 			"us-west-2": 3.06,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       true,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               true,
+		NetworkPerformance: "25 Gigabit",
+		EBSThroughput:      2375.000000,
 	},
 	{
-		Name:         "c4.large",
-		EBSOptimized: true,
-		VCPU:         2,
-		Memory:       3.750000,
+		Name:                  "c4.large",
+		EBSOptimized:          true,
+		EBSOptimizedByDefault: true,
+		VCPU:                  2,
+		Memory:                3.750000,
 		Price: map[string]float64{
 			"ap-northeast-1": 0.126,
 			"ap-northeast-2": 0.114,
@@ -706,15 +806,18 @@ var Types = []Type{
 			"us-west-1":      0.124,
 			"us-west-2":      0.1,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "Moderate",
+		EBSThroughput:      62.500000,
 	},
 	{
-		Name:         "c4.xlarge",
-		EBSOptimized: true,
-		VCPU:         4,
-		Memory:       7.500000,
+		Name:                  "c4.xlarge",
+		EBSOptimized:          true,
+		EBSOptimizedByDefault: true,
+		VCPU:                  4,
+		Memory:                7.500000,
 		Price: map[string]float64{
 			"ap-northeast-1": 0.252,
 			"ap-northeast-2": 0.227,
@@ -732,15 +835,18 @@ var Types = []Type{
 			"us-west-1":      0.249,
 			"us-west-2":      0.199,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "High",
+		EBSThroughput:      93.750000,
 	},
 	{
-		Name:         "c4.2xlarge",
-		EBSOptimized: true,
-		VCPU:         8,
-		Memory:       15.000000,
+		Name:                  "c4.2xlarge",
+		EBSOptimized:          true,
+		EBSOptimizedByDefault: true,
+		VCPU:                  8,
+		Memory:                15.000000,
 		Price: map[string]float64{
 			"ap-northeast-1": 0.504,
 			"ap-northeast-2": 0.454,
@@ -758,15 +864,18 @@ var Types = []Type{
 			"us-west-1":      0.498,
 			"us-west-2":      0.398,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "High",
+		EBSThroughput:      125.000000,
 	},
 	{
-		Name:         "c4.4xlarge",
-		EBSOptimized: true,
-		VCPU:         16,
-		Memory:       30.000000,
+		Name:                  "c4.4xlarge",
+		EBSOptimized:          true,
+		EBSOptimizedByDefault: true,
+		VCPU:                  16,
+		Memory:                30.000000,
 		Price: map[string]float64{
 			"ap-northeast-1": 1.008,
 			"ap-northeast-2": 0.907,
@@ -784,15 +893,18 @@ var Types = []Type{
 			"us-west-1":      0.997,
 			"us-west-2":      0.796,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "High",
+		EBSThroughput:      250.000000,
 	},
 	{
-		Name:         "c4.8xlarge",
-		EBSOptimized: true,
-		VCPU:         36,
-		Memory:       60.000000,
+		Name:                  "c4.8xlarge",
+		EBSOptimized:          true,
+		EBSOptimizedByDefault: true,
+		VCPU:                  36,
+		Memory:                60.000000,
 		Price: map[string]float64{
 			"ap-northeast-1": 2.016,
 			"ap-northeast-2": 1.815,
@@ -810,15 +922,18 @@ var Types = []Type{
 			"us-west-1":      1.993,
 			"us-west-2":      1.591,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "10 Gigabit",
+		EBSThroughput:      500.000000,
 	},
 	{
-		Name:         "c3.large",
-		EBSOptimized: false,
-		VCPU:         2,
-		Memory:       3.750000,
+		Name:                  "c3.large",
+		EBSOptimized:          false,
+		EBSOptimizedByDefault: false,
+		VCPU:                  2,
+		Memory:                3.750000,
 		Price: map[string]float64{
 			"ap-northeast-1": 0.128,
 			"ap-southeast-1": 0.132,
@@ -831,15 +946,18 @@ var Types = []Type{
 			"us-west-1":      0.12,
 			"us-west-2":      0.105,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "Moderate",
+		EBSThroughput:      0.000000,
 	},
 	{
-		Name:         "c3.xlarge",
-		EBSOptimized: true,
-		VCPU:         4,
-		Memory:       7.500000,
+		Name:                  "c3.xlarge",
+		EBSOptimized:          true,
+		EBSOptimizedByDefault: false,
+		VCPU:                  4,
+		Memory:                7.500000,
 		Price: map[string]float64{
 			"ap-northeast-1": 0.255,
 			"ap-southeast-1": 0.265,
@@ -852,15 +970,18 @@ var Types = []Type{
 			"us-west-1":      0.239,
 			"us-west-2":      0.21,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "Moderate",
+		EBSThroughput:      62.500000,
 	},
 	{
-		Name:         "c3.2xlarge",
-		EBSOptimized: true,
-		VCPU:         8,
-		Memory:       15.000000,
+		Name:                  "c3.2xlarge",
+		EBSOptimized:          true,
+		EBSOptimizedByDefault: false,
+		VCPU:                  8,
+		Memory:                15.000000,
 		Price: map[string]float64{
 			"ap-northeast-1": 0.511,
 			"ap-southeast-1": 0.529,
@@ -873,15 +994,18 @@ var Types = []Type{
 			"us-west-1":      0.478,
 			"us-west-2":      0.42,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "High",
+		EBSThroughput:      125.000000,
 	},
 	{
-		Name:         "c3.4xlarge",
-		EBSOptimized: true,
-		VCPU:         16,
-		Memory:       30.000000,
+		Name:                  "c3.4xlarge",
+		EBSOptimized:          true,
+		EBSOptimizedByDefault: false,
+		VCPU:                  16,
+		Memory:                30.000000,
 		Price: map[string]float64{
 			"ap-northeast-1": 1.021,
 			"ap-southeast-1": 1.058,
@@ -894,15 +1018,18 @@ var Types = []Type{
 			"us-west-1":      0.956,
 			"us-west-2":      0.84,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "High",
+		EBSThroughput:      250.000000,
 	},
 	{
-		Name:         "c3.8xlarge",
-		EBSOptimized: false,
-		VCPU:         32,
-		Memory:       60.000000,
+		Name:                  "c3.8xlarge",
+		EBSOptimized:          false,
+		EBSOptimizedByDefault: false,
+		VCPU:                  32,
+		Memory:                60.000000,
 		Price: map[string]float64{
 			"ap-northeast-1": 2.043,
 			"ap-southeast-1": 2.117,
@@ -915,15 +1042,18 @@ var Types = []Type{
 			"us-west-1":      1.912,
 			"us-west-2":      1.68,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "10 Gigabit",
+		EBSThroughput:      0.000000,
 	},
 	{
-		Name:         "x1.16xlarge",
-		EBSOptimized: true,
-		VCPU:         64,
-		Memory:       976.000000,
+		Name:                  "x1.16xlarge",
+		EBSOptimized:          true,
+		EBSOptimizedByDefault: true,
+		VCPU:                  64,
+		Memory:                976.000000,
 		Price: map[string]float64{
 			"ap-northeast-1": 9.671,
 			"ap-northeast-2": 9.671,
@@ -940,15 +1070,18 @@ var Types = []Type{
 			"us-gov-west-1":  8.003,
 			"us-west-2":      6.669,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "10 Gigabit",
+		EBSThroughput:      875.000000,
 	},
 	{
-		Name:         "x1.32xlarge",
-		EBSOptimized: true,
-		VCPU:         128,
-		Memory:       1952.000000,
+		Name:                  "x1.32xlarge",
+		EBSOptimized:          true,
+		EBSOptimizedByDefault: true,
+		VCPU:                  128,
+		Memory:                1952.000000,
 		Price: map[string]float64{
 			"ap-northeast-1": 19.341,
 			"ap-northeast-2": 19.341,
@@ -965,15 +1098,18 @@ var Types = []Type{
 			"us-gov-west-1":  16.006,
 			"us-west-2":      13.338,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "25 Gigabit",
+		EBSThroughput:      1750.000000,
 	},
 	{
-		Name:         "r4.large",
-		EBSOptimized: true,
-		VCPU:         2,
-		Memory:       15.250000,
+		Name:                  "r4.large",
+		EBSOptimized:          true,
+		EBSOptimizedByDefault: true,
+		VCPU:                  2,
+		Memory:                15.250000,
 		Price: map[string]float64{
 			"ap-northeast-1": 0.16,
 			"ap-northeast-2": 0.16,
@@ -991,15 +1127,18 @@ var Types = []Type{
 			"us-west-1":      0.148,
 			"us-west-2":      0.133,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "Up to 10 Gigabit",
+		EBSThroughput:      53.125000,
 	},
 	{
-		Name:         "r4.xlarge",
-		EBSOptimized: true,
-		VCPU:         4,
-		Memory:       30.500000,
+		Name:                  "r4.xlarge",
+		EBSOptimized:          true,
+		EBSOptimizedByDefault: true,
+		VCPU:                  4,
+		Memory:                30.500000,
 		Price: map[string]float64{
 			"ap-northeast-1": 0.32,
 			"ap-northeast-2": 0.32,
@@ -1017,15 +1156,18 @@ var Types = []Type{
 			"us-west-1":      0.296,
 			"us-west-2":      0.266,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "Up to 10 Gigabit",
+		EBSThroughput:      106.250000,
 	},
 	{
-		Name:         "r4.2xlarge",
-		EBSOptimized: true,
-		VCPU:         8,
-		Memory:       61.000000,
+		Name:                  "r4.2xlarge",
+		EBSOptimized:          true,
+		EBSOptimizedByDefault: true,
+		VCPU:                  8,
+		Memory:                61.000000,
 		Price: map[string]float64{
 			"ap-northeast-1": 0.64,
 			"ap-northeast-2": 0.64,
@@ -1043,15 +1185,18 @@ var Types = []Type{
 			"us-west-1":      0.593,
 			"us-west-2":      0.532,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "Up to 10 Gigabit",
+		EBSThroughput:      212.500000,
 	},
 	{
-		Name:         "r4.4xlarge",
-		EBSOptimized: true,
-		VCPU:         16,
-		Memory:       122.000000,
+		Name:                  "r4.4xlarge",
+		EBSOptimized:          true,
+		EBSOptimizedByDefault: true,
+		VCPU:                  16,
+		Memory:                122.000000,
 		Price: map[string]float64{
 			"ap-northeast-1": 1.28,
 			"ap-northeast-2": 1.28,
@@ -1069,15 +1214,18 @@ var Types = []Type{
 			"us-west-1":      1.186,
 			"us-west-2":      1.064,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "Up to 10 Gigabit",
+		EBSThroughput:      437.500000,
 	},
 	{
-		Name:         "r4.8xlarge",
-		EBSOptimized: true,
-		VCPU:         32,
-		Memory:       244.000000,
+		Name:                  "r4.8xlarge",
+		EBSOptimized:          true,
+		EBSOptimizedByDefault: true,
+		VCPU:                  32,
+		Memory:                244.000000,
 		Price: map[string]float64{
 			"ap-northeast-1": 2.56,
 			"ap-northeast-2": 2.56,
@@ -1095,15 +1243,18 @@ var Types = []Type{
 			"us-west-1":      2.371,
 			"us-west-2":      2.128,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "10 Gigabit",
+		EBSThroughput:      875.000000,
 	},
 	{
-		Name:         "r4.16xlarge",
-		EBSOptimized: true,
-		VCPU:         64,
-		Memory:       488.000000,
+		Name:                  "r4.16xlarge",
+		EBSOptimized:          true,
+		EBSOptimizedByDefault: true,
+		VCPU:                  64,
+		Memory:                488.000000,
 		Price: map[string]float64{
 			"ap-northeast-1": 5.12,
 			"ap-northeast-2": 5.12,
@@ -1121,15 +1272,18 @@ var Types = []Type{
 			"us-west-1":      4.742,
 			"us-west-2":      4.256,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "25 Gigabit",
+		EBSThroughput:      1750.000000,
 	},
 	{
-		Name:         "r3.large",
-		EBSOptimized: false,
-		VCPU:         2,
-		Memory:       15.250000,
+		Name:                  "r3.large",
+		EBSOptimized:          false,
+		EBSOptimizedByDefault: false,
+		VCPU:                  2,
+		Memory:                15.250000,
 		Price: map[string]float64{
 			"ap-northeast-1": 0.2,
 			"ap-northeast-2": 0.2,
@@ -1145,15 +1299,18 @@ var Types = []Type{
 			"us-west-1":      0.185,
 			"us-west-2":      0.166,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "Moderate",
+		EBSThroughput:      0.000000,
 	},
 	{
-		Name:         "r3.xlarge",
-		EBSOptimized: true,
-		VCPU:         4,
-		Memory:       30.500000,
+		Name:                  "r3.xlarge",
+		EBSOptimized:          true,
+		EBSOptimizedByDefault: false,
+		VCPU:                  4,
+		Memory:                30.500000,
 		Price: map[string]float64{
 			"ap-northeast-1": 0.399,
 			"ap-northeast-2": 0.399,
@@ -1169,15 +1326,18 @@ var Types = []Type{
 			"us-west-1":      0.371,
 			"us-west-2":      0.333,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "Moderate",
+		EBSThroughput:      62.500000,
 	},
 	{
-		Name:         "r3.2xlarge",
-		EBSOptimized: true,
-		VCPU:         8,
-		Memory:       61.000000,
+		Name:                  "r3.2xlarge",
+		EBSOptimized:          true,
+		EBSOptimizedByDefault: false,
+		VCPU:                  8,
+		Memory:                61.000000,
 		Price: map[string]float64{
 			"ap-northeast-1": 0.798,
 			"ap-northeast-2": 0.798,
@@ -1193,15 +1353,18 @@ var Types = []Type{
 			"us-west-1":      0.741,
 			"us-west-2":      0.665,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "High",
+		EBSThroughput:      125.000000,
 	},
 	{
-		Name:         "r3.4xlarge",
-		EBSOptimized: true,
-		VCPU:         16,
-		Memory:       122.000000,
+		Name:                  "r3.4xlarge",
+		EBSOptimized:          true,
+		EBSOptimizedByDefault: false,
+		VCPU:                  16,
+		Memory:                122.000000,
 		Price: map[string]float64{
 			"ap-northeast-1": 1.596,
 			"ap-northeast-2": 1.596,
@@ -1217,15 +1380,18 @@ var Types = []Type{
 			"us-west-1":      1.482,
 			"us-west-2":      1.33,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "High",
+		EBSThroughput:      250.000000,
 	},
 	{
-		Name:         "r3.8xlarge",
-		EBSOptimized: false,
-		VCPU:         32,
-		Memory:       244.000000,
+		Name:                  "r3.8xlarge",
+		EBSOptimized:          false,
+		EBSOptimizedByDefault: false,
+		VCPU:                  32,
+		Memory:                244.000000,
 		Price: map[string]float64{
 			"ap-northeast-1": 3.192,
 			"ap-northeast-2": 3.192,
@@ -1241,15 +1407,18 @@ var Types = []Type{
 			"us-west-1":      2.964,
 			"us-west-2":      2.66,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "10 Gigabit",
+		EBSThroughput:      0.000000,
 	},
 	{
-		Name:         "p2.xlarge",
-		EBSOptimized: true,
-		VCPU:         4,
-		Memory:       61.000000,
+		Name:                  "p2.xlarge",
+		EBSOptimized:          true,
+		EBSOptimizedByDefault: true,
+		VCPU:                  4,
+		Memory:                61.000000,
 		Price: map[string]float64{
 			"ap-northeast-1": 1.542,
 			"ap-northeast-2": 1.465,
@@ -1263,15 +1432,18 @@ var Types = []Type{
 			"us-gov-west-1":  1.08,
 			"us-west-2":      0.9,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "High",
+		EBSThroughput:      93.750000,
 	},
 	{
-		Name:         "p2.8xlarge",
-		EBSOptimized: true,
-		VCPU:         32,
-		Memory:       488.000000,
+		Name:                  "p2.8xlarge",
+		EBSOptimized:          true,
+		EBSOptimizedByDefault: true,
+		VCPU:                  32,
+		Memory:                488.000000,
 		Price: map[string]float64{
 			"ap-northeast-1": 12.336,
 			"ap-northeast-2": 11.72,
@@ -1285,15 +1457,18 @@ var Types = []Type{
 			"us-gov-west-1":  8.64,
 			"us-west-2":      7.2,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "10 Gigabit",
+		EBSThroughput:      625.000000,
 	},
 	{
-		Name:         "p2.16xlarge",
-		EBSOptimized: true,
-		VCPU:         64,
-		Memory:       732.000000,
+		Name:                  "p2.16xlarge",
+		EBSOptimized:          true,
+		EBSOptimizedByDefault: true,
+		VCPU:                  64,
+		Memory:                732.000000,
 		Price: map[string]float64{
 			"ap-northeast-1": 24.672,
 			"ap-northeast-2": 23.44,
@@ -1307,15 +1482,18 @@ var Types = []Type{
 			"us-gov-west-1":  17.28,
 			"us-west-2":      14.4,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "25 Gigabit",
+		EBSThroughput:      1250.000000,
 	},
 	{
-		Name:         "g3.4xlarge",
-		EBSOptimized: true,
-		VCPU:         16,
-		Memory:       122.000000,
+		Name:                  "g3.4xlarge",
+		EBSOptimized:          true,
+		EBSOptimizedByDefault: true,
+		VCPU:                  16,
+		Memory:                122.000000,
 		Price: map[string]float64{
 			"ap-northeast-1": 1.58,
 			"ap-southeast-1": 1.67,
@@ -1328,15 +1506,18 @@ var Types = []Type{
 			"us-west-1":      1.534,
 			"us-west-2":      1.14,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "Up to 10 Gigabit",
+		EBSThroughput:      437.500000,
 	},
 	{
-		Name:         "g3.8xlarge",
-		EBSOptimized: true,
-		VCPU:         32,
-		Memory:       244.000000,
+		Name:                  "g3.8xlarge",
+		EBSOptimized:          true,
+		EBSOptimizedByDefault: true,
+		VCPU:                  32,
+		Memory:                244.000000,
 		Price: map[string]float64{
 			"ap-northeast-1": 3.16,
 			"ap-southeast-1": 3.34,
@@ -1349,15 +1530,18 @@ var Types = []Type{
 			"us-west-1":      3.068,
 			"us-west-2":      2.28,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "10 Gigabit",
+		EBSThroughput:      875.000000,
 	},
 	{
-		Name:         "g3.16xlarge",
-		EBSOptimized: true,
-		VCPU:         64,
-		Memory:       488.000000,
+		Name:                  "g3.16xlarge",
+		EBSOptimized:          true,
+		EBSOptimizedByDefault: true,
+		VCPU:                  64,
+		Memory:                488.000000,
 		Price: map[string]float64{
 			"ap-northeast-1": 6.32,
 			"ap-southeast-1": 6.68,
@@ -1370,43 +1554,52 @@ var Types = []Type{
 			"us-west-1":      6.136,
 			"us-west-2":      4.56,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "25 Gigabit",
+		EBSThroughput:      1750.000000,
 	},
 	{
-		Name:         "f1.2xlarge",
-		EBSOptimized: true,
-		VCPU:         8,
-		Memory:       122.000000,
+		Name:                  "f1.2xlarge",
+		EBSOptimized:          true,
+		EBSOptimizedByDefault: true,
+		VCPU:                  8,
+		Memory:                122.000000,
 		Price: map[string]float64{
 			"eu-west-1": 1.815,
 			"us-east-1": 1.65,
 			"us-west-2": 1.65,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "Up to 10 Gigabit",
+		EBSThroughput:      212.500000,
 	},
 	{
-		Name:         "f1.16xlarge",
-		EBSOptimized: true,
-		VCPU:         64,
-		Memory:       976.000000,
+		Name:                  "f1.16xlarge",
+		EBSOptimized:          true,
+		EBSOptimizedByDefault: true,
+		VCPU:                  64,
+		Memory:                976.000000,
 		Price: map[string]float64{
 			"eu-west-1": 14.52,
 			"us-east-1": 13.2,
 			"us-west-2": 13.2,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "25 Gigabit",
+		EBSThroughput:      1750.000000,
 	},
 	{
-		Name:         "d2.xlarge",
-		EBSOptimized: true,
-		VCPU:         4,
-		Memory:       30.500000,
+		Name:                  "d2.xlarge",
+		EBSOptimized:          true,
+		EBSOptimizedByDefault: true,
+		VCPU:                  4,
+		Memory:                30.500000,
 		Price: map[string]float64{
 			"ap-northeast-1": 0.844,
 			"ap-northeast-2": 0.844,
@@ -1423,15 +1616,18 @@ var Types = []Type{
 			"us-west-1":      0.781,
 			"us-west-2":      0.69,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "Moderate",
+		EBSThroughput:      93.750000,
 	},
 	{
-		Name:         "d2.2xlarge",
-		EBSOptimized: true,
-		VCPU:         8,
-		Memory:       61.000000,
+		Name:                  "d2.2xlarge",
+		EBSOptimized:          true,
+		EBSOptimizedByDefault: true,
+		VCPU:                  8,
+		Memory:                61.000000,
 		Price: map[string]float64{
 			"ap-northeast-1": 1.688,
 			"ap-northeast-2": 1.688,
@@ -1448,15 +1644,18 @@ var Types = []Type{
 			"us-west-1":      1.563,
 			"us-west-2":      1.38,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "High",
+		EBSThroughput:      125.000000,
 	},
 	{
-		Name:         "d2.4xlarge",
-		EBSOptimized: true,
-		VCPU:         16,
-		Memory:       122.000000,
+		Name:                  "d2.4xlarge",
+		EBSOptimized:          true,
+		EBSOptimizedByDefault: true,
+		VCPU:                  16,
+		Memory:                122.000000,
 		Price: map[string]float64{
 			"ap-northeast-1": 3.376,
 			"ap-northeast-2": 3.376,
@@ -1473,15 +1672,18 @@ var Types = []Type{
 			"us-west-1":      3.125,
 			"us-west-2":      2.76,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "High",
+		EBSThroughput:      250.000000,
 	},
 	{
-		Name:         "d2.8xlarge",
-		EBSOptimized: true,
-		VCPU:         36,
-		Memory:       244.000000,
+		Name:                  "d2.8xlarge",
+		EBSOptimized:          true,
+		EBSOptimizedByDefault: true,
+		VCPU:                  36,
+		Memory:                244.000000,
 		Price: map[string]float64{
 			"ap-northeast-1": 6.752,
 			"ap-northeast-2": 6.752,
@@ -1498,8 +1700,10 @@ var Types = []Type{
 			"us-west-1":      6.25,
 			"us-west-2":      5.52,
 		},
-		Generation: "current",
-		Virt:       "HVM",
-		NVMe:       false,
+		Generation:         "current",
+		Virt:               "HVM",
+		NVMe:               false,
+		NetworkPerformance: "10 Gigabit",
+		EBSThroughput:      500.000000,
 	},
 }
@@ -0,0 +1,96 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/aws/aws-sdk-go/private/protocol/jsonrpc"
+)
+
+// defaultKMSDecryptImage is the Docker image used to decrypt the
+// Reflow configuration at boot.
+const defaultKMSDecryptImage = "amazon/aws-cli"
+
+// kmsMaxPlaintext is the maximum size, in bytes, of plaintexts that
+// KMS encrypts directly.
+const kmsMaxPlaintext = 4096
+
+// KMS is the subset of the AWS KMS API used to encrypt the Reflow
+// configuration that is embedded in instance user data.
+type KMS interface {
+	// Encrypt encrypts plaintext with the KMS key with the given ID
+	// (or ARN or alias), returning the ciphertext blob.
+	Encrypt(ctx context.Context, keyID string, plaintext []byte) ([]byte, error)
+}
+
+// kmsClient is a minimal KMS client, built from the SDK's core
+// facilities, that implements KMS.
+type kmsClient struct {
+	*client.Client
+}
+
+// NewKMS returns a KMS client configured from the provided
+// configuration provider (e.g., a session).
+func NewKMS(p client.ConfigProvider, cfgs ...*aws.Config) KMS {
+	c := p.ClientConfig("kms", cfgs...)
+	svc := &kmsClient{
+		Client: client.New(
+			*c.Config,
+			metadata.ClientInfo{
+				ServiceName:   "kms",
+				SigningName:   c.SigningName,
+				SigningRegion: c.SigningRegion,
+				Endpoint:      c.Endpoint,
+				APIVersion:    "2014-11-01",
+				JSONVersion:   "1.1",
+				TargetPrefix:  "TrentService",
+			},
+			c.Handlers,
+		),
+	}
+	svc.Handlers.Sign.PushBackNamed(v4.SignRequestHandler)
+	svc.Handlers.Build.PushBackNamed(jsonrpc.BuildHandler)
+	svc.Handlers.Unmarshal.PushBackNamed(jsonrpc.UnmarshalHandler)
+	svc.Handlers.UnmarshalMeta.PushBackNamed(jsonrpc.UnmarshalMetaHandler)
+	svc.Handlers.UnmarshalError.PushBackNamed(jsonrpc.UnmarshalErrorHandler)
+	return svc
+}
+
+type kmsEncryptInput struct {
+	_ struct{} `type:"structure"`
+
+	KeyId     *string `type:"string" required:"true"`
+	Plaintext []byte  `type:"blob" required:"true"`
+}
+
+type kmsEncryptOutput struct {
+	_ struct{} `type:"structure"`
+
+	CiphertextBlob []byte  `type:"blob"`
+	KeyId          *string `type:"string"`
+}
+
+// Encrypt implements KMS.
+func (c *kmsClient) Encrypt(ctx context.Context, keyID string, plaintext []byte) ([]byte, error) {
+	op := &request.Operation{
+		Name:       "Encrypt",
+		HTTPMethod: "POST",
+		HTTPPath:   "/",
+	}
+	input := &kmsEncryptInput{KeyId: aws.String(keyID), Plaintext: plaintext}
+	output := new(kmsEncryptOutput)
+	req := c.NewRequest(op, input, output)
+	req.SetContext(ctx)
+	if err := req.Send(); err != nil {
+		return nil, err
+	}
+	return output.CiphertextBlob, nil
+}
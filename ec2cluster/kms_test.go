@@ -0,0 +1,138 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/grailbio/reflow/config"
+	"github.com/grailbio/reflow/errors"
+)
+
+// testKMS is a mock KMS that "encrypts" by reversing its input.
+type testKMS struct {
+	keyID     string
+	plaintext []byte
+}
+
+func (k *testKMS) Encrypt(ctx context.Context, keyID string, plaintext []byte) ([]byte, error) {
+	k.keyID = keyID
+	k.plaintext = plaintext
+	ciphertext := make([]byte, len(plaintext))
+	for i, b := range plaintext {
+		ciphertext[len(plaintext)-1-i] = b
+	}
+	return ciphertext, nil
+}
+
+func TestUserDataEncryptedConfig(t *testing.T) {
+	kms := new(testKMS)
+	i := newTestInstance()
+	i.Region = "us-west-2"
+	i.ConfigKMSKey = "alias/reflow"
+	i.KMS = kms
+	ud := renderUserData(t, i)
+	if got, want := kms.keyID, "alias/reflow"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if kms.plaintext == nil {
+		t.Error("configuration was not encrypted")
+	}
+	ciphertext, _ := kms.Encrypt(context.Background(), "", kms.plaintext)
+	for _, want := range []string{
+		`path: "/etc/reflowconfig.enc"`,
+		base64.StdEncoding.EncodeToString(ciphertext),
+		"amazon/aws-cli kms decrypt --region us-west-2",
+		"Requires=reflowconfig.service",
+	} {
+		if !strings.Contains(ud, want) {
+			t.Errorf("expected %q, got:\n%s", want, ud)
+		}
+	}
+	if strings.Contains(ud, `path: "/etc/reflowconfig"`) {
+		t.Errorf("plaintext configuration embedded in user data:\n%s", ud)
+	}
+
+	i.KMS = nil
+	if _, err := i.renderUserData(); !errors.Match(errors.Fatal, err) {
+		t.Errorf("expected fatal error, got %v", err)
+	}
+}
+
+func TestUserDataEncryptedConfigLimit(t *testing.T) {
+	kms := new(testKMS)
+	i := newTestInstance()
+	i.ConfigKMSKey = "alias/reflow"
+	i.KMS = kms
+	i.ReflowConfig = config.Base{"padding": strings.Repeat("x", kmsMaxPlaintext)}
+	_, err := i.renderUserData()
+	if !errors.Match(errors.Fatal, err) {
+		t.Errorf("expected fatal error, got %v", err)
+	}
+	if kms.plaintext != nil {
+		t.Error("oversized configuration was sent to KMS")
+	}
+	// Configurations within the limit are encrypted.
+	i.ReflowConfig = config.Base{"padding": strings.Repeat("x", kmsMaxPlaintext/2)}
+	if _, err := i.renderUserData(); err != nil {
+		t.Fatal(err)
+	}
+	if kms.plaintext == nil {
+		t.Error("configuration was not encrypted")
+	}
+}
+
+func TestKMSEncrypt(t *testing.T) {
+	var (
+		target string
+		input  map[string]string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target = r.Header.Get("X-Amz-Target")
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			t.Fatal(err)
+		}
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		json.NewEncoder(w).Encode(map[string]string{
+			"CiphertextBlob": base64.StdEncoding.EncodeToString([]byte("ciphertext")),
+			"KeyId":          input["KeyId"],
+		})
+	}))
+	defer srv.Close()
+	sess, err := session.NewSession(&aws.Config{
+		Endpoint:    aws.String(srv.URL),
+		Region:      aws.String("us-west-2"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		MaxRetries:  aws.Int(0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := NewKMS(sess).Encrypt(context.Background(), "alias/reflow", []byte("plaintext"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(ciphertext), "ciphertext"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := target, "TrentService.Encrypt"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := input["KeyId"], "alias/reflow"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := input["Plaintext"], base64.StdEncoding.EncodeToString([]byte("plaintext")); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
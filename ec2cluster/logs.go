@@ -0,0 +1,204 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/aws/aws-sdk-go/private/protocol/query"
+	"github.com/grailbio/reflow/errors"
+)
+
+// awslogsActions are the CloudWatch Logs actions that an instance's
+// profile must permit for its reflowlet logs to be forwarded by
+// Docker's awslogs log driver.
+var awslogsActions = []string{"logs:CreateLogStream", "logs:PutLogEvents"}
+
+// logGroupName matches valid CloudWatch Logs group names.
+var logGroupName = regexp.MustCompile(`^[\.\-_/#A-Za-z0-9]{1,512}$`)
+
+// logStreamPrefix returns the prefix of the log streams of
+// instances with the provided tag. Characters that are not permitted
+// in stream names, or that would be interpreted by systemd or the
+// shell, are replaced.
+func logStreamPrefix(tag string) string {
+	if tag == "" {
+		return "reflowlet"
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == ':', r == '*', r == '%', r == '\\', r == '\'', r == '"', unicode.IsSpace(r):
+			return '-'
+		}
+		return r
+	}, tag)
+}
+
+// IAM is the subset of the AWS Identity and Access Management API
+// used to validate the permissions of instance profiles.
+type IAM interface {
+	// DeniedActions returns the subset of the provided actions that
+	// are not permitted by the role of the instance profile with the
+	// given ARN.
+	DeniedActions(ctx context.Context, instanceProfileARN string, actions []string) ([]string, error)
+}
+
+// CheckLogForwarding checks that the instance profile with the given
+// ARN permits its instances to forward their reflowlet logs to the
+// CloudWatch Logs group with the given name. CheckLogForwarding
+// returns an errors.NotAllowed error if it does not, and an
+// errors.Invalid error if no instance profile is provided.
+func CheckLogForwarding(ctx context.Context, api IAM, instanceProfileARN, group string) error {
+	if !logGroupName.MatchString(group) {
+		return errors.E(errors.Fatal, errors.Errorf("invalid log group name %q", group))
+	}
+	if instanceProfileARN == "" {
+		return errors.E("check log forwarding", errors.Invalid,
+			errors.New("log forwarding requires an instance profile"))
+	}
+	denied, err := api.DeniedActions(ctx, instanceProfileARN, awslogsActions)
+	if err != nil {
+		return errors.E("check log forwarding", instanceProfileARN, err)
+	}
+	if len(denied) > 0 {
+		return errors.E("check log forwarding", instanceProfileARN, errors.NotAllowed,
+			errors.Errorf("instance profile does not permit %s", strings.Join(denied, ", ")))
+	}
+	return nil
+}
+
+// iamClient is a minimal IAM client, built from the SDK's core
+// facilities, that implements IAM.
+type iamClient struct {
+	*client.Client
+}
+
+// NewIAM returns an IAM client configured from the provided
+// configuration provider (e.g., a session).
+func NewIAM(p client.ConfigProvider, cfgs ...*aws.Config) IAM {
+	c := p.ClientConfig("iam", cfgs...)
+	svc := &iamClient{
+		Client: client.New(
+			*c.Config,
+			metadata.ClientInfo{
+				ServiceName:   "iam",
+				SigningName:   c.SigningName,
+				SigningRegion: c.SigningRegion,
+				Endpoint:      c.Endpoint,
+				APIVersion:    "2010-05-08",
+			},
+			c.Handlers,
+		),
+	}
+	svc.Handlers.Sign.PushBackNamed(v4.SignRequestHandler)
+	svc.Handlers.Build.PushBackNamed(query.BuildHandler)
+	svc.Handlers.Unmarshal.PushBackNamed(query.UnmarshalHandler)
+	svc.Handlers.UnmarshalMeta.PushBackNamed(query.UnmarshalMetaHandler)
+	svc.Handlers.UnmarshalError.PushBackNamed(query.UnmarshalErrorHandler)
+	return svc
+}
+
+type iamGetInstanceProfileInput struct {
+	_ struct{} `type:"structure"`
+
+	InstanceProfileName *string `min:"1" type:"string" required:"true"`
+}
+
+type iamGetInstanceProfileOutput struct {
+	_ struct{} `type:"structure"`
+
+	InstanceProfile *iamInstanceProfile `type:"structure" required:"true"`
+}
+
+type iamInstanceProfile struct {
+	_ struct{} `type:"structure"`
+
+	Roles []*iamRole `type:"list" required:"true"`
+}
+
+type iamRole struct {
+	_ struct{} `type:"structure"`
+
+	Arn *string `type:"string" required:"true"`
+}
+
+type iamSimulatePrincipalPolicyInput struct {
+	_ struct{} `type:"structure"`
+
+	PolicySourceArn *string   `min:"20" type:"string" required:"true"`
+	ActionNames     []*string `type:"list" required:"true"`
+}
+
+type iamSimulatePrincipalPolicyOutput struct {
+	_ struct{} `type:"structure"`
+
+	EvaluationResults []*iamEvaluationResult `type:"list"`
+}
+
+type iamEvaluationResult struct {
+	_ struct{} `type:"structure"`
+
+	EvalActionName *string `min:"3" type:"string" required:"true"`
+	EvalDecision   *string `type:"string" required:"true"`
+}
+
+// DeniedActions implements IAM. The instance profile's actions are
+// those of its role, which are evaluated by the IAM policy
+// simulator.
+func (c *iamClient) DeniedActions(ctx context.Context, instanceProfileARN string, actions []string) ([]string, error) {
+	// Instance profile ARNs are of the form
+	// arn:aws:iam::account:instance-profile/path/name.
+	name := instanceProfileARN[strings.LastIndex(instanceProfileARN, "/")+1:]
+	profile := new(iamGetInstanceProfileOutput)
+	req := c.NewRequest(&request.Operation{
+		Name:       "GetInstanceProfile",
+		HTTPMethod: "POST",
+		HTTPPath:   "/",
+	}, &iamGetInstanceProfileInput{InstanceProfileName: aws.String(name)}, profile)
+	req.SetContext(ctx)
+	if err := req.Send(); err != nil {
+		return nil, err
+	}
+	// Instance profiles contain at most one role.
+	if profile.InstanceProfile == nil || len(profile.InstanceProfile.Roles) == 0 || aws.StringValue(profile.InstanceProfile.Roles[0].Arn) == "" {
+		return nil, errors.E("iam.getinstanceprofile", instanceProfileARN, errors.Invalid,
+			errors.New("instance profile has no role"))
+	}
+	input := &iamSimulatePrincipalPolicyInput{
+		PolicySourceArn: profile.InstanceProfile.Roles[0].Arn,
+		ActionNames:     aws.StringSlice(actions),
+	}
+	output := new(iamSimulatePrincipalPolicyOutput)
+	req = c.NewRequest(&request.Operation{
+		Name:       "SimulatePrincipalPolicy",
+		HTTPMethod: "POST",
+		HTTPPath:   "/",
+	}, input, output)
+	req.SetContext(ctx)
+	if err := req.Send(); err != nil {
+		return nil, err
+	}
+	allowed := make(map[string]bool)
+	for _, result := range output.EvaluationResults {
+		if aws.StringValue(result.EvalDecision) == "allowed" {
+			allowed[aws.StringValue(result.EvalActionName)] = true
+		}
+	}
+	var denied []string
+	for _, action := range actions {
+		if !allowed[action] {
+			denied = append(denied, action)
+		}
+	}
+	return denied, nil
+}
@@ -0,0 +1,192 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/grailbio/reflow/errors"
+)
+
+// testIAM is a mock IAM that permits the provided actions.
+type testIAM struct {
+	allowed map[string]bool
+}
+
+func (i testIAM) DeniedActions(ctx context.Context, arn string, actions []string) ([]string, error) {
+	var denied []string
+	for _, action := range actions {
+		if !i.allowed[action] {
+			denied = append(denied, action)
+		}
+	}
+	return denied, nil
+}
+
+func TestUserDataLogGroup(t *testing.T) {
+	i := newTestInstance()
+	i.Region = "us-west-2"
+	i.Tag = "reflow:test"
+	ud := renderUserData(t, i)
+	if strings.Contains(ud, "awslogs") {
+		t.Errorf("unexpected log driver:\n%s", ud)
+	}
+	i.LogGroup = "/reflow/reflowlets"
+	const want = "--log-driver=awslogs --log-opt awslogs-region=us-west-2 --log-opt awslogs-group=/reflow/reflowlets --log-opt awslogs-stream=reflow-test/%H/%n \\"
+	ud = renderUserData(t, i)
+	if !strings.Contains(ud, want) {
+		t.Errorf("missing log driver flags %q:\n%s", want, ud)
+	}
+	i.BootConfig = bootConfigIgnition
+	ud = strings.NewReplacer(`\n`, "\n", `\\`, `\`).Replace(renderUserData(t, i))
+	if !strings.Contains(ud, want) {
+		t.Errorf("missing log driver flags %q:\n%s", want, ud)
+	}
+
+	i.LogGroup = "reflow logs"
+	if _, err := i.renderUserData(); !errors.Match(errors.Fatal, err) {
+		t.Errorf("expected fatal error, got %v", err)
+	}
+}
+
+func TestCheckLogForwarding(t *testing.T) {
+	ctx := context.Background()
+	api := testIAM{map[string]bool{"logs:CreateLogStream": true, "logs:PutLogEvents": true}}
+	if err := CheckLogForwarding(ctx, api, "arn:aws:iam::123:instance-profile/reflowlet", "/reflow"); err != nil {
+		t.Error(err)
+	}
+	api = testIAM{map[string]bool{"logs:CreateLogStream": true}}
+	err := CheckLogForwarding(ctx, api, "arn:aws:iam::123:instance-profile/reflowlet", "/reflow")
+	if !errors.Match(errors.NotAllowed, err) {
+		t.Errorf("expected not allowed error, got %v", err)
+	}
+	if err != nil && !strings.Contains(err.Error(), "logs:PutLogEvents") {
+		t.Errorf("expected denied action in error, got %v", err)
+	}
+}
+
+// testProfileIAM is a mock IAM that permits all actions to the
+// provided instance profiles, and none to others.
+type testProfileIAM map[string]bool
+
+func (i testProfileIAM) DeniedActions(ctx context.Context, arn string, actions []string) ([]string, error) {
+	if i[arn] {
+		return nil, nil
+	}
+	return actions, nil
+}
+
+func TestClusterCheckLogForwarding(t *testing.T) {
+	ctx := context.Background()
+	api := testProfileIAM{"arn:aws:iam::123:instance-profile/a": true}
+	c := &Cluster{IAM: api, LogGroup: "/reflow", InstanceProfile: "arn:aws:iam::123:instance-profile/a"}
+	if err := c.checkLogForwarding(ctx); err != nil {
+		t.Error(err)
+	}
+	// Every candidate instance profile is checked.
+	c.InstanceProfiles = []string{"arn:aws:iam::123:instance-profile/a", "arn:aws:iam::123:instance-profile/b"}
+	err := c.checkLogForwarding(ctx)
+	if !errors.Match(errors.NotAllowed, err) {
+		t.Errorf("expected not allowed error, got %v", err)
+	}
+	if err != nil && !strings.Contains(err.Error(), "instance-profile/b") {
+		t.Errorf("expected denied profile in error, got %v", err)
+	}
+	api["arn:aws:iam::123:instance-profile/b"] = true
+	if err := c.checkLogForwarding(ctx); err != nil {
+		t.Error(err)
+	}
+	// Log forwarding requires an instance profile.
+	c.InstanceProfile, c.InstanceProfiles = "", nil
+	if err := c.checkLogForwarding(ctx); !errors.Match(errors.Invalid, err) {
+		t.Errorf("expected invalid error, got %v", err)
+	}
+}
+
+func TestIAMDeniedActions(t *testing.T) {
+	var actions []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Fatal(err)
+		}
+		action := r.PostForm.Get("Action")
+		actions = append(actions, action)
+		var result string
+		switch action {
+		case "GetInstanceProfile":
+			if got, want := r.PostForm.Get("InstanceProfileName"), "reflowlet"; got != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			result = `<InstanceProfile><Roles><member><Arn>arn:aws:iam::123:role/reflowlet</Arn></member></Roles></InstanceProfile>`
+		case "SimulatePrincipalPolicy":
+			if got, want := r.PostForm.Get("PolicySourceArn"), "arn:aws:iam::123:role/reflowlet"; got != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			if got, want := r.PostForm.Get("ActionNames.member.2"), "logs:PutLogEvents"; got != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			result = `<EvaluationResults>` +
+				`<member><EvalActionName>logs:CreateLogStream</EvalActionName><EvalDecision>allowed</EvalDecision></member>` +
+				`<member><EvalActionName>logs:PutLogEvents</EvalActionName><EvalDecision>implicitDeny</EvalDecision></member>` +
+				`</EvaluationResults>`
+		}
+		fmt.Fprintf(w, `<%sResponse xmlns="https://iam.amazonaws.com/doc/2010-05-08/"><%sResult>%s</%sResult><ResponseMetadata><RequestId>test</RequestId></ResponseMetadata></%sResponse>`, action, action, result, action, action)
+	}))
+	defer srv.Close()
+	sess, err := session.NewSession(&aws.Config{
+		Endpoint:    aws.String(srv.URL),
+		Region:      aws.String("us-west-2"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		MaxRetries:  aws.Int(0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	denied, err := NewIAM(sess).DeniedActions(context.Background(), "arn:aws:iam::123:instance-profile/reflowlet", awslogsActions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := denied, []string{"logs:PutLogEvents"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := actions, []string{"GetInstanceProfile", "SimulatePrincipalPolicy"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestIAMDeniedActionsNoRole(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := r.PostForm.Get("Action"), "GetInstanceProfile"; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		fmt.Fprint(w, `<GetInstanceProfileResponse xmlns="https://iam.amazonaws.com/doc/2010-05-08/"><GetInstanceProfileResult><InstanceProfile><Roles></Roles></InstanceProfile></GetInstanceProfileResult><ResponseMetadata><RequestId>test</RequestId></ResponseMetadata></GetInstanceProfileResponse>`)
+	}))
+	defer srv.Close()
+	sess, err := session.NewSession(&aws.Config{
+		Endpoint:    aws.String(srv.URL),
+		Region:      aws.String("us-west-2"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		MaxRetries:  aws.Int(0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = CheckLogForwarding(context.Background(), NewIAM(sess), "arn:aws:iam::123:instance-profile/reflowlet", "/reflow")
+	if !errors.Match(errors.Invalid, err) {
+		t.Errorf("expected invalid error, got %v", err)
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/grailbio/reflow/pool"
+)
+
+// mockEC2 is a mock EC2 client. Calls to methods that are not
+// explicitly mocked panic.
+type mockEC2 struct {
+	ec2iface.EC2API
+
+	AllocateAddressFunc               func(*ec2.AllocateAddressInput) (*ec2.AllocateAddressOutput, error)
+	AssociateAddressFunc              func(*ec2.AssociateAddressInput) (*ec2.AssociateAddressOutput, error)
+	DescribeAddressesFunc             func(*ec2.DescribeAddressesInput) (*ec2.DescribeAddressesOutput, error)
+	DisassociateAddressFunc           func(*ec2.DisassociateAddressInput) (*ec2.DisassociateAddressOutput, error)
+	ReleaseAddressFunc                func(*ec2.ReleaseAddressInput) (*ec2.ReleaseAddressOutput, error)
+	DescribeInstancesPagesFunc        func(*ec2.DescribeInstancesInput) ([]*ec2.DescribeInstancesOutput, error)
+	DescribeInstancesFunc             func(*ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error)
+	DescribeSpotPriceHistoryFunc      func(*ec2.DescribeSpotPriceHistoryInput) (*ec2.DescribeSpotPriceHistoryOutput, error)
+	DescribeSubnetsFunc               func(*ec2.DescribeSubnetsInput) (*ec2.DescribeSubnetsOutput, error)
+	DescribeHostsFunc                 func(*ec2.DescribeHostsInput) (*ec2.DescribeHostsOutput, error)
+	AllocateHostsFunc                 func(*ec2.AllocateHostsInput) (*ec2.AllocateHostsOutput, error)
+	CreateTagsFunc                    func(*ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error)
+	CreateSnapshotFunc                func(*ec2.CreateSnapshotInput) (*ec2.Snapshot, error)
+	DescribeImagesFunc                func(*ec2.DescribeImagesInput) (*ec2.DescribeImagesOutput, error)
+	DescribeSecurityGroupsFunc        func(*ec2.DescribeSecurityGroupsInput) (*ec2.DescribeSecurityGroupsOutput, error)
+	CreateSecurityGroupFunc           func(*ec2.CreateSecurityGroupInput) (*ec2.CreateSecurityGroupOutput, error)
+	AuthorizeSecurityGroupIngressFunc func(*ec2.AuthorizeSecurityGroupIngressInput) (*ec2.AuthorizeSecurityGroupIngressOutput, error)
+	RequestSpotInstancesFunc          func(*ec2.RequestSpotInstancesInput) (*ec2.RequestSpotInstancesOutput, error)
+	DescribeSpotInstanceRequestsFunc  func(*ec2.DescribeSpotInstanceRequestsInput) (*ec2.DescribeSpotInstanceRequestsOutput, error)
+	CancelSpotInstanceRequestsFunc    func(*ec2.CancelSpotInstanceRequestsInput) (*ec2.CancelSpotInstanceRequestsOutput, error)
+	RunInstancesFunc                  func(*ec2.RunInstancesInput) (*ec2.Reservation, error)
+	WaitUntilInstanceRunningFunc      func(aws.Context, *ec2.DescribeInstancesInput) error
+	TerminateInstancesFunc            func(*ec2.TerminateInstancesInput) (*ec2.TerminateInstancesOutput, error)
+}
+
+// newLaunchMockEC2 returns a mock EC2 client that successfully
+// launches instances with the given ID and public DNS name.
+func newLaunchMockEC2(id, dns string) *mockEC2 {
+	return &mockEC2{
+		RunInstancesFunc: func(input *ec2.RunInstancesInput) (*ec2.Reservation, error) {
+			return &ec2.Reservation{Instances: []*ec2.Instance{{InstanceId: aws.String(id)}}}, nil
+		},
+		CreateTagsFunc: func(input *ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error) {
+			return &ec2.CreateTagsOutput{}, nil
+		},
+		WaitUntilInstanceRunningFunc: func(ctx aws.Context, input *ec2.DescribeInstancesInput) error {
+			return nil
+		},
+		DescribeInstancesFunc: func(input *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
+			return &ec2.DescribeInstancesOutput{
+				Reservations: []*ec2.Reservation{{
+					Instances: []*ec2.Instance{{
+						InstanceId:    aws.String(id),
+						PublicDnsName: aws.String(dns),
+					}},
+				}},
+			}, nil
+		},
+	}
+}
+
+func (m *mockEC2) DescribeSubnetsWithContext(ctx aws.Context, input *ec2.DescribeSubnetsInput, opts ...request.Option) (*ec2.DescribeSubnetsOutput, error) {
+	return m.DescribeSubnetsFunc(input)
+}
+
+func (m *mockEC2) DescribeHostsWithContext(ctx aws.Context, input *ec2.DescribeHostsInput, opts ...request.Option) (*ec2.DescribeHostsOutput, error) {
+	return m.DescribeHostsFunc(input)
+}
+
+func (m *mockEC2) AllocateHostsWithContext(ctx aws.Context, input *ec2.AllocateHostsInput, opts ...request.Option) (*ec2.AllocateHostsOutput, error) {
+	return m.AllocateHostsFunc(input)
+}
+
+func (m *mockEC2) CreateTagsWithContext(ctx aws.Context, input *ec2.CreateTagsInput, opts ...request.Option) (*ec2.CreateTagsOutput, error) {
+	return m.CreateTagsFunc(input)
+}
+
+func (m *mockEC2) CreateTags(input *ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error) {
+	return m.CreateTagsFunc(input)
+}
+
+func (m *mockEC2) RunInstances(input *ec2.RunInstancesInput) (*ec2.Reservation, error) {
+	return m.RunInstancesFunc(input)
+}
+
+func (m *mockEC2) RunInstancesWithContext(ctx aws.Context, input *ec2.RunInstancesInput, opts ...request.Option) (*ec2.Reservation, error) {
+	return m.RunInstancesFunc(input)
+}
+
+func (m *mockEC2) WaitUntilInstanceRunningWithContext(ctx aws.Context, input *ec2.DescribeInstancesInput, opts ...request.WaiterOption) error {
+	return m.WaitUntilInstanceRunningFunc(ctx, input)
+}
+
+func (m *mockEC2) TerminateInstancesWithContext(ctx aws.Context, input *ec2.TerminateInstancesInput, opts ...request.Option) (*ec2.TerminateInstancesOutput, error) {
+	return m.TerminateInstancesFunc(input)
+}
+
+// testPool is a mock pool whose offers are provided by OffersFunc.
+type testPool struct {
+	pool.Pool
+	OffersFunc func() ([]pool.Offer, error)
+}
+
+func (p *testPool) Offers(ctx context.Context) ([]pool.Offer, error) {
+	return p.OffersFunc()
+}
+
+func (m *mockEC2) AllocateAddressWithContext(ctx aws.Context, input *ec2.AllocateAddressInput, opts ...request.Option) (*ec2.AllocateAddressOutput, error) {
+	return m.AllocateAddressFunc(input)
+}
+
+func (m *mockEC2) AssociateAddressWithContext(ctx aws.Context, input *ec2.AssociateAddressInput, opts ...request.Option) (*ec2.AssociateAddressOutput, error) {
+	return m.AssociateAddressFunc(input)
+}
+
+func (m *mockEC2) DescribeAddressesWithContext(ctx aws.Context, input *ec2.DescribeAddressesInput, opts ...request.Option) (*ec2.DescribeAddressesOutput, error) {
+	return m.DescribeAddressesFunc(input)
+}
+
+func (m *mockEC2) DisassociateAddressWithContext(ctx aws.Context, input *ec2.DisassociateAddressInput, opts ...request.Option) (*ec2.DisassociateAddressOutput, error) {
+	return m.DisassociateAddressFunc(input)
+}
+
+func (m *mockEC2) ReleaseAddressWithContext(ctx aws.Context, input *ec2.ReleaseAddressInput, opts ...request.Option) (*ec2.ReleaseAddressOutput, error) {
+	return m.ReleaseAddressFunc(input)
+}
+
+func (m *mockEC2) DescribeInstancesWithContext(ctx aws.Context, input *ec2.DescribeInstancesInput, opts ...request.Option) (*ec2.DescribeInstancesOutput, error) {
+	return m.DescribeInstancesFunc(input)
+}
+
+func (m *mockEC2) DescribeInstancesPagesWithContext(ctx aws.Context, input *ec2.DescribeInstancesInput, fn func(*ec2.DescribeInstancesOutput, bool) bool, opts ...request.Option) error {
+	pages, err := m.DescribeInstancesPagesFunc(input)
+	if err != nil {
+		return err
+	}
+	for i, page := range pages {
+		if !fn(page, i == len(pages)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+func (m *mockEC2) DescribeSpotPriceHistoryWithContext(ctx aws.Context, input *ec2.DescribeSpotPriceHistoryInput, opts ...request.Option) (*ec2.DescribeSpotPriceHistoryOutput, error) {
+	return m.DescribeSpotPriceHistoryFunc(input)
+}
+
+func (m *mockEC2) CreateSnapshotWithContext(ctx aws.Context, input *ec2.CreateSnapshotInput, opts ...request.Option) (*ec2.Snapshot, error) {
+	return m.CreateSnapshotFunc(input)
+}
+
+func (m *mockEC2) DescribeImagesWithContext(ctx aws.Context, input *ec2.DescribeImagesInput, opts ...request.Option) (*ec2.DescribeImagesOutput, error) {
+	return m.DescribeImagesFunc(input)
+}
+
+func (m *mockEC2) DescribeSecurityGroupsWithContext(ctx aws.Context, input *ec2.DescribeSecurityGroupsInput, opts ...request.Option) (*ec2.DescribeSecurityGroupsOutput, error) {
+	return m.DescribeSecurityGroupsFunc(input)
+}
+
+func (m *mockEC2) RequestSpotInstancesWithContext(ctx aws.Context, input *ec2.RequestSpotInstancesInput, opts ...request.Option) (*ec2.RequestSpotInstancesOutput, error) {
+	return m.RequestSpotInstancesFunc(input)
+}
+
+func (m *mockEC2) DescribeSpotInstanceRequestsWithContext(ctx aws.Context, input *ec2.DescribeSpotInstanceRequestsInput, opts ...request.Option) (*ec2.DescribeSpotInstanceRequestsOutput, error) {
+	return m.DescribeSpotInstanceRequestsFunc(input)
+}
+
+func (m *mockEC2) CancelSpotInstanceRequestsWithContext(ctx aws.Context, input *ec2.CancelSpotInstanceRequestsInput, opts ...request.Option) (*ec2.CancelSpotInstanceRequestsOutput, error) {
+	return m.CancelSpotInstanceRequestsFunc(input)
+}
+
+func (m *mockEC2) CreateSecurityGroupWithContext(ctx aws.Context, input *ec2.CreateSecurityGroupInput, opts ...request.Option) (*ec2.CreateSecurityGroupOutput, error) {
+	return m.CreateSecurityGroupFunc(input)
+}
+
+func (m *mockEC2) AuthorizeSecurityGroupIngressWithContext(ctx aws.Context, input *ec2.AuthorizeSecurityGroupIngressInput, opts ...request.Option) (*ec2.AuthorizeSecurityGroupIngressOutput, error) {
+	return m.AuthorizeSecurityGroupIngressFunc(input)
+}
@@ -0,0 +1,79 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/grailbio/reflow/errors"
+)
+
+// defaultNFSOptions are the mount options used for NFS mounts that
+// do not specify their own. They are those recommended for EFS.
+const defaultNFSOptions = "nfsvers=4.1,rsize=1048576,wsize=1048576,hard,timeo=600,retrans=2,noresvport"
+
+// NFSMount describes an NFS share (e.g., an EFS file system) that is
+// mounted on cluster instances before the reflowlet starts.
+type NFSMount struct {
+	// Source is the NFS share to mount, e.g.,
+	// "fs-12345678.efs.us-west-2.amazonaws.com:/".
+	Source string
+	// Path is the absolute path at which the share is mounted.
+	Path string
+	// Options are the mount options. If empty, defaultNFSOptions
+	// are used.
+	Options string
+}
+
+// nfsMountArgs are the user data parameters for an NFS mount.
+type nfsMountArgs struct {
+	NFSMount
+	// Unit is the name of the systemd mount unit.
+	Unit string
+}
+
+// newNFSMountArgs validates the provided mounts and computes their
+// user data parameters.
+func newNFSMountArgs(mounts []NFSMount) ([]nfsMountArgs, error) {
+	var args []nfsMountArgs
+	for _, m := range mounts {
+		if m.Source == "" {
+			return nil, errors.E(errors.Fatal, errors.Errorf("nfs mount %s: missing source", m.Path))
+		}
+		if !path.IsAbs(m.Path) || path.Clean(m.Path) != m.Path || m.Path == "/" {
+			return nil, errors.E(errors.Fatal, errors.Errorf("nfs mount %s: invalid path %q", m.Source, m.Path))
+		}
+		if strings.ContainsAny(m.Source+m.Options, " \t\n") {
+			return nil, errors.E(errors.Fatal, errors.Errorf("nfs mount %s: source and options may not contain whitespace", m.Path))
+		}
+		if m.Options == "" {
+			m.Options = defaultNFSOptions
+		}
+		args = append(args, nfsMountArgs{m, systemdEscapePath(m.Path) + ".mount"})
+	}
+	return args, nil
+}
+
+// systemdEscapePath escapes the absolute path p as systemd does
+// (see systemd-escape --path) to name the units associated with it.
+func systemdEscapePath(p string) string {
+	p = strings.Trim(p, "/")
+	var b bytes.Buffer
+	for i := 0; i < len(p); i++ {
+		switch c := p[i]; {
+		case c == '/':
+			b.WriteByte('-')
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9',
+			c == ':', c == '_', c == '.' && i > 0:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, `\x%02x`, c)
+		}
+	}
+	return b.String()
+}
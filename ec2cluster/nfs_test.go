@@ -0,0 +1,98 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/grailbio/reflow/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestSystemdEscapePath(t *testing.T) {
+	for _, c := range []struct{ path, escaped string }{
+		{"/mnt/data", "mnt-data"},
+		{"/mnt/ref-data", `mnt-ref\x2ddata`},
+		{"/mnt/.hidden", "mnt-.hidden"},
+		{"/.hidden", `\x2ehidden`},
+		{"/mnt/a b", `mnt-a\x20b`},
+	} {
+		if got, want := systemdEscapePath(c.path), c.escaped; got != want {
+			t.Errorf("%s: got %v, want %v", c.path, got, want)
+		}
+	}
+}
+
+func TestUserDataNFSMounts(t *testing.T) {
+	i := newTestInstance()
+	i.NFSMounts = []NFSMount{
+		{Source: "fs-12345678.efs.us-west-2.amazonaws.com:/", Path: "/mnt/ref-data"},
+		{Source: "nfs.example.com:/exports/scratch", Path: "/mnt/scratch", Options: "nfsvers=4.0,ro"},
+	}
+	ud := renderUserData(t, i)
+	var cloudConfig struct {
+		Coreos struct {
+			Units []struct {
+				Name    string
+				Content string
+			}
+		}
+	}
+	if err := yaml.Unmarshal([]byte(ud), &cloudConfig); err != nil {
+		t.Fatalf("invalid user data: %v\n%s", err, ud)
+	}
+	var (
+		names     []string
+		reflowlet string
+		units     = make(map[string]string)
+	)
+	for _, unit := range cloudConfig.Coreos.Units {
+		names = append(names, unit.Name)
+		units[unit.Name] = unit.Content
+		if unit.Name == "reflowlet.service" {
+			reflowlet = unit.Content
+		}
+	}
+	for _, c := range []struct{ unit, source, path, options string }{
+		{`mnt-ref\x2ddata.mount`, "fs-12345678.efs.us-west-2.amazonaws.com:/", "/mnt/ref-data", defaultNFSOptions},
+		{"mnt-scratch.mount", "nfs.example.com:/exports/scratch", "/mnt/scratch", "nfsvers=4.0,ro"},
+	} {
+		content, ok := units[c.unit]
+		if !ok {
+			t.Errorf("missing unit %s in %v", c.unit, names)
+			continue
+		}
+		for _, want := range []string{"What=" + c.source, "Where=" + c.path, "Type=nfs4", "Options=" + c.options} {
+			if !strings.Contains(content, want) {
+				t.Errorf("%s: expected %q, got:\n%s", c.unit, want, content)
+			}
+		}
+		// The reflowlet must start after the share is mounted.
+		for _, want := range []string{"Requires=" + c.unit, "After=" + c.unit} {
+			if !strings.Contains(reflowlet, want) {
+				t.Errorf("reflowlet.service: expected %q, got:\n%s", want, reflowlet)
+			}
+		}
+	}
+
+	i.BootConfig = bootConfigIgnition
+	if ud := renderUserData(t, i); !strings.Contains(ud, `"name":"mnt-scratch.mount"`) || !strings.Contains(ud, `After=mnt-scratch.mount`) {
+		t.Errorf("ignition config is missing the NFS mount:\n%s", ud)
+	}
+
+	for _, mount := range []NFSMount{
+		{Source: "nfs.example.com:/", Path: "relative"},
+		{Source: "nfs.example.com:/", Path: "/"},
+		{Source: "nfs.example.com:/", Path: "/mnt/../etc"},
+		{Path: "/mnt/scratch"},
+		{Source: "nfs.example.com:/", Path: "/mnt/scratch", Options: "ro\nExecStart=/bin/evil"},
+	} {
+		i.NFSMounts = []NFSMount{mount}
+		if _, err := i.renderUserData(); !errors.Match(errors.Fatal, err) {
+			t.Errorf("%+v: expected fatal error, got %v", mount, err)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster
+
+import (
+	"sort"
+
+	"github.com/grailbio/reflow"
+)
+
+// Placement is an instance, by its config, together with the tasks
+// that are packed onto it.
+type Placement struct {
+	// Config is the instance type of the placement.
+	Config instanceConfig
+	// Tasks are the indices, into the needs provided to PackInto, of
+	// the tasks that are placed on the instance.
+	Tasks []int
+
+	free reflow.Resources
+}
+
+// PackInto packs tasks with the provided resource needs onto
+// currently available instance types, attempting to minimize their
+// total cost. It is a scheduling aid: one large instance is often
+// cheaper than many small ones.
+//
+// PackInto uses a first-fit-decreasing heuristic: tasks are
+// considered in decreasing order of size, and each is placed on the
+// first instance on which it fits. When a task fits on no instance,
+// a new one is added, of the type with the lowest cost per task,
+// where the number of tasks is estimated by first-fitting the
+// remaining tasks into it. Tasks that fit on no available instance
+// type are not placed.
+func (s *instanceState) PackInto(needs []reflow.Resources, spot bool) []Placement {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var candidates []instanceConfig
+	for _, config := range s.configs {
+		if s.coolingDown(config.Type) || !s.permitsRatio(config) || spot && !config.SpotOk {
+			continue
+		}
+		if s.effectivePrice(config, spot) == 0 {
+			continue
+		}
+		candidates = append(candidates, config)
+	}
+	order := make([]int, len(needs))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := needs[order[i]], needs[order[j]]
+		if a.Memory != b.Memory {
+			return a.Memory > b.Memory
+		}
+		return a.CPU > b.CPU
+	})
+	var placements []Placement
+	for k, task := range order {
+		need := needs[task]
+		placed := false
+		for i := range placements {
+			if need.LessEqualAll(placements[i].free) {
+				placements[i].free = placements[i].free.Sub(need)
+				placements[i].Tasks = append(placements[i].Tasks, task)
+				placed = true
+				break
+			}
+		}
+		if placed {
+			continue
+		}
+		var (
+			best     instanceConfig
+			bestCost float64
+		)
+		for _, config := range candidates {
+			if !need.LessEqualAll(config.Resources) {
+				continue
+			}
+			// Estimate the number of the remaining tasks that would be
+			// placed on an instance of this type.
+			n, free := 1, config.Resources.Sub(need)
+			for _, next := range order[k+1:] {
+				if needs[next].LessEqualAll(free) {
+					free = free.Sub(needs[next])
+					n++
+				}
+			}
+			price := s.effectivePrice(config, spot)
+			if cost := price / float64(n); best.Type == "" || cost < bestCost || cost == bestCost && price < s.effectivePrice(best, spot) {
+				best, bestCost = config, cost
+			}
+		}
+		if best.Type == "" {
+			continue
+		}
+		placements = append(placements, Placement{
+			Config: best,
+			Tasks:  []int{task},
+			free:   best.Resources.Sub(need),
+		})
+	}
+	return placements
+}
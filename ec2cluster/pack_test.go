@@ -0,0 +1,81 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/grailbio/reflow"
+)
+
+func TestPackInto(t *testing.T) {
+	configs := []instanceConfig{
+		{Type: "small", Resources: reflow.Resources{CPU: 2, Memory: 4 << 30}, Price: map[string]float64{"us-west-2": 0.1}},
+		{Type: "medium", Resources: reflow.Resources{CPU: 8, Memory: 32 << 30}, Price: map[string]float64{"us-west-2": 0.4}},
+		{Type: "large", Resources: reflow.Resources{CPU: 16, Memory: 64 << 30}, Price: map[string]float64{"us-west-2": 0.6}},
+	}
+	s := newInstanceState(configs, time.Minute, "us-west-2")
+	var needs []reflow.Resources
+	for i := 0; i < 12; i++ {
+		needs = append(needs, reflow.Resources{CPU: 1, Memory: 2 << 30})
+	}
+	needs = append(needs,
+		reflow.Resources{CPU: 6, Memory: 24 << 30},
+		reflow.Resources{CPU: 4, Memory: 16 << 30},
+		reflow.Resources{CPU: 128, Memory: 1 << 40},
+	)
+	placements := s.PackInto(needs, false)
+
+	placed := make(map[int]bool)
+	var plan []instanceConfig
+	for _, p := range placements {
+		var total reflow.Resources
+		for _, task := range p.Tasks {
+			if placed[task] {
+				t.Errorf("task %d placed more than once", task)
+			}
+			placed[task] = true
+			total = total.Add(needs[task])
+		}
+		if !total.LessEqualAll(p.Config.Resources) {
+			t.Errorf("tasks %v (%s) do not fit in %s", p.Tasks, total, p.Config.Type)
+		}
+		plan = append(plan, p.Config)
+	}
+	// The last task does not fit on any instance type.
+	if got, want := len(placed), len(needs)-1; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if placed[len(needs)-1] {
+		t.Error("unexpected placement of oversized task")
+	}
+
+	// Compare against one instance per task.
+	var naive []instanceConfig
+	for _, need := range needs[:len(needs)-1] {
+		config, ok := s.MinAvailable(need, false)
+		if !ok {
+			t.Fatal("no available instance type")
+		}
+		naive = append(naive, config)
+	}
+	packed, unpacked := s.EstimateCost(plan, false), s.EstimateCost(naive, false)
+	if got, want := packed, 0.9; math.Abs(got-want) > 1e-9 {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if packed >= unpacked {
+		t.Errorf("packed cost %v is not less than naive cost %v", packed, unpacked)
+	}
+
+	// Types that are cooling down are not used.
+	s.Unavailable(configs[2])
+	for _, p := range s.PackInto(needs, false) {
+		if p.Config.Type == "large" {
+			t.Error("unexpected placement on unavailable type")
+		}
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster
+
+import "github.com/grailbio/reflow/pool"
+
+// A LaunchProfile bundles instance launch settings that are
+// commonly used together, e.g., for a class of workloads. Zero
+// values in a profile leave the corresponding instance settings
+// unchanged.
+type LaunchProfile struct {
+	// Name is the name of the profile.
+	Name string
+
+	// EBSType, EBSTypes, and EBSSize configure the data volume.
+	EBSType  string
+	EBSTypes []string
+	EBSSize  uint64
+	// DockerEBSType and DockerEBSSize configure the Docker volume.
+	DockerEBSType string
+	DockerEBSSize uint64
+
+	// HostPool sets the dedicated host pool (and thus host tenancy)
+	// of the instance.
+	HostPool string
+	// AvailabilityZone and Subnet configure instance placement.
+	AvailabilityZone string
+	Subnet           string
+	// SecurityGroup and InstanceProfile configure instance access.
+	SecurityGroup   string
+	InstanceProfile string
+
+	// Labels are added to the instance's labels; they take precedence
+	// over existing labels with the same keys.
+	Labels pool.Labels
+}
+
+// ApplyProfile populates the instance's settings from the provided
+// launch profile.
+func (i *instance) ApplyProfile(p LaunchProfile) {
+	setString := func(dst *string, src string) {
+		if src != "" {
+			*dst = src
+		}
+	}
+	setString(&i.EBSType, p.EBSType)
+	if len(p.EBSTypes) > 0 {
+		i.EBSTypes = append([]string(nil), p.EBSTypes...)
+	}
+	if p.EBSSize > 0 {
+		i.EBSSize = p.EBSSize
+	}
+	setString(&i.DockerEBSType, p.DockerEBSType)
+	if p.DockerEBSSize > 0 {
+		i.DockerEBSSize = p.DockerEBSSize
+	}
+	setString(&i.HostPool, p.HostPool)
+	setString(&i.AvailabilityZone, p.AvailabilityZone)
+	setString(&i.Subnet, p.Subnet)
+	setString(&i.SecurityGroup, p.SecurityGroup)
+	setString(&i.InstanceProfile, p.InstanceProfile)
+	if len(p.Labels) > 0 {
+		i.Labels = pool.MergeLabels(i.Labels, p.Labels)
+	}
+}
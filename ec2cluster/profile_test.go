@@ -0,0 +1,60 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/grailbio/reflow/pool"
+)
+
+func TestApplyProfile(t *testing.T) {
+	i := newTestInstance()
+	i.EBSType = "gp2"
+	i.EBSSize = 100
+	i.SecurityGroup = "sg-default"
+	i.Labels = pool.Labels{"team": "infra", "class": "default"}
+	profile := LaunchProfile{
+		Name:             "highmem",
+		EBSTypes:         []string{"gp3", "gp2"},
+		EBSSize:          1000,
+		DockerEBSSize:    200,
+		HostPool:         "dedicated",
+		AvailabilityZone: "us-west-2a",
+		Subnet:           "subnet-123",
+		Labels:           pool.Labels{"class": "highmem"},
+	}
+	i.ApplyProfile(profile)
+	if got, want := i.EBSTypes, []string{"gp3", "gp2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := i.EBSSize, uint64(1000); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := i.DockerEBSSize, uint64(200); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for _, c := range []struct{ got, want string }{
+		{i.HostPool, "dedicated"},
+		{i.AvailabilityZone, "us-west-2a"},
+		{i.Subnet, "subnet-123"},
+		// Unset profile fields leave settings unchanged.
+		{i.EBSType, "gp2"},
+		{i.SecurityGroup, "sg-default"},
+	} {
+		if c.got != c.want {
+			t.Errorf("got %v, want %v", c.got, c.want)
+		}
+	}
+	if got, want := i.Labels, (pool.Labels{"team": "infra", "class": "highmem"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// The profile is not aliased by the instance.
+	i.EBSTypes[0] = "io1"
+	if got, want := profile.EBSTypes[0], "gp3"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/grailbio/reflow/errors"
+	"github.com/grailbio/reflow/log"
+	"github.com/grailbio/reflow/pool"
+)
+
+// reaperProbeTimeout is the amount of time a reflowlet is given to
+// respond to a health probe.
+const reaperProbeTimeout = 10 * time.Second
+
+// A Reaper reclaims zombie instances: running instances whose
+// reflowlet has died. Such instances are invisible to EC2-based
+// liveness checks (e.g., ListInstances), but cannot do any work.
+type Reaper struct {
+	// EC2 is the EC2 API through which instances are listed and
+	// terminated.
+	EC2 ec2iface.EC2API
+	// Tag is the Reflow tag of the instances that are reaped.
+	Tag string
+	// Grace is the amount of time an instance's reflowlet must fail
+	// health probes before the instance is terminated. Instances are
+	// not reaped before they have been up for the grace period.
+	Grace time.Duration
+	// Dial returns a pool client for the reflowlet at the provided
+	// base URL.
+	Dial func(baseurl string) (pool.Pool, error)
+	// Log, if set, logs reaped instances.
+	Log *log.Logger
+	// AllowPrivateAddress permits probing reflowlets on an instance's
+	// private address when it has no public one.
+	AllowPrivateAddress bool
+	// Reflowlets is the number of reflowlets that run on each
+	// instance. An instance is healthy as long as any of its
+	// reflowlets passes its probe, since idle reflowlets may exit
+	// while others are busy.
+	Reflowlets int
+
+	// now is the time source used for grace periods.
+	now func() time.Time
+	// failing stores the time of the first of the current run of
+	// failed probes of each failing instance.
+	failing map[string]time.Time
+}
+
+// Reap probes the reflowlet of each running instance (as returned
+// by ListInstances) by querying its offers, and terminates the
+// instances whose reflowlets have failed their probes for longer
+// than the grace period. Reap returns the IDs of the terminated
+// instances.
+func (r *Reaper) Reap(ctx context.Context) ([]string, error) {
+	if r.now == nil {
+		r.now = time.Now
+	}
+	if r.failing == nil {
+		r.failing = make(map[string]time.Time)
+	}
+	instances, err := ListInstances(ctx, r.EC2, r.Tag)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		now     = r.now()
+		running = make(map[string]bool)
+		reaped  []string
+	)
+	for _, inst := range instances {
+		id := aws.StringValue(inst.InstanceId)
+		if aws.StringValue(inst.State.Name) != ec2.InstanceStateNameRunning || now.Sub(aws.TimeValue(inst.LaunchTime)) < r.Grace {
+			continue
+		}
+		running[id] = true
+		if err := r.probe(ctx, inst); err == nil {
+			delete(r.failing, id)
+			continue
+		} else if _, ok := r.failing[id]; !ok {
+			r.Log.Debugf("reflowlet on instance %s failed health probe: %v", id, err)
+			r.failing[id] = now
+		}
+		if now.Sub(r.failing[id]) < r.Grace {
+			continue
+		}
+		r.Log.Printf("terminating instance %s: reflowlet failed health probes for %s", id, now.Sub(r.failing[id]))
+		_, err := r.EC2.TerminateInstancesWithContext(ctx, &ec2.TerminateInstancesInput{
+			InstanceIds: []*string{aws.String(id)},
+		})
+		if err != nil {
+			r.Log.Errorf("ec2.terminateinstances %s: %v", id, err)
+			continue
+		}
+		delete(r.failing, id)
+		reaped = append(reaped, id)
+	}
+	// Forget instances that are no longer running.
+	for id := range r.failing {
+		if !running[id] {
+			delete(r.failing, id)
+		}
+	}
+	return reaped, nil
+}
+
+// Go reaps instances every interval until the context is done.
+func (r *Reaper) Go(ctx context.Context, interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		if _, err := r.Reap(ctx); err != nil {
+			r.Log.Errorf("reap: %v", err)
+		}
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// probe queries the offers of the instance's reflowlets. It
+// succeeds if any of them responds.
+func (r *Reaper) probe(ctx context.Context, inst *ec2.Instance) error {
+	addr := instanceAddress(inst, r.AllowPrivateAddress)
+	if addr == "" {
+		return errors.Errorf("instance %s has no public DNS name or IP address", aws.StringValue(inst.InstanceId))
+	}
+	var err error
+	for _, port := range reflowletPorts(r.Reflowlets) {
+		if err = r.probePort(ctx, addr, port); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// probePort queries the offers of the reflowlet serving on the
+// provided address and port.
+func (r *Reaper) probePort(ctx context.Context, addr string, port int) error {
+	p, err := r.Dial(fmt.Sprintf("https://%s:%d/v1/", addr, port))
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, reaperProbeTimeout)
+	defer cancel()
+	_, err = p.Offers(ctx)
+	return err
+}
@@ -0,0 +1,207 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/grailbio/reflow/errors"
+	"github.com/grailbio/reflow/pool"
+)
+
+func TestReaper(t *testing.T) {
+	start := time.Date(2017, 1, 1, 12, 0, 0, 0, time.UTC)
+	now := start
+	instance := func(id, state string, launched time.Time) *ec2.Instance {
+		return &ec2.Instance{
+			InstanceId:    aws.String(id),
+			PublicDnsName: aws.String(id + ".example.com"),
+			State:         &ec2.InstanceState{Name: aws.String(state)},
+			LaunchTime:    aws.Time(launched),
+		}
+	}
+	var terminated []string
+	api := &mockEC2{
+		DescribeInstancesPagesFunc: func(input *ec2.DescribeInstancesInput) ([]*ec2.DescribeInstancesOutput, error) {
+			return []*ec2.DescribeInstancesOutput{{
+				Reservations: []*ec2.Reservation{{
+					Instances: []*ec2.Instance{
+						instance("i-healthy", "running", start.Add(-time.Hour)),
+						instance("i-zombie", "running", start.Add(-time.Hour)),
+						instance("i-booting", "running", start.Add(-time.Minute)),
+						instance("i-pending", "pending", start.Add(-time.Hour)),
+					},
+				}},
+			}}, nil
+		},
+		TerminateInstancesFunc: func(input *ec2.TerminateInstancesInput) (*ec2.TerminateInstancesOutput, error) {
+			terminated = append(terminated, aws.StringValue(input.InstanceIds[0]))
+			return &ec2.TerminateInstancesOutput{}, nil
+		},
+	}
+	var probed []string
+	r := &Reaper{
+		EC2:   api,
+		Tag:   "test (reflow)",
+		Grace: 10 * time.Minute,
+		Dial: func(baseurl string) (pool.Pool, error) {
+			return &testPool{OffersFunc: func() ([]pool.Offer, error) {
+				probed = append(probed, baseurl)
+				if strings.Contains(baseurl, "zombie") || strings.Contains(baseurl, "booting") {
+					return nil, errors.New("connection refused")
+				}
+				return nil, nil
+			}}, nil
+		},
+		now: func() time.Time { return now },
+	}
+	ctx := context.Background()
+	reaped, err := r.Reap(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reaped) != 0 {
+		t.Errorf("unexpected reaped instances %v", reaped)
+	}
+	if got, want := strings.Join(probed, ","), "https://i-healthy.example.com:9000/v1/,https://i-zombie.example.com:9000/v1/"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	now = now.Add(5 * time.Minute)
+	if reaped, _ := r.Reap(ctx); len(reaped) != 0 {
+		t.Errorf("unexpected reaped instances %v", reaped)
+	}
+	now = now.Add(5 * time.Minute)
+	reaped, err = r.Reap(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(reaped, ","), "i-zombie"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := strings.Join(terminated, ","), "i-zombie"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// The booting instance has now been up for the grace period, but
+	// has only just begun to fail its probes.
+	if _, ok := r.failing["i-booting"]; !ok {
+		t.Error("expected i-booting to be failing")
+	}
+}
+
+func TestReaperPrivateAddress(t *testing.T) {
+	now := time.Date(2017, 1, 1, 12, 0, 0, 0, time.UTC)
+	api := &mockEC2{
+		DescribeInstancesPagesFunc: func(input *ec2.DescribeInstancesInput) ([]*ec2.DescribeInstancesOutput, error) {
+			return []*ec2.DescribeInstancesOutput{{
+				Reservations: []*ec2.Reservation{{
+					Instances: []*ec2.Instance{{
+						InstanceId:       aws.String("i-private"),
+						PrivateIpAddress: aws.String("10.0.0.1"),
+						State:            &ec2.InstanceState{Name: aws.String("running")},
+						LaunchTime:       aws.Time(now.Add(-time.Hour)),
+					}},
+				}},
+			}}, nil
+		},
+	}
+	var probed []string
+	r := &Reaper{
+		EC2:   api,
+		Tag:   "test (reflow)",
+		Grace: 10 * time.Minute,
+		Dial: func(baseurl string) (pool.Pool, error) {
+			return &testPool{OffersFunc: func() ([]pool.Offer, error) {
+				probed = append(probed, baseurl)
+				return nil, nil
+			}}, nil
+		},
+		AllowPrivateAddress: true,
+		now:                 func() time.Time { return now },
+	}
+	if _, err := r.Reap(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(probed, ","), "https://10.0.0.1:9000/v1/"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if len(r.failing) != 0 {
+		t.Errorf("unexpected failing instances %v", r.failing)
+	}
+
+	// Without private addresses, the instance cannot be probed.
+	r.AllowPrivateAddress = false
+	probed = nil
+	if _, err := r.Reap(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(probed) != 0 {
+		t.Errorf("unexpected probes %v", probed)
+	}
+	if _, ok := r.failing["i-private"]; !ok {
+		t.Error("expected i-private to be failing")
+	}
+}
+
+func TestReaperMultipleReflowlets(t *testing.T) {
+	now := time.Date(2017, 1, 1, 12, 0, 0, 0, time.UTC)
+	api := &mockEC2{
+		DescribeInstancesPagesFunc: func(input *ec2.DescribeInstancesInput) ([]*ec2.DescribeInstancesOutput, error) {
+			return []*ec2.DescribeInstancesOutput{{
+				Reservations: []*ec2.Reservation{{
+					Instances: []*ec2.Instance{{
+						InstanceId:    aws.String("i-123"),
+						PublicDnsName: aws.String("i-123.example.com"),
+						State:         &ec2.InstanceState{Name: aws.String("running")},
+						LaunchTime:    aws.Time(now.Add(-time.Hour)),
+					}},
+				}},
+			}}, nil
+		},
+	}
+	var (
+		probed []string
+		alive  = map[string]bool{"https://i-123.example.com:9001/v1/": true}
+	)
+	r := &Reaper{
+		EC2:   api,
+		Tag:   "test (reflow)",
+		Grace: 10 * time.Minute,
+		Dial: func(baseurl string) (pool.Pool, error) {
+			return &testPool{OffersFunc: func() ([]pool.Offer, error) {
+				probed = append(probed, baseurl)
+				if !alive[baseurl] {
+					return nil, errors.New("connection refused")
+				}
+				return nil, nil
+			}}, nil
+		},
+		Reflowlets: 2,
+		now:        func() time.Time { return now },
+	}
+	// The instance is healthy while any of its reflowlets is.
+	if _, err := r.Reap(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(probed, ","), "https://i-123.example.com:9000/v1/,https://i-123.example.com:9001/v1/"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if len(r.failing) != 0 {
+		t.Errorf("unexpected failing instances %v", r.failing)
+	}
+
+	alive = nil
+	if _, err := r.Reap(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.failing["i-123"]; !ok {
+		t.Error("expected i-123 to be failing")
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster
+
+import (
+	"context"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// ListInstances returns the live (pending or running) EC2
+// instances whose cluster tag (see clusterTag) matches the provided
+// Reflow tag.
+func ListInstances(ctx context.Context, api ec2iface.EC2API, tag string) ([]*ec2.Instance, error) {
+	input := &ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("tag:" + clusterTag), Values: []*string{aws.String(tag)}},
+			{Name: aws.String("instance-state-name"), Values: aws.StringSlice([]string{"pending", "running"})},
+		},
+	}
+	var instances []*ec2.Instance
+	err := api.DescribeInstancesPagesWithContext(ctx, input, func(resp *ec2.DescribeInstancesOutput, last bool) bool {
+		for _, resv := range resp.Reservations {
+			instances = append(instances, resv.Instances...)
+		}
+		return true
+	})
+	return instances, err
+}
+
+// Reconcile compares the set of desired instance configurations
+// with the live instances tagged with the provided tag (as returned
+// by ListInstances). It returns the configurations that must be
+// launched and the instances that must be terminated in order for
+// the running set to match the desired one. Instances are matched
+// by type; desired may contain multiple entries of the same type.
+func Reconcile(ctx context.Context, api ec2iface.EC2API, desired []instanceConfig, tag string) (toLaunch []instanceConfig, toTerminate []*ec2.Instance, err error) {
+	running, err := ListInstances(ctx, api, tag)
+	if err != nil {
+		return nil, nil, err
+	}
+	byType := make(map[string][]*ec2.Instance)
+	for _, inst := range running {
+		typ := aws.StringValue(inst.InstanceType)
+		byType[typ] = append(byType[typ], inst)
+	}
+	// Retain instances in a deterministic order so that the
+	// terminated set is stable.
+	for _, insts := range byType {
+		sort.Slice(insts, func(i, j int) bool {
+			return aws.StringValue(insts[i].InstanceId) < aws.StringValue(insts[j].InstanceId)
+		})
+	}
+	for _, config := range desired {
+		if insts := byType[config.Type]; len(insts) > 0 {
+			byType[config.Type] = insts[1:]
+			continue
+		}
+		toLaunch = append(toLaunch, config)
+	}
+	types := make([]string, 0, len(byType))
+	for typ := range byType {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	for _, typ := range types {
+		toTerminate = append(toTerminate, byType[typ]...)
+	}
+	return toLaunch, toTerminate, nil
+}
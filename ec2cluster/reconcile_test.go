@@ -0,0 +1,128 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestReconcile(t *testing.T) {
+	const tag = "test (reflow)"
+	api := &mockEC2{
+		DescribeInstancesPagesFunc: func(input *ec2.DescribeInstancesInput) ([]*ec2.DescribeInstancesOutput, error) {
+			var tagged bool
+			for _, f := range input.Filters {
+				if aws.StringValue(f.Name) == "tag:"+clusterTag && aws.StringValue(f.Values[0]) == tag {
+					tagged = true
+				}
+			}
+			if !tagged {
+				t.Errorf("expected filter on tag %s", tag)
+			}
+			inst := func(id, typ string) *ec2.Instance {
+				return &ec2.Instance{InstanceId: aws.String(id), InstanceType: aws.String(typ)}
+			}
+			return []*ec2.DescribeInstancesOutput{
+				{Reservations: []*ec2.Reservation{{Instances: []*ec2.Instance{inst("i-1", "m4.xlarge"), inst("i-2", "m4.xlarge")}}}},
+				{Reservations: []*ec2.Reservation{{Instances: []*ec2.Instance{inst("i-3", "c4.large"), inst("i-4", "r4.large")}}}},
+			}, nil
+		},
+	}
+	desired := []instanceConfig{
+		{Type: "m4.xlarge"},
+		{Type: "c4.large"},
+		{Type: "c4.large"},
+		{Type: "x1.16xlarge"},
+	}
+	toLaunch, toTerminate, err := Reconcile(context.Background(), api, desired, tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var launch []string
+	for _, config := range toLaunch {
+		launch = append(launch, config.Type)
+	}
+	if got, want := launch, []string{"c4.large", "x1.16xlarge"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	var terminate []string
+	for _, inst := range toTerminate {
+		terminate = append(terminate, aws.StringValue(inst.InstanceId))
+	}
+	if got, want := terminate, []string{"i-2", "i-4"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestListInstancesClusterTag(t *testing.T) {
+	const tag = "test (reflow)"
+	tags := func(name, cluster string) []*ec2.Tag {
+		return []*ec2.Tag{
+			{Key: aws.String("Name"), Value: aws.String(name)},
+			{Key: aws.String(clusterTag), Value: aws.String(cluster)},
+		}
+	}
+	instances := []*ec2.Instance{
+		{InstanceId: aws.String("i-1"), Tags: tags(tag, tag)},
+		{InstanceId: aws.String("i-2"), Tags: tags(tag+"-9abcdef0", tag)},
+		{InstanceId: aws.String("i-3"), Tags: tags("other (reflow)", "other (reflow)")},
+		// A different cluster whose tag happens to look like a
+		// uniquely named instance of this one.
+		{InstanceId: aws.String("i-4"), Tags: tags(tag+"-stagings", tag+"-stagings")},
+		{InstanceId: aws.String("i-5"), Tags: tags(tag+"-stagings-01234567", tag+"-stagings")},
+	}
+	api := &mockEC2{
+		// Emulate EC2's filtering of tags.
+		DescribeInstancesPagesFunc: func(input *ec2.DescribeInstancesInput) ([]*ec2.DescribeInstancesOutput, error) {
+			var (
+				key    string
+				values []string
+			)
+			for _, f := range input.Filters {
+				if name := aws.StringValue(f.Name); strings.HasPrefix(name, "tag:") {
+					key, values = strings.TrimPrefix(name, "tag:"), aws.StringValueSlice(f.Values)
+				}
+			}
+			if key != clusterTag {
+				t.Errorf("got filter on tag %q, want %q", key, clusterTag)
+			}
+			var matched []*ec2.Instance
+			for _, inst := range instances {
+				for _, it := range inst.Tags {
+					if aws.StringValue(it.Key) != key {
+						continue
+					}
+					for _, v := range values {
+						if aws.StringValue(it.Value) == v {
+							matched = append(matched, inst)
+						}
+					}
+				}
+			}
+			return []*ec2.DescribeInstancesOutput{{Reservations: []*ec2.Reservation{{Instances: matched}}}}, nil
+		},
+	}
+	// Uniquely named instances are named as in instance.name.
+	if got, want := (&instance{Tag: tag, UniqueNames: true}).name("i-0123456789abcdef0"), tag+"-9abcdef0"; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	list, err := ListInstances(context.Background(), api, tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, inst := range list {
+		ids = append(ids, aws.StringValue(inst.InstanceId))
+	}
+	if got, want := ids, []string{"i-1", "i-2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster
+
+import (
+	"context"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/grailbio/reflow"
+	"github.com/grailbio/reflow/errors"
+)
+
+// FailoverRegion is a region into which a Cluster launches instances
+// when no instance type satisfying a launch is available in the
+// cluster's own region.
+type FailoverRegion struct {
+	// Name is the name of the region, e.g., "us-east-1".
+	Name string
+	// EC2 is the EC2 client of the region.
+	EC2 ec2iface.EC2API
+	// AMI is the ID of the AMI of instances in the region.
+	AMI string
+	// SecurityGroup and Subnet, if set, are the security group and VPC
+	// subnet of instances in the region.
+	SecurityGroup string
+	Subnet        string
+}
+
+// regionTarget is a region into which instances may be launched,
+// together with the region-specific parameters of the launch.
+type regionTarget struct {
+	// Name is the name of the region, e.g., "us-west-2".
+	Name string
+	// EC2 is the EC2 client of the region.
+	EC2 ec2iface.EC2API
+	// AMI is the ID of the (region-specific) AMI of instances.
+	AMI string
+	// SecurityGroup, if set, is the security group of instances in
+	// the region. Otherwise the template's is used.
+	SecurityGroup string
+	// Subnet, if set, is the VPC subnet of instances in the region.
+	// Otherwise the template's is used.
+	Subnet string
+
+	state *instanceState
+}
+
+// launchWithFailover launches an instance that satisfies need into
+// the first of the provided regions, in order of preference, that
+// has capacity for it. Within each region, instance types are tried
+// in the order given by the region's instanceState.MinAvailable;
+// types whose launches fail with errors.Unavailable are marked
+// unavailable and the next type is tried. Once no available type in a
+// region satisfies need, the next region is tried. The instance is
+// configured from the template, with the region's parameters; errors
+// other than errors.Unavailable are returned immediately.
+//
+// launchWithFailover is useful for region-agnostic workloads, which
+// may be unblocked in another region when capacity is exhausted in
+// the preferred one.
+func launchWithFailover(ctx context.Context, regions []*regionTarget, template *instance, need reflow.Resources) (*instance, error) {
+	var err error
+	for _, region := range regions {
+		for {
+			config, ok := region.state.MinAvailable(need, template.Spot)
+			if !ok || !need.LessEqualAll(config.Resources) {
+				break
+			}
+			i := new(instance)
+			*i = *template
+			i.Config = config
+			i.Region = region.Name
+			i.EC2 = region.EC2
+			i.AMI = region.AMI
+			// Availability zones are region-specific.
+			i.AvailabilityZone = ""
+			i.Price = config.Price[region.Name]
+			if region.SecurityGroup != "" {
+				i.SecurityGroup = region.SecurityGroup
+			}
+			if region.Subnet != "" {
+				i.Subnet = region.Subnet
+			}
+			i.Go(ctx)
+			if err = i.Err(); err == nil {
+				region.state.Booted(config.Type)
+				return i, nil
+			}
+			if !errors.Match(errors.Unavailable, err) {
+				return nil, err
+			}
+			template.Log.Printf("instance type %s unavailable in region %s: %v", config.Type, region.Name, err)
+			region.state.Unavailable(config)
+		}
+		template.Log.Printf("no instance types satisfying %s are available in region %s", need, region.Name)
+	}
+	if err == nil {
+		err = errors.Errorf("no instance types satisfying %s are available", need)
+	}
+	return nil, errors.E(errors.Unavailable, "launch", err)
+}
+
+// regionEC2 returns the EC2 client of the region, among the provided
+// ones, in which the instance inst is placed, or else def.
+func regionEC2(regions []*regionTarget, inst *ec2.Instance, def ec2iface.EC2API) ec2iface.EC2API {
+	if inst == nil || inst.Placement == nil {
+		return def
+	}
+	az := aws.StringValue(inst.Placement.AvailabilityZone)
+	for _, region := range regions {
+		if strings.HasPrefix(az, region.Name) {
+			return region.EC2
+		}
+	}
+	return def
+}
@@ -0,0 +1,109 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/grailbio/reflow"
+	"github.com/grailbio/reflow/errors"
+	"github.com/grailbio/reflow/pool"
+)
+
+func TestLaunchWithFailover(t *testing.T) {
+	configs := []instanceConfig{
+		{Type: "small", Resources: reflow.Resources{CPU: 2, Memory: 4 << 30}, Price: map[string]float64{"us-west-2": 0.1, "us-east-1": 0.1}},
+		{Type: "large", Resources: reflow.Resources{CPU: 16, Memory: 64 << 30}, Price: map[string]float64{"us-west-2": 0.8, "us-east-1": 0.8}},
+	}
+	// Region A is exhausted.
+	var attempts []string
+	exhausted := newLaunchMockEC2("i-a", "a.example.com")
+	exhausted.RunInstancesFunc = func(input *ec2.RunInstancesInput) (*ec2.Reservation, error) {
+		if got, want := aws.StringValue(input.ImageId), "ami-a"; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		attempts = append(attempts, aws.StringValue(input.InstanceType))
+		return nil, awserr.New("InsufficientInstanceCapacity", "no capacity", nil)
+	}
+	// Region B succeeds.
+	available := newLaunchMockEC2("i-b", "b.example.com")
+	available.RunInstancesFunc = func(input *ec2.RunInstancesInput) (*ec2.Reservation, error) {
+		if got, want := aws.StringValue(input.ImageId), "ami-b"; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		if got, want := aws.StringValue(input.SubnetId), "subnet-b"; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		return &ec2.Reservation{Instances: []*ec2.Instance{{InstanceId: aws.String("i-b")}}}, nil
+	}
+	regions := []*regionTarget{
+		{Name: "us-west-2", EC2: exhausted, AMI: "ami-a", state: newInstanceState(configs, time.Minute, "us-west-2")},
+		{Name: "us-east-1", EC2: available, AMI: "ami-b", SecurityGroup: "sg-b", Subnet: "subnet-b", state: newInstanceState(configs, time.Minute, "us-east-1")},
+	}
+	template := newLaunchTestInstance(nil, &testPool{OffersFunc: func() ([]pool.Offer, error) { return nil, nil }})
+	template.SecurityGroup = "sg-a"
+	need := reflow.Resources{CPU: 1, Memory: 1 << 30}
+	i, err := launchWithFailover(context.Background(), regions, template, need)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(attempts, ","), "small,large"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := aws.StringValue(i.Instance().InstanceId), "i-b"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := i.Region, "us-east-1"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := i.SecurityGroup, "sg-b"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := i.Config.Type, "small"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// The exhausted types are cooling down in region A.
+	if _, ok := regions[0].state.MaxAvailable(false); ok {
+		t.Error("expected no instance types to be available in us-west-2")
+	}
+
+	// When all regions are exhausted, the launch is unavailable.
+	attempts = nil
+	regions[1].state.Unavailable(configs[0])
+	regions[1].state.Unavailable(configs[1])
+	if _, err := launchWithFailover(context.Background(), regions, template, need); !errors.Match(errors.Unavailable, err) {
+		t.Errorf("expected unavailable error, got %v", err)
+	}
+	if len(attempts) != 0 {
+		t.Errorf("unexpected launch attempts %v", attempts)
+	}
+}
+
+func TestRegionEC2(t *testing.T) {
+	def, east := new(mockEC2), new(mockEC2)
+	regions := []*regionTarget{{Name: "us-east-1", EC2: east}}
+	inst := func(az string) *ec2.Instance {
+		return &ec2.Instance{Placement: &ec2.Placement{AvailabilityZone: aws.String(az)}}
+	}
+	for _, c := range []struct {
+		inst *ec2.Instance
+		want *mockEC2
+	}{
+		{inst("us-east-1b"), east},
+		{inst("us-west-2a"), def},
+		{&ec2.Instance{}, def},
+		{nil, def},
+	} {
+		if got := regionEC2(regions, c.inst, def); got != c.want {
+			t.Errorf("%v: got %p, want %p", c.inst, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/grailbio/reflow/errors"
+)
+
+// reflowletPort is the port on which reflowlets serve.
+const reflowletPort = 9000
+
+// ValidateSecurityGroup checks that the security group with the
+// given ID has inbound rules that permit TCP traffic on each of the
+// provided ports from some source. If it does not, instances in the
+// group are unreachable on those ports, and ValidateSecurityGroup
+// returns an errors.Invalid error.
+func ValidateSecurityGroup(ctx context.Context, api ec2iface.EC2API, sgID string, ports ...int) error {
+	resp, err := api.DescribeSecurityGroupsWithContext(ctx, &ec2.DescribeSecurityGroupsInput{
+		GroupIds: []*string{aws.String(sgID)},
+	})
+	if err != nil {
+		return err
+	}
+	if n := len(resp.SecurityGroups); n != 1 {
+		return errors.E(errors.NotExist, errors.Errorf("ec2.describesecuritygroups %s: got %d entries, want 1", sgID, n))
+	}
+	var denied []string
+outer:
+	for _, port := range ports {
+		for _, perm := range resp.SecurityGroups[0].IpPermissions {
+			if permits(perm, port) {
+				continue outer
+			}
+		}
+		denied = append(denied, fmt.Sprint(port))
+	}
+	if len(denied) == 0 {
+		return nil
+	}
+	noun := "port"
+	if len(denied) > 1 {
+		noun = "ports"
+	}
+	return errors.E(errors.Invalid,
+		errors.Errorf("security group %s does not permit inbound TCP traffic on %s %s", sgID, noun, strings.Join(denied, ", ")))
+}
+
+// permits tells whether the permission perm admits inbound TCP
+// traffic on the given port from any source.
+func permits(perm *ec2.IpPermission, port int) bool {
+	switch aws.StringValue(perm.IpProtocol) {
+	case "-1":
+		// All protocols and ports.
+	case "tcp", "6":
+		if perm.FromPort != nil && int64(port) < *perm.FromPort {
+			return false
+		}
+		if perm.ToPort != nil && int64(port) > *perm.ToPort {
+			return false
+		}
+	default:
+		return false
+	}
+	return len(perm.IpRanges) > 0 || len(perm.Ipv6Ranges) > 0 ||
+		len(perm.UserIdGroupPairs) > 0 || len(perm.PrefixListIds) > 0
+}
+
+// EnsureSecurityGroup returns the ID of the security group with the
+// provided name in the provided VPC (or the default VPC, if vpcID is
+// empty), creating it if it does not exist. Created groups are
+// tagged with their name, and permit inbound TCP traffic on the
+// reflowlet port from members of the group and from the controller
+// CIDR block, if provided. Existing groups are reused as they are.
+func EnsureSecurityGroup(ctx context.Context, api ec2iface.EC2API, name, vpcID, controllerCIDR string) (string, error) {
+	if id, err := findSecurityGroup(ctx, api, name, vpcID); err == nil || !errors.Match(errors.NotExist, err) {
+		return id, err
+	}
+	resp, err := api.CreateSecurityGroupWithContext(ctx, &ec2.CreateSecurityGroupInput{
+		GroupName:   aws.String(name),
+		Description: aws.String("reflow: " + name),
+		VpcId:       nonemptyString(vpcID),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "InvalidGroup.Duplicate" {
+			// The group was created concurrently.
+			return findSecurityGroup(ctx, api, name, vpcID)
+		}
+		return "", errors.E("ec2.createsecuritygroup", name, err)
+	}
+	id := aws.StringValue(resp.GroupId)
+	_, err = api.CreateTagsWithContext(ctx, &ec2.CreateTagsInput{
+		Resources: []*string{aws.String(id)},
+		Tags:      []*ec2.Tag{{Key: aws.String("Name"), Value: aws.String(name)}},
+	})
+	if err != nil {
+		return "", errors.E("ec2.createtags", id, err)
+	}
+	perm := &ec2.IpPermission{
+		IpProtocol:       aws.String("tcp"),
+		FromPort:         aws.Int64(reflowletPort),
+		ToPort:           aws.Int64(reflowletPort),
+		UserIdGroupPairs: []*ec2.UserIdGroupPair{{GroupId: aws.String(id)}},
+	}
+	if controllerCIDR != "" {
+		perm.IpRanges = []*ec2.IpRange{{CidrIp: aws.String(controllerCIDR)}}
+	}
+	_, err = api.AuthorizeSecurityGroupIngressWithContext(ctx, &ec2.AuthorizeSecurityGroupIngressInput{
+		GroupId:       aws.String(id),
+		IpPermissions: []*ec2.IpPermission{perm},
+	})
+	if err != nil {
+		return "", errors.E("ec2.authorizesecuritygroupingress", id, err)
+	}
+	return id, nil
+}
+
+// findSecurityGroup returns the ID of the security group with the
+// provided name in the provided VPC. It returns an errors.NotExist
+// error if there is no such group.
+func findSecurityGroup(ctx context.Context, api ec2iface.EC2API, name, vpcID string) (string, error) {
+	input := &ec2.DescribeSecurityGroupsInput{
+		Filters: []*ec2.Filter{{Name: aws.String("group-name"), Values: []*string{aws.String(name)}}},
+	}
+	if vpcID != "" {
+		input.Filters = append(input.Filters, &ec2.Filter{Name: aws.String("vpc-id"), Values: []*string{aws.String(vpcID)}})
+	}
+	resp, err := api.DescribeSecurityGroupsWithContext(ctx, input)
+	if err != nil {
+		return "", err
+	}
+	switch n := len(resp.SecurityGroups); n {
+	case 0:
+		return "", errors.E(errors.NotExist, errors.Errorf("security group %s does not exist", name))
+	case 1:
+		return aws.StringValue(resp.SecurityGroups[0].GroupId), nil
+	default:
+		return "", errors.Errorf("ec2.describesecuritygroups %s: got %d entries, want 1", name, n)
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/grailbio/reflow/errors"
+)
+
+func TestValidateSecurityGroup(t *testing.T) {
+	anywhere := []*ec2.IpRange{{CidrIp: aws.String("0.0.0.0/0")}}
+	tcp := func(from, to int64, ranges []*ec2.IpRange) *ec2.IpPermission {
+		return &ec2.IpPermission{
+			IpProtocol: aws.String("tcp"),
+			FromPort:   aws.Int64(from),
+			ToPort:     aws.Int64(to),
+			IpRanges:   ranges,
+		}
+	}
+	for _, c := range []struct {
+		name  string
+		perms []*ec2.IpPermission
+		ok    bool
+	}{
+		{"none", nil, false},
+		{"ssh only", []*ec2.IpPermission{tcp(22, 22, anywhere)}, false},
+		{"exact", []*ec2.IpPermission{tcp(22, 22, anywhere), tcp(9000, 9000, anywhere)}, true},
+		{"range", []*ec2.IpPermission{tcp(8000, 9999, anywhere)}, true},
+		{"below range", []*ec2.IpPermission{tcp(9001, 9999, anywhere)}, false},
+		{"no source", []*ec2.IpPermission{tcp(9000, 9000, nil)}, false},
+		{"udp", []*ec2.IpPermission{{
+			IpProtocol: aws.String("udp"), FromPort: aws.Int64(9000), ToPort: aws.Int64(9000), IpRanges: anywhere,
+		}}, false},
+		{"all traffic", []*ec2.IpPermission{{IpProtocol: aws.String("-1"), IpRanges: anywhere}}, true},
+		{"group", []*ec2.IpPermission{{
+			IpProtocol:       aws.String("tcp"),
+			FromPort:         aws.Int64(9000),
+			ToPort:           aws.Int64(9000),
+			UserIdGroupPairs: []*ec2.UserIdGroupPair{{GroupId: aws.String("sg-controller")}},
+		}}, true},
+	} {
+		api := &mockEC2{
+			DescribeSecurityGroupsFunc: func(in *ec2.DescribeSecurityGroupsInput) (*ec2.DescribeSecurityGroupsOutput, error) {
+				if got, want := aws.StringValue(in.GroupIds[0]), "sg-123"; got != want {
+					t.Errorf("got %v, want %v", got, want)
+				}
+				return &ec2.DescribeSecurityGroupsOutput{
+					SecurityGroups: []*ec2.SecurityGroup{{GroupId: aws.String("sg-123"), IpPermissions: c.perms}},
+				}, nil
+			},
+		}
+		err := ValidateSecurityGroup(context.Background(), api, "sg-123", reflowletPort)
+		switch {
+		case c.ok && err != nil:
+			t.Errorf("%s: unexpected error %v", c.name, err)
+		case !c.ok && !errors.Match(errors.Invalid, err):
+			t.Errorf("%s: expected invalid error, got %v", c.name, err)
+		}
+	}
+}
+
+func TestValidateSecurityGroupPorts(t *testing.T) {
+	anywhere := []*ec2.IpRange{{CidrIp: aws.String("0.0.0.0/0")}}
+	perms := []*ec2.IpPermission{
+		{IpProtocol: aws.String("tcp"), FromPort: aws.Int64(9000), ToPort: aws.Int64(9001), IpRanges: anywhere},
+	}
+	api := &mockEC2{
+		DescribeSecurityGroupsFunc: func(in *ec2.DescribeSecurityGroupsInput) (*ec2.DescribeSecurityGroupsOutput, error) {
+			return &ec2.DescribeSecurityGroupsOutput{
+				SecurityGroups: []*ec2.SecurityGroup{{GroupId: aws.String("sg-123"), IpPermissions: perms}},
+			}, nil
+		},
+	}
+	ctx := context.Background()
+	if err := ValidateSecurityGroup(ctx, api, "sg-123", reflowletPorts(2)...); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	err := ValidateSecurityGroup(ctx, api, "sg-123", reflowletPorts(4)...)
+	if !errors.Match(errors.Invalid, err) {
+		t.Fatalf("expected invalid error, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "ports 9002, 9003") {
+		t.Errorf("expected unpermitted ports in error, got %v", err)
+	}
+}
+
+func TestEnsureSecurityGroup(t *testing.T) {
+	var (
+		groups     []*ec2.SecurityGroup
+		created    int
+		authorized *ec2.AuthorizeSecurityGroupIngressInput
+		tagged     *ec2.CreateTagsInput
+	)
+	api := &mockEC2{
+		DescribeSecurityGroupsFunc: func(input *ec2.DescribeSecurityGroupsInput) (*ec2.DescribeSecurityGroupsOutput, error) {
+			filters := make(map[string]string)
+			for _, f := range input.Filters {
+				filters[aws.StringValue(f.Name)] = aws.StringValue(f.Values[0])
+			}
+			if got, want := filters["group-name"], "reflow-test"; got != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			if got, want := filters["vpc-id"], "vpc-1234"; got != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			return &ec2.DescribeSecurityGroupsOutput{SecurityGroups: groups}, nil
+		},
+		CreateSecurityGroupFunc: func(input *ec2.CreateSecurityGroupInput) (*ec2.CreateSecurityGroupOutput, error) {
+			created++
+			if got, want := aws.StringValue(input.VpcId), "vpc-1234"; got != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			groups = append(groups, &ec2.SecurityGroup{GroupId: aws.String("sg-1234"), GroupName: input.GroupName})
+			return &ec2.CreateSecurityGroupOutput{GroupId: aws.String("sg-1234")}, nil
+		},
+		CreateTagsFunc: func(input *ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error) {
+			tagged = input
+			return &ec2.CreateTagsOutput{}, nil
+		},
+		AuthorizeSecurityGroupIngressFunc: func(input *ec2.AuthorizeSecurityGroupIngressInput) (*ec2.AuthorizeSecurityGroupIngressOutput, error) {
+			authorized = input
+			return &ec2.AuthorizeSecurityGroupIngressOutput{}, nil
+		},
+	}
+	ctx := context.Background()
+	id, err := EnsureSecurityGroup(ctx, api, "reflow-test", "vpc-1234", "10.0.0.0/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := id, "sg-1234"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := created, 1; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if tagged == nil || aws.StringValue(tagged.Resources[0]) != "sg-1234" || aws.StringValue(tagged.Tags[0].Value) != "reflow-test" {
+		t.Errorf("security group was not tagged: %v", tagged)
+	}
+	if authorized == nil {
+		t.Fatal("no ingress rules were authorized")
+	}
+	if got, want := len(authorized.IpPermissions), 1; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	perm := authorized.IpPermissions[0]
+	if !permits(perm, reflowletPort) {
+		t.Errorf("permission %v does not admit reflowlet traffic", perm)
+	}
+	if got, want := aws.StringValue(perm.UserIdGroupPairs[0].GroupId), "sg-1234"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := aws.StringValue(perm.IpRanges[0].CidrIp), "10.0.0.0/16"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// The group is now reused.
+	id, err = EnsureSecurityGroup(ctx, api, "reflow-test", "vpc-1234", "10.0.0.0/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := id, "sg-1234"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := created, 1; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
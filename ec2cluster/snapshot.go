@@ -0,0 +1,71 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/grailbio/reflow/errors"
+)
+
+// dataDeviceName is the device name of the EBS volume that stores
+// all Reflow data. EC2 reports this name regardless of how the
+// device is exposed to the instance (e.g., as an NVMe device).
+const dataDeviceName = "/dev/xvdb"
+
+// snapshotInstanceTag is the tag key used to record the ID of the
+// instance from which a data volume snapshot was taken.
+const snapshotInstanceTag = "reflow:instance"
+
+// SnapshotDataVolume creates a snapshot of the data volume of the
+// instance with the given ID, returning the snapshot ID. The
+// snapshot is tagged with the instance ID. SnapshotDataVolume can
+// be used to preserve the data of a (failed) instance before it is
+// terminated.
+func SnapshotDataVolume(ctx context.Context, api ec2iface.EC2API, instanceID string) (snapshotID string, err error) {
+	resp, err := api.DescribeInstancesWithContext(ctx, &ec2.DescribeInstancesInput{
+		InstanceIds: []*string{aws.String(instanceID)},
+	})
+	if err != nil {
+		return "", err
+	}
+	inst := findInstance(resp, instanceID)
+	if inst == nil {
+		return "", errors.E(errors.NotExist, errors.Errorf("ec2.describeinstances %s: instance not found", instanceID))
+	}
+	var volumeID string
+	for _, m := range inst.BlockDeviceMappings {
+		if aws.StringValue(m.DeviceName) == dataDeviceName && m.Ebs != nil {
+			volumeID = aws.StringValue(m.Ebs.VolumeId)
+			break
+		}
+	}
+	if volumeID == "" {
+		return "", errors.E(errors.NotExist, errors.Errorf("instance %s has no data volume %s", instanceID, dataDeviceName))
+	}
+	snapshot, err := api.CreateSnapshotWithContext(ctx, &ec2.CreateSnapshotInput{
+		VolumeId:    aws.String(volumeID),
+		Description: aws.String(fmt.Sprintf("reflow data volume of instance %s", instanceID)),
+	})
+	if err != nil {
+		return "", err
+	}
+	snapshotID = aws.StringValue(snapshot.SnapshotId)
+	_, err = api.CreateTagsWithContext(ctx, &ec2.CreateTagsInput{
+		Resources: []*string{aws.String(snapshotID)},
+		Tags: []*ec2.Tag{
+			{Key: aws.String("Name"), Value: aws.String("reflow-data-" + instanceID)},
+			{Key: aws.String(snapshotInstanceTag), Value: aws.String(instanceID)},
+		},
+	})
+	if err != nil {
+		return snapshotID, errors.E("tag snapshot", snapshotID, err)
+	}
+	return snapshotID, nil
+}
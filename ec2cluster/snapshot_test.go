@@ -0,0 +1,70 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/grailbio/reflow/errors"
+)
+
+func TestSnapshotDataVolume(t *testing.T) {
+	var (
+		volumeID string
+		tags     = map[string]string{}
+	)
+	api := &mockEC2{
+		DescribeInstancesFunc: func(in *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
+			if got, want := aws.StringValue(in.InstanceIds[0]), "i-123"; got != want {
+				return &ec2.DescribeInstancesOutput{}, nil
+			}
+			return &ec2.DescribeInstancesOutput{
+				Reservations: []*ec2.Reservation{{
+					Instances: []*ec2.Instance{{
+						InstanceId: aws.String("i-123"),
+						BlockDeviceMappings: []*ec2.InstanceBlockDeviceMapping{
+							{DeviceName: aws.String("/dev/xvda"), Ebs: &ec2.EbsInstanceBlockDevice{VolumeId: aws.String("vol-root")}},
+							{DeviceName: aws.String("/dev/xvdb"), Ebs: &ec2.EbsInstanceBlockDevice{VolumeId: aws.String("vol-data")}},
+						},
+					}},
+				}},
+			}, nil
+		},
+		CreateSnapshotFunc: func(in *ec2.CreateSnapshotInput) (*ec2.Snapshot, error) {
+			volumeID = aws.StringValue(in.VolumeId)
+			return &ec2.Snapshot{SnapshotId: aws.String("snap-123"), VolumeId: in.VolumeId}, nil
+		},
+		CreateTagsFunc: func(in *ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error) {
+			if got, want := aws.StringValue(in.Resources[0]), "snap-123"; got != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			for _, tag := range in.Tags {
+				tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+			}
+			return &ec2.CreateTagsOutput{}, nil
+		},
+	}
+	ctx := context.Background()
+	id, err := SnapshotDataVolume(ctx, api, "i-123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := id, "snap-123"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := volumeID, "vol-data"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := tags[snapshotInstanceTag], "i-123"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if _, err := SnapshotDataVolume(ctx, api, "i-456"); !errors.Match(errors.NotExist, err) {
+		t.Errorf("expected not exist error, got %v", err)
+	}
+}
@@ -0,0 +1,387 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/grailbio/base/limiter"
+	"github.com/grailbio/reflow/errors"
+)
+
+// Spot instance interruption behaviors.
+const (
+	spotInterruptTerminate = "terminate"
+	spotInterruptStop      = "stop"
+	spotInterruptHibernate = "hibernate"
+)
+
+// hibernationFamilies are the instance families that support
+// hibernation.
+var hibernationFamilies = map[string]bool{
+	"c4": true, "c5": true,
+	"m4": true, "m5": true,
+	"r4": true, "r5": true,
+}
+
+// maxHibernationMemory is the maximum amount of memory of instance
+// types that support hibernation.
+const maxHibernationMemory = 100 << 30
+
+// supportsHibernation tells whether instances of the given
+// configuration may be hibernated.
+func supportsHibernation(config instanceConfig) bool {
+	family := strings.SplitN(config.Type, ".", 2)[0]
+	return hibernationFamilies[family] && config.Resources.Memory < maxHibernationMemory
+}
+
+// checkSpotInterruptionBehavior checks that the provided spot
+// interruption behavior is valid for the instance configuration.
+func checkSpotInterruptionBehavior(behavior string, config instanceConfig) error {
+	switch behavior {
+	case "", spotInterruptTerminate, spotInterruptStop:
+		return nil
+	case spotInterruptHibernate:
+		if !supportsHibernation(config) {
+			return errors.E(errors.Fatal, errors.Errorf("instance type %s does not support hibernation", config.Type))
+		}
+		return nil
+	default:
+		return errors.E(errors.Fatal, errors.Errorf("invalid spot interruption behavior %q", behavior))
+	}
+}
+
+// persistentSpotRequestLifetime is the lifetime of the persistent
+// spot requests of instances that are stopped or hibernated when
+// interrupted, unless the instances' own lifetimes are shorter. The
+// requests must outlive interruptions so that their instances are
+// restarted.
+const persistentSpotRequestLifetime = 7 * 24 * time.Hour
+
+// persistentSpot tells whether the instance's spot request is
+// persistent, as required to stop or hibernate it on interruption.
+func (i *instance) persistentSpot() bool {
+	b := i.SpotInterruptionBehavior
+	return b != "" && b != spotInterruptTerminate
+}
+
+// spotRequestValidUntil returns the time, given the current time
+// now, until which the instance's spot request is valid. One-time
+// requests are valid only briefly; persistent ones are valid for
+// the lifetime of the instance.
+func (i *instance) spotRequestValidUntil(now time.Time) time.Time {
+	if !i.persistentSpot() {
+		return now.Add(time.Minute)
+	}
+	until := now.Add(persistentSpotRequestLifetime)
+	if i.MaxLifetime > 0 && now.Add(i.MaxLifetime).Before(until) {
+		until = now.Add(i.MaxLifetime)
+	}
+	if i.Deadline.After(now) && i.Deadline.Before(until) {
+		until = i.Deadline
+	}
+	return until
+}
+
+// cancelSpotRequest cancels the instance's persistent spot request,
+// if any, so that EC2 does not launch or restart instances for it
+// once the instance is abandoned. Errors are logged.
+func (i *instance) cancelSpotRequest(ctx context.Context) {
+	if i.spotRequestID == "" || !i.persistentSpot() {
+		return
+	}
+	req := &ec2.SpotInstanceRequest{SpotInstanceRequestId: aws.String(i.spotRequestID)}
+	if err := CancelSpotRequests(ctx, i.EC2, []*ec2.SpotInstanceRequest{req}); err != nil {
+		i.Log.Errorf("ec2.cancelspotinstancerequests %s: %v", i.spotRequestID, err)
+	}
+}
+
+// withQueryParam returns a request option that adds the provided
+// parameter to an EC2 query request. It is used to supply
+// parameters that are not yet modeled by the AWS SDK.
+func withQueryParam(key, value string) request.Option {
+	return func(r *request.Request) {
+		r.Handlers.Build.PushBack(func(r *request.Request) {
+			if r.Error != nil || r.Body == nil {
+				return
+			}
+			b, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				r.Error = err
+				return
+			}
+			var buf bytes.Buffer
+			buf.Write(b)
+			buf.WriteString("&" + url.QueryEscape(key) + "=" + url.QueryEscape(value))
+			r.SetBufferBody(buf.Bytes())
+		})
+	}
+}
+
+// spotBidIncrease is the fraction by which the spot bid is increased
+// after a spot request fails because its price was too low.
+const spotBidIncrease = 0.2
+
+// priceTooLowError is the underlying error of spot requests that
+// failed because the bid was too low.
+type priceTooLowError struct{ error }
+
+// isPriceTooLow tells whether err indicates that a spot request's
+// bid was too low.
+func isPriceTooLow(err error) bool {
+	if err == nil {
+		return false
+	}
+	_, ok := errors.Recover(err).Err.(priceTooLowError)
+	return ok
+}
+
+// classifySpotError classifies err according to the provided spot
+// error code, which is either an EC2 API error code or a spot
+// request status code. Bids that are too low are temporary (the bid
+// is raised on retry); exhausted limits or capacity are unavailable,
+// so that the caller may choose a different instance type; and bad
+// parameters are fatal. Errors with other codes are returned
+// unchanged.
+func classifySpotError(code string, err error) error {
+	switch code {
+	case "SpotMaxPriceTooLow", "price-too-low":
+		return errors.E(errors.Temporary, priceTooLowError{err})
+	case "MaxSpotInstanceCountExceeded", "InsufficientInstanceCapacity",
+		"capacity-not-available", "capacity-oversubscribed", "schedule-expired":
+		return errors.E(errors.Unavailable, err)
+	case "system-error", "canceled-before-fulfillment":
+		return errors.E(errors.Temporary, err)
+	case "bad-parameters":
+		// The request is misconfigured: it would fail for any
+		// instance type.
+		return errors.E(errors.Fatal, err)
+	}
+	return err
+}
+
+// spotWaitLimiter limits the number of concurrent spot fulfillment
+// waits, each of which polls the EC2 API, and keeps track of the
+// number of active and queued waits. A nil spotWaitLimiter imposes
+// no limit.
+type spotWaitLimiter struct {
+	limiter        *limiter.Limiter
+	active, queued int32
+}
+
+// newSpotWaitLimiter returns a spotWaitLimiter that permits up to n
+// concurrent spot fulfillment waits.
+func newSpotWaitLimiter(n int) *spotWaitLimiter {
+	l := &spotWaitLimiter{limiter: limiter.New()}
+	l.limiter.Release(n)
+	return l
+}
+
+// Acquire blocks until a wait may proceed, or until the context is
+// done. Each successful call to Acquire must be followed by a call
+// to Release.
+func (l *spotWaitLimiter) Acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	atomic.AddInt32(&l.queued, 1)
+	defer atomic.AddInt32(&l.queued, -1)
+	if err := l.limiter.Acquire(ctx, 1); err != nil {
+		return err
+	}
+	atomic.AddInt32(&l.active, 1)
+	return nil
+}
+
+// Release releases a wait slot acquired by Acquire.
+func (l *spotWaitLimiter) Release() {
+	if l == nil {
+		return
+	}
+	atomic.AddInt32(&l.active, -1)
+	l.limiter.Release(1)
+}
+
+// Stats returns the number of active and queued waits.
+func (l *spotWaitLimiter) Stats() (active, queued int) {
+	if l == nil {
+		return 0, 0
+	}
+	return int(atomic.LoadInt32(&l.active)), int(atomic.LoadInt32(&l.queued))
+}
+
+// spotMix returns, for each of n instances to be launched, whether
+// the instance should be launched on the spot market. If spot is
+// set, enough instances are launched on-demand that, together with
+// the cluster's existing (live or pending) instances, of which
+// ondemand of total are on-demand, the given fraction (rounded up)
+// of the cluster's instances are on-demand. The on-demand instances
+// are ordered first, so that a stable baseline is launched before
+// the remainder is filled with spot instances.
+func spotMix(n int, spot bool, onDemandFraction float64, ondemand, total int) []bool {
+	mix := make([]bool, n)
+	if !spot {
+		return mix
+	}
+	need := int(math.Ceil(float64(total+n)*onDemandFraction-1e-9)) - ondemand
+	if need < 0 {
+		need = 0
+	}
+	for k := need; k < n; k++ {
+		mix[k] = true
+	}
+	return mix
+}
+
+// countOnDemand returns the number of on-demand instances among
+// the provided ones.
+func countOnDemand(instances map[string]*ec2.Instance) int {
+	var n int
+	for _, inst := range instances {
+		if aws.StringValue(inst.InstanceLifecycle) != ec2.InstanceLifecycleTypeSpot {
+			n++
+		}
+	}
+	return n
+}
+
+// awsErrorCode returns the code of err if it is an AWS error.
+func awsErrorCode(err error) string {
+	if awserr, ok := err.(awserr.Error); ok {
+		return awserr.Code()
+	}
+	return ""
+}
+
+// SpotRequestStatus returns the current status code (e.g.,
+// "price-too-low", "capacity-not-available") and message of the spot
+// request with the provided ID. It is useful for debugging spot
+// requests that are not fulfilled.
+func SpotRequestStatus(ctx context.Context, api ec2iface.EC2API, reqid string) (code, message string, err error) {
+	resp, err := api.DescribeSpotInstanceRequestsWithContext(ctx, &ec2.DescribeSpotInstanceRequestsInput{
+		SpotInstanceRequestIds: []*string{aws.String(reqid)},
+	})
+	if err != nil {
+		return "", "", err
+	}
+	if n := len(resp.SpotInstanceRequests); n != 1 || resp.SpotInstanceRequests[0].Status == nil {
+		return "", "", errors.Errorf("ec2.describespotinstancerequests %s: no status", reqid)
+	}
+	status := resp.SpotInstanceRequests[0].Status
+	return aws.StringValue(status.Code), aws.StringValue(status.Message), nil
+}
+
+// spotInterruptionCodes are the spot request status codes indicating
+// that the request's instance is about to be interrupted.
+var spotInterruptionCodes = map[string]bool{
+	"marked-for-termination": true,
+	"marked-for-stop":        true,
+	"marked-for-hibernation": true,
+}
+
+// WatchInterruption polls the status of the instance's spot request
+// every interval, and marks the instance as pending interruption
+// (see InterruptionPending) once EC2 issues an interruption notice.
+// WatchInterruption returns when a notice is observed, when the
+// instance is no longer running, or when the context is done. It
+// returns immediately for on-demand instances.
+func (i *instance) WatchInterruption(ctx context.Context, interval time.Duration) {
+	if i.spotRequestID == "" {
+		return
+	}
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		code, _, err := SpotRequestStatus(ctx, i.EC2, i.spotRequestID)
+		switch {
+		case err != nil:
+			i.Log.Debugf("spot request %s: %v", i.spotRequestID, err)
+		case spotInterruptionCodes[code]:
+			i.Log.Printf("spot request %s: interruption notice: %s", i.spotRequestID, code)
+			atomic.StoreInt32(&i.interruptionPending, 1)
+			return
+		case strings.HasPrefix(code, "instance-terminated-") || strings.HasPrefix(code, "instance-stopped-"):
+			return
+		}
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// InterruptionPending tells whether EC2 has issued an interruption
+// notice for the (spot) instance, which is thus about to be
+// reclaimed. Such instances should be drained rather than filled.
+func (i *instance) InterruptionPending() bool {
+	return atomic.LoadInt32(&i.interruptionPending) == 1
+}
+
+// WatchPrice polls the spot market price of the (spot) instance's
+// type in its availability zone every interval, and marks the
+// instance's price as spiked (see PriceSpiked) once the price has
+// exceeded the provided ceiling, in dollars per hour, for at least
+// the sustain period, as observed by consecutive successful polls;
+// a failed poll restarts the period. Such instances are better
+// relinquished and relaunched elsewhere. WatchPrice returns when a
+// spike is observed or when the context is done. It returns
+// immediately for on-demand instances.
+func (i *instance) WatchPrice(ctx context.Context, interval time.Duration, ceiling float64, sustain time.Duration) {
+	if !i.Spot {
+		return
+	}
+	az := i.AvailabilityZone
+	if inst := i.ec2inst; inst != nil && inst.Placement != nil {
+		az = aws.StringValue(inst.Placement.AvailabilityZone)
+	}
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	var since time.Time
+	for {
+		price, err := i.Config.PriceInAZ(ctx, i.EC2, i.Region, az, true)
+		switch {
+		case err != nil:
+			// Without a reading, the spike cannot be known to be
+			// sustained.
+			i.Log.Debugf("spot market price of %s in %s: %v", i.Config.Type, az, err)
+			since = time.Time{}
+		case price <= ceiling:
+			since = time.Time{}
+		case since.IsZero():
+			since = time.Now()
+		}
+		if !since.IsZero() && time.Since(since) >= sustain {
+			i.Log.Printf("spot market price of %s in %s exceeded %.4f for %s; relinquishing instance",
+				i.Config.Type, az, ceiling, sustain)
+			atomic.StoreInt32(&i.priceSpiked, 1)
+			return
+		}
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// PriceSpiked tells whether the spot market price of the (spot)
+// instance has exceeded its ceiling for a sustained period. Such
+// instances should be drained and terminated.
+func (i *instance) PriceSpiked() bool {
+	return atomic.LoadInt32(&i.priceSpiked) == 1
+}
@@ -0,0 +1,901 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/grailbio/reflow/errors"
+)
+
+// newTestEC2 returns an EC2 client whose requests are served by the
+// provided handler.
+func newTestEC2(t *testing.T, handler http.HandlerFunc) (*ec2.EC2, func()) {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	sess, err := session.NewSession(&aws.Config{
+		Endpoint:    aws.String(srv.URL),
+		Region:      aws.String("us-west-2"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		MaxRetries:  aws.Int(0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ec2.New(sess), srv.Close
+}
+
+func TestSpotInterruptionBehavior(t *testing.T) {
+	var form url.Values
+	api, cleanup := newTestEC2(t, func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Fatal(err)
+		}
+		form = r.PostForm
+		// Fail the request: we only care about its parameters.
+		http.Error(w, "", http.StatusBadRequest)
+	})
+	defer cleanup()
+	ctx := context.Background()
+	for _, c := range []struct {
+		behavior, typ string
+		param         string
+		persistent    bool
+	}{
+		{"", "m4.xlarge", "", false},
+		{"terminate", "m4.xlarge", "", false},
+		{"stop", "m4.xlarge", "stop", true},
+		{"hibernate", "m4.xlarge", "hibernate", true},
+	} {
+		form = nil
+		i := &instance{EC2: api, Config: instanceTypes[c.typ], SpotInterruptionBehavior: c.behavior}
+		if _, err := i.ec2RunSpotInstance(ctx); err == nil {
+			t.Fatal("expected error")
+		}
+		if form == nil {
+			t.Fatalf("%s: no request was made", c.behavior)
+		}
+		if got, want := form.Get("Action"), "RequestSpotInstances"; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		if got, want := form.Get("InstanceInterruptionBehavior"), c.param; got != want {
+			t.Errorf("%s: got %v, want %v", c.behavior, got, want)
+		}
+		if got, want := form.Get("Type") == ec2.SpotInstanceTypePersistent, c.persistent; got != want {
+			t.Errorf("%s: got %v, want %v", c.behavior, got, want)
+		}
+	}
+
+	for _, c := range []struct{ behavior, typ string }{
+		{"hibernate", "x1.32xlarge"},
+		{"hibernate", "m4.16xlarge"},
+		{"hibernate", "c3.large"},
+		{"hibernate", "m3.xlarge"},
+		{"hibernate", "r3.large"},
+		{"shutdown", "m4.xlarge"},
+	} {
+		form = nil
+		i := &instance{EC2: api, Config: instanceTypes[c.typ], SpotInterruptionBehavior: c.behavior}
+		_, err := i.ec2RunSpotInstance(ctx)
+		if !errors.Match(errors.Fatal, err) {
+			t.Errorf("%s, %s: expected fatal error, got %v", c.behavior, c.typ, err)
+		}
+		if form != nil {
+			t.Errorf("%s, %s: unexpected request", c.behavior, c.typ)
+		}
+	}
+}
+
+func TestSpotRequestValidUntil(t *testing.T) {
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, c := range []struct {
+		i    *instance
+		want time.Time
+	}{
+		{&instance{}, now.Add(time.Minute)},
+		{&instance{SpotInterruptionBehavior: "terminate", MaxLifetime: time.Hour}, now.Add(time.Minute)},
+		{&instance{SpotInterruptionBehavior: "stop"}, now.Add(persistentSpotRequestLifetime)},
+		{&instance{SpotInterruptionBehavior: "hibernate", MaxLifetime: time.Hour}, now.Add(time.Hour)},
+		{&instance{SpotInterruptionBehavior: "stop", MaxLifetime: time.Hour, Deadline: now.Add(30 * time.Minute)}, now.Add(30 * time.Minute)},
+		{&instance{SpotInterruptionBehavior: "stop", Deadline: now.Add(-time.Hour)}, now.Add(persistentSpotRequestLifetime)},
+	} {
+		if got, want := c.i.spotRequestValidUntil(now), c.want; !got.Equal(want) {
+			t.Errorf("%s: got %v, want %v", c.i.SpotInterruptionBehavior, got, want)
+		}
+	}
+}
+
+func TestTerminateCancelsPersistentSpotRequest(t *testing.T) {
+	for _, c := range []struct {
+		behavior string
+		canceled bool
+	}{
+		{"", false},
+		{"terminate", false},
+		{"stop", true},
+		{"hibernate", true},
+	} {
+		var canceled []string
+		api := &mockEC2{
+			CancelSpotInstanceRequestsFunc: func(input *ec2.CancelSpotInstanceRequestsInput) (*ec2.CancelSpotInstanceRequestsOutput, error) {
+				canceled = append(canceled, aws.StringValueSlice(input.SpotInstanceRequestIds)...)
+				return &ec2.CancelSpotInstanceRequestsOutput{}, nil
+			},
+			TerminateInstancesFunc: func(input *ec2.TerminateInstancesInput) (*ec2.TerminateInstancesOutput, error) {
+				if len(canceled) == 0 && c.canceled {
+					t.Errorf("%s: instance terminated before its spot request was canceled", c.behavior)
+				}
+				return &ec2.TerminateInstancesOutput{}, nil
+			},
+		}
+		i := &instance{EC2: api, SpotInterruptionBehavior: c.behavior, spotRequestID: "sir-123"}
+		i.terminate(context.Background(), "i-123")
+		var want []string
+		if c.canceled {
+			want = []string{"sir-123"}
+		}
+		if got := canceled; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", c.behavior, got, want)
+		}
+	}
+}
+
+func TestClassifySpotError(t *testing.T) {
+	for _, c := range []struct {
+		code        string
+		kind        errors.Kind
+		priceTooLow bool
+	}{
+		{"SpotMaxPriceTooLow", errors.Temporary, true},
+		{"price-too-low", errors.Temporary, true},
+		{"MaxSpotInstanceCountExceeded", errors.Unavailable, false},
+		{"InsufficientInstanceCapacity", errors.Unavailable, false},
+		{"capacity-not-available", errors.Unavailable, false},
+		{"capacity-oversubscribed", errors.Unavailable, false},
+		{"schedule-expired", errors.Unavailable, false},
+		{"system-error", errors.Temporary, false},
+		{"canceled-before-fulfillment", errors.Temporary, false},
+		{"bad-parameters", errors.Fatal, false},
+		{"UnknownCode", errors.Other, false},
+	} {
+		err := classifySpotError(c.code, awserr.New(c.code, "test", nil))
+		if got, want := errors.Recover(err).Kind, c.kind; got != want {
+			t.Errorf("%s: got %v, want %v", c.code, got, want)
+		}
+		if got, want := isPriceTooLow(err), c.priceTooLow; got != want {
+			t.Errorf("%s: got %v, want %v", c.code, got, want)
+		}
+	}
+}
+
+func TestSpotBidIncrease(t *testing.T) {
+	defer func(d time.Duration) { retryDelay = d }(retryDelay)
+	retryDelay = time.Millisecond
+	var bids []string
+	api := &mockEC2{
+		RunInstancesFunc: func(in *ec2.RunInstancesInput) (*ec2.Reservation, error) {
+			return nil, awserr.New("DryRunOperation", "ok", nil)
+		},
+		RequestSpotInstancesFunc: func(in *ec2.RequestSpotInstancesInput) (*ec2.RequestSpotInstancesOutput, error) {
+			bids = append(bids, aws.StringValue(in.SpotPrice))
+			if len(bids) < 3 {
+				return nil, awserr.New("SpotMaxPriceTooLow", "bid too low", nil)
+			}
+			return nil, awserr.New("MaxSpotInstanceCountExceeded", "too many spot instances", nil)
+		},
+	}
+	i := newLaunchTestInstance(api, nil)
+	i.Spot = true
+	i.Price = 1
+	i.Go(context.Background())
+	if err := i.Err(); !errors.Match(errors.Unavailable, err) {
+		t.Errorf("expected unavailable error, got %v", err)
+	}
+	if got, want := strings.Join(bids, ","), "1.000,1.200,1.440"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestSpotRequestStatus(t *testing.T) {
+	var reqid string
+	api, cleanup := newTestEC2(t, func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Fatal(err)
+		}
+		reqid = r.PostForm.Get("SpotInstanceRequestId.1")
+		w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<DescribeSpotInstanceRequestsResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/">
+  <requestId>test</requestId>
+  <spotInstanceRequestSet>
+    <item>
+      <spotInstanceRequestId>sir-1234</spotInstanceRequestId>
+      <state>open</state>
+      <status>
+        <code>price-too-low</code>
+        <updateTime>2017-01-01T00:00:00.000Z</updateTime>
+        <message>Your Spot request price of 0.1 is lower than the minimum required Spot request fulfillment price of 0.2.</message>
+      </status>
+    </item>
+  </spotInstanceRequestSet>
+</DescribeSpotInstanceRequestsResponse>`))
+	})
+	defer cleanup()
+	code, message, err := SpotRequestStatus(context.Background(), api, "sir-1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := reqid, "sir-1234"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := code, "price-too-low"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if !strings.HasPrefix(message, "Your Spot request price of 0.1") {
+		t.Errorf("unexpected message %q", message)
+	}
+
+	var m mockEC2
+	m.DescribeSpotInstanceRequestsFunc = func(*ec2.DescribeSpotInstanceRequestsInput) (*ec2.DescribeSpotInstanceRequestsOutput, error) {
+		return &ec2.DescribeSpotInstanceRequestsOutput{}, nil
+	}
+	if _, _, err := SpotRequestStatus(context.Background(), &m, "sir-1234"); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestSpotMix(t *testing.T) {
+	for _, c := range []struct {
+		n                 int
+		spot              bool
+		fraction          float64
+		ondemand, spotted int
+	}{
+		{10, true, 0.2, 2, 8},
+		{10, true, 0, 0, 10},
+		{10, true, 1, 10, 0},
+		{10, false, 0.2, 10, 0},
+		{3, true, 0.2, 1, 2},
+		{5, true, 0.5, 3, 2},
+		{1, true, 0.2, 1, 0},
+		{0, true, 0.2, 0, 0},
+	} {
+		mix := spotMix(c.n, c.spot, c.fraction, 0, 0)
+		if got, want := len(mix), c.n; got != want {
+			t.Errorf("%+v: got %v, want %v", c, got, want)
+			continue
+		}
+		var ondemand, spot int
+		for k, s := range mix {
+			if s {
+				spot++
+				continue
+			}
+			ondemand++
+			if k > 0 && mix[k-1] {
+				t.Errorf("%+v: on-demand instance launched after spot instance: %v", c, mix)
+			}
+		}
+		if ondemand != c.ondemand || spot != c.spotted {
+			t.Errorf("%+v: got %d on-demand, %d spot, want %d, %d", c, ondemand, spot, c.ondemand, c.spotted)
+		}
+	}
+}
+
+func TestSpotMixIncremental(t *testing.T) {
+	// Scale up one instance at a time: the cluster converges to the
+	// configured on-demand fraction.
+	var ondemand, total int
+	for k := 0; k < 20; k++ {
+		mix := spotMix(1, true, 0.2, ondemand, total)
+		if !mix[0] {
+			ondemand++
+		}
+		total++
+		if want := int(math.Ceil(float64(total) * 0.2)); ondemand != want {
+			t.Errorf("%d instances: got %d on-demand, want %d", total, ondemand, want)
+		}
+	}
+	if got, want := ondemand, 4; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// Clusters that already exceed the fraction launch spot instances.
+	if got, want := spotMix(3, true, 0.2, 5, 5), []bool{true, true, true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestCountOnDemand(t *testing.T) {
+	instances := map[string]*ec2.Instance{
+		"i-1": {InstanceId: aws.String("i-1")},
+		"i-2": {InstanceId: aws.String("i-2"), InstanceLifecycle: aws.String(ec2.InstanceLifecycleTypeSpot)},
+		"i-3": {InstanceId: aws.String("i-3"), InstanceLifecycle: aws.String(ec2.InstanceLifecycleTypeSpot)},
+	}
+	if got, want := countOnDemand(instances), 1; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestSpotTerminalStatus(t *testing.T) {
+	for _, c := range []struct {
+		code string
+		kind errors.Kind
+	}{
+		{"bad-parameters", errors.Fatal},
+		{"schedule-expired", errors.Unavailable},
+		{"system-error", errors.Temporary},
+		{"canceled-before-fulfillment", errors.Temporary},
+		{"price-too-low", errors.Temporary},
+	} {
+		api, cleanup := newTestEC2(t, func(w http.ResponseWriter, r *http.Request) {
+			if err := r.ParseForm(); err != nil {
+				t.Fatal(err)
+			}
+			switch action := r.PostForm.Get("Action"); action {
+			case "RequestSpotInstances":
+				w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<RequestSpotInstancesResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/">
+  <requestId>test</requestId>
+  <spotInstanceRequestSet><item><spotInstanceRequestId>sir-1234</spotInstanceRequestId></item></spotInstanceRequestSet>
+</RequestSpotInstancesResponse>`))
+			case "DescribeSpotInstanceRequests":
+				w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<DescribeSpotInstanceRequestsResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/">
+  <requestId>test</requestId>
+  <spotInstanceRequestSet>
+    <item>
+      <spotInstanceRequestId>sir-1234</spotInstanceRequestId>
+      <state>closed</state>
+      <status><code>` + c.code + `</code><message>test</message></status>
+    </item>
+  </spotInstanceRequestSet>
+</DescribeSpotInstanceRequestsResponse>`))
+			default:
+				t.Errorf("unexpected action %s", action)
+				http.Error(w, "", http.StatusBadRequest)
+			}
+		})
+		i := newTestInstance()
+		i.EC2 = api
+		i.Config = instanceConfig{Type: "m4.xlarge"}
+		i.Spot = true
+		i.Price = 1
+		i.userData = "test"
+		_, err := i.ec2RunSpotInstance(context.Background())
+		cleanup()
+		if got, want := errors.Recover(err).Kind, c.kind; got != want {
+			t.Errorf("%s: got %v, want %v (%v)", c.code, got, want, err)
+		}
+		if !strings.Contains(err.Error(), c.code) {
+			t.Errorf("%s: error %v does not mention the terminal status", c.code, err)
+		}
+	}
+}
+
+func TestSpotFailureCancelsPersistentRequest(t *testing.T) {
+	var canceled string
+	api, cleanup := newTestEC2(t, func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Fatal(err)
+		}
+		switch action := r.PostForm.Get("Action"); action {
+		case "RequestSpotInstances":
+			w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<RequestSpotInstancesResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/">
+  <requestId>test</requestId>
+  <spotInstanceRequestSet><item><spotInstanceRequestId>sir-1234</spotInstanceRequestId></item></spotInstanceRequestSet>
+</RequestSpotInstancesResponse>`))
+		case "DescribeSpotInstanceRequests":
+			w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<DescribeSpotInstanceRequestsResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/">
+  <requestId>test</requestId>
+  <spotInstanceRequestSet>
+    <item>
+      <spotInstanceRequestId>sir-1234</spotInstanceRequestId>
+      <state>open</state>
+      <status><code>bad-parameters</code><message>test</message></status>
+    </item>
+  </spotInstanceRequestSet>
+</DescribeSpotInstanceRequestsResponse>`))
+		case "CancelSpotInstanceRequests":
+			canceled = r.PostForm.Get("SpotInstanceRequestId.1")
+			w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<CancelSpotInstanceRequestsResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/">
+  <requestId>test</requestId>
+</CancelSpotInstanceRequestsResponse>`))
+		default:
+			t.Errorf("unexpected action %s", action)
+			http.Error(w, "", http.StatusBadRequest)
+		}
+	})
+	defer cleanup()
+	i := newTestInstance()
+	i.EC2 = api
+	i.Config = instanceTypes["m4.xlarge"]
+	i.Spot = true
+	i.Price = 1
+	i.userData = "test"
+	i.SpotInterruptionBehavior = "stop"
+	if _, err := i.ec2RunSpotInstance(context.Background()); !errors.Match(errors.Fatal, err) {
+		t.Errorf("expected fatal error, got %v", err)
+	}
+	if got, want := canceled, "sir-1234"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestSpotWaitLimiter(t *testing.T) {
+	const (
+		limit    = 2
+		launches = 8
+	)
+	var (
+		mu               sync.Mutex
+		inflight, maxInf int
+		nreq             int32
+		describes        = make(map[string]int)
+	)
+	api, cleanup := newTestEC2(t, func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Fatal(err)
+		}
+		switch action := r.PostForm.Get("Action"); action {
+		case "RequestSpotInstances":
+			n := atomic.AddInt32(&nreq, 1)
+			mu.Lock()
+			inflight++
+			if inflight > maxInf {
+				maxInf = inflight
+			}
+			mu.Unlock()
+			fmt.Fprintf(w, `<RequestSpotInstancesResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/"><requestId>test</requestId>
+<spotInstanceRequestSet><item><spotInstanceRequestId>sir-%d</spotInstanceRequestId></item></spotInstanceRequestSet></RequestSpotInstancesResponse>`, n)
+		case "DescribeSpotInstanceRequests":
+			// Fulfillment takes a little while. The second describe
+			// call for a request is made after its wait has ended.
+			time.Sleep(20 * time.Millisecond)
+			reqid := r.PostForm.Get("SpotInstanceRequestId.1")
+			mu.Lock()
+			if describes[reqid]++; describes[reqid] == 2 {
+				inflight--
+			}
+			mu.Unlock()
+			fmt.Fprintf(w, `<DescribeSpotInstanceRequestsResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/"><requestId>test</requestId>
+<spotInstanceRequestSet><item><spotInstanceRequestId>%s</spotInstanceRequestId><instanceId>i-%s</instanceId><state>active</state><status><code>fulfilled</code></status></item></spotInstanceRequestSet></DescribeSpotInstanceRequestsResponse>`, reqid, reqid)
+		default:
+			t.Errorf("unexpected action %s", action)
+			http.Error(w, "", http.StatusBadRequest)
+		}
+	})
+	defer cleanup()
+	waits := newSpotWaitLimiter(limit)
+	var (
+		wg      sync.WaitGroup
+		maxWait int
+	)
+	for k := 0; k < launches; k++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			i := newTestInstance()
+			i.EC2 = api
+			i.Config = instanceConfig{Type: "m4.xlarge"}
+			i.Spot = true
+			i.Price = 1
+			i.userData = "test"
+			i.spotWaits = waits
+			_, err := i.ec2RunSpotInstance(context.Background())
+			mu.Lock()
+			if active, _ := waits.Stats(); active > maxWait {
+				maxWait = active
+			}
+			mu.Unlock()
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got, want := int(nreq), launches; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if maxInf > limit {
+		t.Errorf("%d concurrent spot waits, limit %d", maxInf, limit)
+	}
+	if maxWait > limit {
+		t.Errorf("%d active spot waits, limit %d", maxWait, limit)
+	}
+	if active, queued := waits.Stats(); active != 0 || queued != 0 {
+		t.Errorf("got %d active, %d queued, want 0, 0", active, queued)
+	}
+	if active, queued := (*spotWaitLimiter)(nil).Stats(); active != 0 || queued != 0 {
+		t.Errorf("got %d active, %d queued, want 0, 0", active, queued)
+	}
+}
+
+func TestSpotHeadroom(t *testing.T) {
+	api, cleanup := newTestEC2(t, func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Fatal(err)
+		}
+		switch action := r.PostForm.Get("Action"); action {
+		case "RequestSpotInstances":
+			w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<RequestSpotInstancesResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/">
+  <requestId>test</requestId>
+  <spotInstanceRequestSet><item><spotInstanceRequestId>sir-1234</spotInstanceRequestId></item></spotInstanceRequestSet>
+</RequestSpotInstancesResponse>`))
+		case "DescribeSpotInstanceRequests":
+			w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<DescribeSpotInstanceRequestsResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/">
+  <requestId>test</requestId>
+  <spotInstanceRequestSet>
+    <item>
+      <spotInstanceRequestId>sir-1234</spotInstanceRequestId>
+      <instanceId>i-1234</instanceId>
+      <spotPrice>0.500000</spotPrice>
+      <launchedAvailabilityZone>us-west-2a</launchedAvailabilityZone>
+      <state>active</state>
+      <status><code>fulfilled</code></status>
+    </item>
+  </spotInstanceRequestSet>
+</DescribeSpotInstanceRequestsResponse>`))
+		case "DescribeSpotPriceHistory":
+			if got, want := r.PostForm.Get("AvailabilityZone"), "us-west-2a"; got != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<DescribeSpotPriceHistoryResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/">
+  <requestId>test</requestId>
+  <spotPriceHistorySet>
+    <item>
+      <instanceType>m4.xlarge</instanceType>
+      <productDescription>Linux/UNIX</productDescription>
+      <spotPrice>0.120000</spotPrice>
+      <timestamp>2017-06-01T00:00:00.000Z</timestamp>
+      <availabilityZone>us-west-2a</availabilityZone>
+    </item>
+  </spotPriceHistorySet>
+</DescribeSpotPriceHistoryResponse>`))
+		default:
+			t.Errorf("unexpected action %s", action)
+			http.Error(w, "", http.StatusBadRequest)
+		}
+	})
+	defer cleanup()
+	i := newTestInstance()
+	i.EC2 = api
+	i.Config = instanceConfig{Type: "m4.xlarge"}
+	i.Spot = true
+	i.Price = 1
+	i.userData = "test"
+	if got := i.SpotHeadroom(); got != 0 {
+		t.Errorf("got %v, want 0", got)
+	}
+	id, err := i.ec2RunSpotInstance(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := id, "i-1234"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := i.SpotHeadroom(), 0.38; math.Abs(got-want) > 1e-9 {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestWatchInterruption(t *testing.T) {
+	var (
+		n     int
+		codes = []string{"fulfilled", "fulfilled", "marked-for-termination"}
+	)
+	api := &mockEC2{
+		DescribeSpotInstanceRequestsFunc: func(input *ec2.DescribeSpotInstanceRequestsInput) (*ec2.DescribeSpotInstanceRequestsOutput, error) {
+			if got, want := aws.StringValue(input.SpotInstanceRequestIds[0]), "sir-123"; got != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			code := codes[n]
+			if n < len(codes)-1 {
+				n++
+			}
+			return &ec2.DescribeSpotInstanceRequestsOutput{
+				SpotInstanceRequests: []*ec2.SpotInstanceRequest{{
+					Status: &ec2.SpotInstanceStatus{Code: aws.String(code)},
+				}},
+			}, nil
+		},
+	}
+	i := newTestInstance()
+	i.EC2 = api
+	i.spotRequestID = "sir-123"
+	if i.InterruptionPending() {
+		t.Fatal("unexpected interruption")
+	}
+	i.WatchInterruption(context.Background(), time.Millisecond)
+	if !i.InterruptionPending() {
+		t.Error("expected interruption to be pending")
+	}
+	if got, want := n, 2; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Terminated instances are no longer watched.
+	codes, n = []string{"instance-terminated-by-user"}, 0
+	i = newTestInstance()
+	i.EC2 = api
+	i.spotRequestID = "sir-123"
+	i.WatchInterruption(context.Background(), time.Millisecond)
+	if i.InterruptionPending() {
+		t.Error("unexpected interruption")
+	}
+
+	// On-demand instances are not watched.
+	i = newTestInstance()
+	i.WatchInterruption(context.Background(), time.Millisecond)
+	if i.InterruptionPending() {
+		t.Error("unexpected interruption")
+	}
+
+	// Clusters report the interruptions of their instances.
+	codes, n = []string{"fulfilled", "marked-for-stop"}, 0
+	c := &Cluster{SpotInterruptionPollInterval: time.Millisecond}
+	i = newTestInstance()
+	i.EC2 = api
+	i.spotRequestID = "sir-123"
+	i.ec2inst = &ec2.Instance{InstanceId: aws.String("i-123")}
+	c.watchInterruption(i)
+	for deadline := time.Now().Add(5 * time.Second); !c.InterruptionPending("i-123"); {
+		if time.Now().After(deadline) {
+			t.Fatal("expected interruption to be pending")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if c.InterruptionPending("i-456") {
+		t.Error("unexpected interruption")
+	}
+}
+
+func TestWatchInterruptionRemove(t *testing.T) {
+	var n int32
+	api := &mockEC2{
+		DescribeSpotInstanceRequestsFunc: func(input *ec2.DescribeSpotInstanceRequestsInput) (*ec2.DescribeSpotInstanceRequestsOutput, error) {
+			atomic.AddInt32(&n, 1)
+			return &ec2.DescribeSpotInstanceRequestsOutput{
+				SpotInstanceRequests: []*ec2.SpotInstanceRequest{{
+					Status: &ec2.SpotInstanceStatus{Code: aws.String("fulfilled")},
+				}},
+			}, nil
+		},
+	}
+	file, cleanup := newTestStateFile(t)
+	defer cleanup()
+	c := &Cluster{EC2: api, File: file, SpotInterruptionPollInterval: time.Millisecond}
+	i := newTestInstance()
+	i.EC2 = api
+	i.spotRequestID = "sir-123"
+	i.ec2inst = &ec2.Instance{InstanceId: aws.String("i-123")}
+	c.add(i.Instance())
+	c.watchInterruption(i)
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt32(&n) < 2; {
+		if time.Now().After(deadline) {
+			t.Fatal("instance is not watched")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// Removed instances are no longer watched.
+	c.remove("i-123")
+	time.Sleep(10 * time.Millisecond)
+	polls := atomic.LoadInt32(&n)
+	time.Sleep(20 * time.Millisecond)
+	if got, want := atomic.LoadInt32(&n), polls; got != want {
+		t.Errorf("got %v polls after removal, want %v", got, want)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.watched) != 0 {
+		t.Errorf("unexpected watched instances %v", c.watched)
+	}
+}
+
+func TestMetadataHopLimit(t *testing.T) {
+	var form url.Values
+	api, cleanup := newTestEC2(t, func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Fatal(err)
+		}
+		form = r.PostForm
+		http.Error(w, "", http.StatusBadRequest)
+	})
+	defer cleanup()
+	ctx := context.Background()
+	for _, c := range []struct {
+		limit int
+		want  string
+	}{
+		{0, "2"},
+		{1, "1"},
+		{3, "3"},
+	} {
+		form = nil
+		i := &instance{EC2: api, Config: instanceTypes["m4.xlarge"], MetadataHopLimit: c.limit}
+		if _, err := i.ec2RunInstance(ctx); err == nil {
+			t.Fatal("expected error")
+		}
+		if form == nil {
+			t.Fatalf("%d: no request was made", c.limit)
+		}
+		if got, want := form.Get("Action"), "RunInstances"; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		if got, want := form.Get("MetadataOptions.HttpPutResponseHopLimit"), c.want; got != want {
+			t.Errorf("%d: got %v, want %v", c.limit, got, want)
+		}
+	}
+}
+
+func TestDescribeFulfilledSpotRequest(t *testing.T) {
+	defer func(d time.Duration) { spotInstanceIDRetryDelay = d }(spotInstanceIDRetryDelay)
+	spotInstanceIDRetryDelay = time.Millisecond
+	var (
+		api   mockEC2
+		calls int
+		empty int
+	)
+	api.DescribeSpotInstanceRequestsFunc = func(input *ec2.DescribeSpotInstanceRequestsInput) (*ec2.DescribeSpotInstanceRequestsOutput, error) {
+		calls++
+		req := &ec2.SpotInstanceRequest{SpotInstanceRequestId: input.SpotInstanceRequestIds[0]}
+		if calls > empty {
+			req.InstanceId = aws.String("i-123")
+		}
+		return &ec2.DescribeSpotInstanceRequestsOutput{SpotInstanceRequests: []*ec2.SpotInstanceRequest{req}}, nil
+	}
+	ctx := context.Background()
+
+	// The instance ID appears after two empty descriptions.
+	empty = 2
+	i := newTestInstance()
+	i.EC2 = &api
+	req, err := i.describeFulfilledSpotRequest(ctx, "sir-1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := aws.StringValue(req.InstanceId), "i-123"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := calls, 3; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Retries are bounded.
+	calls, empty = 0, 100
+	i.SpotInstanceIDRetries = 3
+	if _, err := i.describeFulfilledSpotRequest(ctx, "sir-1234"); err == nil {
+		t.Error("expected error")
+	}
+	if got, want := calls, 4; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Describe errors are not retried.
+	calls = 0
+	api.DescribeSpotInstanceRequestsFunc = func(input *ec2.DescribeSpotInstanceRequestsInput) (*ec2.DescribeSpotInstanceRequestsOutput, error) {
+		calls++
+		return nil, awserr.New("InvalidSpotInstanceRequestID.NotFound", "not found", nil)
+	}
+	if _, err := i.describeFulfilledSpotRequest(ctx, "sir-1234"); err == nil {
+		t.Error("expected error")
+	}
+	if got, want := calls, 1; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestWatchPrice(t *testing.T) {
+	var (
+		n      int
+		prices = []string{"0.10", "0.30", "0.10", "0.30", "0.30", "0.30"}
+	)
+	api := &mockEC2{
+		DescribeSpotPriceHistoryFunc: func(input *ec2.DescribeSpotPriceHistoryInput) (*ec2.DescribeSpotPriceHistoryOutput, error) {
+			price := prices[n]
+			if n < len(prices)-1 {
+				n++
+			}
+			return &ec2.DescribeSpotPriceHistoryOutput{
+				SpotPriceHistory: []*ec2.SpotPrice{{
+					AvailabilityZone: input.AvailabilityZone,
+					InstanceType:     input.InstanceTypes[0],
+					SpotPrice:        aws.String(price),
+					Timestamp:        aws.Time(time.Now()),
+				}},
+			}, nil
+		},
+	}
+	i := newTestInstance()
+	i.EC2 = api
+	i.Spot = true
+	i.Config = instanceTypes["m4.xlarge"]
+	i.AvailabilityZone = "us-west-2a"
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// The brief spike at the second poll is not sustained.
+	i.WatchPrice(ctx, time.Millisecond, 0.2, 2*time.Millisecond)
+	if !i.PriceSpiked() {
+		t.Fatal("expected price spike")
+	}
+	if n < 5 {
+		t.Errorf("spike observed after %d polls", n)
+	}
+
+	// Prices below the ceiling do not trigger the signal.
+	prices, n = []string{"0.10"}, 0
+	i = newTestInstance()
+	i.EC2 = api
+	i.Spot = true
+	i.Config = instanceTypes["m4.xlarge"]
+	i.AvailabilityZone = "us-west-2a"
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	i.WatchPrice(ctx, time.Millisecond, 0.2, time.Millisecond)
+	if i.PriceSpiked() {
+		t.Error("unexpected price spike")
+	}
+
+	// Failed polls interrupt the spike: it must be observed by
+	// consecutive successful polls.
+	var polls int
+	failing := &mockEC2{
+		DescribeSpotPriceHistoryFunc: func(input *ec2.DescribeSpotPriceHistoryInput) (*ec2.DescribeSpotPriceHistoryOutput, error) {
+			polls++
+			if polls%2 == 0 {
+				return nil, awserr.New("RequestLimitExceeded", "slow down", nil)
+			}
+			return &ec2.DescribeSpotPriceHistoryOutput{
+				SpotPriceHistory: []*ec2.SpotPrice{{
+					AvailabilityZone: input.AvailabilityZone,
+					InstanceType:     input.InstanceTypes[0],
+					SpotPrice:        aws.String("0.30"),
+					Timestamp:        aws.Time(time.Now()),
+				}},
+			}, nil
+		},
+	}
+	i = newTestInstance()
+	i.EC2 = failing
+	i.Spot = true
+	i.Config = instanceTypes["m4.xlarge"]
+	i.AvailabilityZone = "us-west-2a"
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	i.WatchPrice(ctx, 5*time.Millisecond, 0.2, 10*time.Millisecond)
+	if i.PriceSpiked() {
+		t.Error("unexpected price spike")
+	}
+	if polls < 4 {
+		t.Errorf("only %d polls were made", polls)
+	}
+
+	// On-demand instances are not watched.
+	i = newTestInstance()
+	i.WatchPrice(context.Background(), time.Millisecond, 0.2, 0)
+	if i.PriceSpiked() {
+		t.Error("unexpected price spike")
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/grailbio/reflow/errors"
+)
+
+// spotAdvisorURL is the location of the EC2 Spot Instance Advisor
+// data feed.
+var spotAdvisorURL = "https://spot-bid-advisor.s3.amazonaws.com/spot-advisor-data.json"
+
+// spotAdvisorClient is the HTTP client used to retrieve the Spot
+// Instance Advisor data feed. Its timeout bounds the retrieval, so
+// that an unresponsive feed does not stall cluster initialization.
+var spotAdvisorClient = &http.Client{Timeout: time.Minute}
+
+// spotAdvisorData is the subset of the Spot Instance Advisor data
+// feed used by Reflow.
+type spotAdvisorData struct {
+	// SpotAdvisor is indexed by region, operating system and instance type.
+	SpotAdvisor map[string]map[string]map[string]struct {
+		// Savings is the percentage savings over on-demand.
+		Savings int `json:"s"`
+		// Range is the index of the interruption frequency range.
+		Range int `json:"r"`
+	} `json:"spot_advisor"`
+}
+
+// InterruptionScores returns the spot interruption scores for the
+// provided instance types in the given region, as published by the
+// EC2 Spot Instance Advisor. Scores are the index of the advisor's
+// interruption frequency range: 0 denotes the lowest frequency
+// (<5%), and higher scores denote progressively more frequent
+// interruptions. Types for which no data is available are omitted
+// from the returned map.
+func InterruptionScores(ctx context.Context, region string, types []string) (map[string]int, error) {
+	req, err := http.NewRequest("GET", spotAdvisorURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := spotAdvisorClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.E("spot advisor", spotAdvisorURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("spot advisor %s: %s", spotAdvisorURL, resp.Status)
+	}
+	return interruptionScores(resp.Body, region, types)
+}
+
+func interruptionScores(r io.Reader, region string, types []string) (map[string]int, error) {
+	var data spotAdvisorData
+	if err := json.NewDecoder(r).Decode(&data); err != nil {
+		return nil, errors.E("decoding spot advisor data", err)
+	}
+	linux := data.SpotAdvisor[region]["Linux"]
+	scores := make(map[string]int)
+	for _, typ := range types {
+		if entry, ok := linux[typ]; ok {
+			scores[typ] = entry.Range
+		}
+	}
+	return scores, nil
+}
+
+// preferInterruptionScore returns a tie-break function (see
+// instanceState.SetTieBreak) that prefers instance types with lower
+// spot interruption scores. Types without scores are least
+// preferred.
+func preferInterruptionScore(scores map[string]int) func(a, b instanceConfig) bool {
+	return func(a, b instanceConfig) bool {
+		sa, aok := scores[a.Type]
+		sb, bok := scores[b.Type]
+		switch {
+		case !aok:
+			return false
+		case !bok:
+			return true
+		default:
+			return sa < sb
+		}
+	}
+}
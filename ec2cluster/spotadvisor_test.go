@@ -0,0 +1,56 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestInterruptionScores(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "testdata/spot-advisor.json")
+	}))
+	defer srv.Close()
+	defer func(url string) { spotAdvisorURL = url }(spotAdvisorURL)
+	spotAdvisorURL = srv.URL
+
+	scores, err := InterruptionScores(context.Background(), "us-west-2", []string{"m4.xlarge", "c4.large", "r4.large", "x1.32xlarge"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{"m4.xlarge": 0, "c4.large": 2, "r4.large": 4}
+	if !reflect.DeepEqual(scores, want) {
+		t.Errorf("got %v, want %v", scores, want)
+	}
+	scores, err = InterruptionScores(context.Background(), "us-east-1", []string{"m4.xlarge", "c4.large"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := scores, map[string]int{"m4.xlarge": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestInterruptionScoresCancel(t *testing.T) {
+	unblock := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	}))
+	defer srv.Close()
+	defer close(unblock)
+	defer func(url string) { spotAdvisorURL = url }(spotAdvisorURL)
+	spotAdvisorURL = srv.URL
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := InterruptionScores(ctx, "us-west-2", []string{"m4.xlarge"}); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// ListOpenSpotRequests returns the open spot instance requests
+// tagged with the provided key and value. Spot requests placed by
+// cluster instances are tagged with their Name tag (see
+// instance.Tag). Open requests may be fulfilled at any time, and so
+// requests that are left open (e.g., because the process that placed
+// them died) may launch instances that are never used.
+func ListOpenSpotRequests(ctx context.Context, api ec2iface.EC2API, tagKey, tagValue string) ([]*ec2.SpotInstanceRequest, error) {
+	resp, err := api.DescribeSpotInstanceRequestsWithContext(ctx, &ec2.DescribeSpotInstanceRequestsInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("tag:" + tagKey), Values: []*string{aws.String(tagValue)}},
+			{Name: aws.String("state"), Values: []*string{aws.String(ec2.SpotInstanceStateOpen)}},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var reqs []*ec2.SpotInstanceRequest
+	for _, req := range resp.SpotInstanceRequests {
+		if aws.StringValue(req.State) == ec2.SpotInstanceStateOpen {
+			reqs = append(reqs, req)
+		}
+	}
+	return reqs, nil
+}
+
+// CancelSpotRequests cancels the provided spot instance requests.
+// Instances that have already been launched by the requests are not
+// terminated.
+func CancelSpotRequests(ctx context.Context, api ec2iface.EC2API, reqs []*ec2.SpotInstanceRequest) error {
+	if len(reqs) == 0 {
+		return nil
+	}
+	input := &ec2.CancelSpotInstanceRequestsInput{}
+	for _, req := range reqs {
+		input.SpotInstanceRequestIds = append(input.SpotInstanceRequestIds, req.SpotInstanceRequestId)
+	}
+	_, err := api.CancelSpotInstanceRequestsWithContext(ctx, input)
+	return err
+}
+
+// tagSpotRequest tags the spot request with the provided ID with
+// the instance's Name tag, so that it may be found by
+// ListOpenSpotRequests. Tags are informational: failures are logged.
+func (i *instance) tagSpotRequest(ctx context.Context, reqid string) {
+	if i.SkipTagging || i.Tag == "" {
+		return
+	}
+	_, err := i.EC2.CreateTagsWithContext(ctx, &ec2.CreateTagsInput{
+		Resources: []*string{aws.String(reqid)},
+		Tags:      []*ec2.Tag{{Key: aws.String("Name"), Value: aws.String(i.Tag)}},
+	})
+	if err != nil {
+		i.Log.Errorf("ec2.createtags %v: %v", reqid, err)
+	}
+}
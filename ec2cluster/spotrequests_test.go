@@ -0,0 +1,100 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestListOpenSpotRequests(t *testing.T) {
+	api := &mockEC2{
+		DescribeSpotInstanceRequestsFunc: func(input *ec2.DescribeSpotInstanceRequestsInput) (*ec2.DescribeSpotInstanceRequestsOutput, error) {
+			filters := make(map[string][]string)
+			for _, f := range input.Filters {
+				filters[aws.StringValue(f.Name)] = aws.StringValueSlice(f.Values)
+			}
+			if got, want := filters, map[string][]string{
+				"tag:Name": {"reflow-test"},
+				"state":    {"open"},
+			}; !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			return &ec2.DescribeSpotInstanceRequestsOutput{
+				SpotInstanceRequests: []*ec2.SpotInstanceRequest{
+					{SpotInstanceRequestId: aws.String("sir-open"), State: aws.String("open")},
+					{SpotInstanceRequestId: aws.String("sir-active"), State: aws.String("active"), InstanceId: aws.String("i-123")},
+				},
+			}, nil
+		},
+	}
+	ctx := context.Background()
+	reqs, err := ListOpenSpotRequests(ctx, api, "Name", "reflow-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(reqs), 1; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got, want := aws.StringValue(reqs[0].SpotInstanceRequestId), "sir-open"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	var canceled []string
+	api.CancelSpotInstanceRequestsFunc = func(input *ec2.CancelSpotInstanceRequestsInput) (*ec2.CancelSpotInstanceRequestsOutput, error) {
+		canceled = aws.StringValueSlice(input.SpotInstanceRequestIds)
+		return &ec2.CancelSpotInstanceRequestsOutput{}, nil
+	}
+	if err := CancelSpotRequests(ctx, api, reqs); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := canceled, []string{"sir-open"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	canceled = nil
+	if err := CancelSpotRequests(ctx, api, nil); err != nil {
+		t.Fatal(err)
+	}
+	if canceled != nil {
+		t.Errorf("unexpected cancellation of %v", canceled)
+	}
+}
+
+func TestTagSpotRequest(t *testing.T) {
+	var tagged *ec2.CreateTagsInput
+	api := &mockEC2{
+		CreateTagsFunc: func(input *ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error) {
+			tagged = input
+			return &ec2.CreateTagsOutput{}, nil
+		},
+	}
+	i := newTestInstance()
+	i.EC2 = api
+	i.Tag = "reflow-test"
+	i.tagSpotRequest(context.Background(), "sir-1234")
+	if tagged == nil {
+		t.Fatal("spot request was not tagged")
+	}
+	if got, want := aws.StringValueSlice(tagged.Resources), []string{"sir-1234"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := len(tagged.Tags), 1; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got, want := aws.StringValue(tagged.Tags[0].Key)+"="+aws.StringValue(tagged.Tags[0].Value), "Name=reflow-test"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	tagged = nil
+	i.SkipTagging = true
+	i.tagSpotRequest(context.Background(), "sir-1234")
+	if tagged != nil {
+		t.Error("unexpected tagging with SkipTagging")
+	}
+}
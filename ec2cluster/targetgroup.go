@@ -0,0 +1,106 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/aws/aws-sdk-go/private/protocol/query"
+)
+
+// ELBV2 is the subset of the AWS Elastic Load Balancing (v2) API
+// used to register instances with a load balancer's target group.
+type ELBV2 interface {
+	// RegisterTargets registers the instance with the given ID, at
+	// the given port, with the target group with the given ARN. If
+	// port is zero, the target group's port is used.
+	RegisterTargets(ctx context.Context, targetGroupARN, id string, port int) error
+	// DeregisterTargets deregisters the instance with the given ID,
+	// at the given port, from the target group with the given ARN.
+	DeregisterTargets(ctx context.Context, targetGroupARN, id string, port int) error
+}
+
+// elbv2Client is a minimal Elastic Load Balancing (v2) client,
+// built from the SDK's core facilities, that implements ELBV2.
+type elbv2Client struct {
+	*client.Client
+}
+
+// NewELBV2 returns an ELBV2 client configured from the provided
+// configuration provider (e.g., a session).
+func NewELBV2(p client.ConfigProvider, cfgs ...*aws.Config) ELBV2 {
+	c := p.ClientConfig("elasticloadbalancing", cfgs...)
+	svc := &elbv2Client{
+		Client: client.New(
+			*c.Config,
+			metadata.ClientInfo{
+				ServiceName:   "elasticloadbalancing",
+				SigningName:   c.SigningName,
+				SigningRegion: c.SigningRegion,
+				Endpoint:      c.Endpoint,
+				APIVersion:    "2015-12-01",
+			},
+			c.Handlers,
+		),
+	}
+	svc.Handlers.Sign.PushBackNamed(v4.SignRequestHandler)
+	svc.Handlers.Build.PushBackNamed(query.BuildHandler)
+	svc.Handlers.Unmarshal.PushBackNamed(query.UnmarshalHandler)
+	svc.Handlers.UnmarshalMeta.PushBackNamed(query.UnmarshalMetaHandler)
+	svc.Handlers.UnmarshalError.PushBackNamed(query.UnmarshalErrorHandler)
+	return svc
+}
+
+type elbv2TargetsInput struct {
+	_ struct{} `type:"structure"`
+
+	TargetGroupArn *string                   `type:"string" required:"true"`
+	Targets        []*elbv2TargetDescription `type:"list" required:"true"`
+}
+
+type elbv2TargetDescription struct {
+	_ struct{} `type:"structure"`
+
+	Id   *string `type:"string" required:"true"`
+	Port *int64  `min:"1" type:"integer"`
+}
+
+type elbv2TargetsOutput struct {
+	_ struct{} `type:"structure"`
+}
+
+// RegisterTargets implements ELBV2.
+func (c *elbv2Client) RegisterTargets(ctx context.Context, targetGroupARN, id string, port int) error {
+	return c.targets(ctx, "RegisterTargets", targetGroupARN, id, port)
+}
+
+// DeregisterTargets implements ELBV2.
+func (c *elbv2Client) DeregisterTargets(ctx context.Context, targetGroupARN, id string, port int) error {
+	return c.targets(ctx, "DeregisterTargets", targetGroupARN, id, port)
+}
+
+func (c *elbv2Client) targets(ctx context.Context, name, targetGroupARN, id string, port int) error {
+	op := &request.Operation{
+		Name:       name,
+		HTTPMethod: "POST",
+		HTTPPath:   "/",
+	}
+	target := &elbv2TargetDescription{Id: aws.String(id)}
+	if port > 0 {
+		target.Port = aws.Int64(int64(port))
+	}
+	input := &elbv2TargetsInput{
+		TargetGroupArn: aws.String(targetGroupARN),
+		Targets:        []*elbv2TargetDescription{target},
+	}
+	req := c.NewRequest(op, input, new(elbv2TargetsOutput))
+	req.SetContext(ctx)
+	return req.Send()
+}
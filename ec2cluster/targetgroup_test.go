@@ -0,0 +1,139 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/grailbio/reflow/errors"
+	"github.com/grailbio/reflow/pool"
+)
+
+// testELBV2 is a mock ELBV2 that records (de)registrations.
+type testELBV2 struct {
+	registered, deregistered []string
+}
+
+func (e *testELBV2) RegisterTargets(ctx context.Context, arn, id string, port int) error {
+	e.registered = append(e.registered, fmt.Sprintf("%s:%s:%d", arn, id, port))
+	return nil
+}
+
+func (e *testELBV2) DeregisterTargets(ctx context.Context, arn, id string, port int) error {
+	e.deregistered = append(e.deregistered, fmt.Sprintf("%s:%s:%d", arn, id, port))
+	return nil
+}
+
+func TestTargetGroupRegistration(t *testing.T) {
+	lb := new(testELBV2)
+	p := &testPool{OffersFunc: func() ([]pool.Offer, error) { return nil, nil }}
+	i := newLaunchTestInstance(newLaunchMockEC2("i-123", "test.example.com"), p)
+	i.TargetGroupARN = "arn:tg"
+	i.TargetGroupPort = 9000
+	i.ELBV2 = lb
+	i.Go(context.Background())
+	if err := i.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(lb.registered, ","), "arn:tg:i-123:9000"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if len(lb.deregistered) != 0 {
+		t.Errorf("unexpected deregistrations %v", lb.deregistered)
+	}
+
+	// Instances are deregistered when they are terminated.
+	lb = new(testELBV2)
+	api := newLaunchMockEC2("i-123", "test.example.com")
+	api.TerminateInstancesFunc = func(input *ec2.TerminateInstancesInput) (*ec2.TerminateInstancesOutput, error) {
+		return &ec2.TerminateInstancesOutput{}, nil
+	}
+	p = &testPool{OffersFunc: func() ([]pool.Offer, error) { return nil, errors.E(errors.Temporary, errors.New("not ready")) }}
+	i = newLaunchTestInstance(api, p)
+	i.TargetGroupARN = "arn:tg"
+	i.ELBV2 = lb
+	i.ReadyTimeout = 100 * time.Millisecond
+	i.Go(context.Background())
+	if err := i.Err(); !errors.Match(errors.Unavailable, err) {
+		t.Errorf("expected unavailable error, got %v", err)
+	}
+	if got, want := strings.Join(lb.registered, ","), "arn:tg:i-123:0"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := strings.Join(lb.deregistered, ","), "arn:tg:i-123:0"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	i = newLaunchTestInstance(newLaunchMockEC2("i-123", "test.example.com"), p)
+	i.TargetGroupARN = "arn:tg"
+	i.Go(context.Background())
+	if err := i.Err(); !errors.Match(errors.Fatal, err) {
+		t.Errorf("expected fatal error, got %v", err)
+	}
+}
+
+func TestELBV2Targets(t *testing.T) {
+	var forms []url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Fatal(err)
+		}
+		forms = append(forms, r.PostForm)
+		action := r.PostForm.Get("Action")
+		fmt.Fprintf(w, `<%sResponse xmlns="http://elasticloadbalancing.amazonaws.com/doc/2015-12-01/"><%sResult/><ResponseMetadata><RequestId>test</RequestId></ResponseMetadata></%sResponse>`, action, action, action)
+	}))
+	defer srv.Close()
+	sess, err := session.NewSession(&aws.Config{
+		Endpoint:    aws.String(srv.URL),
+		Region:      aws.String("us-west-2"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		MaxRetries:  aws.Int(0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := NewELBV2(sess)
+	ctx := context.Background()
+	if err := lb.RegisterTargets(ctx, "arn:tg", "i-123", 9000); err != nil {
+		t.Fatal(err)
+	}
+	if err := lb.DeregisterTargets(ctx, "arn:tg", "i-123", 0); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(forms), 2; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for _, c := range []struct {
+		form   url.Values
+		action string
+		port   string
+	}{
+		{forms[0], "RegisterTargets", "9000"},
+		{forms[1], "DeregisterTargets", ""},
+	} {
+		for key, want := range map[string]string{
+			"Action":                c.action,
+			"Version":               "2015-12-01",
+			"TargetGroupArn":        "arn:tg",
+			"Targets.member.1.Id":   "i-123",
+			"Targets.member.1.Port": c.port,
+		} {
+			if got := c.form.Get(key); got != want {
+				t.Errorf("%s: %s: got %q, want %q", c.action, key, got, want)
+			}
+		}
+	}
+}
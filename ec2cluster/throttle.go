@@ -0,0 +1,150 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// Default parameters for the EC2 API throttle.
+const (
+	defaultThrottleMin      = 100 * time.Millisecond
+	defaultThrottleMax      = 10 * time.Second
+	defaultThrottleStep     = 50 * time.Millisecond
+	defaultThrottleCooldown = 30 * time.Second
+)
+
+// throttle is an adaptive rate limiter shared by all calls made
+// through an API client. When calls are throttled by the API, the
+// throttle multiplicatively increases the spacing between
+// successive calls (across all callers), and holds it for a
+// cooldown window; thereafter, successful calls additively decrease
+// the spacing until calls are no longer delayed (AIMD).
+//
+// Because the throttle is shared, concurrent callers that are
+// throttled together do not independently back off and then
+// re-collide.
+type throttle struct {
+	// Min is the spacing imposed after the first throttling error;
+	// Max bounds the spacing.
+	Min, Max time.Duration
+	// Step is the amount by which the spacing is decreased after
+	// each successful call, once the cooldown window has passed.
+	Step time.Duration
+	// Cooldown is the amount of time after the last throttling error
+	// during which the spacing is not decreased.
+	Cooldown time.Duration
+
+	mu        sync.Mutex
+	delay     time.Duration
+	next      time.Time
+	throttled time.Time
+}
+
+// newThrottle returns a throttle with default parameters.
+func newThrottle() *throttle {
+	return &throttle{
+		Min:      defaultThrottleMin,
+		Max:      defaultThrottleMax,
+		Step:     defaultThrottleStep,
+		Cooldown: defaultThrottleCooldown,
+	}
+}
+
+// Delay returns the current spacing between calls.
+func (t *throttle) Delay() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.delay
+}
+
+// Wait blocks until the caller may proceed with its call, or until
+// the context is done.
+func (t *throttle) Wait(ctx context.Context) error {
+	t.mu.Lock()
+	if t.delay == 0 {
+		t.mu.Unlock()
+		return nil
+	}
+	now := time.Now()
+	slot := t.next
+	if slot.Before(now) {
+		slot = now
+	}
+	t.next = slot.Add(t.delay)
+	t.mu.Unlock()
+	if slot.Equal(now) {
+		return nil
+	}
+	timer := time.NewTimer(slot.Sub(now))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Throttled informs the throttle that a call was throttled.
+func (t *throttle) Throttled() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.delay *= 2
+	if t.delay < t.Min {
+		t.delay = t.Min
+	}
+	if t.delay > t.Max {
+		t.delay = t.Max
+	}
+	t.throttled = time.Now()
+}
+
+// Succeeded informs the throttle that a call succeeded.
+func (t *throttle) Succeeded() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.delay == 0 || time.Since(t.throttled) < t.Cooldown {
+		return
+	}
+	t.delay -= t.Step
+	if t.delay < 0 {
+		t.delay = 0
+	}
+}
+
+// Install installs the throttle into the provided client request
+// handlers, so that every request attempt made through the client
+// waits on the throttle, and every outcome is reported to it.
+func (t *throttle) Install(h *request.Handlers) {
+	h.Sign.PushFrontNamed(request.NamedHandler{
+		Name: "reflow.ec2cluster.throttle.Wait",
+		Fn: func(r *request.Request) {
+			if err := t.Wait(r.Context()); err != nil {
+				r.Error = err
+			}
+		},
+	})
+	h.Retry.PushFrontNamed(request.NamedHandler{
+		Name: "reflow.ec2cluster.throttle.Throttled",
+		Fn: func(r *request.Request) {
+			if request.IsErrorThrottle(r.Error) {
+				t.Throttled()
+			}
+		},
+	})
+	h.Complete.PushBackNamed(request.NamedHandler{
+		Name: "reflow.ec2cluster.throttle.Succeeded",
+		Fn: func(r *request.Request) {
+			if r.Error == nil {
+				t.Succeeded()
+			}
+		},
+	})
+}
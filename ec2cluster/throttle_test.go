@@ -0,0 +1,105 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+const (
+	throttledResponse = `<?xml version="1.0" encoding="UTF-8"?>
+<Response><Errors><Error><Code>RequestLimitExceeded</Code><Message>Request limit exceeded.</Message></Error></Errors><RequestID>test</RequestID></Response>`
+	describeInstancesResponse = `<?xml version="1.0" encoding="UTF-8"?>
+<DescribeInstancesResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/"><requestId>test</requestId><reservationSet/></DescribeInstancesResponse>`
+)
+
+func TestThrottle(t *testing.T) {
+	const concurrency = 4
+	var throttled int32 = concurrency
+	api, cleanup := newTestEC2(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&throttled, -1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(throttledResponse))
+			return
+		}
+		w.Write([]byte(describeInstancesResponse))
+	})
+	defer cleanup()
+	th := &throttle{
+		Min:      20 * time.Millisecond,
+		Max:      time.Second,
+		Step:     10 * time.Millisecond,
+		Cooldown: time.Hour,
+	}
+	th.Install(&api.Handlers)
+	ctx := context.Background()
+	describe := func() error {
+		_, err := api.DescribeInstancesWithContext(ctx, &ec2.DescribeInstancesInput{})
+		return err
+	}
+	concurrently := func(f func() error) (errs []error) {
+		var (
+			mu sync.Mutex
+			wg sync.WaitGroup
+		)
+		for n := 0; n < concurrency; n++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := f()
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+			}()
+		}
+		wg.Wait()
+		return
+	}
+
+	if got := th.Delay(); got != 0 {
+		t.Fatalf("got %v, want 0", got)
+	}
+	for _, err := range concurrently(describe) {
+		if err == nil {
+			t.Fatal("expected throttling error")
+		}
+	}
+	// Each throttled call slows all calls down further.
+	delay := th.Delay()
+	if got, want := delay, 160*time.Millisecond; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Calls are now globally spaced, and they do not speed up while
+	// the throttle is cooling down.
+	start := time.Now()
+	for _, err := range concurrently(describe) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := time.Since(start), (concurrency-1)*delay; got < want {
+		t.Errorf("calls completed in %v, expected at least %v", got, want)
+	}
+	if got, want := th.Delay(), delay; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// After the cooldown, successful calls speed things up again.
+	th.Cooldown = 0
+	if err := describe(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := th.Delay(), delay-th.Step; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -85,6 +85,10 @@ type Pool struct {
 	// S3FileLimiter controls the number of S3 file downloads that may
 	// proceed concurrently.
 	S3FileLimiter *limiter.Limiter
+	// Share, if nonzero, is the fraction of the host's resources that
+	// is offered by the pool. This permits multiple pools to share a
+	// host.
+	Share float64
 
 	mu        sync.Mutex
 	allocs    map[string]*alloc // the set of active allocs
@@ -144,6 +148,9 @@ func (p *Pool) Start() error {
 		log.Printf("stat %s: %v", root, err)
 		p.resources.Disk = 2e12
 	}
+	if p.Share > 0 && p.Share < 1 {
+		p.resources = p.resources.Scale(p.Share)
+	}
 
 	if err := os.MkdirAll(filepath.Join(p.Prefix, p.Dir, allocsPath), 0777); err != nil {
 		return err
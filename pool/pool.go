@@ -79,6 +79,23 @@ func (l Labels) Copy() Labels {
 	return m
 }
 
+// MergeLabels returns a new set of labels containing the labels
+// from each of the provided sets. Sets are given in increasing order
+// of precedence: labels in later sets override those in earlier ones,
+// except that empty values never override nonempty ones.
+func MergeLabels(sets ...Labels) Labels {
+	m := make(Labels)
+	for _, l := range sets {
+		for k, v := range l {
+			if v == "" && m[k] != "" {
+				continue
+			}
+			m[k] = v
+		}
+	}
+	return m
+}
+
 // AllocMeta contains Alloc requester metadata.
 type AllocMeta struct {
 	Want   reflow.Resources
@@ -6,6 +6,7 @@ package pool
 
 import (
 	"context"
+	"reflect"
 	"testing"
 	"time"
 
@@ -155,3 +156,23 @@ func TestPick(t *testing.T) {
 		t.Errorf("got %v, want %v", got, want)
 	}
 }
+
+func TestMergeLabels(t *testing.T) {
+	cluster := Labels{"project": "cluster", "user": "cluster", "env": "prod"}
+	run := Labels{"project": "run", "user": "", "run": "run"}
+	instance := Labels{"project": "instance", "env": "", "instance": "instance"}
+	got := MergeLabels(cluster, run, instance)
+	want := Labels{
+		"project":  "instance",
+		"user":     "cluster",
+		"env":      "prod",
+		"run":      "run",
+		"instance": "instance",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := cluster["project"], "cluster"; got != want {
+		t.Errorf("merge modified its input: got %v, want %v", got, want)
+	}
+}
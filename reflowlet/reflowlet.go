@@ -52,6 +52,9 @@ type Server struct {
 	// EC2Cluster tells whether this reflowlet is part of an EC2cluster.
 	// When true, the reflowlet shuts down if it is idle after 10 minutes.
 	EC2Cluster bool
+	// Share is the fraction of the host's resources that is offered
+	// by the reflowlet, so that multiple reflowlets may share a host.
+	Share float64
 
 	configFlag string
 }
@@ -66,6 +69,7 @@ func (s *Server) AddFlags(flags *flag.FlagSet) {
 	flags.StringVar(&s.Dir, "dir", "/mnt/data/reflow", "runtime data directory")
 	flags.IntVar(&s.NDigest, "ndigest", 32, "number of allowable concurrent digest ops")
 	flags.BoolVar(&s.EC2Cluster, "ec2cluster", false, "this reflowlet is part of an ec2cluster")
+	flags.Float64Var(&s.Share, "share", 1, "fraction of the host's resources offered by this reflowlet")
 }
 
 // ListenAndServe serves the Reflowlet server on the configured address.
@@ -131,6 +135,7 @@ func (s *Server) ListenAndServe() error {
 		AWSCreds:      creds,
 		Log:           log.Std.Tee(nil, "executor: "),
 		DigestLimiter: lim,
+		Share:         s.Share,
 	}
 	if err := p.Start(); err != nil {
 		return err
@@ -5,8 +5,11 @@
 package test
 
 import (
+	"io"
+	"strconv"
 	"strings"
 
+	"github.com/grailbio/base/digest"
 	"github.com/grailbio/reflow"
 )
 
@@ -36,7 +39,79 @@ func Files(files ...string) reflow.Fileset {
 	return v
 }
 
+// FilesWithSizes returns a value comprising files with the given
+// paths and exact sizes. A file's contents are its path (followed by
+// a newline) repeated and truncated to its size; digests are thus
+// deterministic.
+func FilesWithSizes(m map[string]int64) reflow.Fileset {
+	var v reflow.Fileset
+	v.Map = map[string]reflow.File{}
+	for path, size := range m {
+		pattern := []byte(path + "\n")
+		w := reflow.Digester.NewWriter()
+		for n := size; n > 0; {
+			p := pattern
+			if int64(len(p)) > n {
+				p = p[:n]
+			}
+			io.WriteString(w, string(p))
+			n -= int64(len(p))
+		}
+		v.Map[path] = reflow.File{w.Digest(), size}
+	}
+	return v
+}
+
 // List constructs a list value.
 func List(values ...reflow.Fileset) reflow.Fileset {
 	return reflow.Fileset{List: values}
 }
+
+// Contains tells whether the fileset got contains the fileset want:
+// every path in want must be present in got, with the same digest
+// and size. List filesets are compared element-wise; got may contain
+// more elements than want.
+func Contains(got, want reflow.Fileset) bool {
+	if len(want.List) > len(got.List) {
+		return false
+	}
+	for i := range want.List {
+		if !Contains(got.List[i], want.List[i]) {
+			return false
+		}
+	}
+	for path, file := range want.Map {
+		if f, ok := got.Map[path]; !ok || f != file {
+			return false
+		}
+	}
+	return true
+}
+
+// Digest returns the digest of the fileset v, as computed by Reflow
+// (e.g., to key cache entries). It is useful for asserting the
+// digests of filesets constructed by Files.
+func Digest(v reflow.Fileset) digest.Digest {
+	return v.Digest()
+}
+
+// ContentTree returns the digests of the files in the fileset v,
+// keyed by path, across all of its (possibly nested) lists. The
+// paths of files in list filesets are prefixed by the index of
+// their list element, e.g., "1/0/a" names file "a" in the first
+// element of the second element of v. ContentTree is useful for
+// asserting exactly which files differ between two filesets.
+func ContentTree(v reflow.Fileset) map[string]digest.Digest {
+	tree := make(map[string]digest.Digest)
+	contentTree(tree, "", v)
+	return tree
+}
+
+func contentTree(tree map[string]digest.Digest, prefix string, v reflow.Fileset) {
+	for i, w := range v.List {
+		contentTree(tree, prefix+strconv.Itoa(i)+"/", w)
+	}
+	for path, file := range v.Map {
+		tree[prefix+path] = file.ID
+	}
+}
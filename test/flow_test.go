@@ -5,10 +5,12 @@
 package test
 
 import (
+	"io"
 	"net/url"
 	"reflect"
 	"testing"
 
+	"github.com/grailbio/base/digest"
 	"github.com/grailbio/reflow"
 	"github.com/grailbio/reflow/test/flow"
 )
@@ -95,3 +97,108 @@ func TestRequirements(t *testing.T) {
 		t.Errorf("got %v, want %v", got, want)
 	}
 }
+
+func TestContains(t *testing.T) {
+	got := List(Files("a", "b", "c"), Files("d", "e"))
+	for _, want := range []reflow.Fileset{
+		List(),
+		List(Files("a")),
+		List(Files("a", "c"), Files("e")),
+		List(Files(), Files("d", "e")),
+	} {
+		if !Contains(got, want) {
+			t.Errorf("expected %v to contain %v", got, want)
+		}
+	}
+	for _, want := range []reflow.Fileset{
+		List(Files("x")),
+		List(Files("a:other")),
+		List(Files("a"), Files("d"), Files("f")),
+		Files("a"),
+	} {
+		if Contains(got, want) {
+			t.Errorf("did not expect %v to contain %v", got, want)
+		}
+	}
+	if !Contains(Files("a", "b"), Files("b")) {
+		t.Error("expected fileset to contain subset")
+	}
+}
+
+func TestFilesWithSizes(t *testing.T) {
+	sizes := map[string]int64{"empty": 0, "a": 1, "b": 2, "large": 1 << 20}
+	v := FilesWithSizes(sizes)
+	if got, want := len(v.Map), len(sizes); got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for path, size := range sizes {
+		if got, want := v.Map[path].Size, size; got != want {
+			t.Errorf("%s: got %v, want %v", path, got, want)
+		}
+	}
+	if got, want := v.Map["b"].ID, reflow.Digester.FromString("b\n"); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := v.Map["a"].ID, reflow.Digester.FromString("a"); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := FilesWithSizes(sizes).Digest(), v.Digest(); got != want {
+		t.Errorf("unstable digest: got %v, want %v", got, want)
+	}
+	if v.Map["a"].ID == FilesWithSizes(map[string]int64{"a": 2}).Map["a"].ID {
+		t.Error("expected files of different sizes to have different digests")
+	}
+}
+
+func TestDigest(t *testing.T) {
+	// The digest of a fileset is the digest of its sorted paths,
+	// each followed by the digest of its file.
+	w := reflow.Digester.NewWriter()
+	for _, path := range []string{"a", "b"} {
+		io.WriteString(w, path)
+		digest.WriteDigest(w, reflow.Digester.FromString(path))
+	}
+	v := Files("b", "a")
+	if got, want := Digest(v), w.Digest(); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	const stable = "sha256:c2bfbf0defebc0e5a4d89f5c85d367ddd917cb442c02b03183f2d2d2fae90e8e"
+	if got, want := Digest(v).String(), stable; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if Digest(v) == Digest(Files("a", "b:c")) {
+		t.Error("expected filesets with different contents to have different digests")
+	}
+	if got, want := Digest(List(v)), List(v).Digest(); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestContentTree(t *testing.T) {
+	v := List(Files("a", "b:x"), List(Files("c"), Files()), Files("a:y"))
+	want := map[string]digest.Digest{
+		"0/a":   reflow.Digester.FromString("a"),
+		"0/b":   reflow.Digester.FromString("x"),
+		"1/0/c": reflow.Digester.FromString("c"),
+		"2/a":   reflow.Digester.FromString("y"),
+	}
+	if got := ContentTree(v); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := ContentTree(Files("a")), map[string]digest.Digest{"a": reflow.Digester.FromString("a")}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Changed files are identified by their differing digests.
+	w := List(Files("a", "b:z"), List(Files("c"), Files()), Files("a:y"))
+	var changed []string
+	wt := ContentTree(w)
+	for path, d := range ContentTree(v) {
+		if wt[path] != d {
+			changed = append(changed, path)
+		}
+	}
+	if got, want := changed, []string{"0/b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}